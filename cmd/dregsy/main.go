@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	_ "time/tzdata" // for task time zones, in case system has no tz database
 
 	log "github.com/sirupsen/logrus"
 
@@ -32,16 +33,8 @@ func init() {
 
 	log.SetOutput(os.Stdout)
 
-	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
-	switch format {
-	case "json":
-		log.SetFormatter(&log.JSONFormatter{})
-	case "text":
-		log.SetFormatter(&log.TextFormatter{
-			ForceColors: strings.ToLower(os.Getenv("LOG_FORCE_COLORS")) == "true"})
-	case "":
-	default:
-		log.Errorf("invalid log format: '%s'", format)
+	if err := setLogFormat(os.Getenv("LOG_FORMAT")); err != nil {
+		log.Error(err)
 	}
 
 	if strings.ToLower(os.Getenv("LOG_METHODS")) == "true" {
@@ -60,6 +53,22 @@ func init() {
 	}
 }
 
+// setLogFormat switches the log format to format, either `json` or `text`.
+// When format is empty, the log format is left as it is.
+func setLogFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	case "text":
+		log.SetFormatter(&log.TextFormatter{
+			ForceColors: strings.ToLower(os.Getenv("LOG_FORCE_COLORS")) == "true"})
+	case "":
+	default:
+		return fmt.Errorf("invalid log format: '%s'", format)
+	}
+	return nil
+}
+
 //
 var DregsyVersion string
 
@@ -79,35 +88,106 @@ func main() {
 
 	dregsyExitCode = 0
 
-	fs := flag.NewFlagSet("dregsy", flag.ContinueOnError)
-	configFile := fs.String("config", "", "path to config file")
-	taskFilter := fs.String("run", "", "task filter regex")
-
+	args := os.Args[1:]
 	if testRound {
-		if len(testArgs) > 0 {
-			failOnError(fs.Parse(testArgs))
-		} else {
+		if len(testArgs) == 0 {
 			panic("no test arguments")
 		}
-	} else {
-		failOnError(fs.Parse(os.Args[1:]))
+		args = testArgs
+	}
+
+	if len(args) > 0 && args[0] == "list" {
+		list(args[1:])
+		return
+	}
+
+	if len(args) > 0 && args[0] == "plan" {
+		plan(args[1:])
+		return
 	}
 
+	fs := flag.NewFlagSet("dregsy", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file or directory")
+	taskFilter := fs.String("run", "", "task filter regex")
+	dryRun := fs.Bool("dry-run", false,
+		"only list images that would be synced, as JSON lines on stdout")
+	deepDryRun := fs.Bool("deep-dry-run", false,
+		"like -dry-run, but also check targets with read-only requests")
+	reconcile := fs.Bool("reconcile", false,
+		"only list images missing or differing in targets, as JSON lines")
+	reconcileFix := fs.Bool("reconcile-fix", false,
+		"like -reconcile, but also sync the images found")
+	reconcileExtra := fs.Bool("reconcile-extra", false,
+		"with -reconcile, also list target tags not in the source")
+	validate := fs.Bool("validate", false,
+		"only validate config, list all errors found")
+	once := fs.Bool("once", false,
+		"run all tasks once, regardless of their schedule, then exit")
+	preflight := fs.Bool("preflight", false,
+		"only check that the registries of all tasks can be accessed")
+	force := fs.Bool("force", false,
+		"sync mappings even if they exceed their 'max-repos' limit")
+	logFormat := fs.String("log-format", "",
+		"log format, either 'json' or 'text'; overrides LOG_FORMAT and config")
+
+	failOnError(fs.Parse(args))
+	failOnError(setLogFormat(*logFormat))
+
 	if len(*configFile) == 0 {
 		version()
-		fmt.Println(
-			"synopsis: dregsy -config={config file} [-run {task name regex}]")
+		fmt.Println("synopsis: dregsy -config={config file} " +
+			"[-run {task name regex}] [-once] [-dry-run] [-deep-dry-run] " +
+			"[-reconcile] [-reconcile-fix] [-reconcile-extra] " +
+			"[-validate] [-preflight] [-force] [-log-format {json|text}]")
+		fmt.Println("          dregsy list [-config={config file}] [-tags] " +
+			"[-log-format {json|text}] {registry}")
+		fmt.Println("          dregsy plan -config={config file} " +
+			"[-task {task name}] -from {path} [-to {path}] [-tags {tag}]... " +
+			"[-platform {platform}] [-force] [-log-format {json|text}]")
 		exit(1)
 	}
 
+	if *dryRun || *deepDryRun || *reconcile || *reconcileFix {
+		// keep stdout clean for dry run and reconcile output
+		log.SetOutput(os.Stderr)
+	}
+
 	version()
 
+	if *validate {
+		errs := sync.ValidateConfig(*configFile)
+		for _, err := range errs {
+			log.Error(err)
+		}
+		if len(errs) > 0 {
+			log.Errorf("config has %d error(s)", len(errs))
+			exit(1)
+			return
+		}
+		log.Info("config is valid")
+		exit(0)
+		return
+	}
+
 	conf, err := sync.LoadConfig(*configFile)
 	failOnError(err)
 
+	if *logFormat == "" {
+		failOnError(setLogFormat(conf.LogFormat))
+	}
+
 	s, err := sync.New(conf)
 	failOnError(err)
 
+	s.SetDryRun(*dryRun)
+	s.SetDeepDryRun(*deepDryRun)
+	s.SetReconcile(*reconcile || *reconcileFix, *reconcileFix,
+		*reconcileExtra)
+	s.SetOnce(*once)
+	s.SetPreflight(*preflight)
+	s.SetForce(*force)
+	s.SetConfigFile(*configFile)
+
 	if testRound {
 		testSync <- s
 	}
@@ -120,6 +200,119 @@ func main() {
 	exit(0)
 }
 
+// list runs the `list` command with args, which writes the repositories, or
+// tags, of a registry to stdout.
+func list(args []string) {
+
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	configFile := fs.String("config", "",
+		"path to config file or directory, for registry settings")
+	withTags := fs.Bool("tags", false, "list tags of all repositories")
+	logFormat := fs.String("log-format", "",
+		"log format, either 'json' or 'text'; overrides LOG_FORMAT and config")
+
+	failOnError(fs.Parse(args))
+	failOnError(setLogFormat(*logFormat))
+
+	// keep stdout clean for the list
+	log.SetOutput(os.Stderr)
+
+	if fs.NArg() != 1 {
+		version()
+		fmt.Fprintln(os.Stderr, "synopsis: dregsy list "+
+			"[-config={config file}] [-tags] [-log-format {json|text}] "+
+			"{registry}")
+		exit(1)
+		return
+	}
+
+	var conf *sync.SyncConfig
+	if *configFile != "" {
+		var err error
+		if conf, err = sync.LoadConfig(*configFile); err != nil {
+			failOnError(err)
+			return
+		}
+		if *logFormat == "" {
+			failOnError(setLogFormat(conf.LogFormat))
+		}
+	}
+
+	if err := sync.ListRegistry(
+		conf, fs.Arg(0), *withTags, os.Stdout); err != nil {
+		failOnError(err)
+		return
+	}
+	exit(0)
+}
+
+// plan runs the `plan` command with args, which resolves a single mapping
+// given on the command line against the registries of a task, and writes the
+// images it would sync to stdout, in the same format as a dry run.
+func plan(args []string) {
+
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	configFile := fs.String("config", "",
+		"path to config file or directory, for registry settings")
+	task := fs.String("task", "",
+		"task whose registries to use; may be omitted for a single task")
+	from := fs.String("from", "", "'from' of the mapping")
+	to := fs.String("to", "", "'to' of the mapping")
+	var tags stringList
+	fs.Var(&tags, "tags", "item of the 'tags' list of the mapping; repeatable")
+	platform := fs.String("platform", "", "'platform' of the mapping")
+	force := fs.Bool("force", false,
+		"resolve the mapping even if it exceeds its 'max-repos' limit")
+	logFormat := fs.String("log-format", "",
+		"log format, either 'json' or 'text'; overrides LOG_FORMAT and config")
+
+	failOnError(fs.Parse(args))
+	failOnError(setLogFormat(*logFormat))
+
+	// keep stdout clean for the plan
+	log.SetOutput(os.Stderr)
+
+	if *configFile == "" || *from == "" || fs.NArg() != 0 {
+		version()
+		fmt.Fprintln(os.Stderr, "synopsis: dregsy plan "+
+			"-config={config file} [-task {task name}] -from {path} "+
+			"[-to {path}] [-tags {tag}]... [-platform {platform}] [-force] "+
+			"[-log-format {json|text}]")
+		exit(1)
+		return
+	}
+
+	conf, err := sync.LoadConfig(*configFile)
+	if err != nil {
+		failOnError(err)
+		return
+	}
+	if *logFormat == "" {
+		failOnError(setLogFormat(conf.LogFormat))
+	}
+
+	m := &sync.Mapping{From: *from, To: *to, Tags: tags, Platform: *platform}
+	if err := sync.PlanMapping(conf, *task, m, *force, os.Stdout); err != nil {
+		failOnError(err)
+		return
+	}
+	exit(0)
+}
+
+// stringList is a flag that can be given several times, collecting all values
+type stringList []string
+
+//
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+//
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 //
 func failOnError(err error) {
 	if err != nil {
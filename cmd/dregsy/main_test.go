@@ -17,6 +17,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -360,7 +361,7 @@ func validateAgainstExpectations(th *test.TestHelper, c *sync.SyncConfig,
 
 	for eRef, eTags := range expectations {
 		ref := fmt.Sprintf("%s/%s", t.Target.Registry, eRef)
-		tags, err := skopeo.ListAllTags(ref,
+		tags, err := skopeo.ListAllTags(context.Background(), ref,
 			util.DecodeJSONAuth(t.Target.GetAuth()),
 			"", t.Target.SkipTLSVerify)
 		th.AssertNoError(err)
@@ -375,7 +376,7 @@ func validateAgainstTaskMapping(th *test.TestHelper, c *sync.SyncConfig) {
 		th.AssertNoError(t.Target.RefreshAuth())
 		for _, m := range t.Mappings {
 			ref := fmt.Sprintf("%s%s", t.Target.Registry, m.To)
-			tags, err := skopeo.ListAllTags(ref,
+			tags, err := skopeo.ListAllTags(context.Background(), ref,
 				util.DecodeJSONAuth(t.Target.GetAuth()),
 				"", t.Target.SkipTLSVerify)
 			th.AssertNoError(err)
@@ -410,7 +411,7 @@ func validatePlatforms(th *test.TestHelper, ref string, task *sync.Task,
 
 		for plt, exp := range plts {
 
-			info, err := skopeo.Inspect(
+			info, err := skopeo.Inspect(context.Background(),
 				fmt.Sprintf("%s:%s", ref, t), plt, "{{.Os}}/{{.Architecture}}",
 				util.DecodeJSONAuth(task.Target.GetAuth()),
 				"", task.Target.SkipTLSVerify)
@@ -0,0 +1,160 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// assumed role credentials are refreshed this long before they expire
+const assumeRoleExpiryWindow = 5 * time.Minute
+
+//
+var assumedRoles = map[AWSRole]*credentials.Credentials{}
+var assumedRolesLock sync.Mutex
+
+// AWSRole describes an IAM role to assume when accessing AWS APIs, e.g. for
+// accessing an ECR registry in a different account.
+type AWSRole struct {
+	ARN        string
+	ExternalID string
+}
+
+// NewAWSSession creates an AWS session for region. When region is empty, it
+// is resolved with the region chain of the AWS SDK instead, see resolveRegion.
+// When role is not nil, the session uses credentials obtained by assuming that
+// role. Those credentials are shared between all sessions for the same role,
+// and refreshed shortly before they expire. When transport is not nil, it is
+// used for all requests of the session, e.g. for going through a proxy.
+func NewAWSSession(region string, role *AWSRole, transport *http.Transport) (
+	*session.Session, error) {
+
+	conf := aws.Config{}
+	if region != "" {
+		conf.Region = aws.String(region)
+	}
+	if transport != nil {
+		conf.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	var sess *session.Session
+	var err error
+	if region != "" {
+		sess, err = session.NewSession(&conf)
+	} else {
+		sess, err = resolveRegion(conf)
+	}
+	if err != nil || role == nil || role.ARN == "" {
+		return sess, err
+	}
+
+	return sess.Copy(&aws.Config{Credentials: role.credentials(sess)}), nil
+}
+
+// resolveRegion creates an AWS session with conf, taking the region from the
+// AWS_REGION or AWS_DEFAULT_REGION environment variables, or the shared config
+// of the selected profile. When none of these set a region, as is common on
+// EC2 instances and EKS nodes, the region is taken from the instance metadata.
+// It is an error if the region cannot be determined at all.
+func resolveRegion(conf aws.Config) (*session.Session, error) {
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            conf,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if aws.StringValue(sess.Config.Region) != "" {
+		return sess, nil
+	}
+
+	// the metadata service is local to the instance, so it is not accessed
+	// via the configured transport, and with the SDK's short timeouts
+	region, err := ec2metadata.New(sess.Copy(
+		&aws.Config{HTTPClient: http.DefaultClient})).Region()
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine AWS region, none set in "+
+			"environment or shared config, and instance metadata not "+
+			"available: %v", err)
+	}
+
+	log.WithField("region", region).Debug(
+		"using AWS region from instance metadata")
+	return sess.Copy(&aws.Config{Region: aws.String(region)}), nil
+}
+
+// RetryOnExpiredToken runs op. If op fails because the AWS credentials it
+// used have expired, creds get expired so that they are retrieved again on
+// next use, and op is retried once. Note that for an assumed role, this
+// affects all sessions using that role.
+func RetryOnExpiredToken(creds *credentials.Credentials, op func() error) error {
+
+	err := op()
+	if creds == nil || !IsExpiredToken(err) {
+		return err
+	}
+
+	log.Debug("AWS credentials expired, retrying with new credentials")
+	creds.Expire()
+	return op()
+}
+
+// IsExpiredToken determines whether err was caused by expired AWS credentials.
+func IsExpiredToken(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "ExpiredTokenException" ||
+			aerr.Code() == "ExpiredToken"
+	}
+	return false
+}
+
+//
+func (r *AWSRole) credentials(sess *session.Session) *credentials.Credentials {
+
+	assumedRolesLock.Lock()
+	defer assumedRolesLock.Unlock()
+
+	if creds, ok := assumedRoles[*r]; ok {
+		return creds
+	}
+
+	log.WithField("role", r.ARN).Debug("assuming AWS role")
+
+	creds := stscreds.NewCredentials(sess, r.ARN,
+		func(p *stscreds.AssumeRoleProvider) {
+			if r.ExternalID != "" {
+				p.ExternalID = aws.String(r.ExternalID)
+			}
+			p.ExpiryWindow = assumeRoleExpiryWindow
+		})
+	assumedRoles[*r] = creds
+
+	return creds
+}
@@ -0,0 +1,130 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestRetryOnExpiredToken(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	creds := credentials.NewStaticCredentials("id", "secret", "")
+	_, err := creds.Get()
+	th.AssertNoError(err)
+
+	// other errors are not retried
+	calls := 0
+	err = auth.RetryOnExpiredToken(creds, func() error {
+		calls++
+		return errors.New("boom")
+	})
+	th.AssertError(err, "boom")
+	th.AssertEqual(1, calls)
+	th.AssertFalse(creds.IsExpired())
+
+	// expired token causes credentials to expire, and a single retry
+	calls = 0
+	err = auth.RetryOnExpiredToken(creds, func() error {
+		calls++
+		if calls == 1 {
+			return awserr.New("ExpiredTokenException", "expired", nil)
+		}
+		return nil
+	})
+	th.AssertNoError(err)
+	th.AssertEqual(2, calls)
+	th.AssertTrue(creds.IsExpired())
+
+	// no endless retrying
+	calls = 0
+	err = auth.RetryOnExpiredToken(creds, func() error {
+		calls++
+		return awserr.New("ExpiredToken", "expired", nil)
+	})
+	th.AssertError(err, "expired")
+	th.AssertEqual(2, calls)
+}
+
+//
+func TestNewAWSSessionRegion(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	imds := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/latest/api/token":
+				w.Write([]byte("token"))
+			case "/latest/dynamic/instance-identity/document":
+				json.NewEncoder(w).Encode(map[string]string{
+					"region": "ap-south-1"})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer imds.Close()
+
+	// keep the host's AWS config out of the way
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", imds.URL)
+
+	// a given region always wins
+	t.Setenv("AWS_REGION", "eu-west-1")
+	sess, err := auth.NewAWSSession("eu-central-1", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual("eu-central-1", aws.StringValue(sess.Config.Region))
+
+	// without one, the environment comes first
+	sess, err = auth.NewAWSSession("", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual("eu-west-1", aws.StringValue(sess.Config.Region))
+
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "us-west-2")
+	sess, err = auth.NewAWSSession("", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual("us-west-2", aws.StringValue(sess.Config.Region))
+
+	// and instance metadata last
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	sess, err = auth.NewAWSSession("", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual("ap-south-1", aws.StringValue(sess.Config.Region))
+
+	imds.Close()
+	_, err = auth.NewAWSSession("", nil, nil)
+	th.AssertError(err, "cannot determine AWS region")
+}
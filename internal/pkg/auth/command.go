@@ -0,0 +1,82 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// NewCommandAuthRefresher creates a refresher that runs command and uses its
+// output as bearer token. The command is run again once interval has passed,
+// or earlier if the token is a JWT that expires before that. With interval 0,
+// it is only run again once the token expires, or on each refresh if the
+// token's expiry is not known.
+func NewCommandAuthRefresher(command []string,
+	interval time.Duration) Refresher {
+	return &commandAuthRefresher{command: command, interval: interval}
+}
+
+//
+type commandAuthRefresher struct {
+	command  []string
+	interval time.Duration
+	expiry   time.Time
+}
+
+//
+func (rf *commandAuthRefresher) Refresh(creds *Credentials) error {
+
+	if len(rf.command) == 0 || time.Now().Before(rf.expiry) {
+		return nil
+	}
+
+	cmd := exec.Command(rf.command[0], rf.command[1:]...)
+	bufOut := new(bytes.Buffer)
+	bufErr := new(bytes.Buffer)
+	cmd.Stdout = bufOut
+	cmd.Stderr = bufErr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(bufErr.String()); msg != "" {
+			return fmt.Errorf("error running auth command: %v: %s", err, msg)
+		}
+		return fmt.Errorf("error running auth command: %v", err)
+	}
+
+	raw := strings.TrimSpace(bufOut.String())
+	if raw == "" {
+		return fmt.Errorf("auth command did not print a token")
+	}
+
+	token := NewToken(raw)
+	creds.token = token
+
+	rf.expiry = time.Time{}
+	if rf.interval > 0 {
+		rf.expiry = time.Now().Add(rf.interval)
+	}
+	if token.IsValid() && (rf.expiry.IsZero() || token.expiry.Before(
+		rf.expiry)) {
+		rf.expiry = token.expiry
+	}
+
+	return nil
+}
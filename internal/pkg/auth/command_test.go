@@ -0,0 +1,64 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestCommandAuthRefresher(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// each run of the command appends to a file, and prints its content
+	count := filepath.Join(t.TempDir(), "count")
+	script := []string{"sh", "-c", "printf x >> " + count + "; cat " + count}
+
+	creds := &auth.Credentials{}
+	creds.SetRefresher(auth.NewCommandAuthRefresher(script, time.Hour))
+	th.AssertNoError(creds.Refresh())
+	th.AssertEqual("x", creds.BearerToken())
+
+	// not run again within interval
+	th.AssertNoError(creds.Refresh())
+	th.AssertEqual("x", creds.BearerToken())
+
+	// without interval and expiry, run on each refresh
+	creds.SetRefresher(auth.NewCommandAuthRefresher(script, 0))
+	th.AssertNoError(creds.Refresh())
+	th.AssertEqual("xx", creds.BearerToken())
+	th.AssertNoError(creds.Refresh())
+	th.AssertEqual("xxx", creds.BearerToken())
+
+	b, err := ioutil.ReadFile(count)
+	th.AssertNoError(err)
+	th.AssertEqual("xxx", string(b))
+
+	creds.SetRefresher(auth.NewCommandAuthRefresher(
+		[]string{"sh", "-c", "echo broken >&2; exit 1"}, 0))
+	th.AssertError(creds.Refresh(), "broken")
+
+	creds.SetRefresher(auth.NewCommandAuthRefresher([]string{"true"}, 0))
+	th.AssertError(creds.Refresh(), "did not print a token")
+}
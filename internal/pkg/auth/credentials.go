@@ -16,11 +16,21 @@
 
 package auth
 
+import (
+	"net/http"
+)
+
 //
 type Refresher interface {
 	Refresh(creds *Credentials) error
 }
 
+// Rejecter is implemented by refreshers that cache credentials until they get
+// rejected by the registry.
+type Rejecter interface {
+	Reject()
+}
+
 //
 func NewCredentialsFromBasic(username, password string) (*Credentials, error) {
 	return &Credentials{username: username, password: password}, nil
@@ -80,6 +90,29 @@ func (c *Credentials) SetToken(t *Token) {
 	c.token = t
 }
 
+// BearerToken returns the raw bearer token of these credentials, or an empty
+// string if there is none.
+func (c *Credentials) BearerToken() string {
+	if c == nil || c.token == nil {
+		return ""
+	}
+	return c.token.Raw()
+}
+
+// Authorize sets the authorization header of req for these credentials, i.e.
+// basic auth when there is a user name or password, or otherwise the bearer
+// token if set. Without any credentials, req is left as is.
+func (c *Credentials) Authorize(req *http.Request) {
+	if c == nil {
+		return
+	}
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	} else if t := c.BearerToken(); t != "" {
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+}
+
 //
 func (c *Credentials) SetRefresher(r Refresher) {
 	c.refresher = r
@@ -92,3 +125,17 @@ func (c *Credentials) Refresh() error {
 	}
 	return c.refresher.Refresh(c)
 }
+
+// Reject tells the refresher of these credentials that the registry rejected
+// them, so that they are retrieved anew on the next refresh. Returns whether
+// the refresher supports this.
+func (c *Credentials) Reject() bool {
+	if c == nil {
+		return false
+	}
+	if r, ok := c.refresher.(Rejecter); ok {
+		r.Reject()
+		return true
+	}
+	return false
+}
@@ -19,29 +19,37 @@ package auth
 import (
 	"encoding/base64"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 )
 
+// ECR tokens are refreshed at the latest this long before they expire
+const ecrTokenExpiryWindow = 5 * time.Minute
+
 //
-func NewECRAuthRefresher(account, region string, interval time.Duration) Refresher {
+func NewECRAuthRefresher(account, region string, interval time.Duration,
+	role *AWSRole, transport *http.Transport) Refresher {
 	return &ecrAuthRefresher{
-		account:  account,
-		region:   region,
-		interval: interval,
+		account:   account,
+		region:    region,
+		interval:  interval,
+		role:      role,
+		transport: transport,
 	}
 }
 
 //
 type ecrAuthRefresher struct {
-	account  string
-	region   string
-	interval time.Duration
-	expiry   time.Time
+	account   string
+	region    string
+	interval  time.Duration
+	expiry    time.Time
+	role      *AWSRole
+	transport *http.Transport
 }
 
 //
@@ -52,17 +60,21 @@ func (rf *ecrAuthRefresher) Refresh(creds *Credentials) error {
 		return nil
 	}
 
-	sess, err := session.NewSession()
+	sess, err := NewAWSSession(rf.region, rf.role, rf.transport)
 	if err != nil {
 		return err
 	}
 
-	svc := ecr.New(sess, &aws.Config{Region: aws.String(rf.region)})
+	svc := ecr.New(sess)
 	input := &ecr.GetAuthorizationTokenInput{
 		RegistryIds: []*string{aws.String(rf.account)},
 	}
-	authToken, err := svc.GetAuthorizationToken(input)
-	if err != nil {
+
+	var authToken *ecr.GetAuthorizationTokenOutput
+	if err := RetryOnExpiredToken(sess.Config.Credentials, func() error {
+		authToken, err = svc.GetAuthorizationToken(input)
+		return err
+	}); err != nil {
 		return err
 	}
 
@@ -81,7 +93,16 @@ func (rf *ecrAuthRefresher) Refresh(creds *Credentials) error {
 		creds.username = strings.TrimSpace(split[0])
 		creds.password = strings.TrimSpace(split[1])
 		creds.auther = BasicAuthJSON
+
+		// refresh after interval, but no later than shortly before the
+		// token expires
 		rf.expiry = time.Now().Add(rf.interval)
+		if data.ExpiresAt != nil {
+			if exp := data.ExpiresAt.Add(-ecrTokenExpiryWindow); exp.Before(
+				rf.expiry) {
+				rf.expiry = exp
+			}
+		}
 
 		return nil
 	}
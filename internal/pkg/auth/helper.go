@@ -0,0 +1,137 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// prefix of Docker credential helper executables
+const helperPrefix = "docker-credential-"
+
+// HelperExecutable returns the executable for credential helper helper. Plain
+// names are taken as Docker credential helpers, i.e. `pass` is run as
+// `docker-credential-pass`, while paths are used as is.
+func HelperExecutable(helper string) string {
+	if strings.ContainsRune(helper, '/') ||
+		strings.HasPrefix(helper, helperPrefix) {
+		return helper
+	}
+	return helperPrefix + helper
+}
+
+// NewHelperAuthRefresher creates a refresher that retrieves the credentials
+// for server from credential helper helper, using the protocol of Docker's
+// credential helpers. The credentials are cached until they get rejected by
+// the registry, or interval has passed, if set.
+func NewHelperAuthRefresher(helper, server string,
+	interval time.Duration) Refresher {
+	return &helperAuthRefresher{
+		helper: HelperExecutable(helper), server: server, interval: interval}
+}
+
+//
+type helperAuthRefresher struct {
+	helper   string
+	server   string
+	interval time.Duration
+	expiry   time.Time
+	valid    bool
+	mutex    gosync.Mutex
+}
+
+// output of a credential helper's `get` command
+type helperCreds struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+//
+func (rf *helperAuthRefresher) Refresh(creds *Credentials) error {
+
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.valid && (rf.expiry.IsZero() || time.Now().Before(rf.expiry)) {
+		return nil
+	}
+
+	cmd := exec.Command(rf.helper, "get")
+	cmd.Stdin = strings.NewReader(rf.server)
+	bufOut := new(bytes.Buffer)
+	bufErr := new(bytes.Buffer)
+	cmd.Stdout = bufOut
+	cmd.Stderr = bufErr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(bufErr.String())
+		if msg == "" {
+			msg = strings.TrimSpace(bufOut.String())
+		}
+		if msg != "" {
+			return fmt.Errorf("error running credential helper '%s': %v: %s",
+				rf.helper, err, msg)
+		}
+		return fmt.Errorf("error running credential helper '%s': %v",
+			rf.helper, err)
+	}
+
+	hc := &helperCreds{}
+	if err := json.Unmarshal(bufOut.Bytes(), hc); err != nil {
+		return fmt.Errorf("invalid output of credential helper '%s': %v",
+			rf.helper, err)
+	}
+	if hc.Secret == "" {
+		return fmt.Errorf("credential helper '%s' returned no secret for '%s'",
+			rf.helper, rf.server)
+	}
+
+	// without user name, the secret is a bearer token
+	if hc.Username == "" {
+		creds.username = ""
+		creds.password = ""
+		creds.token = NewToken(hc.Secret)
+	} else {
+		creds.username = hc.Username
+		creds.password = hc.Secret
+		creds.token = nil
+		creds.auther = BasicAuthJSON
+	}
+
+	rf.valid = true
+	rf.expiry = time.Time{}
+	if rf.interval > 0 {
+		rf.expiry = time.Now().Add(rf.interval)
+	}
+
+	return nil
+}
+
+// Reject discards the cached credentials, so that the credential helper is
+// run again on the next refresh.
+func (rf *helperAuthRefresher) Reject() {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	rf.valid = false
+}
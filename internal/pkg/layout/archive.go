@@ -0,0 +1,407 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package layout
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// media types of manifests that refer to further blobs
+const (
+	mediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerList  = "application/vnd.docker.distribution.manifest." +
+		"list.v2+json"
+	mediaTypeDockerImage = "application/vnd.docker.distribution.manifest." +
+		"v2+json"
+)
+
+// the `oci-layout` file of an OCI layout, and its content
+const (
+	ociLayoutFile    = "oci-layout"
+	ociLayoutVersion = `{"imageLayoutVersion":"1.0.0"}`
+)
+
+// errNotFound is returned by stores for objects that do not exist
+var errNotFound = errors.New("not found")
+
+// store is an object storage bucket holding an OCI layout under a prefix. Keys
+// are relative to that prefix, e.g. `index.json`.
+type store interface {
+	get(ctx context.Context, key string) (io.ReadCloser, error)
+	put(ctx context.Context, key string, r io.Reader, size int64) error
+	exists(ctx context.Context, key string) (bool, error)
+}
+
+// descriptor is the part of an OCI content descriptor needed for copying the
+// blob it refers to
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// getStore returns the store of this layout, which is created on first use.
+func (l *Layout) getStore() (store, error) {
+
+	l.storeMu.Lock()
+	defer l.storeMu.Unlock()
+
+	if l.store != nil {
+		return l.store, nil
+	}
+
+	parts := strings.SplitN(l.path, "/", 2)
+	bucket, prefix := parts[0], ""
+	if len(parts) > 1 {
+		prefix = parts[1]
+	}
+
+	var err error
+	if l.transport == S3 {
+		l.store, err = newS3Store(bucket, prefix)
+	} else {
+		l.store, err = newGCSStore(bucket, prefix)
+	}
+	return l.store, err
+}
+
+// readArchiveIndex reads the names and descriptors of the images in this
+// layout from its `index.json` in object storage.
+func (l *Layout) readArchiveIndex(ctx context.Context) ([]string,
+	map[string]json.RawMessage, error) {
+
+	st, err := l.getStore()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := st.get(ctx, "index.json")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	return parseOCIIndex(r)
+}
+
+// Fetch copies the image with tag t from this layout in object storage into a
+// local OCI layout, and calls copy with the reference of the image in there,
+// including the transport as understood by skopeo. The local layout is removed
+// afterwards.
+func (l *Layout) Fetch(ctx context.Context, t string,
+	copy func(src string) error) error {
+
+	if err := l.load(); err != nil {
+		return err
+	}
+	name, ok := l.refs[t]
+	if !ok {
+		return fmt.Errorf("no image with tag '%s' in layout '%s'", t, l)
+	}
+
+	st, err := l.getStore()
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "dregsy-layout-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var desc descriptor
+	if err := json.Unmarshal(l.descs[name], &desc); err != nil {
+		return fmt.Errorf("invalid descriptor for '%s': %v", name, err)
+	}
+
+	log.WithFields(log.Fields{"layout": l.String(), "image": name}).Debug(
+		"fetching image from object storage")
+	if err := fetchBlobs(ctx, st, dir, desc); err != nil {
+		return fmt.Errorf("cannot fetch '%s' from layout '%s': %v",
+			name, l, err)
+	}
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []json.RawMessage{l.descs[name]}})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(
+		filepath.Join(dir, "index.json"), index, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ociLayoutFile),
+		[]byte(ociLayoutVersion), 0644); err != nil {
+		return err
+	}
+
+	return copy(fmt.Sprintf("%s:%s:%s", OCI, dir, name))
+}
+
+// fetchBlobs downloads the blob of desc from st into the local OCI layout at
+// dir, along with all blobs it refers to if it is a manifest or index.
+func fetchBlobs(ctx context.Context, st store, dir string,
+	desc descriptor) error {
+
+	path, err := blobPath(desc.Digest)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, path)
+
+	if _, err := os.Stat(file); err != nil {
+		if err := fetchBlob(ctx, st, path, file, desc.Digest); err != nil {
+			return err
+		}
+	}
+
+	var refs []descriptor
+	switch desc.MediaType {
+	case mediaTypeOCIIndex, mediaTypeDockerList:
+		var index struct {
+			Manifests []descriptor `json:"manifests"`
+		}
+		if err := readJSON(file, &index); err != nil {
+			return err
+		}
+		refs = index.Manifests
+	case mediaTypeOCIManifest, mediaTypeDockerImage:
+		var manifest struct {
+			Config descriptor   `json:"config"`
+			Layers []descriptor `json:"layers"`
+		}
+		if err := readJSON(file, &manifest); err != nil {
+			return err
+		}
+		refs = append([]descriptor{manifest.Config}, manifest.Layers...)
+	}
+
+	for _, r := range refs {
+		if err := fetchBlobs(ctx, st, dir, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchBlob downloads the blob at key from st to file, and checks that it has
+// digest dgst.
+func fetchBlob(ctx context.Context, st store, key, file,
+	dgst string) error {
+
+	r, err := st.get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("cannot get blob '%s': %v", dgst, err)
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return fmt.Errorf("cannot get blob '%s': %v", dgst, err)
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != dgst {
+		return fmt.Errorf("blob '%s' has wrong digest '%s'", dgst, got)
+	}
+	return f.Close()
+}
+
+// Store calls copy with the reference of an image with tag t in a new local
+// OCI layout, including the transport as understood by skopeo. Once copy has
+// written the image, its blobs are uploaded to this layout in object storage,
+// unless they exist there already, and the image is added to the index of the
+// layout, replacing any previous image with tag t. The local layout is removed
+// afterwards.
+func (l *Layout) Store(ctx context.Context, t string,
+	copy func(trgt string) error) error {
+
+	st, err := l.getStore()
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "dregsy-layout-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := copy(fmt.Sprintf("%s:%s:%s", OCI, dir, t)); err != nil {
+		return err
+	}
+
+	_, descs, err := readOCINames(dir)
+	if err != nil {
+		return err
+	}
+	desc, ok := descs[t]
+	if !ok {
+		return fmt.Errorf("no image with tag '%s' was written", t)
+	}
+
+	log.WithFields(log.Fields{"layout": l.String(), "image": t}).Debug(
+		"storing image in object storage")
+	if err := storeBlobs(ctx, st, dir); err != nil {
+		return fmt.Errorf("cannot store '%s' in layout '%s': %v", t, l, err)
+	}
+
+	// the index is read and written under lock, so that tags stored in
+	// parallel do not drop each other from it
+	l.storeMu.Lock()
+	defer l.storeMu.Unlock()
+
+	if err := addToIndex(ctx, st, t, desc); err != nil {
+		return fmt.Errorf("cannot store '%s' in layout '%s': %v", t, l, err)
+	}
+	return nil
+}
+
+// storeBlobs uploads all blobs of the local OCI layout at dir to st, unless
+// they exist there already.
+func storeBlobs(ctx context.Context, st store, dir string) error {
+
+	return filepath.Walk(filepath.Join(dir, "blobs"),
+		func(path string, info os.FileInfo, err error) error {
+
+			if err != nil || info.IsDir() {
+				return err
+			}
+
+			key, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			key = filepath.ToSlash(key)
+
+			if ok, err := st.exists(ctx, key); err != nil {
+				return err
+			} else if ok {
+				return nil
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return st.put(ctx, key, f, info.Size())
+		})
+}
+
+// addToIndex adds image descriptor desc with name t to the index of the
+// layout in st, replacing any descriptor with the same name. When the layout
+// has no index yet, it is created.
+func addToIndex(ctx context.Context, st store, t string,
+	desc json.RawMessage) error {
+
+	index := map[string]json.RawMessage{}
+	var manifests []json.RawMessage
+
+	r, err := st.get(ctx, "index.json")
+	switch {
+	case errors.Is(err, errNotFound):
+		index["schemaVersion"] = json.RawMessage("2")
+		if err := putBytes(ctx, st, ociLayoutFile,
+			[]byte(ociLayoutVersion)); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		err = json.NewDecoder(r).Decode(&index)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("invalid index.json: %v", err)
+		}
+		if raw, ok := index["manifests"]; ok {
+			if err := json.Unmarshal(raw, &manifests); err != nil {
+				return fmt.Errorf("invalid index.json: %v", err)
+			}
+		}
+	}
+
+	kept := make([]json.RawMessage, 0, len(manifests)+1)
+	for _, m := range manifests {
+		if refName(m) != t {
+			kept = append(kept, m)
+		}
+	}
+	raw, err := json.Marshal(append(kept, desc))
+	if err != nil {
+		return err
+	}
+	index["manifests"] = raw
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return putBytes(ctx, st, "index.json", data)
+}
+
+//
+func putBytes(ctx context.Context, st store, key string, data []byte) error {
+	return st.put(ctx, key, strings.NewReader(string(data)),
+		int64(len(data)))
+}
+
+// blobPath returns the path of the blob with digest dgst within an OCI layout.
+func blobPath(dgst string) (string, error) {
+	parts := strings.SplitN(dgst, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || len(parts[1]) != 64 {
+		return "", fmt.Errorf("unsupported digest '%s'", dgst)
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return "", fmt.Errorf("unsupported digest '%s'", dgst)
+	}
+	return "blobs/sha256/" + parts[1], nil
+}
+
+//
+func readJSON(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid manifest '%s': %v", filepath.Base(file), err)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package layout
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// memStore is a store keeping objects in memory
+type memStore struct {
+	mu      gosync.Mutex
+	objects map[string][]byte
+}
+
+//
+func (s *memStore) get(ctx context.Context, key string) (io.ReadCloser,
+	error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if data, ok := s.objects[key]; ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil, errNotFound
+}
+
+//
+func (s *memStore) put(ctx context.Context, key string, r io.Reader,
+	size int64) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+//
+func (s *memStore) exists(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.objects[key]
+	return ok, nil
+}
+
+//
+func TestArchive(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	th.AssertTrue(IsLayout("s3://bucket/archive"))
+	th.AssertTrue(IsArchive("gs://bucket"))
+	th.AssertFalse(IsArchive("oci:/tmp/layout"))
+
+	_, err := New("s3://")
+	th.AssertError(err, "no bucket for layout")
+	_, err = New("gs:///archive")
+	th.AssertError(err, "no bucket for layout")
+
+	l, err := New("s3://bucket/archive/")
+	th.AssertNoError(err)
+	th.AssertEqual("s3://bucket/archive", l.String())
+	th.AssertNotNil(l.Archive())
+	lo, err := New("oci:/tmp/layout")
+	th.AssertNoError(err)
+	th.AssertNil(lo.Archive())
+
+	st := &memStore{objects: map[string][]byte{}}
+	l.store = st
+
+	// images are stored via a local layout, replacing those with same tag
+	var first string
+	th.AssertNoError(l.Store(ctx, "1.0", func(trgt string) error {
+		first = writeImage(th, trgt, "1.0", "old")
+		return nil
+	}))
+	th.AssertNoError(l.Store(ctx, "1.0", func(trgt string) error {
+		writeImage(th, trgt, "1.0", "new")
+		return nil
+	}))
+	th.AssertNoError(l.Store(ctx, "2.0", func(trgt string) error {
+		writeImage(th, trgt, "2.0", "new")
+		return nil
+	}))
+	th.AssertError(l.Store(ctx, "3.0", func(trgt string) error {
+		return fmt.Errorf("copy failed")
+	}), "copy failed")
+
+	th.AssertEqual(ociLayoutVersion, string(st.objects[ociLayoutFile]))
+	// config and layer of both versions, and two manifests
+	blobs := 0
+	for k := range st.objects {
+		if strings.HasPrefix(k, "blobs/sha256/") {
+			blobs++
+		}
+	}
+	th.AssertEqual(6, blobs)
+
+	// images are fetched into a local layout with just that image
+	l, err = New("s3://bucket/archive")
+	th.AssertNoError(err)
+	l.store = st
+
+	tags, err := l.Tags()
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"1.0", "2.0"}, tags)
+	th.AssertEqual("s3://bucket/archive:2.0", l.Ref("2.0"))
+
+	th.AssertNoError(l.Fetch(ctx, "1.0", func(src string) error {
+		th.AssertTrue(strings.HasPrefix(src, "oci:"))
+		th.AssertTrue(strings.HasSuffix(src, ":1.0"))
+		dir := strings.TrimSuffix(strings.TrimPrefix(src, "oci:"), ":1.0")
+		names, descs, err := readOCINames(dir)
+		th.AssertNoError(err)
+		th.AssertEqualSlices([]string{"1.0"}, names)
+		var desc descriptor
+		th.AssertNoError(json.Unmarshal(descs["1.0"], &desc))
+		th.AssertFalse(desc.Digest == first)
+		for _, f := range []string{"oci-layout", "blobs/sha256"} {
+			_, err := os.Stat(filepath.Join(dir, f))
+			th.AssertNoError(err)
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(dir, "blobs/sha256"))
+		th.AssertNoError(err)
+		th.AssertEqual(3, len(entries))
+		return nil
+	}))
+
+	th.AssertError(l.Fetch(ctx, "3.0", func(src string) error {
+		return nil
+	}), "no image with tag '3.0'")
+
+	// fetched blobs are checked against their digest
+	for k := range st.objects {
+		if strings.HasPrefix(k, "blobs/sha256/") {
+			st.objects[k] = append(st.objects[k], 'x')
+		}
+	}
+	th.AssertError(l.Fetch(ctx, "2.0", func(src string) error {
+		return nil
+	}), "has wrong digest")
+}
+
+//
+func TestGCSStore(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPost && r.URL.Path ==
+				"/upload/storage/v1/b/bucket/o":
+				data, _ := ioutil.ReadAll(r.Body)
+				objects[r.URL.Query().Get("name")] = data
+				w.Write([]byte("{}"))
+			case strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+				data, ok := objects[strings.TrimPrefix(r.URL.Path,
+					"/storage/v1/b/bucket/o/")]
+				switch {
+				case !ok:
+					http.NotFound(w, r)
+				case r.URL.Query().Get("alt") == "media":
+					w.Write(data)
+				default:
+					w.Write([]byte("{}"))
+				}
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+	defer srv.Close()
+
+	st := &gcsStore{bucket: "bucket", prefix: "archive", api: srv.URL,
+		client: srv.Client()}
+
+	ok, err := st.exists(ctx, "index.json")
+	th.AssertNoError(err)
+	th.AssertFalse(ok)
+	_, err = st.get(ctx, "index.json")
+	th.AssertEqual(errNotFound, err)
+
+	th.AssertNoError(putBytes(ctx, st, "index.json", []byte("{}")))
+	th.AssertEqual("{}", string(objects["archive/index.json"]))
+
+	ok, err = st.exists(ctx, "index.json")
+	th.AssertNoError(err)
+	th.AssertTrue(ok)
+	r, err := st.get(ctx, "index.json")
+	th.AssertNoError(err)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	th.AssertNoError(err)
+	th.AssertEqual("{}", string(data))
+
+	st.api = srv.URL + "/invalid"
+	_, err = st.get(ctx, "index.json")
+	th.AssertError(err, "400 Bad Request")
+}
+
+// writeImage writes an image with tag t into the local OCI layout referenced
+// by ref, as skopeo would, and returns the digest of its manifest. Images with
+// different content get different blobs.
+func writeImage(th *test.TestHelper, ref, t, content string) string {
+
+	dir := strings.TrimSuffix(strings.TrimPrefix(ref, "oci:"), ":"+t)
+
+	blob := func(data string) string {
+		dgst := fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+		path := filepath.Join(dir, "blobs", "sha256", dgst)
+		th.AssertNoError(os.MkdirAll(filepath.Dir(path), 0755))
+		th.AssertNoError(ioutil.WriteFile(path, []byte(data), 0644))
+		return "sha256:" + dgst
+	}
+
+	config := `{"config":"` + content + `"}`
+	layer := "layer " + content
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s",`+
+		`"config":{"digest":"%s","size":%d},`+
+		`"layers":[{"digest":"%s","size":%d}]}`, mediaTypeOCIManifest,
+		blob(config), len(config), blob(layer), len(layer))
+	dgst := blob(manifest)
+
+	th.AssertNoError(ioutil.WriteFile(filepath.Join(dir, "index.json"),
+		[]byte(fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"mediaType":`+
+			`"%s","digest":"%s","size":%d,"annotations":`+
+			`{"org.opencontainers.image.ref.name":"%s"}}]}`,
+			mediaTypeOCIManifest, dgst, len(manifest), t)), 0644))
+
+	return dgst
+}
@@ -0,0 +1,157 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package layout
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	gosync "sync"
+
+	"golang.org/x/oauth2/google"
+)
+
+//
+const gcsAPI = "https://storage.googleapis.com"
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsStore is a Google Cloud Storage bucket, accessed via the JSON API.
+// Credentials are taken from the Google application default credentials,
+// i.e. from the file set with GOOGLE_APPLICATION_CREDENTIALS, or from the
+// metadata server. The client is created on first use.
+type gcsStore struct {
+	bucket string
+	prefix string
+	api    string
+	//
+	mu     gosync.Mutex
+	client *http.Client
+}
+
+//
+func newGCSStore(bucket, prefix string) (store, error) {
+	return &gcsStore{bucket: bucket, prefix: prefix, api: gcsAPI}, nil
+}
+
+//
+func (s *gcsStore) getClient(ctx context.Context) (*http.Client, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	// the client outlives ctx, since it is kept for later requests
+	c, err := google.DefaultClient(context.Background(), gcsScope)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get Google credentials: %v", err)
+	}
+	s.client = c
+	return c, nil
+}
+
+// objectURL returns the URL of the object at key, for downloading its data if
+// media is set, or its metadata otherwise.
+func (s *gcsStore) objectURL(key string, media bool) string {
+	u := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", s.api,
+		url.PathEscape(s.bucket), url.PathEscape(path.Join(s.prefix, key)))
+	if media {
+		u += "?alt=media"
+	}
+	return u
+}
+
+//
+func (s *gcsStore) do(ctx context.Context, method, u string, body io.Reader,
+	size int64) (*http.Response, error) {
+
+	c, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errNotFound
+	case resp.StatusCode >= 300:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, msg)
+	}
+
+	return resp, nil
+}
+
+//
+func (s *gcsStore) get(ctx context.Context, key string) (io.ReadCloser,
+	error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(key, true), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+//
+func (s *gcsStore) put(ctx context.Context, key string, r io.Reader,
+	size int64) error {
+
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		s.api, url.PathEscape(s.bucket),
+		url.QueryEscape(path.Join(s.prefix, key)))
+
+	resp, err := s.do(ctx, http.MethodPost, u, r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+//
+func (s *gcsStore) exists(ctx context.Context, key string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(key, false), nil, 0)
+	if err == errNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
@@ -0,0 +1,306 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package layout
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/relays"
+)
+
+// transports of local layouts, named as in skopeo
+const (
+	OCI           = "oci"
+	DockerArchive = "docker-archive"
+)
+
+// schemes of OCI layouts in object storage
+const (
+	S3  = "s3"
+	GCS = "gs"
+)
+
+// ociRefName is the annotation holding the name of an image in an OCI layout
+const ociRefName = "org.opencontainers.image.ref.name"
+
+// IsLayout determines whether ref refers to a local layout, i.e. whether it
+// starts with one of the supported transports, as in `oci:<path>`, or to an
+// OCI layout in object storage.
+func IsLayout(ref string) bool {
+	return strings.HasPrefix(ref, OCI+":") ||
+		strings.HasPrefix(ref, DockerArchive+":") || IsArchive(ref)
+}
+
+// IsArchive determines whether ref refers to an OCI layout in object storage,
+// i.e. whether it is of the form `s3://<bucket>/<prefix>` or
+// `gs://<bucket>/<prefix>`.
+func IsArchive(ref string) bool {
+	return strings.HasPrefix(ref, S3+"://") || strings.HasPrefix(ref, GCS+"://")
+}
+
+// Layout is an image layout, either a local OCI layout directory, a docker
+// archive as written by `docker save`, or an OCI layout in object storage. Its
+// images are read on first use, and not again later on, so a new Layout is
+// needed for picking up changes.
+type Layout struct {
+	transport string
+	path      string
+	//
+	once  gosync.Once
+	refs  map[string]string
+	descs map[string]json.RawMessage
+	err   error
+	//
+	store   store
+	storeMu gosync.Mutex
+}
+
+// New creates the layout for ref, which is either of the form
+// `<transport>:<path>`, or `<scheme>://<bucket>/<prefix>` for object storage.
+// The layout itself is not accessed yet.
+func New(ref string) (*Layout, error) {
+
+	if IsArchive(ref) {
+		parts := strings.SplitN(ref, "://", 2)
+		path := strings.Trim(parts[1], "/")
+		if path == "" || strings.HasPrefix(parts[1], "/") {
+			return nil, fmt.Errorf("no bucket for layout '%s'", ref)
+		}
+		return &Layout{transport: parts[0], path: path}, nil
+	}
+
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) < 2 || (parts[0] != OCI && parts[0] != DockerArchive) {
+		return nil, fmt.Errorf(
+			"'%s' is not a local layout, must start with '%s:' or '%s:', or "+
+				"be in object storage as '%s://' or '%s://'",
+			ref, OCI, DockerArchive, S3, GCS)
+	}
+	if parts[1] == "" {
+		return nil, fmt.Errorf("no path for local layout '%s'", ref)
+	}
+
+	return &Layout{transport: parts[0], path: parts[1]}, nil
+}
+
+// String returns the reference of this layout.
+func (l *Layout) String() string {
+	if l.isArchive() {
+		return fmt.Sprintf("%s://%s", l.transport, l.path)
+	}
+	return fmt.Sprintf("%s:%s", l.transport, l.path)
+}
+
+// Archive returns this layout for copying images from and to it, if it is in
+// object storage. Otherwise, nil is returned, since skopeo can access local
+// layouts directly.
+func (l *Layout) Archive() relays.Archive {
+	if l.isArchive() {
+		return l
+	}
+	return nil
+}
+
+//
+func (l *Layout) isArchive() bool {
+	return l.transport == S3 || l.transport == GCS
+}
+
+// Tags returns the tags of the images in this layout, in lexical order.
+func (l *Layout) Tags() ([]string, error) {
+
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0, len(l.refs))
+	for t := range l.refs {
+		ret = append(ret, t)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Ref returns the reference of the image with tag t in this layout, including
+// the transport, as understood by skopeo. For tags not found in the layout, t
+// is used as the image name, so that copying fails with a meaningful error.
+// Skopeo cannot access layouts in object storage, so for these, the returned
+// reference is only meant for logging.
+func (l *Layout) Ref(t string) string {
+	if l.load() == nil {
+		if r, ok := l.refs[t]; ok {
+			return fmt.Sprintf("%s:%s", l, r)
+		}
+	}
+	return fmt.Sprintf("%s:%s", l, t)
+}
+
+//
+func (l *Layout) load() error {
+	l.once.Do(func() {
+		var names []string
+		switch {
+		case l.isArchive():
+			names, l.descs, l.err = l.readArchiveIndex(context.Background())
+		case l.transport == OCI:
+			names, l.descs, l.err = readOCINames(l.path)
+		default:
+			names, l.err = readArchiveNames(l.path)
+		}
+		if l.err == nil {
+			l.refs, l.err = namesByTag(names)
+		}
+		if l.err != nil {
+			kind := "local layout"
+			if l.isArchive() {
+				kind = "layout"
+			}
+			l.err = fmt.Errorf("cannot read %s '%s': %v", kind, l, l.err)
+		}
+	})
+	return l.err
+}
+
+// namesByTag maps the tag of each image name in names to that name. An image
+// name is either just a tag, or a reference ending in a tag. Names without a
+// valid tag are skipped. It is an error when two names lead to the same tag.
+func namesByTag(names []string) (map[string]string, error) {
+
+	ret := make(map[string]string, len(names))
+
+	for _, n := range names {
+		t := n
+		if ix := strings.LastIndex(n, ":"); ix > strings.LastIndex(n, "/") {
+			t = n[ix+1:]
+		} else if strings.Contains(n, "/") {
+			t = ""
+		}
+		if !relays.IsValidTag(t) {
+			log.WithField("image", n).Warn(
+				"image in local layout has no valid tag, skipping")
+			continue
+		}
+		if prev, ok := ret[t]; ok && prev != n {
+			return nil, fmt.Errorf(
+				"images '%s' and '%s' both have tag '%s'", prev, n, t)
+		}
+		ret[t] = n
+	}
+
+	return ret, nil
+}
+
+// readOCINames reads the names of the images in the OCI layout directory at
+// path, as given by their `org.opencontainers.image.ref.name` annotation, and
+// the descriptors of the images by name.
+func readOCINames(path string) ([]string, map[string]json.RawMessage,
+	error) {
+
+	f, err := os.Open(filepath.Join(path, "index.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	return parseOCIIndex(f)
+}
+
+// parseOCIIndex reads the `index.json` of an OCI layout from r, and returns
+// the names of the images in there, and their descriptors by name.
+func parseOCIIndex(r io.Reader) ([]string, map[string]json.RawMessage,
+	error) {
+
+	var index struct {
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.NewDecoder(r).Decode(&index); err != nil {
+		return nil, nil, fmt.Errorf("invalid index.json: %v", err)
+	}
+
+	var names []string
+	descs := make(map[string]json.RawMessage, len(index.Manifests))
+	for _, raw := range index.Manifests {
+		if n := refName(raw); n != "" {
+			names = append(names, n)
+			descs[n] = raw
+		}
+	}
+	return names, descs, nil
+}
+
+// refName returns the image name annotated in descriptor raw, or an empty
+// string if it has none.
+func refName(raw json.RawMessage) string {
+	var desc struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if json.Unmarshal(raw, &desc) != nil {
+		return ""
+	}
+	return desc.Annotations[ociRefName]
+}
+
+// readArchiveNames reads the names of the images in the docker archive at
+// path, as given by the `RepoTags` in its `manifest.json`.
+func readArchiveNames(path string) ([]string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("no manifest.json in archive")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Name != "manifest.json" {
+			continue
+		}
+
+		var manifest []struct {
+			RepoTags []string `json:"RepoTags"`
+		}
+		if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest.json: %v", err)
+		}
+
+		var ret []string
+		for _, m := range manifest {
+			ret = append(ret, m.RepoTags...)
+		}
+		return ret, nil
+	}
+}
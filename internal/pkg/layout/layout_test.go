@@ -0,0 +1,132 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package layout
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestNew(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertTrue(IsLayout("oci:/tmp/layout"))
+	th.AssertTrue(IsLayout("docker-archive:busybox.tar"))
+	th.AssertFalse(IsLayout("library/busybox"))
+	th.AssertFalse(IsLayout("ocidir/busybox"))
+
+	l, err := New("oci:/tmp/layout")
+	th.AssertNoError(err)
+	th.AssertEqual("oci:/tmp/layout:1.0", l.Ref("1.0"))
+
+	_, err = New("oci:")
+	th.AssertError(err, "no path for local layout")
+	_, err = New("dir:/tmp/layout")
+	th.AssertError(err, "is not a local layout")
+}
+
+//
+func TestOCILayout(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir := t.TempDir()
+	th.AssertNoError(ioutil.WriteFile(filepath.Join(dir, "index.json"),
+		[]byte(`{"schemaVersion":2,"manifests":[
+			{"annotations":{"org.opencontainers.image.ref.name":"1.36"}},
+			{"annotations":{
+				"org.opencontainers.image.ref.name":"docker.io/busybox:latest"}},
+			{"annotations":{
+				"org.opencontainers.image.ref.name":"localhost:5000/busybox"}},
+			{}]}`), 0644))
+
+	l, err := New("oci:" + dir)
+	th.AssertNoError(err)
+
+	tags, err := l.Tags()
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"1.36", "latest"}, tags)
+	th.AssertEqual("oci:"+dir+":docker.io/busybox:latest", l.Ref("latest"))
+	th.AssertEqual("oci:"+dir+":1.36", l.Ref("1.36"))
+
+	l, err = New("oci:" + filepath.Join(dir, "missing"))
+	th.AssertNoError(err)
+	_, err = l.Tags()
+	th.AssertError(err, "cannot read local layout")
+}
+
+//
+func TestDockerArchive(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	archive := filepath.Join(t.TempDir(), "images.tar")
+	writeArchive(th, archive,
+		`[{"RepoTags":["busybox:1.36","busybox:latest"]},{"RepoTags":[]}]`)
+
+	l, err := New("docker-archive:" + archive)
+	th.AssertNoError(err)
+
+	tags, err := l.Tags()
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"1.36", "latest"}, tags)
+	th.AssertEqual("docker-archive:"+archive+":busybox:1.36", l.Ref("1.36"))
+
+	writeArchive(th, archive,
+		`[{"RepoTags":["busybox:1.36"]},{"RepoTags":["alpine:1.36"]}]`)
+	l, err = New("docker-archive:" + archive)
+	th.AssertNoError(err)
+	_, err = l.Tags()
+	th.AssertError(err, "both have tag '1.36'")
+
+	writeArchive(th, archive, "")
+	l, err = New("docker-archive:" + archive)
+	th.AssertNoError(err)
+	_, err = l.Tags()
+	th.AssertError(err, "no manifest.json in archive")
+}
+
+// writeArchive writes a docker archive to path, with manifest as its
+// `manifest.json`. If manifest is empty, there is no `manifest.json`.
+func writeArchive(th *test.TestHelper, path, manifest string) {
+
+	f, err := os.Create(path)
+	th.AssertNoError(err)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	th.AssertNoError(tw.WriteHeader(&tar.Header{
+		Name: "repositories", Mode: 0644, Size: 2}))
+	_, err = tw.Write([]byte("{}"))
+	th.AssertNoError(err)
+
+	if manifest != "" {
+		th.AssertNoError(tw.WriteHeader(&tar.Header{
+			Name: "manifest.json", Mode: 0644, Size: int64(len(manifest))}))
+		_, err = tw.Write([]byte(manifest))
+		th.AssertNoError(err)
+	}
+
+	th.AssertNoError(tw.Close())
+}
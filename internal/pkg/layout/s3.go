@@ -0,0 +1,149 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package layout
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path"
+	gosync "sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+)
+
+// defaultS3Region is where the region of a bucket is looked up, when no
+// region is configured
+const defaultS3Region = "us-east-1"
+
+// s3Store is an S3 bucket. Credentials are taken from the default credential
+// chain of the AWS SDK, i.e. from environment, shared config, or instance
+// role. The client is created on first use, in the region of the bucket.
+type s3Store struct {
+	bucket string
+	prefix string
+	sess   *session.Session
+	//
+	mu       gosync.Mutex
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+//
+func newS3Store(bucket, prefix string) (store, error) {
+	sess, err := auth.NewAWSSession(defaultS3Region, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{bucket: bucket, prefix: prefix, sess: sess}, nil
+}
+
+// getClient returns the S3 client for the region of the bucket.
+func (s *s3Store) getClient(ctx context.Context) (*s3.S3, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	region, err := s3manager.GetBucketRegion(ctx, s.sess, s.bucket,
+		aws.StringValue(s.sess.Config.Region))
+	if err != nil {
+		return nil, err
+	}
+
+	s.client = s3.New(s.sess, aws.NewConfig().WithRegion(region))
+	s.uploader = s3manager.NewUploaderWithClient(s.client)
+	return s.client, nil
+}
+
+//
+func (s *s3Store) key(k string) string {
+	return path.Join(s.prefix, k)
+}
+
+//
+func (s *s3Store) get(ctx context.Context, key string) (io.ReadCloser,
+	error) {
+
+	c, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := c.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if isS3NotFound(err) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+//
+func (s *s3Store) put(ctx context.Context, key string, r io.Reader,
+	size int64) error {
+
+	if _, err := s.getClient(ctx); err != nil {
+		return err
+	}
+
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   r,
+	})
+	return err
+}
+
+//
+func (s *s3Store) exists(ctx context.Context, key string) (bool, error) {
+
+	c, err := s.getClient(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = c.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if isS3NotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// isS3NotFound determines whether err tells that an object does not exist.
+func isS3NotFound(err error) bool {
+	if e, ok := err.(awserr.RequestFailure); ok {
+		return e.StatusCode() == http.StatusNotFound
+	}
+	return false
+}
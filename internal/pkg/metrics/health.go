@@ -0,0 +1,285 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+const DefaultGraceFactor = 2.0
+
+// TaskStatus is the state of a task as reported under `/status`
+type TaskStatus struct {
+	Task        string     `json:"task"`
+	Interval    string     `json:"interval,omitempty"`
+	Running     bool       `json:"running"`
+	LastStart   *time.Time `json:"last-start,omitempty"`
+	LastEnd     *time.Time `json:"last-end,omitempty"`
+	LastResult  string     `json:"last-result,omitempty"`
+	LastError   string     `json:"last-error,omitempty"`
+	LastSuccess *time.Time `json:"last-success,omitempty"`
+	Skipped     int        `json:"skipped,omitempty"`
+	LastSkipped *time.Time `json:"last-skipped,omitempty"`
+	Transferred int64      `json:"transferred-bytes,omitempty"`
+	Circuit     string     `json:"circuit,omitempty"`
+	OpenUntil   *time.Time `json:"circuit-open-until,omitempty"`
+	Fresh       bool       `json:"fresh"`
+}
+
+//
+type taskState struct {
+	interval    time.Duration
+	tracked     time.Time
+	running     bool
+	lastStart   time.Time
+	lastEnd     time.Time
+	lastResult  string
+	lastError   string
+	lastSuccess time.Time
+	skipped     int
+	lastSkipped time.Time
+	transferred int64
+	circuit     string
+	openUntil   time.Time
+}
+
+// fresh determines whether the task succeeded within its interval multiplied
+// by grace, at time now. Before the first success, the time at which tracking
+// started counts instead. Tasks without interval, i.e. one-off tasks, are
+// always fresh.
+func (s *taskState) fresh(now time.Time, grace float64) bool {
+
+	if s.interval <= 0 {
+		return true
+	}
+
+	ref := s.lastSuccess
+	if ref.IsZero() {
+		ref = s.tracked
+	}
+	return now.Sub(ref) <= time.Duration(grace*float64(s.interval))
+}
+
+//
+var health = struct {
+	mu    sync.Mutex
+	tasks map[string]*taskState
+}{tasks: make(map[string]*taskState)}
+
+// TrackTasks sets the tasks for which health is reported, with their expected
+// interval. The state of tasks that were tracked before is kept.
+func TrackTasks(intervals map[string]time.Duration) {
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	tasks := make(map[string]*taskState, len(intervals))
+	now := time.Now()
+
+	for name, i := range intervals {
+		s, ok := health.tasks[name]
+		if !ok {
+			s = &taskState{tracked: now}
+		}
+		s.interval = i
+		tasks[name] = s
+	}
+
+	health.tasks = tasks
+}
+
+// TaskStarted records the start of a run of task. Tasks not tracked so far are
+// tracked from now on, without an interval.
+func TaskStarted(task string) {
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	s, ok := health.tasks[task]
+	if !ok {
+		s = &taskState{tracked: time.Now()}
+		health.tasks[task] = s
+	}
+	s.running = true
+	s.lastStart = time.Now()
+	s.transferred = 0
+}
+
+// taskTransferred records n layer bytes transferred by the current run of
+// task.
+func taskTransferred(task string, n int64) {
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	if s, ok := health.tasks[task]; ok && s.running {
+		s.transferred += n
+	}
+}
+
+// taskSkipped records a run of task that was skipped because the previous run
+// had not finished yet.
+func taskSkipped(task string) {
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	s, ok := health.tasks[task]
+	if !ok {
+		s = &taskState{tracked: time.Now()}
+		health.tasks[task] = s
+	}
+	s.skipped++
+	s.lastSkipped = time.Now()
+}
+
+// taskCircuit records the state of the circuit breaker of task, and until when
+// it is open. Tasks not tracked so far are only tracked from now on if they
+// have a circuit breaker, i.e. state is not empty.
+func taskCircuit(task, state string, until time.Time) {
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	s, ok := health.tasks[task]
+	if !ok {
+		if state == "" {
+			return
+		}
+		s = &taskState{tracked: time.Now()}
+		health.tasks[task] = s
+	}
+	s.circuit = state
+	s.openUntil = until
+}
+
+// taskEnded records the end of a run of task with result, and err being the
+// last error of the run, or nil if there was none.
+func taskEnded(task, result string, err error) {
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	s, ok := health.tasks[task]
+	if !ok {
+		return
+	}
+
+	s.running = false
+	s.lastEnd = time.Now()
+	s.lastError = ""
+	s.transferred = 0
+	s.lastResult = result
+
+	if err != nil {
+		s.lastError = err.Error()
+	}
+	if result == ResultSuccess {
+		s.lastSuccess = s.lastEnd
+	}
+}
+
+// Status returns the status of all tracked tasks at time now, sorted by task
+// name. Freshness is determined with grace factor grace. An open circuit
+// breaker whose cooldown has passed by now is reported as half-open.
+func Status(now time.Time, grace float64) []*TaskStatus {
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	ret := make([]*TaskStatus, 0, len(health.tasks))
+
+	for name, s := range health.tasks {
+		st := &TaskStatus{
+			Task:        name,
+			Running:     s.running,
+			LastStart:   timeOrNil(s.lastStart),
+			LastEnd:     timeOrNil(s.lastEnd),
+			LastResult:  s.lastResult,
+			LastError:   s.lastError,
+			LastSuccess: timeOrNil(s.lastSuccess),
+			Skipped:     s.skipped,
+			LastSkipped: timeOrNil(s.lastSkipped),
+			Transferred: s.transferred,
+			Circuit:     s.circuit,
+			Fresh:       s.fresh(now, grace),
+		}
+		if s.interval > 0 {
+			st.Interval = s.interval.String()
+		}
+		if s.circuit == CircuitOpen {
+			if now.Before(s.openUntil) {
+				st.OpenUntil = timeOrNil(s.openUntil)
+			} else {
+				st.Circuit = CircuitHalfOpen
+			}
+		}
+		ret = append(ret, st)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Task < ret[j].Task })
+	return ret
+}
+
+//
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// handleHealthz reports that the process is alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether all tracked tasks are fresh, responding with
+// `503 Service Unavailable` and the names of stale tasks otherwise.
+func handleReadyz(grace float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var stale []string
+		for _, st := range Status(time.Now(), grace) {
+			if !st.Fresh {
+				stale = append(stale, st.Task)
+			}
+		}
+
+		if len(stale) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "stale tasks: %s\n", strings.Join(stale, ", "))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// handleStatus writes the status of all tracked tasks as JSON.
+func handleStatus(grace float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Status(time.Now(), grace))
+	}
+}
@@ -0,0 +1,185 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestFresh(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	now := time.Now()
+	s := &taskState{interval: time.Minute, tracked: now.Add(-time.Minute)}
+	th.AssertTrue(s.fresh(now, 2))
+	th.AssertFalse(s.fresh(now.Add(90*time.Second), 2))
+
+	s.lastSuccess = now
+	th.AssertTrue(s.fresh(now.Add(90*time.Second), 2))
+	th.AssertFalse(s.fresh(now.Add(90*time.Second), 1))
+
+	s.interval = 0
+	th.AssertTrue(s.fresh(now.Add(time.Hour), 1))
+}
+
+//
+func TestTrackTasks(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	TrackTasks(map[string]time.Duration{"a": time.Minute, "b": time.Hour})
+	TaskStarted("a")
+	TaskRun("a", time.Second, nil)
+	TaskStarted("b")
+	TaskStarted("one-off")
+
+	status := Status(time.Now(), DefaultGraceFactor)
+	th.AssertEqual(3, len(status))
+	th.AssertEqual("a", status[0].Task)
+	th.AssertEqual("1m0s", status[0].Interval)
+	th.AssertEqual(ResultSuccess, status[0].LastResult)
+	th.AssertNotNil(status[0].LastSuccess)
+	th.AssertFalse(status[0].Running)
+	th.AssertTrue(status[1].Running)
+	th.AssertEqual("one-off", status[2].Task)
+	th.AssertEqual("", status[2].Interval)
+
+	// state of tasks still tracked is kept
+	TrackTasks(map[string]time.Duration{"a": 2 * time.Minute})
+	status = Status(time.Now(), DefaultGraceFactor)
+	th.AssertEqual(1, len(status))
+	th.AssertEqual("2m0s", status[0].Interval)
+	th.AssertNotNil(status[0].LastSuccess)
+
+	TaskStarted("a")
+	BytesTransferred("a", 2048)
+	status = Status(time.Now(), DefaultGraceFactor)
+	th.AssertEqual(int64(2048), status[0].Transferred)
+	TaskRun("a", time.Second, errors.New("3 of 5 images failed to sync"))
+	status = Status(time.Now(), DefaultGraceFactor)
+	th.AssertEqual(ResultFailure, status[0].LastResult)
+	th.AssertEqual("3 of 5 images failed to sync", status[0].LastError)
+	th.AssertEqual(int64(0), status[0].Transferred)
+	th.AssertTrue(status[0].Fresh)
+	th.AssertEqual(0, status[0].Skipped)
+	th.AssertNil(status[0].LastSkipped)
+
+	// partial runs are no success
+	last := status[0].LastSuccess
+	TaskStarted("a")
+	TaskRunPartial("a", time.Second)
+	status = Status(time.Now(), DefaultGraceFactor)
+	th.AssertEqual(ResultPartial, status[0].LastResult)
+	th.AssertEqual("", status[0].LastError)
+	th.AssertEqual(*last, *status[0].LastSuccess)
+
+	TaskSkipped("a")
+	TaskSkipped("a")
+	status = Status(time.Now(), DefaultGraceFactor)
+	th.AssertEqual(2, status[0].Skipped)
+	th.AssertNotNil(status[0].LastSkipped)
+}
+
+//
+func TestTaskCircuit(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	TrackTasks(map[string]time.Duration{"a": time.Minute, "b": time.Minute})
+	now := time.Now()
+
+	TaskCircuit("a", CircuitOpen, now.Add(time.Hour))
+	TaskCircuit("b", "", time.Time{})
+	TaskCircuit("untracked", "", time.Time{})
+
+	status := Status(now, DefaultGraceFactor)
+	th.AssertEqual(2, len(status))
+	th.AssertEqual(CircuitOpen, status[0].Circuit)
+	th.AssertEqual(now.Add(time.Hour), *status[0].OpenUntil)
+	th.AssertEqual("", status[1].Circuit)
+	th.AssertNil(status[1].OpenUntil)
+
+	// once the cooldown has passed, the breaker allows a trial run
+	status = Status(now.Add(2*time.Hour), DefaultGraceFactor)
+	th.AssertEqual(CircuitHalfOpen, status[0].Circuit)
+	th.AssertNil(status[0].OpenUntil)
+
+	TaskCircuit("a", CircuitClosed, time.Time{})
+	status = Status(now, DefaultGraceFactor)
+	th.AssertEqual(CircuitClosed, status[0].Circuit)
+	th.AssertNil(status[0].OpenUntil)
+}
+
+//
+func TestHealthEndpoints(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, err := Serve("127.0.0.1:0", DefaultGraceFactor)
+	th.AssertNoError(err)
+	defer s.Close()
+
+	TrackTasks(map[string]time.Duration{"fresh": time.Hour})
+	tryEndpoint(th, s, "healthz", http.StatusOK, "ok\n")
+	tryEndpoint(th, s, "readyz", http.StatusOK, "ok\n")
+
+	health.mu.Lock()
+	health.tasks["stale"] = &taskState{
+		interval: time.Minute, tracked: time.Now().Add(-time.Hour)}
+	health.mu.Unlock()
+
+	tryEndpoint(th, s, "healthz", http.StatusOK, "ok\n")
+	tryEndpoint(th, s, "readyz", http.StatusServiceUnavailable,
+		"stale tasks: stale\n")
+
+	body := tryEndpoint(th, s, "status", http.StatusOK, "")
+	var status []*TaskStatus
+	th.AssertNoError(json.Unmarshal([]byte(body), &status))
+	th.AssertEqual(2, len(status))
+	th.AssertTrue(status[0].Fresh)
+	th.AssertFalse(status[1].Fresh)
+}
+
+//
+func tryEndpoint(th *test.TestHelper, s *Server, path string, code int,
+	want string) string {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/%s", s.Addr(), path))
+	th.AssertNoError(err)
+	defer resp.Body.Close()
+
+	th.AssertEqual(code, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	th.AssertNoError(err)
+	if want != "" {
+		th.AssertEqual(want, string(body))
+	}
+	return string(body)
+}
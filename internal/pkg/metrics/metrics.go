@@ -0,0 +1,193 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultPartial = "partial"
+)
+
+// states of the circuit breaker of a task
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+//
+var (
+	syncTasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dregsy_sync_tasks_total",
+		Help: "Number of task runs, by task and result.",
+	}, []string{"task", "result"})
+
+	skippedRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dregsy_skipped_task_runs_total",
+		Help: "Number of task runs skipped due to a run still in progress, " +
+			"by task.",
+	}, []string{"task"})
+
+	bytesTransferred = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dregsy_transferred_bytes_total",
+		Help: "Number of layer bytes transferred as reported by the relay, " +
+			"by task.",
+	}, []string{"task"})
+
+	imagesCopied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dregsy_images_copied_total",
+		Help: "Number of images successfully synced, by task.",
+	}, []string{"task"})
+
+	syncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dregsy_sync_duration_seconds",
+		Help:    "Duration of task runs in seconds, by task.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"task"})
+
+	lastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dregsy_last_success_timestamp_seconds",
+		Help: "Time of the last successful task run as Unix timestamp, by task.",
+	}, []string{"task"})
+
+	circuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dregsy_circuit_open",
+		Help: "Whether the circuit breaker of a task is open or half-open, " +
+			"by task.",
+	}, []string{"task"})
+)
+
+// TaskRun records a run of task that took duration d. err is the last error
+// of the run, or nil if it succeeded.
+func TaskRun(task string, d time.Duration, err error) {
+	result := ResultSuccess
+	if err != nil {
+		result = ResultFailure
+	}
+	taskRun(task, d, result, err)
+}
+
+// TaskRunPartial records a run of task that took duration d, and stopped
+// before syncing all images, since it used up its budget.
+func TaskRunPartial(task string, d time.Duration) {
+	taskRun(task, d, ResultPartial, nil)
+}
+
+//
+func taskRun(task string, d time.Duration, result string, err error) {
+	taskEnded(task, result, err)
+	if result == ResultSuccess {
+		lastSuccess.WithLabelValues(task).SetToCurrentTime()
+	}
+	syncTasks.WithLabelValues(task, result).Inc()
+	syncDuration.WithLabelValues(task).Observe(d.Seconds())
+}
+
+// TaskSkipped records a run of task that was skipped, since the previous run of
+// task had not finished yet.
+func TaskSkipped(task string) {
+	taskSkipped(task)
+	skippedRuns.WithLabelValues(task).Inc()
+}
+
+// TaskCircuit records state as the state of the circuit breaker of task, which
+// stays open until time until. An empty state means that task has no circuit
+// breaker.
+func TaskCircuit(task, state string, until time.Time) {
+	taskCircuit(task, state, until)
+	switch state {
+	case "":
+		circuitOpen.DeleteLabelValues(task)
+	case CircuitClosed:
+		circuitOpen.WithLabelValues(task).Set(0)
+	default:
+		circuitOpen.WithLabelValues(task).Set(1)
+	}
+}
+
+// BytesTransferred records n layer bytes transferred by a run of task.
+func BytesTransferred(task string, n int64) {
+	taskTransferred(task, n)
+	bytesTransferred.WithLabelValues(task).Add(float64(n))
+}
+
+// ImageCopied records a successfully synced image for task.
+func ImageCopied(task string) {
+	imagesCopied.WithLabelValues(task).Inc()
+}
+
+//
+type Server struct {
+	server *http.Server
+	addr   net.Addr
+}
+
+// Serve starts an HTTP server on address, which exposes the metrics of the
+// default Prometheus registry under `/metrics`. Health of the tracked tasks is
+// reported under `/healthz`, `/readyz`, and `/status`, with tasks considered
+// fresh when they succeeded within their interval multiplied by grace.
+func Serve(address string, grace float64) (*Server, error) {
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.Handle("/readyz", handleReadyz(grace))
+	mux.Handle("/status", handleStatus(grace))
+	s := &Server{server: &http.Server{Handler: mux}, addr: l.Addr()}
+
+	log.WithField("address", s.addr.String()).Info("serving metrics")
+
+	go func() {
+		if err := s.server.Serve(l); err != nil &&
+			!errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("metrics server failed: %v", err)
+		}
+	}()
+
+	return s, nil
+}
+
+// Addr returns the address on which the server is listening.
+func (s *Server) Addr() net.Addr {
+	return s.addr
+}
+
+//
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,72 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestMetrics(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, err := Serve("127.0.0.1:0", DefaultGraceFactor)
+	th.AssertNoError(err)
+	defer s.Close()
+
+	ImageCopied("task-a")
+	ImageCopied("task-a")
+	TaskRun("task-a", 3*time.Second, nil)
+	TaskRun("task-a", time.Second, errors.New("failed"))
+	TaskRunPartial("task-a", time.Second)
+	TaskSkipped("task-a")
+	BytesTransferred("task-a", 1024)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", s.Addr()))
+	th.AssertNoError(err)
+	defer resp.Body.Close()
+	th.AssertEqual(http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	th.AssertNoError(err)
+	metrics := string(body)
+
+	for _, m := range []string{
+		`dregsy_images_copied_total{task="task-a"} 2`,
+		`dregsy_sync_tasks_total{result="success",task="task-a"} 1`,
+		`dregsy_sync_tasks_total{result="failure",task="task-a"} 1`,
+		`dregsy_sync_tasks_total{result="partial",task="task-a"} 1`,
+		`dregsy_sync_duration_seconds_sum{task="task-a"} 5`,
+		`dregsy_sync_duration_seconds_count{task="task-a"} 3`,
+		`dregsy_last_success_timestamp_seconds{task="task-a"} `,
+		`dregsy_skipped_task_runs_total{task="task-a"} 1`,
+		`dregsy_transferred_bytes_total{task="task-a"} 1024`,
+	} {
+		if !strings.Contains(metrics, m) {
+			t.Errorf("metric missing: %s", m)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+)
+
+//
+const acrAuthority = "https://login.microsoftonline.com"
+const acrAADScope = "https://management.azure.com/.default"
+const acrPageSize = 100
+
+// ACR refresh tokens are valid for three hours, we renew them well before that
+const acrRefreshTokenLifetime = time.Hour
+
+// IsACR determines whether registry is an Azure Container Registry.
+func IsACR(registry string) bool {
+	server := strings.SplitN(registry, ":", 2)[0]
+	return strings.HasSuffix(server, ".azurecr.io")
+}
+
+// newACR creates a list source for ACR, using the ACR specific catalog and
+// tag listing APIs. Access is through an AAD service principal, with the
+// client id as user name and the client secret as password in creds. If not
+// set there, they are taken from environment variables `AZURE_CLIENT_ID`
+// and `AZURE_CLIENT_SECRET`, and when tenant is empty, the tenant from
+// `AZURE_TENANT_ID`. The AAD access token for the service principal is
+// exchanged for an ACR refresh token, which is then used for obtaining ACR
+// access tokens.
+func newACR(registry string, transport *http.Transport, tenant string,
+	creds *auth.Credentials) (ListSource, error) {
+
+	ret := &acr{
+		registry:  registry,
+		tenant:    tenant,
+		authority: acrAuthority,
+		client:    &http.Client{Transport: baseTransport(transport)},
+		aadClient: http.DefaultClient,
+	}
+
+	if creds != nil {
+		ret.clientID = creds.Username()
+		ret.clientSecret = creds.Password()
+	}
+	if ret.clientID == "" && ret.clientSecret == "" {
+		ret.clientID = os.Getenv("AZURE_CLIENT_ID")
+		ret.clientSecret = os.Getenv("AZURE_CLIENT_SECRET")
+	}
+	if ret.tenant == "" {
+		ret.tenant = os.Getenv("AZURE_TENANT_ID")
+	}
+
+	if ret.tenant == "" {
+		return nil, errors.New("ACR lister requires a tenant")
+	}
+	if ret.clientID == "" || ret.clientSecret == "" {
+		return nil, errors.New(
+			"ACR lister requires client id and secret of a service principal")
+	}
+
+	return ret, nil
+}
+
+//
+type acr struct {
+	registry     string
+	tenant       string
+	clientID     string
+	clientSecret string
+	authority    string
+	client       *http.Client
+	aadClient    *http.Client
+	//
+	refreshToken  string
+	refreshExpiry time.Time
+}
+
+//
+type acrTagList struct {
+	Tags []acrTagDescriptor `json:"tags"`
+}
+
+//
+type acrTagDescriptor struct {
+	Name           string    `json:"name"`
+	LastUpdateTime time.Time `json:"lastUpdateTime"`
+}
+
+//
+func (a *acr) Retrieve(ctx context.Context, maxItems int) ([]string, error) {
+
+	log.Debug("ACR retrieving image list")
+
+	token, err := a.accessToken(ctx, "registry:catalog:*")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	next := a.url("/acr/v1/_catalog")
+
+	for next != nil {
+
+		var page struct {
+			Repos []string `json:"repositories"`
+		}
+
+		if next, err = a.get(ctx, next, token, &page); err != nil {
+			return nil, fmt.Errorf("error getting catalog page: %v", err)
+		}
+
+		ret = append(ret, page.Repos...)
+		if maxItems > 0 && len(ret) > maxItems {
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+//
+func (a *acr) ListTags(ctx context.Context, repo string) ([]tags.Tag, error) {
+
+	token, err := a.accessToken(ctx, repoScope(repo))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []tags.Tag
+	next := a.url(fmt.Sprintf("/acr/v1/%s/_tags", repo))
+
+	for next != nil {
+
+		var page acrTagList
+		if next, err = a.get(ctx, next, token, &page); err != nil {
+			return nil, fmt.Errorf(
+				"error listing tags for repository '%s': %v", repo, err)
+		}
+
+		for _, t := range page.Tags {
+			ret = append(ret, tags.Tag{Name: t.Name, Pushed: t.LastUpdateTime})
+		}
+	}
+
+	return ret, nil
+}
+
+// LastPushed returns the time repository repo was last updated, which is when
+// an image was last pushed to it, or a tag deleted.
+func (a *acr) LastPushed(ctx context.Context, repo string) (time.Time, error) {
+
+	token, err := a.accessToken(ctx, repoScope(repo))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var attrs struct {
+		LastUpdateTime time.Time `json:"lastUpdateTime"`
+	}
+
+	if _, err := a.get(ctx,
+		a.url(fmt.Sprintf("/acr/v1/%s", repo)), token, &attrs); err != nil {
+		return time.Time{}, fmt.Errorf(
+			"error getting attributes of repository '%s': %v", repo, err)
+	}
+
+	return attrs.LastUpdateTime, nil
+}
+
+//
+func (a *acr) Ping(ctx context.Context) error {
+	_, err := a.accessToken(ctx, "registry:catalog:*")
+	return err
+}
+
+// url returns the URL for ACR API path, with first page size set.
+func (a *acr) url(path string) *url.URL {
+	return &url.URL{
+		Scheme:   "https",
+		Host:     a.registry,
+		Path:     path,
+		RawQuery: fmt.Sprintf("n=%d", acrPageSize),
+	}
+}
+
+// get retrieves u with access token, and decodes the JSON response into v.
+// The URL of the next page is returned, or nil if there is none.
+func (a *acr) get(ctx context.Context,
+	u *url.URL, token string, v interface{}) (*url.URL, error) {
+
+	req, err := http.NewRequestWithContext(
+		ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, err
+	}
+
+	return nextPageURL(resp)
+}
+
+// accessToken gets an ACR access token for scope, renewing the refresh token
+// if needed.
+func (a *acr) accessToken(ctx context.Context, scope string) (string, error) {
+
+	if err := a.ensureRefreshToken(ctx); err != nil {
+		return "", err
+	}
+
+	var res struct {
+		Token string `json:"access_token"`
+	}
+
+	if err := postForm(ctx, a.client, a.oauthURL("token"), url.Values{
+		"grant_type":    {"refresh_token"},
+		"service":       {a.service()},
+		"scope":         {scope},
+		"refresh_token": {a.refreshToken},
+	}, &res); err != nil {
+		return "", fmt.Errorf("error getting ACR access token: %v", err)
+	}
+
+	return res.Token, nil
+}
+
+//
+func (a *acr) ensureRefreshToken(ctx context.Context) error {
+
+	if a.refreshToken != "" && time.Now().Before(a.refreshExpiry) {
+		log.Debug("ACR refresh token already present and still valid")
+		return nil
+	}
+
+	aad, err := a.aadToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	var res struct {
+		Token string `json:"refresh_token"`
+	}
+
+	if err := postForm(ctx, a.client, a.oauthURL("exchange"), url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {a.service()},
+		"tenant":       {a.tenant},
+		"access_token": {aad},
+	}, &res); err != nil {
+		return fmt.Errorf("error getting ACR refresh token: %v", err)
+	}
+
+	a.refreshToken = res.Token
+	a.refreshExpiry = time.Now().Add(acrRefreshTokenLifetime)
+	return nil
+}
+
+// aadToken gets an AAD access token for the service principal.
+func (a *acr) aadToken(ctx context.Context) (string, error) {
+
+	var res struct {
+		Token string `json:"access_token"`
+	}
+
+	if err := postForm(ctx, a.aadClient,
+		fmt.Sprintf("%s/%s/oauth2/v2.0/token", a.authority, a.tenant),
+		url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {a.clientID},
+			"client_secret": {a.clientSecret},
+			"scope":         {acrAADScope},
+		}, &res); err != nil {
+		return "", fmt.Errorf("error getting AAD access token: %v", err)
+	}
+
+	return res.Token, nil
+}
+
+//
+func (a *acr) oauthURL(endpoint string) string {
+	return fmt.Sprintf("https://%s/oauth2/%s", a.registry, endpoint)
+}
+
+//
+func (a *acr) service() string {
+	return strings.SplitN(a.registry, ":", 2)[0]
+}
+
+//
+func repoScope(repo string) string {
+	return fmt.Sprintf("repository:%s:metadata_read", repo)
+}
+
+// postForm posts form to URL u via client, and decodes the JSON response
+// into v.
+func postForm(ctx context.Context, client *http.Client, u string,
+	form url.Values, v interface{}) error {
+
+	req, err := http.NewRequestWithContext(
+		ctx, "POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
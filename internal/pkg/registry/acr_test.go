@@ -0,0 +1,198 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+var acrUpdated = time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+// newACRServer creates a test server acting as both AAD and ACR. It accepts
+// service principal `app` with secret `secret` in tenant `acme`.
+func newACRServer(th *test.TestHelper) *httptest.Server {
+
+	var srv *httptest.Server
+
+	srv = httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			reply := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+			host := strings.SplitN(strings.TrimPrefix(srv.URL, "https://"),
+				":", 2)[0]
+
+			switch r.URL.Path {
+
+			case "/acme/oauth2/v2.0/token":
+				if r.FormValue("client_id") != "app" ||
+					r.FormValue("client_secret") != "secret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				reply(map[string]string{"access_token": "aad"})
+
+			case "/oauth2/exchange":
+				th.AssertEqual(host, r.FormValue("service"))
+				th.AssertEqual("acme", r.FormValue("tenant"))
+				th.AssertEqual("aad", r.FormValue("access_token"))
+				reply(map[string]string{"refresh_token": "refresh"})
+
+			case "/oauth2/token":
+				th.AssertEqual("refresh", r.FormValue("refresh_token"))
+				reply(map[string]string{
+					"access_token": "access:" + r.FormValue("scope")})
+
+			case "/acr/v1/_catalog":
+				th.AssertEqual("Bearer access:registry:catalog:*",
+					r.Header.Get("Authorization"))
+				if r.URL.Query().Get("last") == "" {
+					w.Header().Set("Link",
+						`</acr/v1/_catalog?last=b&n=100>; rel="next"`)
+					reply(map[string][]string{"repositories": {"a", "b"}})
+				} else {
+					reply(map[string][]string{"repositories": {"c"}})
+				}
+
+			case "/acr/v1/team/app/_tags":
+				th.AssertEqual(
+					"Bearer access:repository:team/app:metadata_read",
+					r.Header.Get("Authorization"))
+				reply(map[string]interface{}{"tags": []interface{}{
+					map[string]interface{}{
+						"name": "1.0", "lastUpdateTime": acrUpdated},
+					map[string]interface{}{"name": "latest"},
+				}})
+
+			case "/acr/v1/team/app":
+				reply(map[string]interface{}{"lastUpdateTime": acrUpdated})
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+	return srv
+}
+
+//
+func testACR(th *test.TestHelper, srv *httptest.Server, user, pass string) (
+	*acr, error) {
+
+	creds, err := auth.NewCredentialsFromBasic(user, pass)
+	th.AssertNoError(err)
+
+	// trusts the test server's certificate
+	tr := srv.Client().Transport.(*http.Transport)
+	src, err := newACR(
+		strings.TrimPrefix(srv.URL, "https://"), tr, "acme", creds)
+	if err != nil {
+		return nil, err
+	}
+
+	a := src.(*acr)
+	a.authority = srv.URL
+	a.aadClient = srv.Client()
+	return a, nil
+}
+
+//
+func TestACRLister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	srv := newACRServer(th)
+	defer srv.Close()
+
+	a, err := testACR(th, srv, "app", "secret")
+	th.AssertNoError(err)
+
+	th.AssertNoError(a.Ping(ctx))
+
+	list, err := a.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"a", "b", "c"}, list)
+
+	list, err = a.Retrieve(ctx, 1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"a", "b"}, list)
+
+	tags, err := a.ListTags(ctx, "team/app")
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(tags))
+	th.AssertEqual("1.0", tags[0].Name)
+	th.AssertEqual(acrUpdated, tags[0].Pushed.UTC())
+	th.AssertEqual("latest", tags[1].Name)
+	th.AssertTrue(tags[1].Pushed.IsZero())
+
+	last, err := a.LastPushed(ctx, "team/app")
+	th.AssertNoError(err)
+	th.AssertEqual(acrUpdated, last.UTC())
+
+	_, err = a.ListTags(ctx, "team/other")
+	th.AssertError(err, "error listing tags for repository 'team/other'")
+
+	// wrong secret
+	a, err = testACR(th, srv, "app", "wrong")
+	th.AssertNoError(err)
+	th.AssertError(a.Ping(ctx), "error getting AAD access token")
+}
+
+//
+func TestACRConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertTrue(IsACR("myregistry.azurecr.io"))
+	th.AssertTrue(IsACR("myregistry.azurecr.io:443"))
+	th.AssertFalse(IsACR("registry.acme.com"))
+
+	t.Setenv("AZURE_TENANT_ID", "")
+	t.Setenv("AZURE_CLIENT_ID", "")
+	t.Setenv("AZURE_CLIENT_SECRET", "")
+
+	creds, err := auth.NewCredentialsFromBasic("app", "secret")
+	th.AssertNoError(err)
+
+	_, err = newACR("myregistry.azurecr.io", nil, "", creds)
+	th.AssertError(err, "ACR lister requires a tenant")
+
+	_, err = newACR("myregistry.azurecr.io", nil, "acme", &auth.Credentials{})
+	th.AssertError(err, "requires client id and secret")
+
+	// fall back to environment
+	t.Setenv("AZURE_TENANT_ID", "acme")
+	t.Setenv("AZURE_CLIENT_ID", "app")
+	t.Setenv("AZURE_CLIENT_SECRET", "secret")
+
+	src, err := newACR("myregistry.azurecr.io", nil, "", &auth.Credentials{})
+	th.AssertNoError(err)
+	a := src.(*acr)
+	th.AssertEqual("acme", a.tenant)
+	th.AssertEqual("app", a.clientID)
+	th.AssertEqual("secret", a.clientSecret)
+}
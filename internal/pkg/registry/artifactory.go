@@ -0,0 +1,206 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+)
+
+//
+const artifactoryDomain = ".jfrog.io"
+const artifactoryPageSize = 100
+
+// IsArtifactory determines whether registry is hosted in the JFrog cloud.
+func IsArtifactory(registry string) bool {
+	return strings.HasSuffix(
+		strings.SplitN(registry, ":", 2)[0], artifactoryDomain)
+}
+
+//
+func init() {
+	Register(Artifactory, func(conf *ListSourceConfig) (ListSource, error) {
+		return newArtifactory(conf.Registry, conf.Settings["api"],
+			conf.Settings["repo-key"], conf.Transport, conf.Creds)
+	})
+}
+
+// newArtifactory creates a list source for the Docker repository repoKey in
+// Artifactory, which is listed via the Artifactory Docker REST API under api.
+// If api is empty, Artifactory is expected under path `/artifactory` of the
+// registry. With a user name in creds, basic auth is used, with either the
+// password, an API key, or an access token as password. Otherwise, the
+// password is sent as bearer access token. When creds are empty, access is
+// anonymous.
+func newArtifactory(registry, api, repoKey string, transport *http.Transport,
+	creds *auth.Credentials) (ListSource, error) {
+
+	if repoKey == "" {
+		return nil, errors.New("Artifactory lister requires a 'repo-key'")
+	}
+
+	if api == "" {
+		api = fmt.Sprintf("https://%s/artifactory", registry)
+	}
+
+	return &artifactory{
+		api:     strings.TrimSuffix(api, "/"),
+		repoKey: repoKey,
+		creds:   creds,
+		client:  &http.Client{Transport: baseTransport(transport)},
+	}, nil
+}
+
+//
+type artifactory struct {
+	api     string
+	repoKey string
+	creds   *auth.Credentials
+	client  *http.Client
+}
+
+//
+type artifactoryCatalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+//
+type artifactoryTags struct {
+	Tags []string `json:"tags"`
+}
+
+// Retrieve lists the images in the Docker repository. They are prefixed with
+// the repository key, as for the repository path access method of
+// Artifactory, e.g. `docker-local/busybox`.
+func (a *artifactory) Retrieve(ctx context.Context, maxItems int) (
+	[]string, error) {
+
+	log.Debug("Artifactory retrieving image list")
+
+	var ret []string
+	last := ""
+
+	for {
+		var page artifactoryCatalog
+		if err := a.get(ctx, "_catalog", last, &page); err != nil {
+			return nil, fmt.Errorf("error listing images of '%s': %v",
+				a.repoKey, err)
+		}
+
+		for _, r := range page.Repositories {
+			ret = append(ret, fmt.Sprintf("%s/%s", a.repoKey, r))
+		}
+
+		if len(page.Repositories) < artifactoryPageSize ||
+			(maxItems > 0 && len(ret) > maxItems) {
+			break
+		}
+		last = page.Repositories[len(page.Repositories)-1]
+	}
+
+	return ret, nil
+}
+
+// ListTags lists the tags of repo, which may be prefixed with the repository
+// key. Push times are not available via this API.
+func (a *artifactory) ListTags(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+
+	repo = strings.TrimPrefix(strings.TrimPrefix(repo, "/"), a.repoKey+"/")
+
+	var ret []tags.Tag
+	last := ""
+
+	for {
+		var page artifactoryTags
+		if err := a.get(ctx, repo+"/tags/list", last, &page); err != nil {
+			return nil, fmt.Errorf(
+				"error listing tags for repository '%s': %v", repo, err)
+		}
+
+		for _, t := range page.Tags {
+			ret = append(ret, tags.Tag{Name: t})
+		}
+
+		if len(page.Tags) < artifactoryPageSize {
+			break
+		}
+		last = page.Tags[len(page.Tags)-1]
+	}
+
+	return ret, nil
+}
+
+// Ping checks that the Docker repository can be accessed.
+func (a *artifactory) Ping(ctx context.Context) error {
+	var v struct{}
+	return a.get(ctx, "", "", &v)
+}
+
+// get retrieves path below the v2 API of the Docker repository, and decodes
+// the JSON response into v. For paginated lists, last is the last item of the
+// previous page.
+func (a *artifactory) get(ctx context.Context,
+	path, last string, v interface{}) error {
+
+	u := fmt.Sprintf("%s/api/docker/%s/v2/%s", a.api,
+		url.PathEscape(a.repoKey), path)
+	if path != "" {
+		q := url.Values{}
+		q.Set("n", fmt.Sprintf("%d", artifactoryPageSize))
+		if last != "" {
+			q.Set("last", last)
+		}
+		u = fmt.Sprintf("%s?%s", u, q.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+
+	if a.creds != nil {
+		if a.creds.Username() != "" {
+			req.SetBasicAuth(a.creds.Username(), a.creds.Password())
+		} else if a.creds.Password() != "" {
+			req.Header.Set("Authorization",
+				fmt.Sprintf("Bearer %s", a.creds.Password()))
+		}
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
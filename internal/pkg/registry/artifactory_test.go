@@ -0,0 +1,152 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// newArtifactoryServer creates a test Artifactory with Docker repository
+// `docker-local`, which holds more images than fit on one page. It accepts
+// user `alex` with API key `secret` via basic auth, and access token `token`
+// as bearer token.
+func newArtifactoryServer() *httptest.Server {
+
+	var images []string
+	for i := 0; i < artifactoryPageSize+1; i++ {
+		images = append(images, fmt.Sprintf("image-%03d", i))
+	}
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			user, pass, ok := r.BasicAuth()
+			if !(ok && user == "alex" && pass == "secret") &&
+				r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			base := "/artifactory/api/docker/docker-local/v2/"
+			q := r.URL.Query()
+
+			switch r.URL.Path {
+
+			case base:
+				json.NewEncoder(w).Encode(struct{}{})
+
+			case base + "_catalog":
+				start := 0
+				if last := q.Get("last"); last != "" {
+					for ix, i := range images {
+						if i == last {
+							start = ix + 1
+						}
+					}
+				}
+				end := start + artifactoryPageSize
+				if end > len(images) {
+					end = len(images)
+				}
+				json.NewEncoder(w).Encode(
+					&artifactoryCatalog{Repositories: images[start:end]})
+
+			case base + "tools/cli/tags/list":
+				json.NewEncoder(w).Encode(
+					&artifactoryTags{Tags: []string{"1.0", "latest"}})
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+}
+
+//
+func testArtifactory(th *test.TestHelper, srv *httptest.Server, user,
+	pass string) *artifactory {
+
+	creds, err := auth.NewCredentialsFromBasic(user, pass)
+	th.AssertNoError(err)
+
+	src, err := newArtifactory("acme.jfrog.io", srv.URL+"/artifactory/",
+		"docker-local", nil, creds)
+	th.AssertNoError(err)
+	return src.(*artifactory)
+}
+
+//
+func TestArtifactoryLister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	th.AssertTrue(IsArtifactory("acme.jfrog.io"))
+	th.AssertTrue(IsArtifactory("acme.jfrog.io:443"))
+	th.AssertFalse(IsArtifactory("artifactory.example.com"))
+
+	srv := newArtifactoryServer()
+	defer srv.Close()
+
+	// API key via basic auth, with pagination
+	a := testArtifactory(th, srv, "alex", "secret")
+	th.AssertNoError(a.Ping(ctx))
+
+	list, err := a.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqual(artifactoryPageSize+1, len(list))
+	th.AssertEqual("docker-local/image-000", list[0])
+	th.AssertEqual(fmt.Sprintf("docker-local/image-%03d", artifactoryPageSize),
+		list[artifactoryPageSize])
+
+	list, err = a.Retrieve(ctx, 10)
+	th.AssertNoError(err)
+	th.AssertEqual(artifactoryPageSize, len(list))
+
+	// access token as bearer token
+	a = testArtifactory(th, srv, "", "token")
+	th.AssertNoError(a.Ping(ctx))
+
+	tags, err := a.ListTags(ctx, "/docker-local/tools/cli")
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(tags))
+	th.AssertEqual("latest", tags[1].Name)
+
+	_, err = a.ListTags(ctx, "docker-local/missing")
+	th.AssertError(err, "unexpected status: 404")
+
+	// wrong credentials
+	a = testArtifactory(th, srv, "alex", "wrong")
+	th.AssertError(a.Ping(ctx), "unexpected status: 401")
+	_, err = a.Retrieve(ctx, -1)
+	th.AssertError(err, "error listing images of 'docker-local'")
+
+	// default API location & missing repository key
+	src, err := newArtifactory("acme.jfrog.io", "", "docker-local", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual("https://acme.jfrog.io/artifactory", src.(*artifactory).api)
+
+	_, err = newArtifactory("acme.jfrog.io", "", "", nil, nil)
+	th.AssertError(err, "requires a 'repo-key'")
+}
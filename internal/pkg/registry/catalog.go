@@ -18,49 +18,132 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
-
-	"golang.org/x/oauth2"
+	"net/url"
+	"strings"
+	"time"
 
 	gocrauthn "github.com/google/go-containerregistry/pkg/authn"
 	gocrname "github.com/google/go-containerregistry/pkg/name"
 	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gocrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
 )
 
 //
-func newCatalog(reg string, insecure, bearer bool,
+const defaultCatalogPageSize = 100
+
+//
+func init() {
+	Register(Catalog, detectListSource)
+}
+
+// detectListSource creates the list source for the default lister type. This
+// is the standard catalog, unless the registry is known to need a dedicated
+// list source.
+func detectListSource(conf *ListSourceConfig) (ListSource, error) {
+
+	isECR, region, account := IsECR(conf.Registry)
+	isECRPublic, alias := IsECRPublic(conf.Registry)
+
+	switch {
+
+	case isECRPublic:
+		// ECR Public does not offer a catalog at all
+		log.Info("using dedicated ECR Public lister")
+		if a := conf.Settings["alias"]; a != "" {
+			alias = a
+		}
+		return newECRPublic(alias, conf.Role, conf.Transport), nil
+
+	case isECR:
+		// catalog can be used with ECR, but pagination doesn't work; it
+		// requires an extra `NextToken` parameter which is not standard
+		// and therefore not supported by the go-containerregistry remote
+		// lib; if the registry is ECR we therefore use a dedicated ECR
+		// lister based on the AWS Go SDK
+		log.Info("using dedicated ECR lister instead of standard catalog")
+		return newECR(conf.Registry, region, account, conf.Role,
+			conf.Transport), nil
+
+	case IsACR(conf.Registry):
+		// ACR offers a standard catalog, but listing tags with push
+		// times and repository activity needs its own API
+		log.Info("using dedicated ACR lister instead of standard catalog")
+		return newACR(conf.Registry, conf.Transport, conf.Settings["tenant"],
+			conf.Creds)
+
+	case IsGHCR(conf.Registry):
+		// GHCR has no catalog, so packages are listed via GitHub API
+		log.Info("using dedicated GHCR lister instead of standard catalog")
+		return newGHCR(conf.Settings["owner"], conf.Transport, conf.Creds)
+
+	case IsQuay(conf.Registry):
+		// Quay has no public catalog, so repositories are listed via
+		// the Quay application API
+		log.Info("using dedicated Quay lister instead of standard catalog")
+		return newQuay(conf.Registry, conf.Settings["namespace"],
+			conf.Transport, conf.Creds)
+
+	case IsGitLab(conf.Registry):
+		// the catalog of GitLab.com is not available, so container
+		// repositories are listed via the GitLab API
+		log.Info("using dedicated GitLab lister instead of standard catalog")
+		return newGitLab(conf.Settings["api"], conf.Settings["group"],
+			conf.Settings["project"], conf.Transport, conf.Creds)
+
+	case conf.Settings["projects"] != "":
+		// scoping the list to projects is specific to Harbor, whose
+		// catalog lists the repositories of all accessible projects
+		log.Info("using dedicated Harbor lister instead of standard catalog")
+		return newHarbor(conf.Registry, conf.Settings["projects"],
+			conf.Transport, conf.Creds)
+
+	case IsArtifactory(conf.Registry) && conf.Settings["repo-key"] != "":
+		// the v2 catalog is often disabled in Artifactory, while its own
+		// Docker API can list the images of a repository
+		log.Info("using dedicated Artifactory lister instead of " +
+			"standard catalog")
+		return newArtifactory(conf.Registry, conf.Settings["api"],
+			conf.Settings["repo-key"], conf.Transport, conf.Creds)
+
+	case IsGCR(conf.Registry):
+		// GCR & GAR paginate their catalog via `Link` header only, and
+		// need an access token retrieved via Google credentials
+		log.Info("using dedicated GCR lister instead of standard catalog")
+		return newGCR(conf.Registry, conf.Transport, conf.Creds), nil
+	}
+
+	return newCatalog(conf.Registry, conf.Transport, conf.Creds), nil
+}
+
+//
+func newCatalog(reg string, transport *http.Transport,
 	creds *auth.Credentials) ListSource {
 
 	return &catalog{
-		registry: reg,
-		conf: &oauth2.Config{
-			ClientID: creds.Username(),
-			Endpoint: oauth2.Endpoint{
-				TokenURL: fmt.Sprintf("https://%s/token", reg),
-			},
-		},
-		insecure: insecure,
-		bearer:   bearer,
-		creds:    creds,
+		registry:  reg,
+		transport: transport,
+		creds:     creds,
 	}
 }
 
 //
 type catalog struct {
-	registry string
-	conf     *oauth2.Config
-	insecure bool
-	bearer   bool
-	creds    *auth.Credentials
+	registry  string
+	transport *http.Transport
+	creds     *auth.Credentials
 }
 
 //
-func (c *catalog) Retrieve(maxItems int) ([]string, error) {
+func (c *catalog) Retrieve(ctx context.Context, maxItems int) (
+	[]string, error) {
 
 	reg, err := gocrname.NewRegistry(c.registry)
 	if err != nil {
@@ -69,26 +152,9 @@ func (c *catalog) Retrieve(maxItems int) ([]string, error) {
 
 	log.Debugf("registry scheme = %s", reg.Scheme())
 
-	if err := c.creds.Refresh(); err != nil {
-		return nil, fmt.Errorf("error refreshing credentials: %v", err)
-	}
-
-	var auth gocrauthn.Authenticator
-
-	if c.bearer {
-		auth = &gocrauthn.Bearer{Token: c.creds.Password()}
-	} else {
-		auth = &gocrauthn.Basic{
-			Username: c.creds.Username(),
-			Password: c.creds.Password(),
-		}
-	}
-
-	opts := []gocrremote.Option{gocrremote.WithAuth(auth)}
-	if c.insecure {
-		t := http.DefaultTransport.(*http.Transport).Clone()
-		t.TLSClientConfig.InsecureSkipVerify = true
-		opts = append(opts, gocrremote.WithTransport(t))
+	opts, err := c.remoteOptions(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	var list []string
@@ -110,10 +176,262 @@ func (c *catalog) Retrieve(maxItems int) ([]string, error) {
 	}
 }
 
+// ListTagsWithTimes lists the tags of repository repo, taking the creation
+// times of the tagged images as push times. This is only used for checking
+// repository activity, tags for syncing are still listed by the relays.
+func (c *catalog) ListTagsWithTimes(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+	opts, err := c.remoteOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return listTagsWithCreated(c.registry, repo, opts)
+}
+
 //
-func (c *catalog) Ping() error {
-	// TODO: possibly use this to get token for push/pull?
-	_, err := c.conf.PasswordCredentialsToken(
-		context.TODO(), c.creds.Username(), c.creds.Password())
-	return err
+func (c *catalog) remoteOptions(ctx context.Context) (
+	[]gocrremote.Option, error) {
+
+	auth, err := credsAuthenticator(c.creds)
+	if err != nil {
+		return nil, err
+	}
+	return remoteOptions(ctx, auth, c.transport), nil
+}
+
+// Ping checks that the registry API accepts the credentials of this catalog.
+func (c *catalog) Ping(ctx context.Context) error {
+	return Ping(ctx, c.registry, c.creds, c.transport)
+}
+
+// remoteOptions creates options for go-containerregistry with authenticator
+// auth, and transport. Requests are canceled when ctx is done.
+func remoteOptions(ctx context.Context, auth gocrauthn.Authenticator,
+	transport *http.Transport) []gocrremote.Option {
+	return []gocrremote.Option{
+		gocrremote.WithAuth(auth),
+		gocrremote.WithTransport(baseTransport(transport)),
+		gocrremote.WithContext(ctx),
+	}
+}
+
+// baseTransport returns transport, or the default transport if that is nil.
+func baseTransport(transport *http.Transport) http.RoundTripper {
+	if transport != nil {
+		return transport
+	}
+	return http.DefaultTransport
+}
+
+// skipsTLSVerify determines whether transport skips TLS verification.
+func skipsTLSVerify(transport *http.Transport) bool {
+	return transport != nil && transport.TLSClientConfig != nil &&
+		transport.TLSClientConfig.InsecureSkipVerify
+}
+
+// listTagsV2 lists the tags of a repository via the standard registry v2
+// `/tags/list` endpoint. Push times are not available via this API.
+func listTagsV2(reg, repo string, opts []gocrremote.Option) ([]tags.Tag, error) {
+
+	ref, err := gocrname.NewRepository(fmt.Sprintf("%s/%s", reg, repo))
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository: %v", err)
+	}
+
+	list, err := gocrremote.List(ref, opts...)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error listing tags for repository '%s': %v", repo, err)
+	}
+
+	ret := make([]tags.Tag, 0, len(list))
+	for _, t := range list {
+		ret = append(ret, tags.Tag{Name: t})
+	}
+	return ret, nil
+}
+
+// listTagsWithCreated lists the tags of a repository like listTagsV2, and adds
+// the creation time recorded in the config blob of each tagged image as push
+// time. For multi-platform images, the config of the default platform is
+// used. This needs two more requests per tag. If the creation time of an image
+// cannot be determined, its push time is left empty.
+func listTagsWithCreated(reg, repo string, opts []gocrremote.Option) (
+	[]tags.Tag, error) {
+
+	ret, err := listTagsV2(reg, repo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for ix := range ret {
+		created, err := imageCreated(
+			fmt.Sprintf("%s/%s:%s", reg, repo, ret[ix].Name), opts)
+		if err != nil {
+			log.WithField("tag", ret[ix].Name).Warnf(
+				"cannot determine creation time of image: %v", err)
+			continue
+		}
+		ret[ix].Pushed = created
+	}
+
+	return ret, nil
+}
+
+// imageCreated returns the creation time of image ref, as recorded in its
+// config blob.
+func imageCreated(ref string, opts []gocrremote.Option) (time.Time, error) {
+
+	tag, err := gocrname.NewTag(ref)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid image reference: %v", err)
+	}
+
+	img, err := gocrremote.Image(tag, opts...)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	conf, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return conf.Created.Time, nil
+}
+
+// lastCreated returns the most recent push time from list, or an error if
+// there are tags, but none of them has a push time.
+func lastCreated(list []tags.Tag) (time.Time, error) {
+
+	var last time.Time
+	for _, t := range list {
+		if t.Pushed.After(last) {
+			last = t.Pushed
+		}
+	}
+
+	if len(list) > 0 && last.IsZero() {
+		return last, ErrPushTimeUnknown
+	}
+	return last, nil
+}
+
+// catalogFollowingLinks retrieves the repository catalog of registry reg,
+// following the `Link` header for pagination. This is needed for registries
+// which do not support the `last` query parameter. Retrieval stops once more
+// than maxItems repositories have been collected, unless maxItems is <= 0.
+// When pageSize is <= 0, a default page size is used. Page size never exceeds
+// maxItems. Requests are canceled when ctx is done.
+func catalogFollowingLinks(ctx context.Context, reg gocrname.Registry,
+	maxItems, pageSize int, auth gocrauthn.Authenticator,
+	transport *http.Transport) ([]string, error) {
+
+	if pageSize <= 0 {
+		pageSize = defaultCatalogPageSize
+	}
+	if maxItems > 0 && maxItems < pageSize {
+		pageSize = maxItems
+	}
+
+	tr, err := gocrtransport.New(reg, auth, baseTransport(transport),
+		[]string{reg.Scope(gocrtransport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: tr}
+
+	next := &url.URL{
+		Scheme:   reg.Scheme(),
+		Host:     reg.RegistryStr(),
+		Path:     "/v2/_catalog",
+		RawQuery: fmt.Sprintf("n=%d", pageSize),
+	}
+
+	var list []string
+
+	for next != nil {
+
+		req, err := http.NewRequestWithContext(
+			ctx, "GET", next.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Repos []string `json:"repositories"`
+		}
+
+		if err = gocrtransport.CheckError(resp, http.StatusOK); err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		if err == nil {
+			next, err = nextPageURL(resp)
+		}
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("error getting catalog page: %v", err)
+		}
+
+		list = append(list, page.Repos...)
+		if maxItems > 0 && len(list) > maxItems {
+			break
+		}
+	}
+
+	return list, nil
+}
+
+// nextPageURL returns the URL of the next page as given in the `Link` header
+// of resp, or nil if there is none. The header may list several links, in
+// which case the one with `rel="next"` is used. A single link without any
+// `rel` is taken as the next page.
+func nextPageURL(resp *http.Response) (*url.URL, error) {
+
+	link := resp.Header.Get("Link")
+	if link == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(link, ",")
+
+	for _, p := range parts {
+
+		p = strings.TrimSpace(p)
+		end := strings.Index(p, ">")
+		if !strings.HasPrefix(p, "<") || end == -1 {
+			return nil, fmt.Errorf("malformed Link header: %s", link)
+		}
+
+		rel, hasRel := linkRel(p[end+1:])
+		if rel != "next" && (hasRel || len(parts) > 1) {
+			continue
+		}
+
+		next, err := url.Parse(p[1:end])
+		if err != nil {
+			return nil, err
+		}
+		return resp.Request.URL.ResolveReference(next), nil
+	}
+
+	return nil, nil
+}
+
+// linkRel returns the value of the `rel` parameter from params of a link in
+// a `Link` header, and whether it is present at all.
+func linkRel(params string) (string, bool) {
+	for _, p := range strings.Split(params, ";") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "rel" {
+			return strings.Trim(strings.TrimSpace(kv[1]), `"`), true
+		}
+	}
+	return "", false
 }
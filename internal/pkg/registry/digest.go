@@ -0,0 +1,458 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// ManifestDigest determines the digest of the manifest for image ref, which is
+// a tagged or digested reference, without fetching the manifest itself. For a
+// multi-platform image, this is the digest of the image index. The request is
+// canceled when ctx is done.
+func ManifestDigest(ctx context.Context, ref string, creds *auth.Credentials,
+	transport *http.Transport) (string, error) {
+
+	r, err := gocrname.ParseReference(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid reference '%s': %v", ref, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return "", err
+	}
+
+	desc, err := gocrremote.Head(r, remoteOptions(ctx, auth, transport)...)
+	if err != nil {
+		return "", fmt.Errorf("error resolving digest of '%s': %v", ref, err)
+	}
+
+	return desc.Digest.String(), nil
+}
+
+// RepoExists determines whether repository repo exists, by listing its tags.
+// A repository the registry does not know is reported as not existing, rather
+// than as an error. The request is canceled when ctx is done.
+func RepoExists(ctx context.Context, repo string, creds *auth.Credentials,
+	transport *http.Transport) (bool, error) {
+	_, exists, err := RepoTags(ctx, repo, creds, transport)
+	return exists, err
+}
+
+// RepoTags lists the tags of repository repo, and determines whether it
+// exists. A repository the registry does not know is reported as not
+// existing, rather than as an error. The request is canceled when ctx is done.
+func RepoTags(ctx context.Context, repo string, creds *auth.Credentials,
+	transport *http.Transport) ([]string, bool, error) {
+
+	r, err := gocrname.NewRepository(repo)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid repository '%s': %v", repo, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tags, err := gocrremote.List(r, remoteOptions(ctx, auth, transport)...)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf(
+			"error listing tags of '%s': %v", repo, err)
+	}
+
+	return tags, true, nil
+}
+
+// ManifestExists determines whether the manifest for image ref exists, and
+// returns its digest if so. A manifest the registry does not know is reported
+// as not existing, rather than as an error. The request is canceled when ctx
+// is done.
+func ManifestExists(ctx context.Context, ref string, creds *auth.Credentials,
+	transport *http.Transport) (string, bool, error) {
+
+	r, err := gocrname.ParseReference(ref)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid reference '%s': %v", ref, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return "", false, err
+	}
+
+	desc, err := gocrremote.Head(r, remoteOptions(ctx, auth, transport)...)
+	if err != nil {
+		if isNotFound(err) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf(
+			"error resolving digest of '%s': %v", ref, err)
+	}
+
+	return desc.Digest.String(), true, nil
+}
+
+// ManifestDigests determines the digest of the manifest for image ref, followed
+// by the digests of the platform manifests listed in it if it is an image
+// index. Digests are computed from the fetched manifests, rather than taken
+// from what the registry reports. Requests are canceled when ctx is done.
+func ManifestDigests(ctx context.Context, ref string, creds *auth.Credentials,
+	transport *http.Transport) ([]string, error) {
+
+	r, err := gocrname.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference '%s': %v", ref, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := gocrremote.Get(r, remoteOptions(ctx, auth, transport)...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching manifest of '%s': %v", ref, err)
+	}
+
+	ret := []string{desc.Digest.String()}
+	if !desc.MediaType.IsIndex() {
+		return ret, nil
+	}
+
+	index, err := gocrv1.ParseIndexManifest(bytes.NewReader(desc.Manifest))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image index '%s': %v", ref, err)
+	}
+	for _, m := range index.Manifests {
+		ret = append(ret, m.Digest.String())
+	}
+
+	return ret, nil
+}
+
+// ImageSize determines the size of image ref in bytes, i.e. the sum of the
+// sizes of its manifest, config, and layers. For a multi-platform image, the
+// sizes of all platform images are added to that of the image index. Requests
+// are canceled when ctx is done.
+func ImageSize(ctx context.Context, ref string, creds *auth.Credentials,
+	transport *http.Transport) (int64, error) {
+
+	r, err := gocrname.ParseReference(ref)
+	if err != nil {
+		return 0, fmt.Errorf("invalid reference '%s': %v", ref, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return 0, err
+	}
+
+	desc, err := gocrremote.Get(r, remoteOptions(ctx, auth, transport)...)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching manifest of '%s': %v", ref, err)
+	}
+
+	size := int64(len(desc.Manifest))
+
+	if !desc.MediaType.IsIndex() {
+		m, err := gocrv1.ParseManifest(bytes.NewReader(desc.Manifest))
+		if err != nil {
+			return 0, fmt.Errorf("invalid manifest '%s': %v", ref, err)
+		}
+		size += m.Config.Size
+		for _, l := range m.Layers {
+			size += l.Size
+		}
+		return size, nil
+	}
+
+	index, err := gocrv1.ParseIndexManifest(bytes.NewReader(desc.Manifest))
+	if err != nil {
+		return 0, fmt.Errorf("invalid image index '%s': %v", ref, err)
+	}
+	for _, m := range index.Manifests {
+		s, err := ImageSize(ctx, fmt.Sprintf("%s@%s", r.Context().String(),
+			m.Digest), creds, transport)
+		if err != nil {
+			return 0, err
+		}
+		size += s
+	}
+
+	return size, nil
+}
+
+// ImagePlatforms determines the platforms provided by image ref, in
+// `os/arch[/variant]` form. For a multi-platform image, these are the
+// platforms listed in its image index, otherwise the platform recorded in the
+// config of the image. For an OCI artifact other than a container image, no
+// platforms are returned. Requests are canceled when ctx is done.
+func ImagePlatforms(ctx context.Context, ref string, creds *auth.Credentials,
+	transport *http.Transport) ([]string, error) {
+
+	r, err := gocrname.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference '%s': %v", ref, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := gocrremote.Get(r, remoteOptions(ctx, auth, transport)...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching manifest of '%s': %v", ref, err)
+	}
+
+	typ, err := util.ArtifactType(desc.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest '%s': %v", ref, err)
+	}
+	if !util.IsImageType(typ) {
+		return nil, nil
+	}
+
+	if desc.MediaType.IsIndex() {
+		index, err := gocrv1.ParseIndexManifest(bytes.NewReader(desc.Manifest))
+		if err != nil {
+			return nil, fmt.Errorf("invalid image index '%s': %v", ref, err)
+		}
+		var ret []string
+		for _, m := range index.Manifests {
+			if m.Platform != nil {
+				ret = append(ret, platformString(m.Platform))
+			}
+		}
+		return ret, nil
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return nil, fmt.Errorf("invalid image '%s': %v", ref, err)
+	}
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching config of '%s': %v", ref, err)
+	}
+
+	// the config uses the same field names for the platform as an index
+	var p gocrv1.Platform
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, fmt.Errorf("invalid config of '%s': %v", ref, err)
+	}
+
+	return []string{platformString(&p)}, nil
+}
+
+// ArtifactType returns the artifact type of the image or artifact at reference
+// ref, as determined by util.ArtifactType. Requests are canceled when ctx is
+// done.
+func ArtifactType(ctx context.Context, ref string, creds *auth.Credentials,
+	transport *http.Transport) (string, error) {
+
+	r, err := gocrname.ParseReference(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid reference '%s': %v", ref, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return "", err
+	}
+
+	desc, err := gocrremote.Get(r, remoteOptions(ctx, auth, transport)...)
+	if err != nil {
+		return "", fmt.Errorf("error fetching manifest of '%s': %v", ref, err)
+	}
+
+	typ, err := util.ArtifactType(desc.Manifest)
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest '%s': %v", ref, err)
+	}
+	return typ, nil
+}
+
+// IsImageIndex determines whether the manifest of image ref is an image index
+// or manifest list, i.e. whether it is a multi-platform image. Requests are
+// canceled when ctx is done.
+func IsImageIndex(ctx context.Context, ref string, creds *auth.Credentials,
+	transport *http.Transport) (bool, error) {
+
+	r, err := gocrname.ParseReference(ref)
+	if err != nil {
+		return false, fmt.Errorf("invalid reference '%s': %v", ref, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return false, err
+	}
+
+	desc, err := gocrremote.Get(r, remoteOptions(ctx, auth, transport)...)
+	if err != nil {
+		return false, fmt.Errorf("error fetching manifest of '%s': %v", ref,
+			err)
+	}
+
+	return desc.MediaType.IsIndex(), nil
+}
+
+// ImageMetadata returns the labels from the config of image ref, and the
+// annotations of its manifest. For a multi-platform image, these are the
+// annotations of the image index, and the labels of the first image listed in
+// it with a known platform. An OCI artifact other than a container image has
+// no labels. Requests are canceled when ctx is done.
+func ImageMetadata(ctx context.Context, ref string, creds *auth.Credentials,
+	transport *http.Transport) (map[string]string, map[string]string,
+	error) {
+
+	r, err := gocrname.ParseReference(ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid reference '%s': %v", ref, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	desc, err := gocrremote.Get(r, remoteOptions(ctx, auth, transport)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf(
+			"error fetching manifest of '%s': %v", ref, err)
+	}
+
+	typ, err := util.ArtifactType(desc.Manifest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest '%s': %v", ref, err)
+	}
+
+	var img gocrv1.Image
+	var annotations map[string]string
+
+	if desc.MediaType.IsIndex() {
+		index, err := gocrv1.ParseIndexManifest(bytes.NewReader(desc.Manifest))
+		if err != nil {
+			return nil, nil, fmt.Errorf(
+				"invalid image index '%s': %v", ref, err)
+		}
+		annotations = index.Annotations
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, nil, fmt.Errorf(
+				"invalid image index '%s': %v", ref, err)
+		}
+		for _, m := range index.Manifests {
+			// attestations are listed with platform unknown/unknown
+			if m.Platform == nil || m.Platform.OS == "unknown" {
+				continue
+			}
+			if img, err = idx.Image(m.Digest); err != nil {
+				return nil, nil, fmt.Errorf("invalid image '%s@%s': %v",
+					ref, m.Digest, err)
+			}
+			break
+		}
+
+	} else {
+		manifest, err := gocrv1.ParseManifest(bytes.NewReader(desc.Manifest))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid manifest '%s': %v", ref, err)
+		}
+		annotations = manifest.Annotations
+		if util.IsImageType(typ) {
+			if img, err = desc.Image(); err != nil {
+				return nil, nil, fmt.Errorf(
+					"invalid image '%s': %v", ref, err)
+			}
+		}
+	}
+
+	if img == nil {
+		return nil, annotations, nil
+	}
+
+	config, err := img.ConfigFile()
+	if err != nil {
+		return nil, nil, fmt.Errorf(
+			"error fetching config of '%s': %v", ref, err)
+	}
+
+	return config.Config.Labels, annotations, nil
+}
+
+//
+func platformString(p *gocrv1.Platform) string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// VerifyDigests checks that the manifest of image ref has digest want[0], and
+// that the repository of ref contains the platform manifests with the digests
+// in want[1:], as returned by ManifestDigests for the original image. Requests
+// are canceled when ctx is done.
+func VerifyDigests(ctx context.Context, ref string, want []string,
+	creds *auth.Credentials, transport *http.Transport) error {
+
+	if len(want) == 0 {
+		return fmt.Errorf("no digests to verify '%s' against", ref)
+	}
+
+	r, err := gocrname.ParseReference(ref)
+	if err != nil {
+		return fmt.Errorf("invalid reference '%s': %v", ref, err)
+	}
+
+	got, err := ManifestDigests(ctx, ref, creds, transport)
+	if err != nil {
+		return err
+	}
+	if got[0] != want[0] {
+		return fmt.Errorf("digest mismatch for '%s': expected %s, got %s",
+			ref, want[0], got[0])
+	}
+
+	for _, d := range want[1:] {
+		pref := fmt.Sprintf("%s@%s", r.Context().String(), d)
+		// fetching by digest fails if the content does not match the digest
+		if _, err := ManifestDigests(ctx, pref, creds, transport); err != nil {
+			return fmt.Errorf("error verifying platform manifest %s of "+
+				"'%s': %v", d, ref, err)
+		}
+	}
+
+	return nil
+}
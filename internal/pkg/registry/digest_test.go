@@ -0,0 +1,433 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestManifestDigest(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s := newReferrersServer(false)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	th.AssertNoError(err)
+
+	ctx := context.Background()
+
+	d, err := ManifestDigest(ctx, u.Host+"/app:1.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual(referrersDigest, d)
+
+	_, err = ManifestDigest(ctx, u.Host+"/app:missing", nil, nil)
+	th.AssertError(err, "error resolving digest")
+
+	_, err = ManifestDigest(ctx, "invalid ref:", nil, nil)
+	th.AssertError(err, "invalid reference")
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ManifestDigest(canceled, u.Host+"/app:1.0", nil, nil)
+	th.AssertError(err, "context canceled")
+}
+
+//
+func TestRepoExists(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s := newReferrersServer(false)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	th.AssertNoError(err)
+
+	ctx := context.Background()
+
+	exists, err := RepoExists(ctx, u.Host+"/app", nil, nil)
+	th.AssertNoError(err)
+	th.AssertTrue(exists)
+
+	exists, err = RepoExists(ctx, u.Host+"/missing", nil, nil)
+	th.AssertNoError(err)
+	th.AssertFalse(exists)
+
+	_, err = RepoExists(ctx, "invalid repo", nil, nil)
+	th.AssertError(err, "invalid repository")
+
+	tags, exists, err := RepoTags(ctx, u.Host+"/app", nil, nil)
+	th.AssertNoError(err)
+	th.AssertTrue(exists)
+	th.AssertEqual(7, len(tags))
+	th.AssertEqual("1.0", tags[0])
+
+	tags, exists, err = RepoTags(ctx, u.Host+"/missing", nil, nil)
+	th.AssertNoError(err)
+	th.AssertFalse(exists)
+	th.AssertNil(tags)
+}
+
+//
+func TestManifestExists(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s := newReferrersServer(false)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	th.AssertNoError(err)
+
+	ctx := context.Background()
+
+	d, exists, err := ManifestExists(ctx, u.Host+"/app:1.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertTrue(exists)
+	th.AssertEqual(referrersDigest, d)
+
+	_, exists, err = ManifestExists(ctx, u.Host+"/app:missing", nil, nil)
+	th.AssertNoError(err)
+	th.AssertFalse(exists)
+
+	_, _, err = ManifestExists(ctx, "invalid ref:", nil, nil)
+	th.AssertError(err, "invalid reference")
+}
+
+//
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	testManifestAMD64    = `{"schemaVersion":2,"mediaType":"` +
+		ociManifestMediaType + `","layers":[],"annotations":{"p":"amd64"}}`
+	testManifestARM64 = `{"schemaVersion":2,"mediaType":"` +
+		ociManifestMediaType + `","layers":[],"annotations":{"p":"arm64"}}`
+)
+
+//
+func testDigest(content string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+}
+
+//
+func testIndex(manifests ...string) string {
+	var descs []string
+	for _, m := range manifests {
+		descs = append(descs, fmt.Sprintf(
+			`{"mediaType":"%s","digest":"%s","size":%d}`,
+			ociManifestMediaType, testDigest(m), len(m)))
+	}
+	return fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","manifests":[%s]}`,
+		ociIndexMediaType, strings.Join(descs, ","))
+}
+
+// newManifestServer creates a test registry serving the manifests in tags
+// under their tag in repository `app`, and all platform manifests by digest.
+// When mangle is set, manifests fetched by digest are altered, as could happen
+// with a broken proxy.
+func newManifestServer(tags map[string]string, mangle bool) *httptest.Server {
+
+	content := map[string]string{}
+	for tag, m := range tags {
+		content[tag] = m
+	}
+	for _, m := range []string{testManifestAMD64, testManifestARM64} {
+		content[testDigest(m)] = m
+	}
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			if r.URL.Path == "/v2/" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			ref := strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/")
+			ref = strings.TrimPrefix(ref, "/v2/app/blobs/")
+			m, ok := content[ref]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			mediaType := ociManifestMediaType
+			if strings.Contains(m, `"manifests"`) {
+				mediaType = ociIndexMediaType
+			}
+			digest := testDigest(m)
+			if mangle && strings.HasPrefix(ref, "sha256:") {
+				m = strings.Replace(m, "64", "46", 1)
+			}
+
+			w.Header().Set("Content-Type", mediaType)
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Write([]byte(m))
+		}))
+}
+
+//
+func TestVerifyDigests(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	ctx := context.Background()
+	index := testIndex(testManifestAMD64, testManifestARM64)
+
+	src := newManifestServer(map[string]string{
+		"1.0": index, "2.0": testManifestAMD64}, false)
+	defer src.Close()
+	srcHost := serverHost(th, src)
+
+	want, err := ManifestDigests(ctx, srcHost+"/app:1.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{testDigest(index),
+		testDigest(testManifestAMD64), testDigest(testManifestARM64)}, want)
+
+	single, err := ManifestDigests(ctx, srcHost+"/app:2.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{testDigest(testManifestAMD64)}, single)
+
+	_, err = ManifestDigests(ctx, srcHost+"/app:missing", nil, nil)
+	th.AssertError(err, "error fetching manifest")
+
+	// identical copy
+	trgt := newManifestServer(map[string]string{
+		"1.0": index, "2.0": testManifestAMD64}, false)
+	defer trgt.Close()
+	trgtHost := serverHost(th, trgt)
+	th.AssertNoError(VerifyDigests(ctx, trgtHost+"/app:1.0", want, nil, nil))
+	th.AssertNoError(VerifyDigests(ctx, trgtHost+"/app:2.0", single, nil, nil))
+
+	// different image under the tag
+	th.AssertError(VerifyDigests(ctx, trgtHost+"/app:2.0", want, nil, nil),
+		"digest mismatch for")
+
+	// platform manifest missing
+	missing := append(append([]string{}, want...), testDigest("missing"))
+	th.AssertError(VerifyDigests(ctx, trgtHost+"/app:1.0", missing, nil, nil),
+		"error verifying platform manifest")
+
+	// platform manifests altered
+	mangled := newManifestServer(map[string]string{"1.0": index}, true)
+	defer mangled.Close()
+	th.AssertError(VerifyDigests(ctx, serverHost(th, mangled)+"/app:1.0",
+		want, nil, nil), "error verifying platform manifest")
+
+	th.AssertError(VerifyDigests(ctx, trgtHost+"/app:1.0", nil, nil, nil),
+		"no digests to verify")
+}
+
+//
+func TestImageSize(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	ctx := context.Background()
+	index := testIndex(testManifestAMD64, testManifestARM64)
+	layered := `{"schemaVersion":2,"mediaType":"` + ociManifestMediaType +
+		`","config":{"size":100},"layers":[{"size":1000},{"size":2000}]}`
+
+	s := newManifestServer(map[string]string{
+		"1.0": index, "2.0": testManifestAMD64, "3.0": layered}, false)
+	defer s.Close()
+	host := serverHost(th, s)
+
+	size, err := ImageSize(ctx, host+"/app:1.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual(int64(len(index)+len(testManifestAMD64)+
+		len(testManifestARM64)), size)
+
+	size, err = ImageSize(ctx, host+"/app:2.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual(int64(len(testManifestAMD64)), size)
+
+	size, err = ImageSize(ctx, host+"/app:3.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual(int64(len(layered)+3100), size)
+
+	_, err = ImageSize(ctx, host+"/app:missing", nil, nil)
+	th.AssertError(err, "error fetching manifest")
+}
+
+//
+func TestImagePlatforms(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	ctx := context.Background()
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","manifests":[`+
+		`{"mediaType":"%s","digest":"%s","size":%d,"platform":`+
+		`{"os":"linux","architecture":"amd64"}},`+
+		`{"mediaType":"%s","digest":"%s","size":%d,"platform":`+
+		`{"os":"linux","architecture":"arm","variant":"v7"}}]}`,
+		ociIndexMediaType,
+		ociManifestMediaType, testDigest(testManifestAMD64),
+		len(testManifestAMD64),
+		ociManifestMediaType, testDigest(testManifestARM64),
+		len(testManifestARM64))
+	config := `{"os":"linux","architecture":"arm64","variant":"v8"}`
+	single := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s",`+
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json",`+
+		`"digest":"%s","size":%d},"layers":[]}`,
+		ociManifestMediaType, testDigest(config), len(config))
+
+	s := newManifestServer(map[string]string{
+		"1.0": index, "2.0": single, "chart": testChartManifest,
+		testDigest(config): config}, false)
+	defer s.Close()
+	host := serverHost(th, s)
+
+	platforms, err := ImagePlatforms(ctx, host+"/app:1.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"linux/amd64", "linux/arm/v7"}, platforms)
+
+	platforms, err = ImagePlatforms(ctx, host+"/app:2.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"linux/arm64/v8"}, platforms)
+
+	// platforms do not apply to other artifacts
+	platforms, err = ImagePlatforms(ctx, host+"/app:chart", nil, nil)
+	th.AssertNoError(err)
+	th.AssertNil(platforms)
+
+	_, err = ImagePlatforms(ctx, host+"/app:missing", nil, nil)
+	th.AssertError(err, "error fetching manifest")
+}
+
+// testChartManifest is the manifest of a Helm chart stored as OCI artifact
+const testChartManifest = `{"schemaVersion":2,` +
+	`"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+	`"config":{"mediaType":"application/vnd.cncf.helm.config.v1+json",` +
+	`"digest":"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495` +
+	`991b7852b855","size":0},"layers":[]}`
+
+//
+func TestArtifactType(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	ctx := context.Background()
+	s := newManifestServer(map[string]string{
+		"1.0":   testIndex(testManifestAMD64, testManifestARM64),
+		"chart": testChartManifest}, false)
+	defer s.Close()
+	host := serverHost(th, s)
+
+	typ, err := ArtifactType(ctx, host+"/app:1.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual(ociIndexMediaType, typ)
+
+	typ, err = ArtifactType(ctx, host+"/app:chart", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual("application/vnd.cncf.helm.config.v1+json", typ)
+
+	_, err = ArtifactType(ctx, host+"/app:missing", nil, nil)
+	th.AssertError(err, "error fetching manifest")
+}
+
+//
+func TestIsImageIndex(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	ctx := context.Background()
+	s := newManifestServer(map[string]string{
+		"1.0":   testIndex(testManifestAMD64, testManifestARM64),
+		"amd64": testManifestAMD64}, false)
+	defer s.Close()
+	host := serverHost(th, s)
+
+	index, err := IsImageIndex(ctx, host+"/app:1.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertTrue(index)
+
+	index, err = IsImageIndex(ctx, host+"/app:amd64", nil, nil)
+	th.AssertNoError(err)
+	th.AssertFalse(index)
+
+	_, err = IsImageIndex(ctx, host+"/app:missing", nil, nil)
+	th.AssertError(err, "error fetching manifest")
+}
+
+//
+func TestImageMetadata(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	ctx := context.Background()
+	config := `{"os":"linux","architecture":"arm64",` +
+		`"config":{"Labels":{"channel":"stable"}}}`
+	image := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s",`+
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json",`+
+		`"digest":"%s","size":%d},"layers":[],`+
+		`"annotations":{"org.opencontainers.image.channel":"beta"}}`,
+		ociManifestMediaType, testDigest(config), len(config))
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","manifests":[`+
+		`{"mediaType":"%s","digest":"%s","size":%d,"platform":`+
+		`{"os":"unknown","architecture":"unknown"}},`+
+		`{"mediaType":"%s","digest":"%s","size":%d,"platform":`+
+		`{"os":"linux","architecture":"arm64"}}],`+
+		`"annotations":{"org.opencontainers.image.channel":"stable"}}`,
+		ociIndexMediaType,
+		ociManifestMediaType, testDigest(testManifestAMD64),
+		len(testManifestAMD64),
+		ociManifestMediaType, testDigest(image), len(image))
+
+	s := newManifestServer(map[string]string{
+		"1.0": index, "2.0": image, "chart": testChartManifest,
+		testDigest(image): image, testDigest(config): config}, false)
+	defer s.Close()
+	host := serverHost(th, s)
+
+	labels, annotations, err := ImageMetadata(ctx, host+"/app:1.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual("stable", labels["channel"])
+	th.AssertEqual("stable", annotations["org.opencontainers.image.channel"])
+
+	labels, annotations, err = ImageMetadata(ctx, host+"/app:2.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual("stable", labels["channel"])
+	th.AssertEqual("beta", annotations["org.opencontainers.image.channel"])
+
+	// other artifacts have no labels
+	labels, annotations, err = ImageMetadata(ctx, host+"/app:chart", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(labels))
+	th.AssertEqual(0, len(annotations))
+
+	_, _, err = ImageMetadata(ctx, host+"/app:missing", nil, nil)
+	th.AssertError(err, "error fetching manifest")
+}
+
+//
+func serverHost(th *test.TestHelper, s *httptest.Server) string {
+	u, err := url.Parse(s.URL)
+	th.AssertNoError(err)
+	return u.Host
+}
@@ -17,30 +17,34 @@
 package registry
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
 )
 
 //
 type DHRepoList struct {
-	Items    []DHRepoDescriptor `json:"results",required`
-	NextPage string             `json:"next",omitempty`
+	Items    []DHRepoDescriptor `json:"results"`
+	NextPage string             `json:"next,omitempty"`
 }
 
 //
 type DHRepoDescriptor struct {
-	User        string `json:"user",required`
-	Name        string `json:"name",required`
-	Namespace   string `json:"namespace",required`
-	Type        string `json:"repository_type",required`
-	Description string `json:"description",omitempty`
-	IsPrivate   bool   `json:"is_private",omitempty`
+	User        string `json:"user"`
+	Name        string `json:"name"`
+	Namespace   string `json:"namespace"`
+	Type        string `json:"repository_type"`
+	Description string `json:"description,omitempty"`
+	IsPrivate   bool   `json:"is_private,omitempty"`
 
 	// additional fields; include later on if needed
 	//
@@ -55,6 +59,25 @@ type DHRepoDescriptor struct {
 	// affiliation 			string
 }
 
+//
+type DHTagList struct {
+	Items    []DHTagDescriptor `json:"results"`
+	NextPage string            `json:"next,omitempty"`
+}
+
+//
+type DHTagDescriptor struct {
+	Name       string    `json:"name"`
+	LastPushed time.Time `json:"tag_last_pushed,omitempty"`
+}
+
+//
+func init() {
+	Register(DockerHub, func(conf *ListSourceConfig) (ListSource, error) {
+		return newDockerhub(conf.Creds), nil
+	})
+}
+
 //
 func newDockerhub(creds *auth.Credentials) ListSource {
 	return &dockerhub{creds: creds}
@@ -66,19 +89,12 @@ type dockerhub struct {
 }
 
 //
-func (d *dockerhub) Retrieve(maxItems int) ([]string, error) {
+func (d *dockerhub) Retrieve(ctx context.Context, maxItems int) (
+	[]string, error) {
 
-	var err error
-	token := d.creds.Token()
-
-	if token == nil || token.IsExpired() {
-		token, err = d.getToken()
-		if err != nil {
-			return nil, err
-		}
-		d.creds.SetToken(token)
-	} else {
-		log.Debug("token already present and still valid")
+	token, err := d.ensureToken(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	var ret []string
@@ -88,7 +104,8 @@ func (d *dockerhub) Retrieve(maxItems int) ([]string, error) {
 		d.creds.Username())
 
 	for {
-		req, err := http.NewRequest("GET", url, nil)
+		req, err := http.NewRequestWithContext(
+			ctx, "GET", url, nil)
 		req.Header.Set("Accept", "application/json")
 		req.Header.Set("Authorization", fmt.Sprintf("JWT %s", token.Raw()))
 
@@ -119,13 +136,81 @@ func (d *dockerhub) Retrieve(maxItems int) ([]string, error) {
 }
 
 //
-func (d *dockerhub) Ping() error {
-	_, err := d.getToken()
+func (d *dockerhub) ListTags(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+
+	token, err := d.ensureToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []tags.Tag
+
+	url := fmt.Sprintf(
+		"https://hub.docker.com/v2/repositories/%s/tags/?page_size=100", repo)
+
+	for url != "" {
+		req, err := http.NewRequestWithContext(
+			ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("JWT %s", token.Raw()))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var list DHTagList
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf(
+				"error listing tags for repository '%s': %s", repo, resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&list)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range list.Items {
+			ret = append(ret, tags.Tag{Name: t.Name, Pushed: t.LastPushed})
+		}
+
+		url = list.NextPage
+	}
+
+	return ret, nil
+}
+
+//
+func (d *dockerhub) Ping(ctx context.Context) error {
+	_, err := d.getToken(ctx)
 	return err
 }
 
 //
-func (d *dockerhub) getToken() (*auth.Token, error) {
+func (d *dockerhub) ensureToken(ctx context.Context) (*auth.Token, error) {
+
+	token := d.creds.Token()
+
+	if token == nil || token.IsExpired() {
+		var err error
+		if token, err = d.getToken(ctx); err != nil {
+			return nil, err
+		}
+		d.creds.SetToken(token)
+	} else {
+		log.Debug("token already present and still valid")
+	}
+
+	return token, nil
+}
+
+//
+func (d *dockerhub) getToken(ctx context.Context) (*auth.Token, error) {
 
 	log.Debug("getting token")
 
@@ -134,7 +219,15 @@ func (d *dockerhub) getToken() (*auth.Token, error) {
 		"password": {d.creds.Password()},
 	}
 
-	resp, err := http.PostForm("https://hub.docker.com/v2/users/login/", vals)
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		"https://hub.docker.com/v2/users/login/",
+		strings.NewReader(vals.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
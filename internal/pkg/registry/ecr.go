@@ -17,14 +17,24 @@
 package registry
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	awsecr "github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
 )
 
 //
@@ -46,67 +56,382 @@ func IsECR(registry string) (ecr bool, region, account string) {
 	return
 }
 
+// lifecyclePollInterval is the delay between checks whether a lifecycle policy
+// preview has completed
+var lifecyclePollInterval = 2 * time.Second
+
+// settings for retrying failed ECR requests with exponential backoff and
+// jitter; listing registries with many repositories easily gets throttled, so
+// throttled requests are retried more patiently
+var (
+	ecrMaxRetries       = 10
+	ecrMinRetryDelay    = 100 * time.Millisecond
+	ecrMaxRetryDelay    = 5 * time.Second
+	ecrMinThrottleDelay = 500 * time.Millisecond
+	ecrMaxThrottleDelay = 30 * time.Second
+)
+
+// ecrRetryer is the default retryer of the AWS SDK with the settings above,
+// which logs each retry
+type ecrRetryer struct {
+	client.DefaultRetryer
+}
+
+// ecrConfig returns the config for ECR and ECR Public services, which sets
+// their retryer.
+func ecrConfig() *aws.Config {
+	return request.WithRetryer(aws.NewConfig().WithMaxRetries(ecrMaxRetries),
+		&ecrRetryer{DefaultRetryer: client.DefaultRetryer{
+			NumMaxRetries:    ecrMaxRetries,
+			MinRetryDelay:    ecrMinRetryDelay,
+			MaxRetryDelay:    ecrMaxRetryDelay,
+			MinThrottleDelay: ecrMinThrottleDelay,
+			MaxThrottleDelay: ecrMaxThrottleDelay,
+		}})
+}
+
+// RetryRules returns the delay before retrying failed request r.
+func (e *ecrRetryer) RetryRules(r *request.Request) time.Duration {
+	delay := e.DefaultRetryer.RetryRules(r)
+	log.WithFields(log.Fields{
+		"operation": r.Operation.Name,
+		"retry":     fmt.Sprintf("%d/%d", r.RetryCount+1, e.NumMaxRetries),
+		"throttled": r.IsErrorThrottle(),
+		"delay":     delay,
+	}).Debugf("ECR request failed, retrying: %v", r.Error)
+	return delay
+}
+
 //
-func newECR(registry, region, account string) ListSource {
+func newECR(registry, region, account string, role *auth.AWSRole,
+	transport *http.Transport) ListSource {
 	return &ecr{
-		registry: registry,
-		region:   region,
-		account:  account,
+		registry:  registry,
+		region:    region,
+		account:   account,
+		role:      role,
+		transport: transport,
 	}
 }
 
 //
 type ecr struct {
-	registry string
-	region   string
-	account  string
+	registry  string
+	region    string
+	account   string
+	role      *auth.AWSRole
+	transport *http.Transport
+	//
+	svc   ecriface.ECRAPI
+	creds *credentials.Credentials
 }
 
 //
-func (e *ecr) Retrieve(maxItems int) ([]string, error) {
+func (e *ecr) Retrieve(ctx context.Context, maxItems int) ([]string, error) {
+	var ret []string
+	if err := drain(func(out chan<- string) error {
+		return e.RetrieveStream(ctx, maxItems, out)
+	}, func(repo string) {
+		ret = append(ret, repo)
+	}); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// RetrieveStream sends the repositories to out page by page, while they are
+// being listed.
+func (e *ecr) RetrieveStream(ctx context.Context,
+	maxItems int, out chan<- string) error {
 
 	log.Debug("ECR retrieving image list")
 
-	svc, err := e.getService()
-	if err != nil {
-		return nil, fmt.Errorf("error getting ECR service: %v", err)
+	input := &awsecr.DescribeRepositoriesInput{
+		RegistryId: e.registryID(),
+		MaxResults: aws.Int64(100), // this is max page size
 	}
 
-	input := &awsecr.DescribeRepositoriesInput{
-		RegistryId: aws.String(e.account),
+	sent := 0
+
+	// a throttled page is retried by the service, so listing continues where
+	// it was throttled
+	if err := e.withService(func(svc ecriface.ECRAPI) error {
+		// when retried with new credentials, listing starts over, so skip
+		// those repositories that were already sent
+		seen := 0
+		return svc.DescribeRepositoriesPagesWithContext(ctx, input,
+			func(page *awsecr.DescribeRepositoriesOutput, lastPage bool) bool {
+				for _, r := range page.Repositories {
+					if seen++; seen > sent {
+						out <- aws.StringValue(r.RepositoryName)
+						sent++
+					}
+				}
+				return maxItems <= 0 || seen < maxItems
+			})
+	}); err != nil {
+		return fmt.Errorf("error listing ECR repositories: %v", err)
+	}
+
+	return nil
+}
+
+//
+func (e *ecr) ListTags(ctx context.Context, repo string) ([]tags.Tag, error) {
+
+	log.WithField("repo", repo).Debug("ECR listing image tags")
+
+	input := &awsecr.DescribeImagesInput{
+		RegistryId:     e.registryID(),
+		RepositoryName: aws.String(repo),
+		Filter: &awsecr.DescribeImagesFilter{
+			TagStatus: aws.String(awsecr.TagStatusTagged),
+		},
+		MaxResults: aws.Int64(1000), // this is max page size
+	}
+
+	var ret []tags.Tag
+
+	if err := e.withService(func(svc ecriface.ECRAPI) error {
+		ret = nil
+		return svc.DescribeImagesPagesWithContext(ctx, input,
+			func(page *awsecr.DescribeImagesOutput, lastPage bool) bool {
+				for _, img := range page.ImageDetails {
+					// untagged manifests have no image tags and are skipped
+					for _, t := range img.ImageTags {
+						ret = append(ret, tags.Tag{
+							Name:   aws.StringValue(t),
+							Pushed: aws.TimeValue(img.ImagePushedAt),
+						})
+					}
+				}
+				return true
+			})
+	}); err != nil {
+		return nil, fmt.Errorf(
+			"error listing tags for ECR repository '%s': %v", repo, err)
+	}
+
+	return ret, nil
+}
+
+// LastPushed returns the time of the most recent image push to repository repo,
+// regardless of whether the image is tagged or not.
+func (e *ecr) LastPushed(ctx context.Context, repo string) (time.Time, error) {
+
+	log.WithField("repo", repo).Debug("ECR checking last image push")
+
+	input := &awsecr.DescribeImagesInput{
+		RegistryId:     e.registryID(),
+		RepositoryName: aws.String(repo),
+		MaxResults:     aws.Int64(1000), // this is max page size
+	}
+
+	var ret time.Time
+
+	if err := e.withService(func(svc ecriface.ECRAPI) error {
+		ret = time.Time{}
+		return svc.DescribeImagesPagesWithContext(ctx, input,
+			func(page *awsecr.DescribeImagesOutput, lastPage bool) bool {
+				for _, img := range page.ImageDetails {
+					if p := aws.TimeValue(img.ImagePushedAt); p.After(ret) {
+						ret = p
+					}
+				}
+				return true
+			})
+	}); err != nil {
+		// the repository may have been deleted since the repository list
+		// was cached, which counts as inactive
+		if aerr, ok := err.(awserr.Error); ok &&
+			aerr.Code() == awsecr.ErrCodeRepositoryNotFoundException {
+			log.WithField("repo", repo).Debug("ECR repository not found")
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf(
+			"error listing images for ECR repository '%s': %v", repo, err)
+	}
+
+	return ret, nil
+}
+
+// ResourceTags returns the AWS resource tags of repository repo. A repository
+// that does not exist (anymore) has no tags.
+func (e *ecr) ResourceTags(ctx context.Context, repo string) (
+	map[string]string, error) {
+
+	log.WithField("repo", repo).Debug("ECR listing resource tags")
+
+	input := &awsecr.ListTagsForResourceInput{
+		ResourceArn: aws.String(e.repoARN(repo)),
+	}
+
+	var out *awsecr.ListTagsForResourceOutput
+
+	if err := e.withService(func(svc ecriface.ECRAPI) error {
+		var err error
+		out, err = svc.ListTagsForResourceWithContext(ctx, input)
+		return err
+	}); err != nil {
+		if aerr, ok := err.(awserr.Error); ok &&
+			aerr.Code() == awsecr.ErrCodeRepositoryNotFoundException {
+			log.WithField("repo", repo).Debug("ECR repository not found")
+			return nil, nil
+		}
+		return nil, fmt.Errorf(
+			"error listing resource tags for ECR repository '%s': %v",
+			repo, err)
+	}
+
+	ret := make(map[string]string, len(out.Tags))
+	for _, t := range out.Tags {
+		ret[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return ret, nil
+}
+
+// ExpiringTags returns the tags of repository repo that its lifecycle policy
+// would expire, as determined by a lifecycle policy preview. The preview is
+// started and then polled until it completes. If a preview is in progress
+// already, that one is used. A repository without lifecycle policy has no
+// expiring tags.
+func (e *ecr) ExpiringTags(ctx context.Context, repo string) ([]string,
+	error) {
+
+	rlog := log.WithField("repo", repo)
+	rlog.Debug("ECR previewing lifecycle policy")
+
+	if err := e.withService(func(svc ecriface.ECRAPI) error {
+		_, err := svc.StartLifecyclePolicyPreviewWithContext(ctx,
+			&awsecr.StartLifecyclePolicyPreviewInput{
+				RegistryId:     e.registryID(),
+				RepositoryName: aws.String(repo),
+			})
+		return err
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		switch {
+		case ok && aerr.Code() ==
+			awsecr.ErrCodeLifecyclePolicyNotFoundException:
+			rlog.Debug("ECR repository has no lifecycle policy")
+			return nil, nil
+		case ok && aerr.Code() ==
+			awsecr.ErrCodeLifecyclePolicyPreviewInProgressException:
+			rlog.Debug("ECR lifecycle policy preview already in progress")
+		default:
+			return nil, fmt.Errorf("error starting lifecycle policy preview "+
+				"for ECR repository '%s': %v", repo, err)
+		}
+	}
+
+	input := &awsecr.GetLifecyclePolicyPreviewInput{
+		RegistryId:     e.registryID(),
+		RepositoryName: aws.String(repo),
+		Filter: &awsecr.LifecyclePolicyPreviewFilter{
+			TagStatus: aws.String(awsecr.TagStatusTagged),
+		},
 		MaxResults: aws.Int64(100), // this is max page size
 	}
 
-	var ret []string
+	for {
+		var ret []string
+		var status string
 
-	if err := svc.DescribeRepositoriesPages(input,
-		func(page *awsecr.DescribeRepositoriesOutput, lastPage bool) bool {
-			for _, r := range page.Repositories {
-				ret = append(ret, aws.StringValue(r.RepositoryName))
-			}
-			return maxItems <= 0 || len(ret) < maxItems
+		if err := e.withService(func(svc ecriface.ECRAPI) error {
+			ret = nil
+			return svc.GetLifecyclePolicyPreviewPagesWithContext(ctx, input,
+				func(page *awsecr.GetLifecyclePolicyPreviewOutput,
+					lastPage bool) bool {
+					status = aws.StringValue(page.Status)
+					if status != awsecr.LifecyclePolicyPreviewStatusComplete {
+						return false
+					}
+					for _, r := range page.PreviewResults {
+						ret = append(ret, aws.StringValueSlice(r.ImageTags)...)
+					}
+					return true
+				})
 		}); err != nil {
-		return nil, fmt.Errorf("error listing ECR repositories: %v", err)
+			return nil, fmt.Errorf("error getting lifecycle policy preview "+
+				"for ECR repository '%s': %v", repo, err)
+		}
+
+		switch status {
+		case awsecr.LifecyclePolicyPreviewStatusComplete:
+			return ret, nil
+		case awsecr.LifecyclePolicyPreviewStatusInProgress:
+		default:
+			return nil, fmt.Errorf("lifecycle policy preview for ECR "+
+				"repository '%s' ended with status '%s'", repo, status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lifecyclePollInterval):
+		}
 	}
+}
 
-	return ret, nil
+// repoARN returns the ARN of repository repo in this registry.
+func (e *ecr) repoARN(repo string) string {
+	partition := "aws"
+	if strings.HasSuffix(e.registry, ".cn") {
+		partition = "aws-cn"
+	}
+	return fmt.Sprintf("arn:%s:ecr:%s:%s:repository/%s",
+		partition, e.region, e.account, repo)
 }
 
 //
-func (e *ecr) Ping() error {
+func (e *ecr) Ping(ctx context.Context) error {
+	return e.withService(func(svc ecriface.ECRAPI) error {
+		_, err := svc.DescribeRegistryWithContext(
+			ctx, &awsecr.DescribeRegistryInput{})
+		return err
+	})
+}
+
+// withService runs op with the ECR service. If op fails due to expired
+// credentials, it is retried once with new credentials.
+func (e *ecr) withService(op func(svc ecriface.ECRAPI) error) error {
+
 	svc, err := e.getService()
 	if err != nil {
-		return err
+		return fmt.Errorf("error getting ECR service: %w", err)
 	}
-	_, err = svc.DescribeRegistry(&awsecr.DescribeRegistryInput{})
-	return err
+
+	return auth.RetryOnExpiredToken(e.creds, func() error { return op(svc) })
 }
 
-//
-func (e *ecr) getService() (*awsecr.ECR, error) {
-	sess, err := session.NewSession()
+// getService returns the ECR service for this lister. The service is created
+// on first use and re-used after that. Its credentials are refreshed by the
+// AWS SDK when they expire. Without a region, the service uses the region
+// resolved by the AWS SDK, e.g. from the environment or instance metadata.
+// Failed and throttled requests are retried as set with ecrConfig.
+func (e *ecr) getService() (ecriface.ECRAPI, error) {
+
+	if e.svc != nil {
+		return e.svc, nil
+	}
+
+	sess, err := auth.NewAWSSession(e.region, e.role, e.transport)
 	if err != nil {
 		return nil, err
 	}
-	return awsecr.New(sess, &aws.Config{Region: aws.String(e.region)}), nil
+
+	e.svc = awsecr.New(sess, ecrConfig())
+	e.creds = sess.Config.Credentials
+
+	return e.svc, nil
+}
+
+// registryID returns the registry ID for requests of this lister, which is
+// its account. Without an account, nil is returned, so that requests go to the
+// default registry of the account that the credentials belong to.
+func (e *ecr) registryID() *string {
+	if e.account == "" {
+		return nil
+	}
+	return aws.String(e.account)
 }
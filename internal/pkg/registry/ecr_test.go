@@ -0,0 +1,501 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsecr "github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+type fakeECR struct {
+	ecriface.ECRAPI
+	pages     [][]*awsecr.ImageDetail
+	input     *awsecr.DescribeImagesInput
+	err       error
+	repoPages [][]string
+	repoCalls int
+	resTags   map[string]map[string]string
+	arn       string
+	startErr  error
+	statuses  []string
+	preview   [][]string
+	getCalls  int
+}
+
+//
+func (f *fakeECR) ListTagsForResourceWithContext(ctx aws.Context,
+	input *awsecr.ListTagsForResourceInput,
+	opts ...request.Option) (*awsecr.ListTagsForResourceOutput, error) {
+	f.arn = aws.StringValue(input.ResourceArn)
+	if f.err != nil {
+		return nil, f.err
+	}
+	out := &awsecr.ListTagsForResourceOutput{}
+	for k, v := range f.resTags[f.arn] {
+		out.Tags = append(out.Tags,
+			&awsecr.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return out, nil
+}
+
+//
+func (f *fakeECR) StartLifecyclePolicyPreviewWithContext(ctx aws.Context,
+	input *awsecr.StartLifecyclePolicyPreviewInput,
+	opts ...request.Option) (*awsecr.StartLifecyclePolicyPreviewOutput,
+	error) {
+	if f.startErr != nil {
+		return nil, f.startErr
+	}
+	return &awsecr.StartLifecyclePolicyPreviewOutput{}, nil
+}
+
+//
+func (f *fakeECR) GetLifecyclePolicyPreviewPagesWithContext(ctx aws.Context,
+	input *awsecr.GetLifecyclePolicyPreviewInput,
+	fn func(*awsecr.GetLifecyclePolicyPreviewOutput, bool) bool,
+	opts ...request.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.err != nil {
+		return f.err
+	}
+	status := f.statuses[f.getCalls]
+	f.getCalls++
+	pages := f.preview
+	if len(pages) == 0 {
+		pages = [][]string{nil}
+	}
+	for ix, p := range pages {
+		var res []*awsecr.LifecyclePolicyPreviewResult
+		for _, t := range p {
+			res = append(res, &awsecr.LifecyclePolicyPreviewResult{
+				ImageTags: aws.StringSlice([]string{t})})
+		}
+		if !fn(&awsecr.GetLifecyclePolicyPreviewOutput{
+			Status: aws.String(status), PreviewResults: res},
+			ix == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+//
+func (f *fakeECR) DescribeRepositoriesPagesWithContext(ctx aws.Context,
+	input *awsecr.DescribeRepositoriesInput,
+	fn func(*awsecr.DescribeRepositoriesOutput, bool) bool,
+	opts ...request.Option) error {
+	f.repoCalls++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for ix, p := range f.repoPages {
+		var repos []*awsecr.Repository
+		for _, r := range p {
+			repos = append(repos, &awsecr.Repository{RepositoryName: aws.String(r)})
+		}
+		if !fn(&awsecr.DescribeRepositoriesOutput{Repositories: repos},
+			ix == len(f.repoPages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+//
+func (f *fakeECR) DescribeImagesPagesWithContext(ctx aws.Context,
+	input *awsecr.DescribeImagesInput,
+	fn func(*awsecr.DescribeImagesOutput, bool) bool,
+	opts ...request.Option) error {
+	f.input = input
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.err != nil {
+		return f.err
+	}
+	for ix, p := range f.pages {
+		if !fn(&awsecr.DescribeImagesOutput{ImageDetails: p},
+			ix == len(f.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+//
+func TestECRListTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	t1 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	fake := &fakeECR{pages: [][]*awsecr.ImageDetail{
+		{
+			{ImageTags: aws.StringSlice([]string{"1.0.0", "latest"}),
+				ImagePushedAt: aws.Time(t2)},
+			{ImagePushedAt: aws.Time(t1)}, // untagged
+		},
+		{
+			{ImageTags: aws.StringSlice([]string{"0.9.0"}),
+				ImagePushedAt: aws.Time(t1)},
+		},
+	}}
+
+	e := newECR("123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+		"eu-central-1", "123456789012", nil, nil).(*ecr)
+	e.svc = fake
+
+	list, err := e.ListTags(ctx, "my/repo")
+	th.AssertNoError(err)
+
+	th.AssertEqual("123456789012", aws.StringValue(fake.input.RegistryId))
+	th.AssertEqual("my/repo", aws.StringValue(fake.input.RepositoryName))
+	th.AssertEqual(awsecr.TagStatusTagged,
+		aws.StringValue(fake.input.Filter.TagStatus))
+
+	th.AssertEqual(3, len(list))
+	th.AssertEqual("1.0.0", list[0].Name)
+	th.AssertEqual(t2, list[0].Pushed)
+	th.AssertEqual("latest", list[1].Name)
+	th.AssertEqual(t2, list[1].Pushed)
+	th.AssertEqual("0.9.0", list[2].Name)
+	th.AssertEqual(t1, list[2].Pushed)
+
+	// without account, the default registry of the credentials is used
+	e.account = ""
+	_, err = e.ListTags(ctx, "my/repo")
+	th.AssertNoError(err)
+	th.AssertNil(fake.input.RegistryId)
+}
+
+//
+func TestECRLastPushed(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	t1 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	e := newECR("123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+		"eu-central-1", "123456789012", nil, nil).(*ecr)
+
+	// untagged images count as activity
+	fake := &fakeECR{pages: [][]*awsecr.ImageDetail{
+		{
+			{ImageTags: aws.StringSlice([]string{"1.0.0"}),
+				ImagePushedAt: aws.Time(t1)},
+		},
+		{
+			{ImagePushedAt: aws.Time(t2)},
+		},
+	}}
+	e.svc = fake
+
+	last, err := e.LastPushed(ctx, "my/repo")
+	th.AssertNoError(err)
+	th.AssertEqual(t2, last)
+	th.AssertEqual("my/repo", aws.StringValue(fake.input.RepositoryName))
+	th.AssertNil(fake.input.Filter)
+
+	// no images
+	e.svc = &fakeECR{}
+	last, err = e.LastPushed(ctx, "my/repo")
+	th.AssertNoError(err)
+	th.AssertTrue(last.IsZero())
+
+	// deleted repository
+	e.svc = &fakeECR{err: awserr.New(
+		awsecr.ErrCodeRepositoryNotFoundException, "not found", nil)}
+	last, err = e.LastPushed(ctx, "my/repo")
+	th.AssertNoError(err)
+	th.AssertTrue(last.IsZero())
+
+	e.svc = &fakeECR{err: awserr.New(
+		awsecr.ErrCodeServerException, "failed", nil)}
+	_, err = e.LastPushed(ctx, "my/repo")
+	th.AssertError(err, "error listing images for ECR repository")
+}
+
+//
+func TestECRRetrieveStream(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	fake := &fakeECR{repoPages: [][]string{{"a", "b"}, {"c", "d"}, {"e"}}}
+	e := newECR("123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+		"eu-central-1", "123456789012", nil, nil).(*ecr)
+	e.svc = fake
+
+	list, err := e.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"a", "b", "c", "d", "e"}, list)
+
+	// stops after the page on which max items is reached
+	list, err = e.Retrieve(ctx, 3)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"a", "b", "c", "d"}, list)
+
+	// streaming via repo list, with caching
+	fake.repoCalls = 0
+	l := &RepoList{source: e}
+	l.SetCacheDuration(time.Hour)
+	stream := func(out chan<- string) error { return l.Stream(ctx, out) }
+
+	for i := 0; i < 2; i++ {
+		var repos []string
+		th.AssertNoError(drain(stream, func(r string) {
+			repos = append(repos, r)
+		}))
+		th.AssertEqualSlices([]string{"a", "b", "c", "d", "e"}, repos)
+	}
+	th.AssertEqual(1, fake.repoCalls)
+	th.AssertEqual(5, len(l.repos))
+
+	// without caching, nothing is kept
+	l.SetCacheDuration(-1)
+	var repos []string
+	th.AssertNoError(drain(stream, func(r string) {
+		repos = append(repos, r)
+	}))
+	th.AssertEqual(5, len(repos))
+	th.AssertEqual(2, fake.repoCalls)
+	th.AssertEqual(0, len(l.repos))
+}
+
+//
+func TestECRThrottling(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	defer func(retries int, delays []time.Duration) {
+		ecrMaxRetries = retries
+		ecrMinRetryDelay, ecrMaxRetryDelay = delays[0], delays[1]
+		ecrMinThrottleDelay, ecrMaxThrottleDelay = delays[2], delays[3]
+	}(ecrMaxRetries, []time.Duration{ecrMinRetryDelay, ecrMaxRetryDelay,
+		ecrMinThrottleDelay, ecrMaxThrottleDelay})
+	ecrMaxRetries = 3
+	ecrMinRetryDelay, ecrMaxRetryDelay = time.Millisecond, time.Millisecond
+	ecrMinThrottleDelay, ecrMaxThrottleDelay = time.Millisecond,
+		time.Millisecond
+
+	// every page is throttled twice before it is returned
+	calls := 0
+	throttle := 2
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			if calls%(throttle+1) != 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type":"ThrottlingException",` +
+					`"message":"Rate exceeded"}`))
+				return
+			}
+			if calls == throttle+1 {
+				w.Write([]byte(`{"repositories":[{"repositoryName":"a"},` +
+					`{"repositoryName":"b"}],"nextToken":"next"}`))
+				return
+			}
+			w.Write([]byte(`{"repositories":[{"repositoryName":"c"}]}`))
+		}))
+	defer srv.Close()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("eu-central-1"),
+		Endpoint:    aws.String(srv.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	th.AssertNoError(err)
+
+	e := newECR("123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+		"eu-central-1", "123456789012", nil, nil).(*ecr)
+	e.svc = awsecr.New(sess, ecrConfig())
+
+	list, err := e.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"a", "b", "c"}, list)
+	th.AssertEqual(6, calls)
+
+	// listing fails once the retries are used up
+	calls = 0
+	throttle = 10
+	_, err = e.Retrieve(ctx, -1)
+	th.AssertError(err, "ThrottlingException")
+	th.AssertEqual(ecrMaxRetries+1, calls)
+}
+
+//
+func TestECRCanceled(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	e := newECR("123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+		"eu-central-1", "123456789012", nil, nil).(*ecr)
+	e.svc = &fakeECR{repoPages: [][]string{{"a"}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	list, err := e.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"a"}, list)
+
+	cancel()
+	_, err = e.Retrieve(ctx, -1)
+	th.AssertError(err, "context canceled")
+	_, err = e.ListTags(ctx, "my/repo")
+	th.AssertError(err, "context canceled")
+}
+
+//
+func TestECRResourceTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	arn := "arn:aws:ecr:eu-central-1:123456789012:repository/my/repo"
+	fake := &fakeECR{resTags: map[string]map[string]string{
+		arn: {"mirror": "true", "team": "a"}}}
+
+	e := newECR("123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+		"eu-central-1", "123456789012", nil, nil).(*ecr)
+	e.svc = fake
+
+	l := &RepoList{source: e}
+	th.AssertTrue(l.CanListResourceTags())
+
+	res, err := l.ResourceTags(ctx, "/my/repo")
+	th.AssertNoError(err)
+	th.AssertEqual(arn, fake.arn)
+	th.AssertEqual(2, len(res))
+	th.AssertEqual("true", res["mirror"])
+	th.AssertEqual("a", res["team"])
+
+	res, err = e.ResourceTags(ctx, "other/repo")
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(res))
+
+	// China regions use their own partition
+	e = newECR("123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn",
+		"cn-north-1", "123456789012", nil, nil).(*ecr)
+	e.svc = fake
+	_, err = e.ResourceTags(ctx, "my/repo")
+	th.AssertNoError(err)
+	th.AssertEqual(
+		"arn:aws-cn:ecr:cn-north-1:123456789012:repository/my/repo", fake.arn)
+
+	// deleted repository
+	e.svc = &fakeECR{err: awserr.New(
+		awsecr.ErrCodeRepositoryNotFoundException, "not found", nil)}
+	res, err = e.ResourceTags(ctx, "my/repo")
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(res))
+
+	e.svc = &fakeECR{err: awserr.New(
+		awsecr.ErrCodeServerException, "failed", nil)}
+	_, err = e.ResourceTags(ctx, "my/repo")
+	th.AssertError(err, "error listing resource tags for ECR repository")
+
+	th.AssertFalse((&RepoList{source: &v2{}}).CanListResourceTags())
+}
+
+//
+func TestECRExpiringTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	defer func(d time.Duration) { lifecyclePollInterval = d }(
+		lifecyclePollInterval)
+	lifecyclePollInterval = time.Millisecond
+
+	fake := &fakeECR{
+		startErr: awserr.New(
+			awsecr.ErrCodeLifecyclePolicyPreviewInProgressException,
+			"in progress", nil),
+		statuses: []string{
+			awsecr.LifecyclePolicyPreviewStatusInProgress,
+			awsecr.LifecyclePolicyPreviewStatusComplete,
+		},
+		preview: [][]string{{"a", "b"}, {"c"}},
+	}
+
+	e := newECR("123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+		"eu-central-1", "123456789012", nil, nil).(*ecr)
+	e.svc = fake
+
+	l := &RepoList{source: e}
+	th.AssertTrue(l.CanPreviewLifecycle())
+
+	res, err := l.ExpiringTags(ctx, "/my/repo")
+	th.AssertNoError(err)
+	th.AssertEqual(2, fake.getCalls)
+	th.AssertEqualSlices([]string{"a", "b", "c"}, res)
+
+	// no lifecycle policy
+	e.svc = &fakeECR{startErr: awserr.New(
+		awsecr.ErrCodeLifecyclePolicyNotFoundException, "not found", nil)}
+	res, err = e.ExpiringTags(ctx, "my/repo")
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(res))
+
+	e.svc = &fakeECR{startErr: awserr.New(
+		awsecr.ErrCodeServerException, "failed", nil)}
+	_, err = e.ExpiringTags(ctx, "my/repo")
+	th.AssertError(err, "error starting lifecycle policy preview")
+
+	e.svc = &fakeECR{
+		statuses: []string{awsecr.LifecyclePolicyPreviewStatusFailed}}
+	_, err = e.ExpiringTags(ctx, "my/repo")
+	th.AssertError(err, "ended with status 'FAILED'")
+
+	e.svc = &fakeECR{err: awserr.New(
+		awsecr.ErrCodeServerException, "failed", nil)}
+	_, err = e.ExpiringTags(ctx, "my/repo")
+	th.AssertError(err, "error getting lifecycle policy preview")
+
+	// canceled while waiting for preview
+	cctx, cancel := context.WithCancel(ctx)
+	lifecyclePollInterval = time.Hour
+	e.svc = &fakeECR{
+		statuses: []string{awsecr.LifecyclePolicyPreviewStatusInProgress}}
+	go cancel()
+	_, err = e.ExpiringTags(cctx, "my/repo")
+	th.AssertError(err, "context canceled")
+
+	th.AssertFalse((&RepoList{source: &v2{}}).CanPreviewLifecycle())
+}
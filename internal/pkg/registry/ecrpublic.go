@@ -0,0 +1,212 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awsecrpublic "github.com/aws/aws-sdk-go/service/ecrpublic"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+)
+
+// the ECR Public API is only available in this region
+const ecrPublicRegion = "us-east-1"
+const ecrPublicHost = "public.ecr.aws"
+
+// IsECRPublic determines whether ref points to ECR Public. If ref includes a
+// path, alias is set to the registry alias, i.e. the first path element.
+func IsECRPublic(ref string) (ecrpublic bool, alias string) {
+	parts := strings.SplitN(ref, "/", 3)
+	if parts[0] != ecrPublicHost {
+		return false, ""
+	}
+	if len(parts) > 1 {
+		alias = parts[1]
+	}
+	return true, alias
+}
+
+// newECRPublic creates a list source for ECR Public. Only repositories of
+// the public registry that belongs to the AWS account in use can be listed.
+// When alias is empty, the primary alias of that registry is used.
+func newECRPublic(alias string, role *auth.AWSRole,
+	transport *http.Transport) ListSource {
+	return &ecrpublic{alias: alias, role: role, transport: transport}
+}
+
+//
+type ecrpublic struct {
+	alias     string
+	role      *auth.AWSRole
+	transport *http.Transport
+	//
+	svc   *awsecrpublic.ECRPublic
+	creds *credentials.Credentials
+}
+
+//
+func (e *ecrpublic) Retrieve(ctx context.Context, maxItems int) (
+	[]string, error) {
+
+	log.Debug("ECR Public retrieving image list")
+
+	input := &awsecrpublic.DescribeRepositoriesInput{
+		MaxResults: aws.Int64(100), // this is max page size
+	}
+
+	var ret []string
+
+	if err := e.withService(func(svc *awsecrpublic.ECRPublic) error {
+		alias, err := e.getAlias(ctx, svc)
+		if err != nil {
+			return err
+		}
+		ret = nil
+		return svc.DescribeRepositoriesPagesWithContext(ctx, input,
+			func(page *awsecrpublic.DescribeRepositoriesOutput,
+				lastPage bool) bool {
+				for _, r := range page.Repositories {
+					ret = append(ret, fmt.Sprintf(
+						"%s/%s", alias, aws.StringValue(r.RepositoryName)))
+				}
+				return maxItems <= 0 || len(ret) < maxItems
+			})
+	}); err != nil {
+		return nil, fmt.Errorf(
+			"error listing ECR Public repositories: %v", err)
+	}
+
+	return ret, nil
+}
+
+//
+func (e *ecrpublic) ListTags(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+
+	log.WithField("repo", repo).Debug("ECR Public listing image tags")
+
+	// repo includes the registry alias, which is not part of the repository
+	// name as far as the ECR Public API is concerned
+	if ix := strings.Index(repo, "/"); ix > -1 {
+		repo = repo[ix+1:]
+	}
+
+	input := &awsecrpublic.DescribeImagesInput{
+		RepositoryName: aws.String(repo),
+		MaxResults:     aws.Int64(1000), // this is max page size
+	}
+
+	var ret []tags.Tag
+
+	if err := e.withService(func(svc *awsecrpublic.ECRPublic) error {
+		ret = nil
+		return svc.DescribeImagesPagesWithContext(ctx, input,
+			func(page *awsecrpublic.DescribeImagesOutput, lastPage bool) bool {
+				for _, img := range page.ImageDetails {
+					for _, t := range img.ImageTags {
+						ret = append(ret, tags.Tag{
+							Name:   aws.StringValue(t),
+							Pushed: aws.TimeValue(img.ImagePushedAt),
+						})
+					}
+				}
+				return true
+			})
+	}); err != nil {
+		return nil, fmt.Errorf(
+			"error listing tags for ECR Public repository '%s': %v", repo, err)
+	}
+
+	return ret, nil
+}
+
+//
+func (e *ecrpublic) Ping(ctx context.Context) error {
+	return e.withService(func(svc *awsecrpublic.ECRPublic) error {
+		_, err := e.getAlias(ctx, svc)
+		return err
+	})
+}
+
+//
+func (e *ecrpublic) getAlias(ctx context.Context, svc *awsecrpublic.ECRPublic) (
+	string, error) {
+
+	if e.alias != "" {
+		return e.alias, nil
+	}
+
+	out, err := svc.DescribeRegistriesWithContext(ctx,
+		&awsecrpublic.DescribeRegistriesInput{})
+	if err != nil {
+		return "", fmt.Errorf("error describing ECR Public registry: %v", err)
+	}
+
+	for _, r := range out.Registries {
+		for _, a := range r.Aliases {
+			if aws.BoolValue(a.PrimaryRegistryAlias) {
+				e.alias = aws.StringValue(a.Name)
+				log.WithField("alias", e.alias).Debug(
+					"using primary ECR Public registry alias")
+				return e.alias, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("ECR Public registry has no primary alias")
+}
+
+// withService runs op with the ECR Public service. If op fails due to expired
+// credentials, it is retried once with new credentials.
+func (e *ecrpublic) withService(op func(svc *awsecrpublic.ECRPublic) error) error {
+
+	svc, err := e.getService()
+	if err != nil {
+		return fmt.Errorf("error getting ECR Public service: %v", err)
+	}
+
+	return auth.RetryOnExpiredToken(e.creds, func() error { return op(svc) })
+}
+
+// getService returns the ECR Public service for this lister. The service is
+// created on first use and re-used after that. Like for ECR, failed and
+// throttled requests are retried as set with ecrConfig.
+func (e *ecrpublic) getService() (*awsecrpublic.ECRPublic, error) {
+
+	if e.svc != nil {
+		return e.svc, nil
+	}
+
+	sess, err := auth.NewAWSSession(ecrPublicRegion, e.role, e.transport)
+	if err != nil {
+		return nil, err
+	}
+
+	e.svc = awsecrpublic.New(sess, ecrConfig())
+	e.creds = sess.Config.Credentials
+
+	return e.svc, nil
+}
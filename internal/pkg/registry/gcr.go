@@ -0,0 +1,129 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	gocrauthn "github.com/google/go-containerregistry/pkg/authn"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+)
+
+// IsGCR determines whether registry is a Google Container Registry or a
+// Google Artifact Registry for containers.
+func IsGCR(registry string) bool {
+	server := strings.SplitN(registry, ":", 2)[0]
+	return server == "gcr.io" || strings.HasSuffix(server, ".gcr.io") ||
+		strings.HasSuffix(server, "-docker.pkg.dev")
+}
+
+// newGCR creates a list source for GCR & GAR. The access token is expected
+// as password in creds, which is taken care of by the GCR auth refresher set
+// on the credentials of the location. When creds are empty, i.e. auth is
+// disabled, access is anonymous.
+func newGCR(registry string, transport *http.Transport,
+	creds *auth.Credentials) ListSource {
+	return &gcr{
+		registry:  registry,
+		transport: transport,
+		creds:     creds,
+	}
+}
+
+//
+type gcr struct {
+	registry  string
+	transport *http.Transport
+	creds     *auth.Credentials
+}
+
+//
+func (g *gcr) Retrieve(ctx context.Context, maxItems int) ([]string, error) {
+
+	log.Debug("GCR retrieving image list")
+
+	reg, err := registryName(g.registry)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := g.authenticator()
+	if err != nil {
+		return nil, err
+	}
+
+	return catalogFollowingLinks(
+		ctx, reg, maxItems, 0, auth, g.transport)
+}
+
+//
+func (g *gcr) ListTags(ctx context.Context, repo string) ([]tags.Tag, error) {
+	auth, err := g.authenticator()
+	if err != nil {
+		return nil, err
+	}
+	return listTagsV2(g.registry, repo,
+		remoteOptions(ctx, auth, g.transport))
+}
+
+// ListTagsWithTimes lists the tags of repository repo, taking the creation
+// times of the tagged images as push times.
+func (g *gcr) ListTagsWithTimes(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+	auth, err := g.authenticator()
+	if err != nil {
+		return nil, err
+	}
+	return listTagsWithCreated(g.registry, repo,
+		remoteOptions(ctx, auth, g.transport))
+}
+
+//
+func (g *gcr) Ping(ctx context.Context) error {
+
+	reg, err := registryName(g.registry)
+	if err != nil {
+		return err
+	}
+
+	auth, err := g.authenticator()
+	if err != nil {
+		return err
+	}
+
+	return pingV2(ctx, reg, auth, g.transport)
+}
+
+//
+func (g *gcr) authenticator() (gocrauthn.Authenticator, error) {
+
+	if err := g.creds.Refresh(); err != nil {
+		return nil, fmt.Errorf("error refreshing credentials: %v", err)
+	}
+
+	if g.creds.Password() == "" {
+		return gocrauthn.Anonymous, nil
+	}
+	return &gocrauthn.Bearer{Token: g.creds.Password()}, nil
+}
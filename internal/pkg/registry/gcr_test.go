@@ -0,0 +1,134 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	gocrauthn "github.com/google/go-containerregistry/pkg/authn"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestIsGCR(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertTrue(IsGCR("gcr.io"))
+	th.AssertTrue(IsGCR("gcr.io:443"))
+	th.AssertTrue(IsGCR("eu.gcr.io"))
+	th.AssertTrue(IsGCR("europe-west1-docker.pkg.dev"))
+	th.AssertTrue(IsGCR("europe-west1-docker.pkg.dev:443"))
+
+	th.AssertFalse(IsGCR("registry.acme.com"))
+	th.AssertFalse(IsGCR("mygcr.io"))
+	th.AssertFalse(IsGCR("gcr.io.acme.com"))
+	th.AssertFalse(IsGCR("docker.pkg.dev"))
+}
+
+//
+func TestGCRLister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	// one more repository than fits on a catalog page
+	var repos []string
+	for ix := 0; ix <= defaultCatalogPageSize; ix++ {
+		repos = append(repos, fmt.Sprintf("team/app%03d", ix))
+	}
+
+	// the access token is sent as bearer token
+	srv := newV2Server(true, repos)
+	defer srv.Close()
+
+	creds, err := auth.NewCredentialsFromBasic("oauth2accesstoken", "t0k3n")
+	th.AssertNoError(err)
+	g := newGCR(srv.registry(), nil, creds).(*gcr)
+
+	th.AssertNoError(g.Ping(ctx))
+
+	// catalog pages are followed via their links
+	list, err := g.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(repos, list)
+	th.AssertEqualSlices([]string{"100", "100"}, srv.pageSize)
+
+	srv.pageSize = nil
+	list, err = g.Retrieve(ctx, 1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(repos[:2], list)
+	th.AssertEqualSlices([]string{"1", "1"}, srv.pageSize)
+
+	tags, err := g.ListTags(ctx, "team/app000")
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(tags))
+	th.AssertEqual("1.0", tags[0].Name)
+	th.AssertEqual("latest", tags[1].Name)
+	th.AssertTrue(tags[0].Pushed.IsZero())
+
+	// push times from image config, if available
+	tags, err = g.ListTagsWithTimes(ctx, "team/app000")
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(tags))
+	th.AssertEqual(
+		time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), tags[0].Pushed.UTC())
+	th.AssertTrue(tags[1].Pushed.IsZero())
+
+	// wrong token
+	creds, err = auth.NewCredentialsFromBasic("oauth2accesstoken", "wrong")
+	th.AssertNoError(err)
+	g = newGCR(srv.registry(), nil, creds).(*gcr)
+	th.AssertNotNil(g.Ping(ctx))
+	_, err = g.Retrieve(ctx, -1)
+	th.AssertNotNil(err)
+	_, err = g.ListTags(ctx, "team/app000")
+	th.AssertError(err, "error listing tags for repository 'team/app000'")
+}
+
+//
+func TestGCRAuthenticator(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// without credentials, access is anonymous
+	g := newGCR("gcr.io", nil, &auth.Credentials{}).(*gcr)
+	a, err := g.authenticator()
+	th.AssertNoError(err)
+	th.AssertEqual(gocrauthn.Anonymous, a)
+
+	creds, err := auth.NewCredentialsFromBasic("oauth2accesstoken", "t0k3n")
+	th.AssertNoError(err)
+	g = newGCR("gcr.io", nil, creds).(*gcr)
+	a, err = g.authenticator()
+	th.AssertNoError(err)
+	conf, err := a.Authorization()
+	th.AssertNoError(err)
+	th.AssertEqual("t0k3n", conf.RegistryToken)
+
+	// the token is refreshed first
+	creds = &auth.Credentials{}
+	creds.SetRefresher(auth.NewCommandAuthRefresher([]string{"false"}, 0))
+	g = newGCR("gcr.io", nil, creds).(*gcr)
+	_, err = g.authenticator()
+	th.AssertError(err, "error refreshing credentials")
+}
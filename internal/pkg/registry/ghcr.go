@@ -0,0 +1,200 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	gocrauthn "github.com/google/go-containerregistry/pkg/authn"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+)
+
+//
+const ghcrRegistry = "ghcr.io"
+const githubAPI = "https://api.github.com"
+
+//
+var errGitHubNotFound = errors.New("not found")
+
+// IsGHCR determines whether registry is the GitHub Container Registry.
+func IsGHCR(registry string) bool {
+	return strings.SplitN(registry, ":", 2)[0] == ghcrRegistry
+}
+
+// newGHCR creates a list source for GHCR. Since GHCR does not offer a catalog,
+// the container packages of owner, a GitHub organization or user, are listed
+// via the GitHub packages API. This needs a personal access token with scope
+// `read:packages` as password in creds. If owner is empty, the user name in
+// creds is used. Tags are listed via the standard v2 API, for which the same
+// token is exchanged for a registry bearer token.
+func newGHCR(owner string, transport *http.Transport,
+	creds *auth.Credentials) (ListSource, error) {
+
+	if creds == nil || creds.Password() == "" {
+		return nil, errors.New(
+			"GHCR lister requires a GitHub access token as password")
+	}
+
+	if owner == "" {
+		owner = creds.Username()
+	}
+	if owner == "" {
+		return nil, errors.New("GHCR lister requires an owner")
+	}
+
+	return &ghcr{
+		registry:  ghcrRegistry,
+		api:       githubAPI,
+		owner:     strings.ToLower(owner),
+		transport: transport,
+		creds:     creds,
+		client:    &http.Client{Transport: baseTransport(transport)},
+	}, nil
+}
+
+//
+type ghcr struct {
+	registry  string
+	api       string
+	owner     string
+	transport *http.Transport
+	creds     *auth.Credentials
+	client    *http.Client
+}
+
+//
+type ghPackage struct {
+	Name string `json:"name"`
+}
+
+// Retrieve lists the container packages of the owner as repositories. The
+// owner is first tried as an organization, then as a user.
+func (g *ghcr) Retrieve(ctx context.Context, maxItems int) ([]string, error) {
+
+	log.Debug("GHCR retrieving image list")
+
+	ret, err := g.packages(ctx, "orgs", maxItems)
+	if errors.Is(err, errGitHubNotFound) {
+		log.WithField("owner", g.owner).Debug(
+			"not an organization, listing packages of user")
+		ret, err = g.packages(ctx, "users", maxItems)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing packages of '%s': %v",
+			g.owner, err)
+	}
+	return ret, nil
+}
+
+// packages lists the container packages of the owner, taking the owner as an
+// organization or user, depending on kind.
+func (g *ghcr) packages(ctx context.Context, kind string,
+	maxItems int) ([]string, error) {
+
+	var ret []string
+
+	next, err := url.Parse(fmt.Sprintf(
+		"%s/%s/%s/packages?package_type=container&per_page=100",
+		g.api, kind, url.PathEscape(g.owner)))
+	if err != nil {
+		return nil, err
+	}
+
+	for next != nil {
+
+		var page []ghPackage
+		if next, err = g.get(ctx, next, &page); err != nil {
+			return nil, err
+		}
+
+		for _, p := range page {
+			ret = append(ret, fmt.Sprintf("%s/%s", g.owner, p.Name))
+		}
+
+		if maxItems > 0 && len(ret) > maxItems {
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+//
+func (g *ghcr) ListTags(ctx context.Context, repo string) ([]tags.Tag, error) {
+	return listTagsV2(g.registry, repo, remoteOptions(ctx,
+		&gocrauthn.Basic{
+			Username: g.owner,
+			Password: g.creds.Password(),
+		}, g.transport))
+}
+
+// Ping checks that the access token is accepted by the GitHub API.
+func (g *ghcr) Ping(ctx context.Context) error {
+	u, err := url.Parse(fmt.Sprintf("%s/user", g.api))
+	if err != nil {
+		return err
+	}
+	var user struct{}
+	_, err = g.get(ctx, u, &user)
+	return err
+}
+
+// get retrieves u from the GitHub API, and decodes the JSON response into v.
+// The URL of the next page is returned, or nil if there is none.
+func (g *ghcr) get(ctx context.Context, u *url.URL, v interface{}) (
+	*url.URL, error) {
+
+	req, err := http.NewRequestWithContext(
+		ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization",
+		fmt.Sprintf("Bearer %s", g.creds.Password()))
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errGitHubNotFound
+	default:
+		return nil, newStatusError(resp)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, err
+	}
+
+	return nextPageURL(resp)
+}
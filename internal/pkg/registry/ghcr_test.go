@@ -0,0 +1,156 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// newGitHubServer creates a test GitHub API, accepting token `secret`, with
+// organization `acme` and user `alex`. Package lists of organizations are
+// paginated.
+func newGitHubServer() *httptest.Server {
+
+	var srv *httptest.Server
+
+	srv = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			reply := func(names ...string) {
+				var page []ghPackage
+				for _, n := range names {
+					page = append(page, ghPackage{Name: n})
+				}
+				json.NewEncoder(w).Encode(page)
+			}
+
+			switch r.URL.Path {
+
+			case "/user":
+				json.NewEncoder(w).Encode(map[string]string{"login": "alex"})
+
+			case "/orgs/acme/packages":
+				if r.URL.Query().Get("package_type") != "container" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				base := srv.URL + "/orgs/acme/packages?package_type=container"
+				if r.URL.Query().Get("page") == "" {
+					w.Header().Set("Link", fmt.Sprintf(
+						`<%s&page=2>; rel="next", <%s&page=2>; rel="last"`,
+						base, base))
+					reply("web", "api")
+				} else {
+					w.Header().Set("Link", fmt.Sprintf(
+						`<%s&page=1>; rel="prev", <%s&page=1>; rel="first"`,
+						base, base))
+					reply("tools/cli")
+				}
+
+			case "/users/alex/packages":
+				reply("dotfiles")
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+	return srv
+}
+
+//
+func testGHCR(th *test.TestHelper, srv *httptest.Server, owner, user,
+	token string) (*ghcr, error) {
+
+	creds, err := auth.NewCredentialsFromBasic(user, token)
+	th.AssertNoError(err)
+
+	src, err := newGHCR(owner, nil, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	g := src.(*ghcr)
+	g.api = srv.URL
+	return g, nil
+}
+
+//
+func TestGHCRLister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	th.AssertTrue(IsGHCR("ghcr.io"))
+	th.AssertFalse(IsGHCR("docker.pkg.github.com"))
+
+	srv := newGitHubServer()
+	defer srv.Close()
+
+	// organization, with owner in mixed case
+	g, err := testGHCR(th, srv, "Acme", "alex", "secret")
+	th.AssertNoError(err)
+	th.AssertNoError(g.Ping(ctx))
+
+	list, err := g.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(
+		[]string{"acme/web", "acme/api", "acme/tools/cli"}, list)
+
+	list, err = g.Retrieve(ctx, 1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"acme/web", "acme/api"}, list)
+
+	// user, taken from credentials
+	g, err = testGHCR(th, srv, "", "alex", "secret")
+	th.AssertNoError(err)
+	list, err = g.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"alex/dotfiles"}, list)
+
+	// tags via v2 API, token exchanged for bearer token
+	reg := newV2Server(true, nil)
+	defer reg.Close()
+	g.registry = reg.registry()
+	tags, err := g.ListTags(ctx, "alex/dotfiles")
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(tags))
+
+	// wrong token
+	g, err = testGHCR(th, srv, "acme", "alex", "wrong")
+	th.AssertNoError(err)
+	th.AssertError(g.Ping(ctx), "unexpected status: 401")
+	_, err = g.Retrieve(ctx, -1)
+	th.AssertError(err, "error listing packages of 'acme'")
+
+	// no token
+	_, err = testGHCR(th, srv, "acme", "alex", "")
+	th.AssertError(err, "requires a GitHub access token")
+}
@@ -0,0 +1,228 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+)
+
+//
+const gitlabRegistry = "registry.gitlab.com"
+const gitlabAPI = "https://gitlab.com/api/v4"
+
+// IsGitLab determines whether registry is the container registry of GitLab.com.
+func IsGitLab(registry string) bool {
+	return strings.SplitN(registry, ":", 2)[0] == gitlabRegistry
+}
+
+//
+func init() {
+	Register(GitLab, func(conf *ListSourceConfig) (ListSource, error) {
+		return newGitLab(conf.Settings["api"], conf.Settings["group"],
+			conf.Settings["project"], conf.Transport, conf.Creds)
+	})
+}
+
+// newGitLab creates a list source for the container repositories of a GitLab
+// group or project, which are listed via the GitLab API under api. Group and
+// project can be given as numeric ID or as full path, but only one of them.
+// If api is empty, the API of GitLab.com is used. The password in creds is
+// sent as access token, which needs scope `read_api`.
+func newGitLab(api, group, project string, transport *http.Transport,
+	creds *auth.Credentials) (ListSource, error) {
+
+	if (group == "") == (project == "") {
+		return nil, errors.New(
+			"GitLab lister requires either a 'group' or a 'project'")
+	}
+
+	if creds == nil || creds.Password() == "" {
+		return nil, errors.New(
+			"GitLab lister requires an access token as password")
+	}
+
+	if api == "" {
+		api = gitlabAPI
+	}
+
+	kind, id := "groups", group
+	if project != "" {
+		kind, id = "projects", project
+	}
+
+	return &gitlab{
+		api:    strings.TrimSuffix(api, "/"),
+		kind:   kind,
+		id:     id,
+		creds:  creds,
+		client: &http.Client{Transport: baseTransport(transport)},
+		repos:  make(map[string]glRepository),
+	}, nil
+}
+
+//
+type gitlab struct {
+	api    string
+	kind   string
+	id     string
+	creds  *auth.Credentials
+	client *http.Client
+	repos  map[string]glRepository
+}
+
+//
+type glRepository struct {
+	ID        int    `json:"id"`
+	Path      string `json:"path"`
+	ProjectID int    `json:"project_id"`
+}
+
+//
+type glTag struct {
+	Name string `json:"name"`
+}
+
+// Retrieve lists the container repositories of the group or project. The
+// repositories are remembered for listing their tags.
+func (g *gitlab) Retrieve(ctx context.Context, maxItems int) ([]string, error) {
+
+	log.Debug("GitLab retrieving image list")
+
+	next, err := url.Parse(fmt.Sprintf(
+		"%s/%s/%s/registry/repositories?per_page=100", g.api, g.kind,
+		url.PathEscape(g.id)))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+
+	for next != nil {
+
+		var page []glRepository
+		if next, err = g.get(ctx, next, &page); err != nil {
+			return nil, fmt.Errorf(
+				"error listing container repositories of '%s': %v", g.id, err)
+		}
+
+		for _, r := range page {
+			g.repos[r.Path] = r
+			ret = append(ret, r.Path)
+		}
+
+		if maxItems > 0 && len(ret) > maxItems {
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+// ListTags lists the tags of repo via the GitLab API. Push times are not
+// available via this API.
+func (g *gitlab) ListTags(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+
+	repo = strings.TrimPrefix(repo, "/")
+
+	r, ok := g.repos[repo]
+	if !ok {
+		if _, err := g.Retrieve(ctx, -1); err != nil {
+			return nil, err
+		}
+		if r, ok = g.repos[repo]; !ok {
+			return nil, fmt.Errorf(
+				"container repository '%s' not found in '%s'", repo, g.id)
+		}
+	}
+
+	next, err := url.Parse(fmt.Sprintf(
+		"%s/projects/%d/registry/repositories/%d/tags?per_page=100",
+		g.api, r.ProjectID, r.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []tags.Tag
+
+	for next != nil {
+
+		var page []glTag
+		if next, err = g.get(ctx, next, &page); err != nil {
+			return nil, fmt.Errorf(
+				"error listing tags for repository '%s': %v", repo, err)
+		}
+
+		for _, t := range page {
+			ret = append(ret, tags.Tag{Name: t.Name})
+		}
+	}
+
+	return ret, nil
+}
+
+// Ping checks that the access token is accepted by the GitLab API.
+func (g *gitlab) Ping(ctx context.Context) error {
+	u, err := url.Parse(fmt.Sprintf("%s/%s/%s", g.api, g.kind,
+		url.PathEscape(g.id)))
+	if err != nil {
+		return err
+	}
+	var v struct{}
+	_, err = g.get(ctx, u, &v)
+	return err
+}
+
+// get retrieves u from the GitLab API, and decodes the JSON response into v.
+// The URL of the next page is returned, or nil if there is none.
+func (g *gitlab) get(ctx context.Context, u *url.URL, v interface{}) (
+	*url.URL, error) {
+
+	req, err := http.NewRequestWithContext(
+		ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("PRIVATE-TOKEN", g.creds.Password())
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, err
+	}
+
+	return nextPageURL(resp)
+}
@@ -0,0 +1,144 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// newGitLabServer creates a test GitLab API, accepting token `secret`, with
+// group `acme/infra` containing project `7`. The repository list of the group
+// is paginated.
+func newGitLabServer() *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			if r.Header.Get("PRIVATE-TOKEN") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			web := glRepository{ID: 1, Path: "acme/infra/web", ProjectID: 7}
+			api := glRepository{ID: 2, Path: "acme/infra/web/api",
+				ProjectID: 7}
+
+			switch r.URL.EscapedPath() {
+
+			case "/api/v4/groups/acme%2Finfra", "/api/v4/projects/7":
+				json.NewEncoder(w).Encode(map[string]int{"id": 7})
+
+			case "/api/v4/groups/acme%2Finfra/registry/repositories":
+				if r.URL.Query().Get("page") == "" {
+					w.Header().Set("Link", fmt.Sprintf(
+						`<%s?page=2&per_page=100>; rel="next"`,
+						r.URL.EscapedPath()))
+					json.NewEncoder(w).Encode([]glRepository{web})
+				} else {
+					json.NewEncoder(w).Encode([]glRepository{api})
+				}
+
+			case "/api/v4/projects/7/registry/repositories":
+				json.NewEncoder(w).Encode([]glRepository{web, api})
+
+			case "/api/v4/projects/7/registry/repositories/2/tags":
+				json.NewEncoder(w).Encode(
+					[]glTag{{Name: "1.0"}, {Name: "latest"}})
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+}
+
+//
+func testGitLab(th *test.TestHelper, srv *httptest.Server, group, project,
+	token string) (*gitlab, error) {
+
+	creds, err := auth.NewCredentialsFromBasic("alex", token)
+	th.AssertNoError(err)
+
+	src, err := newGitLab(srv.URL+"/api/v4/", group, project, nil, creds)
+	if err != nil {
+		return nil, err
+	}
+	return src.(*gitlab), nil
+}
+
+//
+func TestGitLabLister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	th.AssertTrue(IsGitLab("registry.gitlab.com"))
+	th.AssertFalse(IsGitLab("gitlab.example.com"))
+
+	srv := newGitLabServer()
+	defer srv.Close()
+
+	// group, given as path
+	g, err := testGitLab(th, srv, "acme/infra", "", "secret")
+	th.AssertNoError(err)
+	th.AssertNoError(g.Ping(ctx))
+
+	list, err := g.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"acme/infra/web", "acme/infra/web/api"}, list)
+
+	// project, tags listed without prior retrieval
+	g, err = testGitLab(th, srv, "", "7", "secret")
+	th.AssertNoError(err)
+	th.AssertNoError(g.Ping(ctx))
+
+	tags, err := g.ListTags(ctx, "/acme/infra/web/api")
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(tags))
+	th.AssertEqual("latest", tags[1].Name)
+
+	_, err = g.ListTags(ctx, "acme/infra/db")
+	th.AssertError(err, "container repository 'acme/infra/db' not found")
+
+	// wrong token
+	g, err = testGitLab(th, srv, "acme/infra", "", "wrong")
+	th.AssertNoError(err)
+	th.AssertError(g.Ping(ctx), "unexpected status: 401")
+	_, err = g.Retrieve(ctx, -1)
+	th.AssertError(err, "error listing container repositories of 'acme/infra'")
+
+	// invalid settings
+	_, err = testGitLab(th, srv, "", "", "secret")
+	th.AssertError(err, "requires either a 'group' or a 'project'")
+	_, err = testGitLab(th, srv, "acme", "7", "secret")
+	th.AssertError(err, "requires either a 'group' or a 'project'")
+	_, err = testGitLab(th, srv, "acme", "", "")
+	th.AssertError(err, "requires an access token")
+
+	creds, err := auth.NewCredentialsFromBasic("alex", "secret")
+	th.AssertNoError(err)
+	src, err := newGitLab("", "acme", "", nil, creds)
+	th.AssertNoError(err)
+	th.AssertEqual(gitlabAPI, src.(*gitlab).api)
+}
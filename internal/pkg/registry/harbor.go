@@ -0,0 +1,214 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+)
+
+//
+const harborPageSize = 100
+
+//
+func init() {
+	Register(Harbor, func(conf *ListSourceConfig) (ListSource, error) {
+		return newHarbor(conf.Registry, conf.Settings["projects"],
+			conf.Transport, conf.Creds)
+	})
+}
+
+// newHarbor creates a list source for the comma separated list of projects in
+// a Harbor registry, which are listed via the Harbor API. This way, only the
+// repositories of those projects are listed, while the catalog would list all
+// repositories the credentials have access to. creds are sent as basic auth,
+// typically of a robot account. When creds are empty, access is anonymous,
+// which only works for public projects.
+func newHarbor(registry, projects string, transport *http.Transport,
+	creds *auth.Credentials) (ListSource, error) {
+
+	var list []string
+	for _, p := range strings.Split(projects, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			list = append(list, p)
+		}
+	}
+
+	if len(list) == 0 {
+		return nil, errors.New("Harbor lister requires 'projects'")
+	}
+
+	return &harbor{
+		api:      fmt.Sprintf("https://%s/api/v2.0", registry),
+		projects: list,
+		creds:    creds,
+		client:   &http.Client{Transport: baseTransport(transport)},
+	}, nil
+}
+
+//
+type harbor struct {
+	api      string
+	projects []string
+	creds    *auth.Credentials
+	client   *http.Client
+}
+
+//
+type harborRepository struct {
+	Name string `json:"name"`
+}
+
+//
+type harborArtifact struct {
+	Tags []struct {
+		Name     string    `json:"name"`
+		PushTime time.Time `json:"push_time"`
+	} `json:"tags"`
+}
+
+// Retrieve lists the repositories of all projects. Repository names returned
+// by Harbor already include the project.
+func (h *harbor) Retrieve(ctx context.Context, maxItems int) ([]string, error) {
+
+	log.Debug("Harbor retrieving image list")
+
+	var ret []string
+
+	for _, p := range h.projects {
+
+		next, err := url.Parse(fmt.Sprintf(
+			"%s/projects/%s/repositories?page_size=%d",
+			h.api, url.PathEscape(p), harborPageSize))
+		if err != nil {
+			return nil, err
+		}
+
+		for next != nil {
+
+			var page []harborRepository
+			if next, err = h.get(ctx, next, &page); err != nil {
+				return nil, fmt.Errorf(
+					"error listing repositories of project '%s': %v", p, err)
+			}
+
+			for _, r := range page {
+				ret = append(ret, r.Name)
+			}
+
+			if maxItems > 0 && len(ret) > maxItems {
+				return ret, nil
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// ListTags lists the tags of repo via the artifacts of the repository, which
+// provides push times. Untagged artifacts are skipped.
+func (h *harbor) ListTags(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+
+	parts := strings.SplitN(strings.TrimPrefix(repo, "/"), "/", 2)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf(
+			"repository '%s' does not start with a project", repo)
+	}
+
+	// slashes in the repository name need to be escaped twice
+	next, err := url.Parse(fmt.Sprintf(
+		"%s/projects/%s/repositories/%s/artifacts?with_tag=true&page_size=%d",
+		h.api, url.PathEscape(parts[0]),
+		url.PathEscape(url.PathEscape(parts[1])), harborPageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []tags.Tag
+
+	for next != nil {
+
+		var page []harborArtifact
+		if next, err = h.get(ctx, next, &page); err != nil {
+			return nil, fmt.Errorf(
+				"error listing tags for repository '%s': %v", repo, err)
+		}
+
+		for _, a := range page {
+			for _, t := range a.Tags {
+				ret = append(ret, tags.Tag{Name: t.Name, Pushed: t.PushTime})
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// Ping checks that the first project can be accessed via the Harbor API.
+func (h *harbor) Ping(ctx context.Context) error {
+	u, err := url.Parse(fmt.Sprintf(
+		"%s/projects/%s", h.api, url.PathEscape(h.projects[0])))
+	if err != nil {
+		return err
+	}
+	var project struct{}
+	_, err = h.get(ctx, u, &project)
+	return err
+}
+
+// get retrieves u from the Harbor API, and decodes the JSON response into v.
+// The URL of the next page is returned, or nil if there is none.
+func (h *harbor) get(ctx context.Context, u *url.URL, v interface{}) (
+	*url.URL, error) {
+
+	req, err := http.NewRequestWithContext(
+		ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.creds != nil {
+		h.creds.Authorize(req)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(resp)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, err
+	}
+
+	return nextPageURL(resp)
+}
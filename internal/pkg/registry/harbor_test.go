@@ -0,0 +1,161 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// newHarborServer creates a test Harbor API, accepting robot account
+// `robot$team-a+ci` with secret `secret`, and holding projects `team-a` and
+// `team-b`. The repository list of `team-a` is paginated.
+func newHarborServer(pushed time.Time) *httptest.Server {
+
+	var srv *httptest.Server
+
+	srv = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			if u, p, ok := r.BasicAuth(); !ok || u != "robot$team-a+ci" ||
+				p != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			reply := func(names ...string) {
+				var page []harborRepository
+				for _, n := range names {
+					page = append(page, harborRepository{Name: n})
+				}
+				json.NewEncoder(w).Encode(page)
+			}
+
+			switch r.URL.Path {
+
+			case "/api/v2.0/projects/team-a":
+				json.NewEncoder(w).Encode(map[string]string{"name": "team-a"})
+
+			case "/api/v2.0/projects/team-a/repositories":
+				if r.URL.Query().Get("page") == "" {
+					w.Header().Set("Link", fmt.Sprintf(
+						`</api/v2.0/projects/team-a/repositories?page=2&`+
+							`page_size=%d>; rel="next"`, harborPageSize))
+					reply("team-a/web", "team-a/api")
+				} else {
+					reply("team-a/tools/cli")
+				}
+
+			case "/api/v2.0/projects/team-b/repositories":
+				reply("team-b/db")
+
+			case "/api/v2.0/projects/team-a/repositories/tools%2Fcli/artifacts":
+				if r.URL.Query().Get("with_tag") != "true" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				json.NewEncoder(w).Encode([]map[string]interface{}{
+					{"tags": []map[string]interface{}{
+						{"name": "1.0", "push_time": pushed},
+						{"name": "latest", "push_time": pushed},
+					}},
+					{"tags": nil}, // untagged
+				})
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+	return srv
+}
+
+//
+func testHarbor(th *test.TestHelper, srv *httptest.Server, projects,
+	secret string) (*harbor, error) {
+
+	creds, err := auth.NewCredentialsFromBasic("robot$team-a+ci", secret)
+	th.AssertNoError(err)
+
+	src, err := newHarbor("harbor.example.com", projects, nil, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	h := src.(*harbor)
+	h.api = srv.URL + "/api/v2.0"
+	return h, nil
+}
+
+//
+func TestHarborLister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	pushed := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := newHarborServer(pushed)
+	defer srv.Close()
+
+	h, err := testHarbor(th, srv, "team-a, team-b", "secret")
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"team-a", "team-b"}, h.projects)
+	th.AssertNoError(h.Ping(ctx))
+
+	list, err := h.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{
+		"team-a/web", "team-a/api", "team-a/tools/cli", "team-b/db"}, list)
+
+	list, err = h.Retrieve(ctx, 1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"team-a/web", "team-a/api"}, list)
+
+	// tags with push times, slashes in repository name escaped
+	tags, err := h.ListTags(ctx, "/team-a/tools/cli")
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(tags))
+	th.AssertEqual("1.0", tags[0].Name)
+	th.AssertTrue(pushed.Equal(tags[0].Pushed))
+	th.AssertEqual("latest", tags[1].Name)
+
+	_, err = h.ListTags(ctx, "cli")
+	th.AssertError(err, "does not start with a project")
+
+	// other team's project
+	h, err = testHarbor(th, srv, "team-c", "secret")
+	th.AssertNoError(err)
+	_, err = h.Retrieve(ctx, -1)
+	th.AssertError(err, "error listing repositories of project 'team-c'")
+
+	// wrong secret
+	h, err = testHarbor(th, srv, "team-a", "wrong")
+	th.AssertNoError(err)
+	th.AssertError(h.Ping(ctx), "unexpected status: 401")
+
+	// no projects
+	_, err = testHarbor(th, srv, " , ", "secret")
+	th.AssertError(err, "requires 'projects'")
+}
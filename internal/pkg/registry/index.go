@@ -27,6 +27,18 @@ import (
 	"github.com/xelalexv/dregsy/internal/pkg/auth"
 )
 
+//
+func init() {
+	Register(Index, func(conf *ListSourceConfig) (ListSource, error) {
+		filter := conf.Settings["search"]
+		if filter == "" {
+			return nil, fmt.Errorf("index lister requires a search expression")
+		}
+		return newIndex(conf.Registry, filter, skipsTLSVerify(conf.Transport),
+			conf.Creds), nil
+	})
+}
+
 //
 func newIndex(reg, filter string, insecure bool, creds *auth.Credentials) ListSource {
 
@@ -62,7 +74,7 @@ type index struct {
 }
 
 //
-func (i *index) Retrieve(maxItems int) ([]string, error) {
+func (i *index) Retrieve(ctx context.Context, maxItems int) ([]string, error) {
 
 	svc, err := registry.NewService(*i.opts)
 	if err != nil {
@@ -71,7 +83,7 @@ func (i *index) Retrieve(maxItems int) ([]string, error) {
 
 	// FIXME: consider using token
 	res, err := svc.Search(
-		context.TODO(), i.filter, maxItems, i.auth, "dregsy", nil)
+		ctx, i.filter, maxItems, i.auth, "dregsy", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -85,12 +97,12 @@ func (i *index) Retrieve(maxItems int) ([]string, error) {
 }
 
 //
-func (i *index) Ping() error {
+func (i *index) Ping(ctx context.Context) error {
 	svc, err := registry.NewService(*i.opts)
 	if err != nil {
 		return err
 	}
-	if _, _, err := svc.Auth(context.TODO(), i.auth, "dregsy"); err != nil {
+	if _, _, err := svc.Auth(ctx, i.auth, "dregsy"); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,207 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	gocrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// FailureKind classifies why a registry or list source could not be accessed
+type FailureKind string
+
+//
+const (
+	FailureAuth         FailureKind = "auth"
+	FailureConnectivity FailureKind = "connectivity"
+	FailureNotFound     FailureKind = "not-found"
+	FailureThrottling   FailureKind = "throttling"
+	FailureUnknown      FailureKind = "unknown"
+)
+
+// PingError is returned by pings of registries and list sources, and tells
+// what kind of failure occurred.
+type PingError struct {
+	Kind FailureKind
+	Err  error
+}
+
+//
+func (e *PingError) Error() string {
+	if e.Kind == FailureUnknown {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s error: %v", e.Kind, e.Err)
+}
+
+//
+func (e *PingError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable determines whether pinging again may succeed, which is the case
+// for connectivity and throttling failures. Authentication failures and
+// missing registries or repositories are permanent.
+func (e *PingError) Retryable() bool {
+	return e.Kind == FailureConnectivity || e.Kind == FailureThrottling
+}
+
+// FailureOf returns the kind of failure of err if it is or wraps a PingError,
+// and FailureUnknown otherwise.
+func FailureOf(err error) FailureKind {
+	var perr *PingError
+	if errors.As(err, &perr) {
+		return perr.Kind
+	}
+	return FailureUnknown
+}
+
+// newPingError wraps err into a PingError with the kind of failure it
+// represents. For nil, nil is returned.
+func newPingError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var perr *PingError
+	if errors.As(err, &perr) {
+		return err
+	}
+	return &PingError{Kind: classifyFailure(err), Err: err}
+}
+
+// statusError is returned by list sources for unexpected HTTP status codes
+type statusError struct {
+	code   int
+	status string
+}
+
+//
+func newStatusError(resp *http.Response) error {
+	return &statusError{code: resp.StatusCode, status: resp.Status}
+}
+
+//
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status: %s", e.status)
+}
+
+// classifyFailure determines the kind of failure err represents. Status codes
+// of registry and API responses are considered first, then AWS error codes and
+// network errors. Remaining errors are classified by their messages.
+func classifyFailure(err error) FailureKind {
+
+	if errors.Is(err, context.Canceled) {
+		return FailureUnknown
+	}
+
+	var terr *gocrtransport.Error
+	if errors.As(err, &terr) {
+		return failureOfStatus(terr.StatusCode)
+	}
+
+	var serr *statusError
+	if errors.As(err, &serr) {
+		return failureOfStatus(serr.code)
+	}
+
+	if errors.Is(err, errGitHubNotFound) {
+		return FailureNotFound
+	}
+
+	var ae awserr.Error
+	if errors.As(err, &ae) {
+		if k := failureOfAWSCode(ae.Code()); k != FailureUnknown {
+			return k
+		}
+		var rf awserr.RequestFailure
+		if errors.As(err, &rf) {
+			if k := failureOfStatus(rf.StatusCode()); k != FailureUnknown {
+				return k
+			}
+		}
+		if ae.OrigErr() != nil {
+			return classifyFailure(ae.OrigErr())
+		}
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) || errors.Is(err, context.DeadlineExceeded) {
+		return FailureConnectivity
+	}
+
+	if util.IsUnauthorized(err) {
+		return FailureAuth
+	}
+
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "denied") || strings.Contains(msg, "forbidden") {
+		return FailureAuth
+	}
+	if util.IsRetryable(err) {
+		if strings.Contains(msg, "throttl") ||
+			strings.Contains(msg, "toomanyrequests") ||
+			strings.Contains(msg, "too many requests") {
+			return FailureThrottling
+		}
+		return FailureConnectivity
+	}
+
+	return FailureUnknown
+}
+
+//
+func failureOfStatus(code int) FailureKind {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return FailureAuth
+	case code == http.StatusNotFound:
+		return FailureNotFound
+	case code == http.StatusTooManyRequests:
+		return FailureThrottling
+	case code >= 500:
+		return FailureConnectivity
+	}
+	return FailureUnknown
+}
+
+//
+func failureOfAWSCode(code string) FailureKind {
+	switch code {
+	case "UnrecognizedClientException", "InvalidSignatureException",
+		"AccessDeniedException", "AccessDenied", "ExpiredTokenException",
+		"InvalidClientTokenId", "SignatureDoesNotMatch",
+		"NoCredentialProviders":
+		return FailureAuth
+	case "ThrottlingException", "Throttling", "ThrottledException",
+		"TooManyRequestsException", "RequestLimitExceeded":
+		return FailureThrottling
+	case "RepositoryNotFoundException", "RegistryNotFoundException":
+		return FailureNotFound
+	case "RequestError", "RequestTimeout", "ServiceUnavailable":
+		return FailureConnectivity
+	}
+	return FailureUnknown
+}
@@ -0,0 +1,104 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	gocrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestClassifyFailure(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, c := range []struct {
+		err  error
+		want FailureKind
+	}{
+		{&gocrtransport.Error{StatusCode: http.StatusUnauthorized},
+			FailureAuth},
+		{&gocrtransport.Error{StatusCode: http.StatusNotFound},
+			FailureNotFound},
+		{&gocrtransport.Error{StatusCode: http.StatusTooManyRequests},
+			FailureThrottling},
+		{&gocrtransport.Error{StatusCode: http.StatusBadGateway},
+			FailureConnectivity},
+		{fmt.Errorf("listing: %w", &statusError{code: 403,
+			status: "403 Forbidden"}), FailureAuth},
+		{errGitHubNotFound, FailureNotFound},
+		{awserr.New("UnrecognizedClientException", "", nil), FailureAuth},
+		{awserr.NewRequestFailure(
+			awserr.New("ThrottlingException", "", nil), 400, ""),
+			FailureThrottling},
+		{awserr.NewRequestFailure(
+			awserr.New("SomethingElse", "", nil), 503, ""),
+			FailureConnectivity},
+		{awserr.New("RepositoryNotFoundException", "", nil),
+			FailureNotFound},
+		{awserr.New("Unknown", "", &net.OpError{Op: "dial",
+			Err: errors.New("connection refused")}), FailureConnectivity},
+		{&net.DNSError{Err: "no such host", Name: "registry"},
+			FailureConnectivity},
+		{errors.New("unauthorized: authentication required"), FailureAuth},
+		{errors.New("denied: requested access to the resource is denied"),
+			FailureAuth},
+		{errors.New("toomanyrequests: rate limit"), FailureThrottling},
+		{errors.New("read: connection reset by peer"), FailureConnectivity},
+		{errors.New("manifest unknown"), FailureUnknown},
+		{context.Canceled, FailureUnknown},
+	} {
+		th.AssertEqual(c.want, classifyFailure(c.err))
+	}
+}
+
+//
+func TestPingError(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNil(newPingError(nil))
+
+	cause := &gocrtransport.Error{StatusCode: http.StatusServiceUnavailable}
+	err := newPingError(cause)
+	th.AssertEqual(FailureConnectivity, FailureOf(err))
+	th.AssertError(err, "connectivity error: ")
+	th.AssertTrue(errors.Is(err, cause))
+
+	var perr *PingError
+	th.AssertTrue(errors.As(fmt.Errorf("preflight: %w", err), &perr))
+	th.AssertTrue(perr.Retryable())
+
+	// already classified errors are kept as they are
+	th.AssertEqual(err, newPingError(err))
+
+	err = newPingError(&gocrtransport.Error{StatusCode: http.StatusForbidden})
+	th.AssertFalse(err.(*PingError).Retryable())
+
+	err = newPingError(errors.New("exit status 1"))
+	th.AssertEqual("exit status 1", err.Error())
+	th.AssertEqual(FailureUnknown, FailureOf(errors.New("other")))
+}
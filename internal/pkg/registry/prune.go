@@ -0,0 +1,119 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gocrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+)
+
+// PruneTags deletes those of tags that are present in repository repo. Since
+// registries delete manifests rather than tags, a tag is only deleted if no
+// other tag of repo refers to the same manifest. Tags that are kept for this
+// reason are logged. The deleted tags are returned, sorted. Requests are
+// canceled when ctx is done.
+func PruneTags(ctx context.Context, repo string, tags []string,
+	creds *auth.Credentials, transport *http.Transport) ([]string, error) {
+
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	r, err := gocrname.NewRepository(repo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository '%s': %v", repo, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return nil, err
+	}
+	opts := remoteOptions(ctx, auth, transport)
+
+	present, err := gocrremote.List(r, opts...)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error listing tags of '%s': %v", repo, err)
+	}
+
+	prune := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		prune[t] = true
+	}
+
+	// digests of all present tags, and which of them are still in use
+	digests := make(map[string]string, len(present))
+	inUse := make(map[string]bool)
+	var candidates []string
+
+	for _, t := range present {
+		desc, err := gocrremote.Head(r.Tag(t), opts...)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error resolving digest of '%s:%s': %v", repo, t, err)
+		}
+		d := desc.Digest.String()
+		digests[t] = d
+		if prune[t] {
+			candidates = append(candidates, t)
+		} else {
+			inUse[d] = true
+		}
+	}
+
+	sort.Strings(candidates)
+	var ret []string
+	deleted := make(map[string]bool)
+
+	for _, t := range candidates {
+		d := digests[t]
+		if inUse[d] {
+			log.WithFields(log.Fields{"repo": repo, "tag": t}).Warn(
+				"not pruning tag, its manifest is also used by a kept tag")
+			continue
+		}
+		if !deleted[d] {
+			if err := gocrremote.Delete(r.Digest(d), opts...); err != nil {
+				return ret, fmt.Errorf(
+					"error deleting '%s:%s': %v", repo, t, err)
+			}
+			deleted[d] = true
+		}
+		ret = append(ret, t)
+	}
+
+	return ret, nil
+}
+
+// isNotFound determines whether err is a registry error for a missing
+// repository or manifest.
+func isNotFound(err error) bool {
+	var terr *gocrtransport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,120 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	gosync "sync"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestPruneTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// 1.0 & 1.1 share a manifest, as do 2.0 & latest
+	s, deleted := newPruneServer(map[string]string{
+		"1.0":    testManifestAMD64,
+		"1.1":    testManifestAMD64,
+		"2.0":    testManifestARM64,
+		"latest": testManifestARM64,
+		"3.0":    `{"schemaVersion":2}`,
+	})
+	defer s.Close()
+	host := serverHost(th, s)
+	ctx := context.Background()
+
+	pruned, err := PruneTags(ctx, host+"/app",
+		[]string{"1.0", "1.1", "2.0", "0.9"}, nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"1.0", "1.1"}, pruned)
+	th.AssertEqualSlices([]string{testDigest(testManifestAMD64)}, *deleted)
+
+	// nothing to prune
+	pruned, err = PruneTags(ctx, host+"/app", nil, nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(pruned))
+
+	// repository not present in target
+	pruned, err = PruneTags(ctx, host+"/missing", []string{"1.0"}, nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(pruned))
+
+	_, err = PruneTags(ctx, "invalid repo:", []string{"1.0"}, nil, nil)
+	th.AssertError(err, "invalid repository")
+}
+
+// newPruneServer creates a test registry serving the manifests in tags under
+// their tag in repository `app`, which can be listed and deleted by digest.
+// Deleted digests are recorded in the returned list.
+func newPruneServer(tags map[string]string) (*httptest.Server, *[]string) {
+
+	var mu gosync.Mutex
+	var deleted []string
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+
+			case r.URL.Path == "/v2/":
+				w.WriteHeader(http.StatusOK)
+
+			case r.URL.Path == "/v2/app/tags/list":
+				var names []string
+				for t := range tags {
+					names = append(names, t)
+				}
+				sort.Strings(names)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"name": "app", "tags": names})
+
+			case strings.HasPrefix(r.URL.Path, "/v2/app/manifests/sha256:") &&
+				r.Method == http.MethodDelete:
+				deleted = append(deleted,
+					strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/"))
+				w.WriteHeader(http.StatusAccepted)
+
+			case strings.HasPrefix(r.URL.Path, "/v2/app/manifests/"):
+				m, ok := tags[strings.TrimPrefix(
+					r.URL.Path, "/v2/app/manifests/")]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", ociManifestMediaType)
+				w.Header().Set("Docker-Content-Digest", testDigest(m))
+				w.Write([]byte(m))
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+	return s, &deleted
+}
@@ -0,0 +1,188 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	gocrauthn "github.com/google/go-containerregistry/pkg/authn"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+)
+
+//
+const quayRegistry = "quay.io"
+
+// quayTokenUser is the user name with which Quay accepts an OAuth token as
+// password for registry access
+const quayTokenUser = "$oauthtoken"
+
+// IsQuay determines whether registry is Quay.io.
+func IsQuay(registry string) bool {
+	return strings.SplitN(registry, ":", 2)[0] == quayRegistry
+}
+
+//
+func init() {
+	Register(Quay, func(conf *ListSourceConfig) (ListSource, error) {
+		return newQuay(conf.Registry, conf.Settings["namespace"],
+			conf.Transport, conf.Creds)
+	})
+}
+
+// newQuay creates a list source for Quay. Since Quay does not offer a public
+// catalog, the repositories of namespace, an organization or user, are listed
+// via the Quay application API. If set, the password in creds is sent as OAuth
+// token, which is needed for listing private repositories. Without a token,
+// only public repositories are listed. Tags are listed via the standard v2
+// API, with the user name in creds, or `$oauthtoken` if there is none.
+func newQuay(registry, namespace string, transport *http.Transport,
+	creds *auth.Credentials) (ListSource, error) {
+
+	if namespace == "" {
+		return nil, errors.New("Quay lister requires a 'namespace'")
+	}
+
+	return &quay{
+		registry:  registry,
+		api:       fmt.Sprintf("https://%s/api/v1", registry),
+		namespace: namespace,
+		transport: transport,
+		creds:     creds,
+		client:    &http.Client{Transport: baseTransport(transport)},
+	}, nil
+}
+
+//
+type quay struct {
+	registry  string
+	api       string
+	namespace string
+	transport *http.Transport
+	creds     *auth.Credentials
+	client    *http.Client
+}
+
+//
+type quayRepositories struct {
+	Repositories []struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"repositories"`
+	NextPage string `json:"next_page"`
+}
+
+// Retrieve lists the repositories of the namespace, prefixed with the
+// namespace.
+func (q *quay) Retrieve(ctx context.Context, maxItems int) ([]string, error) {
+
+	log.Debug("Quay retrieving image list")
+
+	var ret []string
+	next := ""
+
+	for {
+		params := url.Values{}
+		params.Set("namespace", q.namespace)
+		if next != "" {
+			params.Set("next_page", next)
+		}
+
+		var page quayRepositories
+		if err := q.get(ctx, fmt.Sprintf("%s/repository?%s", q.api,
+			params.Encode()), &page); err != nil {
+			return nil, fmt.Errorf("error listing repositories of '%s': %v",
+				q.namespace, err)
+		}
+
+		for _, r := range page.Repositories {
+			ret = append(ret, fmt.Sprintf("%s/%s", r.Namespace, r.Name))
+		}
+
+		if next = page.NextPage; next == "" ||
+			(maxItems > 0 && len(ret) > maxItems) {
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+//
+func (q *quay) ListTags(ctx context.Context, repo string) ([]tags.Tag, error) {
+
+	var authn gocrauthn.Authenticator = gocrauthn.Anonymous
+	if q.token() != "" {
+		user := q.creds.Username()
+		if user == "" {
+			user = quayTokenUser
+		}
+		authn = &gocrauthn.Basic{Username: user, Password: q.token()}
+	}
+
+	return listTagsV2(q.registry, strings.TrimPrefix(repo, "/"),
+		remoteOptions(ctx, authn, q.transport))
+}
+
+// Ping checks that the Quay application API can be accessed, and accepts the
+// OAuth token, if set.
+func (q *quay) Ping(ctx context.Context) error {
+	var v struct{}
+	return q.get(ctx, fmt.Sprintf("%s/discovery", q.api), &v)
+}
+
+// token returns the OAuth token for the application API, if any.
+func (q *quay) token() string {
+	if q.creds == nil {
+		return ""
+	}
+	return q.creds.Password()
+}
+
+// get retrieves u from the Quay application API, and decodes the JSON
+// response into v.
+func (q *quay) get(ctx context.Context, u string, v interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if t := q.token(); t != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t))
+	}
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,155 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// newQuayServer creates a test Quay application API with organization `acme`,
+// whose repository list is paginated. Private repositories are only listed
+// with OAuth token `secret`.
+func newQuayServer() *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			authorized := r.Header.Get("Authorization") == "Bearer secret"
+			if r.Header.Get("Authorization") != "" && !authorized {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			reply := func(next string, names ...string) {
+				page := map[string]interface{}{"next_page": next}
+				var repos []map[string]string
+				for _, n := range names {
+					repos = append(repos,
+						map[string]string{"namespace": "acme", "name": n})
+				}
+				page["repositories"] = repos
+				json.NewEncoder(w).Encode(page)
+			}
+
+			switch r.URL.Path {
+
+			case "/api/v1/discovery":
+				json.NewEncoder(w).Encode(map[string]string{})
+
+			case "/api/v1/repository":
+				if r.URL.Query().Get("namespace") != "acme" {
+					reply("")
+					return
+				}
+				switch r.URL.Query().Get("next_page") {
+				case "":
+					reply("p2", "web", "api")
+				case "p2":
+					if authorized {
+						reply("", "private")
+					} else {
+						reply("")
+					}
+				default:
+					w.WriteHeader(http.StatusBadRequest)
+				}
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+}
+
+//
+func testQuay(th *test.TestHelper, srv *httptest.Server, namespace, user,
+	token string) (*quay, error) {
+
+	creds, err := auth.NewCredentialsFromBasic(user, token)
+	th.AssertNoError(err)
+
+	src, err := newQuay(quayRegistry, namespace, nil, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	q := src.(*quay)
+	q.api = srv.URL + "/api/v1"
+	return q, nil
+}
+
+//
+func TestQuayLister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	th.AssertTrue(IsQuay("quay.io"))
+	th.AssertTrue(IsQuay("quay.io:443"))
+	th.AssertFalse(IsQuay("quay.example.com"))
+
+	srv := newQuayServer()
+	defer srv.Close()
+
+	// with OAuth token, including private repositories
+	q, err := testQuay(th, srv, "acme", "", "secret")
+	th.AssertNoError(err)
+	th.AssertNoError(q.Ping(ctx))
+
+	list, err := q.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(
+		[]string{"acme/web", "acme/api", "acme/private"}, list)
+
+	list, err = q.Retrieve(ctx, 1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"acme/web", "acme/api"}, list)
+
+	// anonymous, only public repositories
+	q, err = testQuay(th, srv, "acme", "", "")
+	th.AssertNoError(err)
+	list, err = q.Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"acme/web", "acme/api"}, list)
+
+	// tags via v2 API, with user from credentials
+	reg := newV2Server(true, nil)
+	defer reg.Close()
+	q, err = testQuay(th, srv, "acme", "alex", "secret")
+	th.AssertNoError(err)
+	q.registry = reg.registry()
+	tags, err := q.ListTags(ctx, "/acme/web")
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(tags))
+
+	// wrong token
+	q, err = testQuay(th, srv, "acme", "", "wrong")
+	th.AssertNoError(err)
+	th.AssertError(q.Ping(ctx), "unexpected status: 401")
+	_, err = q.Retrieve(ctx, -1)
+	th.AssertError(err, "error listing repositories of 'acme'")
+
+	// no namespace
+	_, err = testQuay(th, srv, "", "", "secret")
+	th.AssertError(err, "requires a 'namespace'")
+}
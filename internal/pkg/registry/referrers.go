@@ -0,0 +1,164 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	gocrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gocrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+)
+
+// signatureSuffixes are the suffixes of the tags under which cosign stores
+// signatures, attestations, and SBOMs for an image digest
+var signatureSuffixes = []string{".sig", ".att", ".sbom"}
+
+//
+const ociIndexMediaType = "application/vnd.oci.image.index.v1+json"
+
+// FindReferrers finds the signatures, attestations, and SBOMs of image ref,
+// which is a tagged or digested reference. Referrers stored under the cosign
+// tag scheme, i.e. tags `sha256-<digest>.sig`, `.att`, and `.sbom`, as well as
+// the `sha256-<digest>` fallback tag of the OCI referrers API, are returned as
+// `:<tag>`. Referrers found via the OCI referrers API are returned as
+// `@<digest>`. Registries not supporting that API are no error. Requests are
+// canceled when ctx is done.
+func FindReferrers(ctx context.Context, ref string, creds *auth.Credentials,
+	transport *http.Transport) ([]string, error) {
+
+	r, err := gocrname.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference '%s': %v", ref, err)
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return nil, err
+	}
+	opts := remoteOptions(ctx, auth, transport)
+
+	desc, err := gocrremote.Head(r, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving digest of '%s': %v", ref, err)
+	}
+
+	list, err := gocrremote.List(r.Context(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tags of '%s': %v", ref, err)
+	}
+
+	var ret []string
+
+	prefix := strings.Replace(desc.Digest.String(), ":", "-", 1)
+	for _, tag := range list {
+		if isReferrerTag(tag, prefix) {
+			ret = append(ret, ":"+tag)
+		}
+	}
+
+	digests, err := listReferrers(
+		ctx, r.Context(), desc.Digest.String(), auth, transport)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error listing referrers of '%s': %v", ref, err)
+	}
+	for _, d := range digests {
+		ret = append(ret, "@"+d)
+	}
+
+	return ret, nil
+}
+
+// isReferrerTag determines whether tag refers to the image digest from which
+// prefix was derived.
+func isReferrerTag(tag, prefix string) bool {
+	if tag == prefix {
+		return true
+	}
+	for _, s := range signatureSuffixes {
+		if tag == prefix+s {
+			return true
+		}
+	}
+	return false
+}
+
+// listReferrers lists the digests of the manifests referring to digest in
+// repo, via the OCI referrers API. When the registry does not support this
+// API, the list is empty.
+func listReferrers(ctx context.Context, repo gocrname.Repository,
+	digest string, auth gocrauthn.Authenticator, transport *http.Transport) (
+	[]string, error) {
+
+	tr, err := gocrtransport.New(repo.Registry, auth, baseTransport(transport),
+		[]string{repo.Scope(gocrtransport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: tr}
+
+	u := &url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path: fmt.Sprintf(
+			"/v2/%s/referrers/%s", repo.RepositoryStr(), digest),
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", ociIndexMediaType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := gocrtransport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	var index struct {
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0, len(index.Manifests))
+	for _, m := range index.Manifests {
+		ret = append(ret, m.Digest)
+	}
+	return ret, nil
+}
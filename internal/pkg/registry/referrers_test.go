@@ -0,0 +1,115 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+const referrersDigest = "sha256:" +
+	"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// newReferrersServer creates a test registry with image `app:1.0` and its
+// signature tags. When referrers is set, the OCI referrers API is supported.
+func newReferrersServer(referrers bool) *httptest.Server {
+
+	sigTag := strings.Replace(referrersDigest, ":", "-", 1)
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			switch r.URL.Path {
+
+			case "/v2/":
+				w.WriteHeader(http.StatusOK)
+
+			case "/v2/app/manifests/1.0":
+				w.Header().Set("Content-Type", ociIndexMediaType)
+				w.Header().Set("Content-Length", "2")
+				w.Header().Set("Docker-Content-Digest", referrersDigest)
+				w.WriteHeader(http.StatusOK)
+
+			case "/v2/app/tags/list":
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"name": "app",
+					"tags": []string{"1.0", "latest", sigTag + ".sig",
+						sigTag + ".att", sigTag + ".sbom", sigTag,
+						"sha256-other.sig"}})
+
+			case "/v2/app/referrers/" + referrersDigest:
+				if !referrers {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", ociIndexMediaType)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"schemaVersion": 2,
+					"mediaType":     ociIndexMediaType,
+					"manifests": []map[string]interface{}{
+						{"digest": "sha256:1111"},
+						{"digest": "sha256:2222"},
+					}})
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+}
+
+//
+func TestFindReferrers(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	sigTag := ":" + strings.Replace(referrersDigest, ":", "-", 1)
+	tagRefs := []string{
+		sigTag + ".sig", sigTag + ".att", sigTag + ".sbom", sigTag}
+
+	tryFindReferrers(th, false, tagRefs)
+	tryFindReferrers(th, true,
+		append(tagRefs, "@sha256:1111", "@sha256:2222"))
+
+	_, err := FindReferrers(context.Background(), "invalid ref:", nil, nil)
+	th.AssertError(err, "invalid reference")
+}
+
+//
+func tryFindReferrers(th *test.TestHelper, referrers bool, want []string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	s := newReferrersServer(referrers)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	th.AssertNoError(err)
+
+	refs, err := FindReferrers(
+		context.Background(), u.Host+"/app:1.0", nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(want, refs)
+}
@@ -17,13 +17,17 @@
 package registry
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
 )
 
 //
@@ -34,29 +38,76 @@ const defaultListerCacheDuration = time.Hour
 type ListSourceType string
 
 const (
-	Catalog   ListSourceType = "catalog"
-	DockerHub                = "dockerhub"
-	Index                    = "index"
+	Catalog     ListSourceType = "catalog"
+	DockerHub                  = "dockerhub"
+	Index                      = "index"
+	V2                         = "v2"
+	Artifactory                = "artifactory"
+	Quay                       = "quay"
+	Harbor                     = "harbor"
+	GitLab                     = "gitlab"
 )
 
 //
 func (t ListSourceType) IsValid() bool {
-	switch t {
-	case Catalog, DockerHub, Index:
-		return true
-	}
-	return false
+	return factory(t) != nil
 }
 
-//
+// ListSource lists the repositories of a registry. Requests made by its
+// methods are canceled when the passed context is done.
 type ListSource interface {
-	Ping() error
-	Retrieve(maxItems int) ([]string, error)
+	Ping(ctx context.Context) error
+	Retrieve(ctx context.Context, maxItems int) ([]string, error)
+}
+
+// StreamListSource is implemented by list sources that can send repositories
+// to out while they are still being listed, instead of returning them all at
+// once. out is not closed when done.
+type StreamListSource interface {
+	RetrieveStream(ctx context.Context, maxItems int, out chan<- string) error
+}
+
+// TagListSource is implemented by list sources that can also list the tags of
+// a repository natively, typically providing push times along with the tags.
+type TagListSource interface {
+	ListTags(ctx context.Context, repo string) ([]tags.Tag, error)
+}
+
+// TimedTagListSource is implemented by list sources whose native tag listing
+// does not provide push times, but which can determine them with extra
+// requests, e.g. from the creation time in the image config. Push times are
+// left empty for tags where this is not possible.
+type TimedTagListSource interface {
+	ListTagsWithTimes(ctx context.Context, repo string) ([]tags.Tag, error)
+}
+
+// ResourceTagSource is implemented by list sources that can tell the resource
+// tags of a repository, as used by cloud providers for labeling resources,
+// which are not related to image tags.
+type ResourceTagSource interface {
+	ResourceTags(ctx context.Context, repo string) (map[string]string, error)
+}
+
+// LifecycleSource is implemented by list sources that can tell which tags of a
+// repository its lifecycle policy would expire.
+type LifecycleSource interface {
+	ExpiringTags(ctx context.Context, repo string) ([]string, error)
+}
+
+// ErrPushTimeUnknown is returned when checking repository activity, if the
+// repository contains images, but none of them has a known push time.
+var ErrPushTimeUnknown = errors.New("push time not known for any image")
+
+// ActivitySource is implemented by list sources that can tell when an image
+// was last pushed to a repository.
+type ActivitySource interface {
+	LastPushed(ctx context.Context, repo string) (time.Time, error)
 }
 
 //
-func NewRepoList(registry string, insecure bool, typ ListSourceType,
-	config map[string]string, creds *auth.Credentials) (*RepoList, error) {
+func NewRepoList(registry string, transport *http.Transport,
+	typ ListSourceType, config map[string]string, creds *auth.Credentials,
+	role *auth.AWSRole) (*RepoList, error) {
 
 	list := &RepoList{registry: registry}
 	server := strings.SplitN(registry, ":", 2)[0]
@@ -81,37 +132,25 @@ func NewRepoList(registry string, insecure bool, typ ListSourceType,
 		}
 	}
 
-	switch typ {
-
-	case DockerHub:
-		list.source = newDockerhub(listCreds)
-
-	case Index:
-		if filter, ok := config["search"]; ok && filter != "" {
-			list.source = newIndex(registry, filter, insecure, listCreds)
-		} else {
-			return nil, fmt.Errorf("index lister requires a search expression")
-		}
-
-	case Catalog, "":
-		isECR, region, account := IsECR(registry)
-		if isECR {
-			// catalog can be used with ECR, but pagination doesn't work; it
-			// requires an extra `NextToken` parameter which is not standard
-			// and therefore not supported by the go-containerregistry remote
-			// lib; if the registry is ECR we therefore use a dedicated ECR
-			// lister based on the AWS Go SDK
-			log.Info("using dedicated ECR lister instead of standard catalog")
-			list.source = newECR(registry, region, account)
-		} else {
-			list.source = newCatalog(registry, insecure,
-				strings.HasSuffix(server, ".gcr.io"), listCreds)
-		}
-
-	default:
+	if typ == "" {
+		typ = Catalog
+	}
+	f := factory(typ)
+	if f == nil {
 		return nil, fmt.Errorf("invalid list source type '%s'", typ)
 	}
 
+	var err error
+	if list.source, err = f(&ListSourceConfig{
+		Registry:  registry,
+		Transport: transport,
+		Settings:  config,
+		Creds:     listCreds,
+		Role:      role,
+	}); err != nil {
+		return nil, err
+	}
+
 	list.SetMaxItems(defaultListerMaxItems)
 	list.SetCacheDuration(defaultListerCacheDuration)
 
@@ -157,7 +196,7 @@ func (l *RepoList) cacheList(repos []string) {
 }
 
 //
-func (l *RepoList) Get() ([]string, error) {
+func (l *RepoList) Get(ctx context.Context) ([]string, error) {
 
 	if l.isCacheValid() {
 		log.Debug("repository list still valid, re-using")
@@ -167,10 +206,186 @@ func (l *RepoList) Get() ([]string, error) {
 	l.repos = nil
 	log.Debug("retrieving repository list")
 
-	if ret, err := l.source.Retrieve(l.maxItems); err != nil {
+	if ret, err := l.source.Retrieve(ctx, l.maxItems); err != nil {
 		return nil, err
 	} else {
 		l.cacheList(ret)
 		return ret, nil
 	}
 }
+
+// Stream sends the repositories of this list to out. If the list source
+// supports streaming, repositories are sent while they are being retrieved.
+// Otherwise, or when the cached list is still valid, the complete list is
+// retrieved first. out is not closed when done.
+func (l *RepoList) Stream(ctx context.Context, out chan<- string) error {
+
+	s, ok := l.source.(StreamListSource)
+	if !ok || l.isCacheValid() {
+		repos, err := l.Get(ctx)
+		if err != nil {
+			return err
+		}
+		for _, r := range repos {
+			out <- r
+		}
+		return nil
+	}
+
+	l.repos = nil
+	log.Debug("streaming repository list")
+
+	// only keep the complete list if it's going to be cached
+	var repos []string
+	if err := drain(func(c chan<- string) error {
+		return s.RetrieveStream(ctx, l.maxItems, c)
+	}, func(repo string) {
+		if l.cacheDuration > 0 {
+			repos = append(repos, repo)
+		}
+		out <- repo
+	}); err != nil {
+		return err
+	}
+
+	l.cacheList(repos)
+	return nil
+}
+
+// drain runs stream, and calls fn for each repository sent by it, until stream
+// is done.
+func drain(stream func(out chan<- string) error, fn func(repo string)) error {
+
+	c := make(chan string)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- stream(c)
+		close(c)
+	}()
+
+	for repo := range c {
+		fn(repo)
+	}
+	return <-done
+}
+
+// Ping checks that the list source of this repo list can be accessed. Errors
+// are returned as PingError.
+func (l *RepoList) Ping(ctx context.Context) error {
+	return newPingError(l.source.Ping(ctx))
+}
+
+// CanListTags determines whether the list source of this repo list supports
+// native tag listing.
+func (l *RepoList) CanListTags() bool {
+	_, ok := l.source.(TagListSource)
+	return ok
+}
+
+// CanCheckActivity determines whether the list source of this repo list can
+// tell when an image was last pushed to a repository.
+func (l *RepoList) CanCheckActivity() bool {
+	switch l.source.(type) {
+	case ActivitySource, TimedTagListSource, TagListSource:
+		return true
+	}
+	return false
+}
+
+// CanListResourceTags determines whether the list source of this repo list can
+// tell the resource tags of a repository.
+func (l *RepoList) CanListResourceTags() bool {
+	_, ok := l.source.(ResourceTagSource)
+	return ok
+}
+
+// ResourceTags returns the resource tags of repository repo, as reported by
+// the list source.
+func (l *RepoList) ResourceTags(ctx context.Context, repo string) (
+	map[string]string, error) {
+	src, ok := l.source.(ResourceTagSource)
+	if !ok {
+		return nil, fmt.Errorf(
+			"list source does not support listing resource tags")
+	}
+	log.WithField("repo", repo).Debug("retrieving resource tags")
+	return src.ResourceTags(ctx, strings.TrimPrefix(repo, "/"))
+}
+
+// CanPreviewLifecycle determines whether the list source of this repo list can
+// tell which tags the lifecycle policy of a repository would expire.
+func (l *RepoList) CanPreviewLifecycle() bool {
+	_, ok := l.source.(LifecycleSource)
+	return ok
+}
+
+// ExpiringTags returns the tags of repository repo which its lifecycle policy
+// would expire, as reported by the list source.
+func (l *RepoList) ExpiringTags(ctx context.Context, repo string) (
+	[]string, error) {
+	src, ok := l.source.(LifecycleSource)
+	if !ok {
+		return nil, fmt.Errorf(
+			"list source does not support lifecycle policy previews")
+	}
+	log.WithField("repo", repo).Debug("previewing lifecycle policy")
+	return src.ExpiringTags(ctx, strings.TrimPrefix(repo, "/"))
+}
+
+// LastPushed returns the time an image was last pushed to repository repo, as
+// reported by the list source, or as determined from its timed tag list. If
+// the repository contains no images, the zero time is returned. If it does,
+// but no push time is known, ErrPushTimeUnknown is returned.
+func (l *RepoList) LastPushed(ctx context.Context, repo string) (
+	time.Time, error) {
+
+	log.WithField("repo", repo).Debug("retrieving last push time")
+	repo = strings.TrimPrefix(repo, "/")
+
+	switch src := l.source.(type) {
+	case ActivitySource:
+		return src.LastPushed(ctx, repo)
+	case TimedTagListSource:
+		list, err := src.ListTagsWithTimes(ctx, repo)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return lastCreated(list)
+	case TagListSource:
+		// without push times, this can only tell whether there are any tags
+		list, err := src.ListTags(ctx, repo)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return lastCreated(list)
+	}
+
+	return time.Time{}, fmt.Errorf(
+		"list source does not support checking repository activity")
+}
+
+// ListTags lists the tags of repository repo from the list source. Contrary to
+// the repository list, tag lists are not cached.
+func (l *RepoList) ListTags(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+	src, ok := l.source.(TagListSource)
+	if !ok {
+		return nil, fmt.Errorf("list source does not support listing tags")
+	}
+	log.WithField("repo", repo).Debug("retrieving tag list")
+	return src.ListTags(ctx, strings.TrimPrefix(repo, "/"))
+}
+
+// ListTimedTags lists the tags of repository repo like ListTags, but makes
+// sure push times are included where the list source can provide them, even
+// if that needs extra requests.
+func (l *RepoList) ListTimedTags(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+	src, ok := l.source.(TimedTagListSource)
+	if !ok {
+		return l.ListTags(ctx, repo)
+	}
+	log.WithField("repo", repo).Debug("retrieving tag list with push times")
+	return src.ListTagsWithTimes(ctx, strings.TrimPrefix(repo, "/"))
+}
@@ -0,0 +1,126 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// fakeTagSource is a list source that can only list tags, for repositories
+// given as map keys
+type fakeTagSource struct {
+	ListSource
+	repos map[string][]tags.Tag
+}
+
+//
+func (f *fakeTagSource) ListTags(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+	return f.repos[repo], nil
+}
+
+//
+func TestRepoListLastPushed(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	pushed := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	l := &RepoList{source: &fakeTagSource{repos: map[string][]tags.Tag{
+		"timed":   {{Name: "1.0", Pushed: pushed}, {Name: "0.9"}},
+		"untimed": {{Name: "1.0"}},
+	}}}
+	th.AssertTrue(l.CanCheckActivity())
+
+	last, err := l.LastPushed(ctx, "/timed")
+	th.AssertNoError(err)
+	th.AssertTrue(pushed.Equal(last))
+
+	// tags without push times tell that there are images
+	_, err = l.LastPushed(ctx, "untimed")
+	th.AssertTrue(errors.Is(err, ErrPushTimeUnknown))
+
+	// no tags at all
+	last, err = l.LastPushed(ctx, "empty")
+	th.AssertNoError(err)
+	th.AssertTrue(last.IsZero())
+
+	l = &RepoList{source: &index{}}
+	th.AssertFalse(l.CanCheckActivity())
+}
+
+// fixedSource is a list source returning a fixed list of repositories
+type fixedSource struct {
+	repos []string
+}
+
+//
+func (f *fixedSource) Ping(ctx context.Context) error { return nil }
+
+//
+func (f *fixedSource) Retrieve(ctx context.Context, maxItems int) (
+	[]string, error) {
+	return f.repos, nil
+}
+
+//
+func TestRegister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var got *ListSourceConfig
+	Register("fixed", func(conf *ListSourceConfig) (ListSource, error) {
+		got = conf
+		if conf.Settings["fail"] != "" {
+			return nil, errors.New("cannot create fixed list source")
+		}
+		return &fixedSource{repos: []string{conf.Registry + "/app"}}, nil
+	})
+
+	th.AssertTrue(ListSourceType("fixed").IsValid())
+	th.AssertTrue(ListSourceType(V2).IsValid())
+	th.AssertFalse(ListSourceType("unknown").IsValid())
+
+	l, err := NewRepoList("registry.example.com", nil, "fixed",
+		map[string]string{"type": "fixed"}, nil, nil)
+	th.AssertNoError(err)
+	th.AssertEqual("fixed", got.Settings["type"])
+	repos, err := l.Get(context.Background())
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"registry.example.com/app"}, repos)
+
+	_, err = NewRepoList("registry.example.com", nil, "fixed",
+		map[string]string{"fail": "true"}, nil, nil)
+	th.AssertError(err, "cannot create fixed list source")
+
+	_, err = NewRepoList("registry.example.com", nil, "unknown", nil, nil,
+		nil)
+	th.AssertError(err, "invalid list source type 'unknown'")
+
+	// types can only be registered once
+	defer func() { th.AssertNotNil(recover()) }()
+	Register(V2, func(conf *ListSourceConfig) (ListSource, error) {
+		return nil, nil
+	})
+}
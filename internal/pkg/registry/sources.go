@@ -0,0 +1,74 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	gosync "sync"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+)
+
+// ListSourceConfig holds what a factory needs for creating a list source.
+type ListSourceConfig struct {
+	Registry  string
+	Transport *http.Transport
+	// settings of the `lister` item of the source, including `type`
+	Settings map[string]string
+	// credentials for listing, which for DockerHub are separate from those
+	// used for pulling and pushing
+	Creds *auth.Credentials
+	Role  *auth.AWSRole
+}
+
+// ListSourceFactory creates a list source from conf.
+type ListSourceFactory func(conf *ListSourceConfig) (ListSource, error)
+
+var (
+	factoriesMu gosync.RWMutex
+	factories   = map[ListSourceType]ListSourceFactory{}
+)
+
+// Register makes list sources created by factory available as lister type
+// typ. The built-in list sources are registered in the same way. Register is
+// meant to be called from init functions, and panics if typ is empty or
+// already registered, or if factory is nil.
+func Register(typ ListSourceType, factory ListSourceFactory) {
+
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if typ == "" {
+		panic("list source type must not be empty")
+	}
+	if factory == nil {
+		panic(fmt.Sprintf("factory for list source type '%s' is nil", typ))
+	}
+	if _, dup := factories[typ]; dup {
+		panic(fmt.Sprintf("list source type '%s' registered twice", typ))
+	}
+	factories[typ] = factory
+}
+
+// factory returns the factory registered for lister type typ, or nil if there
+// is none.
+func factory(typ ListSourceType) ListSourceFactory {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	return factories[typ]
+}
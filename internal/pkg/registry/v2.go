@@ -0,0 +1,219 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	gocrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+)
+
+//
+func init() {
+	Register(V2, func(conf *ListSourceConfig) (ListSource, error) {
+		pageSize := 0
+		if ps := conf.Settings["page-size"]; ps != "" {
+			var err error
+			if pageSize, err = strconv.Atoi(ps); err != nil || pageSize < 1 {
+				return nil, fmt.Errorf(
+					"invalid page size for v2 lister: %s", ps)
+			}
+		}
+		return newV2(conf.Registry, conf.Transport, pageSize, conf.Creds), nil
+	})
+}
+
+// newV2 creates a generic list source for registries implementing the
+// registry v2 API, such as plain `registry:2`, Harbor, or Nexus. The catalog
+// is paginated via `Link` header, requesting pageSize items per page, or a
+// default if pageSize is <= 0. Authentication is negotiated based on the
+// `Www-Authenticate` challenge returned by the registry, i.e. credentials are
+// either used directly for basic auth, or for obtaining a bearer token from
+// the token service named in the challenge. When creds are empty, access is
+// anonymous.
+func newV2(registry string, transport *http.Transport, pageSize int,
+	creds *auth.Credentials) ListSource {
+	return &v2{
+		registry:  registry,
+		transport: transport,
+		pageSize:  pageSize,
+		creds:     creds,
+	}
+}
+
+//
+type v2 struct {
+	registry  string
+	transport *http.Transport
+	pageSize  int
+	creds     *auth.Credentials
+}
+
+//
+func (v *v2) Retrieve(ctx context.Context, maxItems int) ([]string, error) {
+
+	log.Debug("v2 retrieving image list")
+
+	reg, err := registryName(v.registry)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := v.authenticator()
+	if err != nil {
+		return nil, err
+	}
+
+	return catalogFollowingLinks(ctx,
+		reg, maxItems, v.pageSize, auth, v.transport)
+}
+
+//
+func (v *v2) ListTags(ctx context.Context, repo string) ([]tags.Tag, error) {
+	auth, err := v.authenticator()
+	if err != nil {
+		return nil, err
+	}
+	return listTagsV2(v.registry, repo,
+		remoteOptions(ctx, auth, v.transport))
+}
+
+// ListTagsWithTimes lists the tags of repository repo, taking the creation
+// times of the tagged images as push times.
+func (v *v2) ListTagsWithTimes(ctx context.Context, repo string) (
+	[]tags.Tag, error) {
+	auth, err := v.authenticator()
+	if err != nil {
+		return nil, err
+	}
+	return listTagsWithCreated(v.registry, repo,
+		remoteOptions(ctx, auth, v.transport))
+}
+
+//
+func (v *v2) Ping(ctx context.Context) error {
+
+	reg, err := registryName(v.registry)
+	if err != nil {
+		return err
+	}
+
+	auth, err := v.authenticator()
+	if err != nil {
+		return err
+	}
+
+	return pingV2(ctx, reg, auth, v.transport)
+}
+
+//
+func (v *v2) authenticator() (gocrauthn.Authenticator, error) {
+	return credsAuthenticator(v.creds)
+}
+
+// credsAuthenticator returns a basic authenticator for creds, after refreshing
+// them. Without user name and password, a bearer token in creds is used as the
+// registry token. When there are no credentials, the anonymous authenticator is
+// used.
+func credsAuthenticator(creds *auth.Credentials) (
+	gocrauthn.Authenticator, error) {
+
+	if creds == nil {
+		return gocrauthn.Anonymous, nil
+	}
+
+	if err := creds.Refresh(); err != nil {
+		return nil, fmt.Errorf("error refreshing credentials: %v", err)
+	}
+
+	if creds.Username() == "" && creds.Password() == "" {
+		if t := creds.BearerToken(); t != "" {
+			return &gocrauthn.Bearer{Token: t}, nil
+		}
+		return gocrauthn.Anonymous, nil
+	}
+
+	return &gocrauthn.Basic{
+		Username: creds.Username(),
+		Password: creds.Password(),
+	}, nil
+}
+
+//
+func registryName(registry string) (gocrname.Registry, error) {
+	reg, err := gocrname.NewRegistry(registry)
+	if err != nil {
+		return reg, fmt.Errorf("invalid registry: %v", err)
+	}
+	return reg, nil
+}
+
+// Ping checks that the v2 API of registry accepts creds. For registries using
+// token authentication, this includes getting a token. The request is canceled
+// when ctx is done. Errors are returned as PingError.
+func Ping(ctx context.Context, registry string, creds *auth.Credentials,
+	transport *http.Transport) error {
+
+	reg, err := registryName(registry)
+	if err != nil {
+		return err
+	}
+
+	auth, err := credsAuthenticator(creds)
+	if err != nil {
+		return err
+	}
+
+	return newPingError(pingV2(ctx, reg, auth, transport))
+}
+
+// pingV2 checks access to the v2 API base endpoint of reg. The transport
+// used here takes care of the auth challenge, so a successful ping means
+// that the credentials in auth are accepted.
+func pingV2(ctx context.Context, reg gocrname.Registry,
+	auth gocrauthn.Authenticator, transport *http.Transport) error {
+
+	tr, err := gocrtransport.New(reg, auth, baseTransport(transport),
+		[]string{reg.Scope(gocrtransport.PullScope)})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s://%s/v2/", reg.Scheme(), reg.RegistryStr()), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return gocrtransport.CheckError(resp, http.StatusOK)
+}
@@ -0,0 +1,345 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+type v2Server struct {
+	*httptest.Server
+	bearer   bool
+	catalog  []string
+	pageSize []string
+}
+
+// newV2Server creates a test registry which requires user `alex` with password
+// `secret`, either directly via basic auth, or for obtaining a bearer token.
+func newV2Server(bearer bool, catalog []string) *v2Server {
+
+	s := &v2Server{bearer: bearer, catalog: catalog}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+//
+func (s *v2Server) handle(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path == "/token" {
+		if u, p, ok := r.BasicAuth(); !ok || u != "alex" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "t0k3n"})
+		return
+	}
+
+	if !s.authorized(r) {
+		if s.bearer {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(
+				`Bearer realm="%s/token",service="test"`, s.URL))
+		} else {
+			w.Header().Set("Www-Authenticate", `Basic realm="test"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+
+	case r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+
+	case r.URL.Path == "/v2/_catalog":
+		s.pageSize = append(s.pageSize, r.URL.Query().Get("n"))
+		var n, start int
+		fmt.Sscan(r.URL.Query().Get("n"), &n)
+		fmt.Sscan(r.URL.Query().Get("start"), &start)
+		end := start + n
+		if end < len(s.catalog) {
+			// relative link, as returned by most registries
+			w.Header().Set("Link", fmt.Sprintf(
+				`</v2/_catalog?n=%d&start=%d>; rel="next"`, n, end))
+		} else {
+			end = len(s.catalog)
+		}
+		json.NewEncoder(w).Encode(
+			map[string][]string{"repositories": s.catalog[start:end]})
+
+	case strings.HasSuffix(r.URL.Path, "/tags/list"):
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name": strings.TrimSuffix(
+				strings.TrimPrefix(r.URL.Path, "/v2/"), "/tags/list"),
+			"tags": []string{"1.0", "latest"}})
+
+	case strings.Contains(r.URL.Path, "/manifests/"):
+		conf := imageConfigs[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+		w.Header().Set("Content-Type", manifestMediaType)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     manifestMediaType,
+			"config": map[string]interface{}{
+				"mediaType": "application/vnd.docker.container.image.v1+json",
+				"size":      len(conf),
+				"digest":    configDigest(conf),
+			},
+			"layers": []interface{}{},
+		})
+
+	case strings.Contains(r.URL.Path, "/blobs/"):
+		for _, conf := range imageConfigs {
+			if strings.HasSuffix(r.URL.Path, configDigest(conf)) {
+				w.Write([]byte(conf))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+//
+const manifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+
+// imageConfigs holds the config blobs of the images served by the test
+// registry, by tag
+var imageConfigs = map[string]string{
+	"1.0":    `{"created":"2021-03-04T05:06:07Z","architecture":"amd64"}`,
+	"latest": `{"architecture":"amd64"}`,
+}
+
+//
+func configDigest(conf string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(conf)))
+}
+
+//
+func (s *v2Server) authorized(r *http.Request) bool {
+	if s.bearer {
+		return r.Header.Get("Authorization") == "Bearer t0k3n"
+	}
+	u, p, ok := r.BasicAuth()
+	return ok && u == "alex" && p == "secret"
+}
+
+//
+func (s *v2Server) registry() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+//
+func TestV2Lister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	repos := []string{"a/one", "a/two", "b/three", "b/four", "c/five"}
+
+	for _, bearer := range []bool{false, true} {
+
+		srv := newV2Server(bearer, repos)
+		defer srv.Close()
+
+		creds, err := auth.NewCredentialsFromBasic("alex", "secret")
+		th.AssertNoError(err)
+		src := newV2(srv.registry(), nil, 2, creds).(TagListSource)
+		v := src.(ListSource)
+
+		th.AssertNoError(v.Ping(ctx))
+		th.AssertNoError(Ping(ctx, srv.registry(), creds, nil))
+		th.AssertNoError(newCatalog(srv.registry(), nil, creds).Ping(ctx))
+
+		list, err := v.Retrieve(ctx, -1)
+		th.AssertNoError(err)
+		th.AssertEqualSlices(repos, list)
+		th.AssertEqualSlices([]string{"2", "2", "2"}, srv.pageSize)
+
+		tags, err := src.ListTags(ctx, "a/one")
+		th.AssertNoError(err)
+		th.AssertEqual(2, len(tags))
+		th.AssertEqual("1.0", tags[0].Name)
+		th.AssertEqual("latest", tags[1].Name)
+		th.AssertTrue(tags[0].Pushed.IsZero())
+
+		// push times from image config, if available
+		tags, err = v.(TimedTagListSource).ListTagsWithTimes(ctx, "a/one")
+		th.AssertNoError(err)
+		th.AssertEqual(2, len(tags))
+		th.AssertEqual(
+			time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), tags[0].Pushed.UTC())
+		th.AssertTrue(tags[1].Pushed.IsZero())
+
+		// page size does not exceed max items, and retrieval stops once
+		// max items are exceeded
+		srv.pageSize = nil
+		list, err = newV2(srv.registry(), nil, 0, creds).Retrieve(ctx, 1)
+		th.AssertNoError(err)
+		th.AssertEqualSlices([]string{"a/one", "a/two"}, list)
+		th.AssertEqualSlices([]string{"1", "1"}, srv.pageSize)
+
+		// canceled requests
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = v.Retrieve(canceled, -1)
+		th.AssertError(err, "context canceled")
+
+		// wrong credentials
+		creds, err = auth.NewCredentialsFromBasic("alex", "wrong")
+		th.AssertNoError(err)
+		th.AssertNotNil(newV2(srv.registry(), nil, 0, creds).Ping(ctx))
+		err = Ping(ctx, srv.registry(), creds, nil)
+		th.AssertNotNil(err)
+		th.AssertEqual(FailureAuth, FailureOf(err))
+		_, err = newV2(srv.registry(), nil, 0, creds).Retrieve(ctx, -1)
+		th.AssertNotNil(err)
+	}
+}
+
+//
+func TestV2ListerBearerToken(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+
+	repos := []string{"a/one", "b/two"}
+	srv := newV2Server(true, repos)
+	defer srv.Close()
+
+	// a token is sent as is, without negotiating one with user and password
+	creds, err := auth.NewCredentialsFromToken("t0k3n")
+	th.AssertNoError(err)
+	src := newV2(srv.registry(), nil, 0, creds).(TagListSource)
+
+	th.AssertNoError(src.(ListSource).Ping(ctx))
+	th.AssertNoError(newCatalog(srv.registry(), nil, creds).Ping(ctx))
+
+	list, err := src.(ListSource).Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(repos, list)
+
+	tags, err := src.ListTags(ctx, "a/one")
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(tags))
+
+	// token obtained from a command
+	creds = &auth.Credentials{}
+	creds.SetRefresher(auth.NewCommandAuthRefresher(
+		[]string{"echo", "t0k3n"}, 0))
+	list, err = newV2(srv.registry(), nil, 0, creds).Retrieve(ctx, -1)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(repos, list)
+
+	creds, err = auth.NewCredentialsFromToken("wrong")
+	th.AssertNoError(err)
+	_, err = newV2(srv.registry(), nil, 0, creds).Retrieve(ctx, -1)
+	th.AssertNotNil(err)
+}
+
+//
+func TestLastCreated(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	t1 := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	last, err := lastCreated(nil)
+	th.AssertNoError(err)
+	th.AssertTrue(last.IsZero())
+
+	last, err = lastCreated([]tags.Tag{{Name: "a", Pushed: t2},
+		{Name: "b"}, {Name: "c", Pushed: t1}})
+	th.AssertNoError(err)
+	th.AssertEqual(t2, last)
+
+	_, err = lastCreated([]tags.Tag{{Name: "a"}, {Name: "b"}})
+	th.AssertEqual(ErrPushTimeUnknown, err)
+}
+
+//
+func TestNextPageURL(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	req, err := url.Parse("https://registry.acme.com/v2/_catalog?n=10")
+	th.AssertNoError(err)
+
+	try := func(link string) (string, error) {
+		resp := &http.Response{
+			Header:  http.Header{},
+			Request: &http.Request{URL: req},
+		}
+		if link != "" {
+			resp.Header.Set("Link", link)
+		}
+		next, err := nextPageURL(resp)
+		if next == nil {
+			return "", err
+		}
+		return next.String(), err
+	}
+
+	next, err := try("")
+	th.AssertNoError(err)
+	th.AssertEqual("", next)
+
+	next, err = try(`</v2/_catalog?last=b&n=10>; rel="next"`)
+	th.AssertNoError(err)
+	th.AssertEqual("https://registry.acme.com/v2/_catalog?last=b&n=10", next)
+
+	next, err = try(`<https://other.acme.com/v2/_catalog?last=b>; rel="next"`)
+	th.AssertNoError(err)
+	th.AssertEqual("https://other.acme.com/v2/_catalog?last=b", next)
+
+	// several links, only next is used
+	next, err = try(`<https://api.acme.com/p?page=1>; rel="prev", ` +
+		`<https://api.acme.com/p?page=3>; rel="next", ` +
+		`<https://api.acme.com/p?page=5>; rel="last"`)
+	th.AssertNoError(err)
+	th.AssertEqual("https://api.acme.com/p?page=3", next)
+
+	next, err = try(`<https://api.acme.com/p?page=1>; rel="prev", ` +
+		`<https://api.acme.com/p?page=1>; rel="first"`)
+	th.AssertNoError(err)
+	th.AssertEqual("", next)
+
+	next, err = try(`</v2/_catalog?last=b>`)
+	th.AssertNoError(err)
+	th.AssertEqual("https://registry.acme.com/v2/_catalog?last=b", next)
+
+	_, err = try(`/v2/_catalog?last=b; rel="next"`)
+	th.AssertError(err, "malformed Link header")
+
+	_, err = try(`</v2/_catalog?last=b; rel="next"`)
+	th.AssertError(err, "malformed Link header")
+}
@@ -0,0 +1,341 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/relays"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+const RelayID = "containerd"
+
+//
+type RelayConfig struct {
+	Binary    string `yaml:"binary"`
+	Address   string `yaml:"address"`
+	Namespace string `yaml:"namespace"`
+}
+
+//
+type Support struct{}
+
+//
+func (s *Support) Platform(p string) error {
+	return nil
+}
+
+//
+func (s *Support) Platforms(p []string) error {
+	if len(p) > 0 {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'platforms'", RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) CopySignatures(c bool) error {
+	if c {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'copy-signatures'",
+			RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) Digest(digest, tag string) error {
+	// images can only be pushed by tag
+	if digest != "" && tag == "" {
+		return fmt.Errorf(
+			"relay '%s' requires 'digest-tag' for mappings with a digest in "+
+				"'from'", RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) SkipExisting(e bool) error {
+	if e {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'skip-existing'",
+			RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) Verify(v bool) error {
+	if v {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'verify'", RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) PreserveDigests(p bool) error {
+	return nil
+}
+
+//
+func (s *Support) LocalSource(l bool) error {
+	if l {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with a local 'from'",
+			RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) TagConcurrency(n int) error {
+	return nil
+}
+
+//
+func (s *Support) ArtifactTypes(t []string) error {
+	return nil
+}
+
+//
+func (s *Support) SkipImmutable(sk bool) error {
+	return nil
+}
+
+//
+func (s *Support) TagRoutes(r bool) error {
+	return nil
+}
+
+//
+func (s *Support) ArchiveTarget(a bool) error {
+	if a {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with object storage in 'to'",
+			RelayID)
+	}
+	return nil
+}
+
+// Compression only accepts keeping layers as they are, since containerd pushes
+// the blobs it pulled without recompressing them.
+func (s *Support) Compression(c string) error {
+	if c != "" && c != "keep" {
+		return fmt.Errorf("relay '%s' does not support 'compression' '%s', "+
+			"only 'keep'", RelayID, c)
+	}
+	return nil
+}
+
+//
+type ContainerdRelay struct {
+	client *ctrClient
+}
+
+//
+func NewContainerdRelay(conf *RelayConfig, out io.Writer) *ContainerdRelay {
+	return &ContainerdRelay{client: newCtrClient(conf, out)}
+}
+
+//
+func (r *ContainerdRelay) Prepare() error {
+
+	bufOut := new(bytes.Buffer)
+	c := *r.client
+	c.wrOut = bufOut
+	// `version` also contacts the daemon, so this checks connectivity
+	if err := c.run(context.Background(), true, "version"); err != nil {
+		return fmt.Errorf("cannot execute ctr: %v", err)
+	}
+
+	log.Info(bufOut.String())
+	log.WithField("relay", RelayID).Info("relay ready")
+
+	return nil
+}
+
+//
+func (r *ContainerdRelay) Dispose() error {
+	return nil
+}
+
+//
+func (r *ContainerdRelay) Sync(opt *relays.SyncOptions) error {
+
+	logger := opt.Logger()
+
+	srcCreds := util.DecodeJSONAuth(opt.SrcAuth)
+	destCreds := util.DecodeJSONAuth(opt.TrgtAuth)
+
+	if opt.Digest != "" {
+		return opt.WithSlot(func() error {
+			return r.syncPinned(srcCreds, destCreds, opt, logger)
+		})
+	}
+
+	tags, err := opt.Tags.Expand(opt.Lister(func() ([]string, error) {
+		return listAllTags(
+			opt.Ctx(), opt.SrcRef, srcCreds, opt.SrcSkipTLSVerify)
+	}))
+
+	if err != nil {
+		return fmt.Errorf("error expanding tags: %v", err)
+	}
+
+	var platforms []string
+	if opt.Platform != "" {
+		platforms = []string{opt.Platform}
+	} else if opt.CheckDigest != nil {
+		// digests can only be kept when pushing all platforms
+		platforms = []string{"all"}
+	}
+
+	errs := opt.EachTag(tags, func(t string) error {
+
+		tlog := logger.WithField("tag", t)
+
+		trgtTag, err := opt.TargetTag(t)
+		if err != nil {
+			tlog.Error(err)
+			return err
+		}
+
+		src := fmt.Sprintf("%s:%s", opt.SrcRef, t)
+		trgt := fmt.Sprintf("%s:%s", opt.TrgtRef, trgtTag)
+
+		if skip, err := opt.LacksArtifactType(src); err != nil {
+			tlog.Error(err)
+			return err
+		} else if skip {
+			tlog.Info("source artifact type not selected, skipping")
+			return nil
+		}
+
+		if skip, err := opt.LacksManifestType(src); err != nil {
+			tlog.Error(err)
+			return err
+		} else if skip {
+			tlog.Debug("source manifest type not selected, skipping")
+			return nil
+		}
+
+		if skip, err := opt.LacksMetadata(src); err != nil {
+			tlog.Error(err)
+			return err
+		} else if skip {
+			tlog.Info("source labels or annotations not matched, skipping")
+			return nil
+		}
+
+		if skip, err := opt.LacksPlatforms(src); err != nil {
+			tlog.Error(err)
+			return err
+		} else if skip {
+			tlog.Warn("source image lacks selected platforms, skipping")
+			return nil
+		}
+
+		tlog.WithField("platform", opt.Platform).Info("syncing tag")
+
+		err = opt.Attempt(func() error {
+			return r.syncTag(src, srcCreds, trgt, destCreds, platforms, opt)
+		})
+		if opt.SkipsImmutable(err) {
+			tlog.Info("target tag exists and is immutable, skipping")
+			err = nil
+		} else if err != nil {
+			tlog.Error(err)
+		}
+
+		if err := r.client.removeImages(src, trgt); err != nil {
+			tlog.Debugf("error removing images from containerd: %v", err)
+		}
+		return err
+	})
+
+	if len(errs) > 0 {
+		return fmt.Errorf("errors during sync: %w", errs)
+	}
+
+	return nil
+}
+
+// syncPinned syncs the source image pinned to a digest, with all platforms,
+// and pushes it under the digest tag.
+func (r *ContainerdRelay) syncPinned(srcCreds, destCreds string,
+	opt *relays.SyncOptions, logger *log.Entry) error {
+
+	src, trgt := opt.PinnedRefs()
+	dlog := logger.WithField("digest", opt.Digest)
+	dlog.WithField("tag", opt.DigestTag).Info("syncing digest")
+
+	err := opt.Attempt(func() error {
+		return r.syncTag(src, srcCreds, trgt, destCreds, []string{"all"}, opt)
+	})
+
+	if err := r.client.removeImages(src, trgt); err != nil {
+		dlog.Debugf("error removing images from containerd: %v", err)
+	}
+
+	if opt.SkipsImmutable(err) {
+		dlog.Info("target tag exists and is immutable, skipping")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error during sync: %v", err)
+	}
+	return nil
+}
+
+// syncTag pulls image src into containerd, tags it as trgt, and pushes it.
+func (r *ContainerdRelay) syncTag(src, srcCreds, trgt, destCreds string,
+	platforms []string, opt *relays.SyncOptions) error {
+
+	started := time.Now()
+
+	if err := r.client.pullImage(opt.Ctx(), src, srcCreds, platforms,
+		opt.SrcSkipTLSVerify, opt.Verbose); err != nil {
+		return fmt.Errorf("error pulling source image '%s': %v", src, err)
+	}
+
+	if err := r.client.tagImage(opt.Ctx(), src, trgt); err != nil {
+		return fmt.Errorf("error tagging image '%s': %v", trgt, err)
+	}
+
+	if err := r.client.pushImage(opt.Ctx(), trgt, destCreds, opt.Platform,
+		opt.TrgtSkipTLSVerify, opt.Verbose); err != nil {
+		return fmt.Errorf("error pushing target image '%s': %v", trgt, err)
+	}
+
+	if opt.CheckDigest != nil {
+		if err := opt.CheckDigest(src, trgt); err != nil {
+			return err
+		}
+	}
+
+	opt.Copied(src, trgt, started)
+	return nil
+}
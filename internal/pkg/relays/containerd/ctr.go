@@ -0,0 +1,214 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	gocrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultCtrBinary = "ctr"
+const defaultAddress = "/run/containerd/containerd.sock"
+const defaultNamespace = "dregsy"
+
+// ctrClient runs containerd's `ctr` CLI against a containerd instance, in a
+// dedicated namespace
+type ctrClient struct {
+	binary    string
+	address   string
+	namespace string
+	wrOut     io.Writer
+}
+
+//
+func newCtrClient(conf *RelayConfig, out io.Writer) *ctrClient {
+
+	c := &ctrClient{
+		binary:    defaultCtrBinary,
+		address:   defaultAddress,
+		namespace: defaultNamespace,
+		wrOut:     out,
+	}
+
+	if conf != nil {
+		if conf.Binary != "" {
+			c.binary = conf.Binary
+		}
+		if conf.Address != "" {
+			c.address = conf.Address
+		}
+		if conf.Namespace != "" {
+			c.namespace = conf.Namespace
+		}
+	}
+
+	return c
+}
+
+//
+func (c *ctrClient) pullImage(ctx context.Context, ref, creds string,
+	platforms []string, skipTLSVerify, verbose bool) error {
+	return c.run(
+		ctx, verbose, pullArgs(ref, creds, platforms, skipTLSVerify)...)
+}
+
+//
+func (c *ctrClient) tagImage(ctx context.Context, src, trgt string) error {
+	return c.run(ctx, false, "images", "tag", "--force", src, trgt)
+}
+
+//
+func (c *ctrClient) pushImage(ctx context.Context, ref, creds, platform string,
+	skipTLSVerify, verbose bool) error {
+	return c.run(
+		ctx, verbose, pushArgs(ref, creds, platform, skipTLSVerify)...)
+}
+
+// removeImages removes the image references refs from the namespace, so that
+// their content can be garbage collected by containerd. This is not bound to
+// the context of a sync, so that clean up also happens for canceled syncs.
+func (c *ctrClient) removeImages(refs ...string) error {
+	return c.run(context.Background(), false,
+		append([]string{"images", "rm"}, refs...)...)
+}
+
+// pullArgs returns the `ctr` arguments for pulling ref. When platforms has a
+// single item `all`, all platforms are pulled. When platforms is empty, the
+// platform of the host is pulled.
+func pullArgs(ref, creds string, platforms []string,
+	skipTLSVerify bool) []string {
+
+	args := registryArgs([]string{"images", "pull"}, creds, skipTLSVerify)
+
+	if len(platforms) == 1 && platforms[0] == "all" {
+		args = append(args, "--all-platforms")
+	} else {
+		for _, p := range platforms {
+			args = append(args, fmt.Sprintf("--platform=%s", p))
+		}
+	}
+
+	return append(args, ref)
+}
+
+// pushArgs returns the `ctr` arguments for pushing ref. With platform set to
+// a single platform, only that platform image is pushed.
+func pushArgs(ref, creds, platform string, skipTLSVerify bool) []string {
+
+	args := registryArgs([]string{"images", "push"}, creds, skipTLSVerify)
+
+	if platform != "" && platform != "all" {
+		args = append(args, fmt.Sprintf("--platform=%s", platform))
+	}
+
+	return append(args, ref)
+}
+
+//
+func registryArgs(args []string, creds string, skipTLSVerify bool) []string {
+	if creds != "" {
+		args = append(args, fmt.Sprintf("--user=%s", creds))
+	}
+	if skipTLSVerify {
+		args = append(args, "--skip-verify")
+	}
+	return args
+}
+
+// run runs ctr with args. The ctr process is killed when ctx is done.
+func (c *ctrClient) run(ctx context.Context, verbose bool,
+	args ...string) error {
+
+	args = append([]string{
+		fmt.Sprintf("--address=%s", c.address),
+		fmt.Sprintf("--namespace=%s", c.namespace),
+	}, args...)
+
+	cmd := exec.CommandContext(ctx, c.binary, args...)
+
+	// error output is also captured, so that errors can be told apart
+	bufErr := new(bytes.Buffer)
+	cmd.Stdout = chooseOutStream(c.wrOut, verbose)
+	cmd.Stderr = io.MultiWriter(chooseOutStream(c.wrOut, verbose), bufErr)
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(bufErr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+
+	return nil
+}
+
+//
+func chooseOutStream(out io.Writer, verbose bool) io.Writer {
+	if verbose {
+		if out != nil {
+			return out
+		}
+		return log.StandardLogger().WriterLevel(log.InfoLevel)
+	}
+	return ioutil.Discard
+}
+
+// listAllTags lists the tags of repository ref via the registry API, since
+// `ctr` cannot list tags. creds are given as `user:password`.
+func listAllTags(ctx context.Context, ref, creds string, skipTLSVerify bool) (
+	[]string, error) {
+
+	repo, err := gocrname.NewRepository(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository '%s': %v", ref, err)
+	}
+
+	var auth gocrauthn.Authenticator = gocrauthn.Anonymous
+	if creds != "" {
+		user, pass := creds, ""
+		if ix := strings.Index(creds, ":"); ix >= 0 {
+			user, pass = creds[:ix], creds[ix+1:]
+		}
+		auth = &gocrauthn.Basic{Username: user, Password: pass}
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if skipTLSVerify {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	ret, err := gocrremote.List(repo,
+		gocrremote.WithAuth(auth), gocrremote.WithTransport(tr),
+		gocrremote.WithContext(ctx))
+	if err != nil {
+		return nil,
+			fmt.Errorf("error listing image tags for ref '%s': %v", ref, err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,74 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package containerd
+
+import (
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestPullArgs(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertEqualSlices(
+		[]string{"images", "pull", "reg/app:1.0"},
+		pullArgs("reg/app:1.0", "", nil, false))
+	th.AssertEqualSlices(
+		[]string{"images", "pull", "--user=alex:secret", "--skip-verify",
+			"--all-platforms", "reg/app:1.0"},
+		pullArgs("reg/app:1.0", "alex:secret", []string{"all"}, true))
+	th.AssertEqualSlices(
+		[]string{"images", "pull", "--platform=linux/arm64", "reg/app:1.0"},
+		pullArgs("reg/app:1.0", "", []string{"linux/arm64"}, false))
+}
+
+//
+func TestPushArgs(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertEqualSlices(
+		[]string{"images", "push", "reg/app:1.0"},
+		pushArgs("reg/app:1.0", "", "", false))
+	th.AssertEqualSlices(
+		[]string{"images", "push", "reg/app:1.0"},
+		pushArgs("reg/app:1.0", "", "all", false))
+	th.AssertEqualSlices(
+		[]string{"images", "push", "--user=alex:secret", "--skip-verify",
+			"--platform=linux/arm64", "reg/app:1.0"},
+		pushArgs("reg/app:1.0", "alex:secret", "linux/arm64", true))
+}
+
+//
+func TestNewCtrClient(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	c := newCtrClient(nil, nil)
+	th.AssertEqual(defaultCtrBinary, c.binary)
+	th.AssertEqual(defaultAddress, c.address)
+	th.AssertEqual(defaultNamespace, c.namespace)
+
+	c = newCtrClient(&RelayConfig{Binary: "/usr/local/bin/ctr",
+		Namespace: "mirror"}, nil)
+	th.AssertEqual("/usr/local/bin/ctr", c.binary)
+	th.AssertEqual(defaultAddress, c.address)
+	th.AssertEqual("mirror", c.namespace)
+}
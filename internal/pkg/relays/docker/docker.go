@@ -17,11 +17,14 @@
 package docker
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/docker/distribution/reference"
@@ -30,6 +33,7 @@ import (
 	"github.com/docker/docker/pkg/jsonmessage"
 	"golang.org/x/crypto/ssh/terminal"
 
+	"github.com/xelalexv/dregsy/internal/pkg/relays"
 	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
@@ -184,20 +188,22 @@ func match(filterRepo, filterPath, filterTag, ref string) (bool, error) {
 }
 
 //
-func (dc *dockerClient) pullImage(ref string, allTags bool, platform, auth string,
-	verbose bool) error {
+func (dc *dockerClient) pullImage(ctx context.Context, ref string,
+	allTags bool, platform, auth string, verbose bool,
+	progress *relays.Progress) error {
 	opts := &types.ImagePullOptions{
 		All:          allTags,
 		RegistryAuth: auth,
 		Platform:     platform,
 	}
-	rc, err := dc.client.ImagePull(context.Background(), ref, *opts)
-	return dc.handleLog(rc, err, verbose)
+	rc, err := dc.client.ImagePull(ctx, ref, *opts)
+	return dc.handleLog(rc, err, verbose, progress)
 }
 
 //
-func (dc *dockerClient) pushImage(image string, allTags bool, platform, auth string,
-	verbose bool) error {
+func (dc *dockerClient) pushImage(ctx context.Context, image string,
+	allTags bool, platform, auth string, verbose bool,
+	progress *relays.Progress) error {
 
 	opts := &types.ImagePushOptions{
 		All:          allTags,
@@ -206,8 +212,8 @@ func (dc *dockerClient) pushImage(image string, allTags bool, platform, auth str
 		//       the Docker client lib
 		Platform: platform,
 	}
-	rc, err := dc.client.ImagePush(context.Background(), image, *opts)
-	return dc.handleLog(rc, err, verbose)
+	rc, err := dc.client.ImagePush(ctx, image, *opts)
+	return dc.handleLog(rc, err, verbose, progress)
 }
 
 //
@@ -215,9 +221,10 @@ func (dc *dockerClient) tagImage(source, target string) error {
 	return dc.client.ImageTag(context.Background(), source, target)
 }
 
-//
+// handleLog displays the JSON messages which the Docker daemon sends while
+// pulling or pushing, and records the reported layer progress with progress.
 func (dc *dockerClient) handleLog(rc io.ReadCloser, err error,
-	verbose bool) error {
+	verbose bool, progress *relays.Progress) error {
 
 	if err != nil {
 		return err
@@ -230,5 +237,54 @@ func (dc *dockerClient) handleLog(rc io.ReadCloser, err error,
 	terminalFd := os.Stdout.Fd()
 	isTerminal := dc.wrOut == os.Stdout && terminal.IsTerminal(int(terminalFd))
 	return jsonmessage.DisplayJSONMessagesStream(
-		rc, out, terminalFd, isTerminal, nil)
+		io.TeeReader(rc, &progressWriter{progress: progress}),
+		out, terminalFd, isTerminal, nil)
+}
+
+// progressWriter parses the JSON messages sent by the Docker daemon, and
+// records the layer progress they report.
+type progressWriter struct {
+	progress *relays.Progress
+	line     []byte
+}
+
+//
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.line = append(w.line, b...)
+	for {
+		ix := bytes.IndexByte(w.line, '\n')
+		if ix < 0 {
+			return len(b), nil
+		}
+		var msg jsonmessage.JSONMessage
+		if json.Unmarshal(w.line[:ix], &msg) == nil {
+			w.record(&msg)
+		}
+		w.line = w.line[ix+1:]
+	}
+}
+
+// record records the progress reported in msg, if it refers to a layer.
+func (w *progressWriter) record(msg *jsonmessage.JSONMessage) {
+
+	if msg.ID == "" {
+		return
+	}
+
+	switch msg.Status {
+	case "Pulling fs layer", "Preparing", "Waiting":
+		w.progress.Started(msg.ID)
+	case "Downloading", "Pushing":
+		if msg.Progress != nil {
+			w.progress.Update(
+				msg.ID, msg.Progress.Current, msg.Progress.Total)
+		}
+	case "Download complete", "Pull complete", "Already exists", "Pushed",
+		"Layer already exists":
+		w.progress.Finished(msg.ID)
+	default:
+		if strings.HasPrefix(msg.Status, "Mounted from") {
+			w.progress.Finished(msg.ID)
+		}
+	}
 }
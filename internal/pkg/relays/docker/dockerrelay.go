@@ -17,6 +17,7 @@
 package docker
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"time"
@@ -49,6 +50,137 @@ func (s *Support) Platform(p string) error {
 	return nil
 }
 
+//
+func (s *Support) Platforms(p []string) error {
+	if len(p) > 0 {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'platforms'", RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) CopySignatures(c bool) error {
+	if c {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'copy-signatures'",
+			RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) Digest(digest, tag string) error {
+	if digest != "" {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with a digest in 'from'",
+			RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) SkipExisting(e bool) error {
+	if e {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'skip-existing'",
+			RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) Verify(v bool) error {
+	if v {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'verify'", RelayID)
+	}
+	return nil
+}
+
+// PreserveDigests only warns, since pulling into and pushing from the Docker
+// daemon keeps digests for some images, but not for others, e.g. not for
+// multi-platform images.
+func (s *Support) PreserveDigests(p bool) error {
+	if p {
+		log.Warnf("relay '%s' cannot guarantee to preserve digests, images "+
+			"whose digest changes will fail to sync", RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) LocalSource(l bool) error {
+	if l {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with a local 'from'",
+			RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) TagConcurrency(n int) error {
+	if n > 1 {
+		return fmt.Errorf(
+			"relay '%s' does not support tasks with 'tag-concurrency'",
+			RelayID)
+	}
+	return nil
+}
+
+// ArtifactTypes is not supported, since only container images can be pulled
+// and pushed with Docker.
+func (s *Support) ArtifactTypes(t []string) error {
+	if len(t) > 0 {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'artifact-types'",
+			RelayID)
+	}
+	return nil
+}
+
+// SkipImmutable is not supported, since all tags of an image are pushed at
+// once, so a conflicting tag would keep the tags after it from being pushed.
+func (s *Support) SkipImmutable(sk bool) error {
+	if sk {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'on-immutable: skip'",
+			RelayID)
+	}
+	return nil
+}
+
+// TagRoutes is not supported, since without tag restrictions, all tags of an
+// image are pulled regardless of where they are routed.
+func (s *Support) TagRoutes(r bool) error {
+	if r {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with 'tag-routes'", RelayID)
+	}
+	return nil
+}
+
+//
+func (s *Support) ArchiveTarget(a bool) error {
+	if a {
+		return fmt.Errorf(
+			"relay '%s' does not support mappings with object storage in 'to'",
+			RelayID)
+	}
+	return nil
+}
+
+// Compression rejects any compression setting, since the Docker daemon
+// compresses layers itself when pushing, and does not keep the source blobs.
+func (s *Support) Compression(c string) error {
+	if c != "" {
+		return fmt.Errorf(
+			"relay '%s' does not support setting 'compression'", RelayID)
+	}
+	return nil
+}
+
 //
 type DockerRelay struct {
 	client *dockerClient
@@ -101,10 +233,21 @@ func (r *DockerRelay) Dispose() error {
 	return r.client.close()
 }
 
-//
+// Sync syncs the source image while holding a copy slot, since the Docker
+// relay copies all tags of a repository in one go.
 func (r *DockerRelay) Sync(opt *relays.SyncOptions) error {
+	return opt.WithSlot(func() error {
+		return r.sync(opt)
+	})
+}
+
+//
+func (r *DockerRelay) sync(opt *relays.SyncOptions) error {
+
+	logger := opt.Logger()
+	started := time.Now()
 
-	log.WithFields(log.Fields{
+	logger.WithFields(log.Fields{
 		"ref":      opt.SrcRef,
 		"platform": opt.Platform}).Info("pulling source image")
 
@@ -116,27 +259,66 @@ func (r *DockerRelay) Sync(opt *relays.SyncOptions) error {
 	var err error
 
 	// When no tags are specified, a simple docker pull without a tag will get
-	// all tags. So for Docker relay, we don't need to list tags in this case.
-	if !opt.Tags.IsEmpty() {
+	// all tags. So for Docker relay, we don't need to list tags in this case,
+	// unless the tag set restricts the tags in some other way, or tags lacking
+	// the selected platform or metadata need to be skipped.
+	if !opt.Tags.IsUnrestricted() || opt.HasPlatforms != nil ||
+		opt.HasMetadata != nil {
 		srcCertDir := ""
 		repo, _, _ := util.SplitRef(opt.SrcRef)
 		if repo != "" {
 			srcCertDir = skopeo.CertsDirForRepo(repo)
 		}
-		tags, err = opt.Tags.Expand(func() ([]string, error) {
-			return skopeo.ListAllTags(
+		tags, err = opt.Tags.Expand(opt.Lister(func() ([]string, error) {
+			return skopeo.ListAllTags(opt.Ctx(),
 				opt.SrcRef, util.DecodeJSONAuth(opt.SrcAuth),
 				srcCertDir, opt.SrcSkipTLSVerify)
-		})
+		}))
 
 		if err != nil {
 			return fmt.Errorf("error expanding tags: %v", err)
 		}
+
+		if opt.HasManifestType != nil {
+			if tags, err = withManifestType(opt, tags); err != nil {
+				return err
+			}
+			if len(tags) == 0 {
+				logger.Info("no tags with selected manifest type to sync")
+				return nil
+			}
+		}
+
+		if opt.HasPlatforms != nil {
+			if tags, err = withPlatform(opt, tags); err != nil {
+				return err
+			}
+			if len(tags) == 0 {
+				logger.Info("no tags with selected platform to sync")
+				return nil
+			}
+		}
+
+		if opt.HasMetadata != nil {
+			if tags, err = withMetadata(opt, tags); err != nil {
+				return err
+			}
+			if len(tags) == 0 {
+				logger.Info("no tags with matching metadata to sync")
+				return nil
+			}
+		}
 	}
 
+	pullProgress := opt.StartProgress(opt.SrcRef)
+	defer pullProgress.Stop()
+
 	if len(tags) == 0 {
-		if err = r.pull(opt.SrcRef, opt.Platform, opt.SrcAuth,
-			true, opt.Verbose); err != nil {
+		opt.WaitThrottle()
+		if err = opt.Attempt(func() error {
+			return r.pull(opt.Ctx(), opt.SrcRef, opt.Platform, opt.SrcAuth,
+				true, opt.Verbose, pullProgress)
+		}); err != nil {
 			return fmt.Errorf(
 				"error pulling source image '%s': %v", opt.SrcRef, err)
 		}
@@ -144,21 +326,24 @@ func (r *DockerRelay) Sync(opt *relays.SyncOptions) error {
 	} else {
 		for _, tag := range tags {
 			srcRefTagged := fmt.Sprintf("%s:%s", opt.SrcRef, tag)
-			if err = r.pull(srcRefTagged, opt.Platform, opt.SrcAuth,
-				false, opt.Verbose); err != nil {
+			opt.WaitThrottle()
+			if err = opt.Attempt(func() error {
+				return r.pull(opt.Ctx(), srcRefTagged, opt.Platform,
+					opt.SrcAuth, false, opt.Verbose, pullProgress)
+			}); err != nil {
 				return fmt.Errorf(
 					"error pulling source image '%s': %v", srcRefTagged, err)
 			}
 		}
 	}
 
-	log.Info("relevant tags:")
+	logger.Info("relevant tags:")
 	var srcImages []*image
 
 	if len(tags) == 0 {
 		srcImages, err = r.list(opt.SrcRef)
 		if err != nil {
-			log.Errorf("error listing all tags of source image '%s': %v",
+			logger.Errorf("error listing all tags of source image '%s': %v",
 				opt.SrcRef, err)
 		}
 
@@ -167,7 +352,7 @@ func (r *DockerRelay) Sync(opt *relays.SyncOptions) error {
 			srcRefTagged := fmt.Sprintf("%s:%s", opt.SrcRef, tag)
 			srcImageTagged, err := r.list(srcRefTagged)
 			if err != nil {
-				log.Errorf(
+				logger.Errorf(
 					"error listing source image '%s': %v", srcRefTagged, err)
 			}
 			srcImages = append(srcImages, srcImageTagged...)
@@ -175,31 +360,123 @@ func (r *DockerRelay) Sync(opt *relays.SyncOptions) error {
 	}
 
 	for _, img := range srcImages {
-		log.Infof(" - %s", img.refWithTags())
+		logger.Infof(" - %s", img.refWithTags())
 	}
 
-	log.WithField("ref", opt.TrgtRef).Info("setting tags for target image")
+	logger.WithField("ref", opt.TrgtRef).Info("setting tags for target image")
 
-	_, err = r.tag(srcImages, opt.TrgtRef)
+	_, err = r.tag(srcImages, opt.TrgtRef, opt.TargetTag)
 	if err != nil {
 		return fmt.Errorf("error setting tags: %v", err)
 	}
 
-	log.WithFields(log.Fields{
+	logger.WithFields(log.Fields{
 		"ref":      opt.TrgtRef,
 		"platform": opt.Platform}).Info("pushing target image")
 
-	if err := r.push(
-		opt.TrgtRef, opt.Platform, opt.TrgtAuth, opt.Verbose); err != nil {
+	pushProgress := opt.StartProgress(opt.TrgtRef)
+	defer pushProgress.Stop()
+
+	if err := opt.Attempt(func() error {
+		return r.push(opt.Ctx(), opt.TrgtRef, opt.Platform, opt.TrgtAuth,
+			opt.Verbose, pushProgress)
+	}); err != nil {
 		return fmt.Errorf("error pushing target image: %v", err)
 	}
 
+	for _, img := range srcImages {
+		for _, tag := range img.Tags {
+			trgtTag, err := opt.TargetTag(tag)
+			if err != nil {
+				return err
+			}
+			src := fmt.Sprintf("%s:%s", opt.SrcRef, tag)
+			trgt := fmt.Sprintf("%s:%s", opt.TrgtRef, trgtTag)
+			if opt.CheckDigest != nil {
+				if err := opt.CheckDigest(src, trgt); err != nil {
+					return err
+				}
+			}
+			opt.Copied(src, trgt, started)
+		}
+	}
+
 	return nil
 }
 
+// withPlatform returns those of tags whose source image provides the platform
+// selected in opt. Tags lacking it are logged and dropped.
+func withPlatform(opt *relays.SyncOptions, tags []string) ([]string, error) {
+
+	var ret []string
+
+	for _, t := range tags {
+		skip, err := opt.LacksPlatforms(fmt.Sprintf("%s:%s", opt.SrcRef, t))
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			opt.Logger().WithField("tag", t).Warn(
+				"source image lacks selected platforms, skipping")
+			continue
+		}
+		ret = append(ret, t)
+	}
+
+	return ret, nil
+}
+
+// withManifestType returns those of tags whose source image is of the manifest
+// type selected in opt. Tags of other types are logged and dropped.
+func withManifestType(opt *relays.SyncOptions, tags []string) ([]string,
+	error) {
+
+	var ret []string
+
+	for _, t := range tags {
+		skip, err := opt.LacksManifestType(
+			fmt.Sprintf("%s:%s", opt.SrcRef, t))
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			opt.Logger().WithField("tag", t).Debug(
+				"source manifest type not selected, skipping")
+			continue
+		}
+		ret = append(ret, t)
+	}
+
+	return ret, nil
+}
+
+// withMetadata returns those of tags whose source image has the labels and
+// annotations selected in opt. Tags not matching them are logged and dropped.
+func withMetadata(opt *relays.SyncOptions, tags []string) ([]string, error) {
+
+	var ret []string
+
+	for _, t := range tags {
+		skip, err := opt.LacksMetadata(fmt.Sprintf("%s:%s", opt.SrcRef, t))
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			opt.Logger().WithField("tag", t).Info(
+				"source labels or annotations not matched, skipping")
+			continue
+		}
+		ret = append(ret, t)
+	}
+
+	return ret, nil
+}
+
 //
-func (r *DockerRelay) pull(ref, platform, auth string, allTags, verbose bool) error {
-	return r.client.pullImage(ref, allTags, platform, auth, verbose)
+func (r *DockerRelay) pull(ctx context.Context, ref, platform, auth string,
+	allTags, verbose bool, progress *relays.Progress) error {
+	return r.client.pullImage(
+		ctx, ref, allTags, platform, auth, verbose, progress)
 }
 
 //
@@ -208,8 +485,8 @@ func (r *DockerRelay) list(ref string) ([]*image, error) {
 }
 
 //
-func (r *DockerRelay) tag(images []*image, targetRef string) (
-	[]*image, error) {
+func (r *DockerRelay) tag(images []*image, targetRef string,
+	targetTag func(string) (string, error)) ([]*image, error) {
 
 	taggedImages := []*image{}
 	targetRepo, targetPath, _ := util.SplitRef(targetRef)
@@ -219,13 +496,17 @@ func (r *DockerRelay) tag(images []*image, targetRef string) (
 			ID:   img.ID,
 			Repo: targetRepo,
 			Path: targetPath,
-			Tags: img.Tags,
 		}
 		for _, tag := range img.Tags {
+			trgtTag, err := targetTag(tag)
+			if err != nil {
+				return nil, err
+			}
 			if err := r.client.tagImage(img.ID, fmt.Sprintf("%s:%s",
-				tagged.ref(), tag)); err != nil {
+				tagged.ref(), trgtTag)); err != nil {
 				return nil, err
 			}
+			tagged.Tags = append(tagged.Tags, trgtTag)
 		}
 		taggedImages = append(taggedImages, tagged)
 	}
@@ -234,6 +515,8 @@ func (r *DockerRelay) tag(images []*image, targetRef string) (
 }
 
 //
-func (r *DockerRelay) push(ref, platform, auth string, verbose bool) error {
-	return r.client.pushImage(ref, true, platform, auth, verbose)
+func (r *DockerRelay) push(ctx context.Context, ref, platform, auth string,
+	verbose bool, progress *relays.Progress) error {
+	return r.client.pushImage(
+		ctx, ref, true, platform, auth, verbose, progress)
 }
@@ -0,0 +1,208 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package relays
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProgressInterval is the interval at which the progress of a running image
+// transfer gets logged
+var ProgressInterval = 15 * time.Second
+
+// Progress tracks the layers of an image transfer, and logs how far the
+// transfer got at regular intervals while it is running. Byte counts are only
+// known for layers for which the relay's tooling reports them.
+type Progress struct {
+	mu     sync.Mutex
+	layers map[string]*layerProgress
+	copied int64
+	log    *log.Entry
+	report func(delta int64)
+	stop   chan bool
+	once   sync.Once
+}
+
+//
+type layerProgress struct {
+	current int64
+	total   int64
+	done    bool
+}
+
+// StartProgress starts tracking the progress of transferring the image
+// at ref with these options. The progress needs to be stopped once the
+// transfer is done. Transferred bytes are passed on to the progress
+// callback set in the options, if any.
+func (o *SyncOptions) StartProgress(ref string) *Progress {
+
+	p := &Progress{
+		layers: make(map[string]*layerProgress),
+		log:    o.Logger().WithField("ref", ref),
+		report: o.OnProgress,
+		stop:   make(chan bool),
+	}
+
+	go func() {
+		ticker := time.NewTicker(ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.logProgress()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// Started records that transfer of layer id has started.
+func (p *Progress) Started(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.layer(id)
+}
+
+// Update records that current of total bytes of layer id were transferred.
+// total is 0 if not known.
+func (p *Progress) Update(id string, current, total int64) {
+
+	p.mu.Lock()
+	l := p.layer(id)
+	delta := current - l.current
+	if delta < 0 {
+		// transfer of layer started over
+		delta = 0
+	}
+	l.current = current
+	if total > 0 {
+		l.total = total
+	}
+	p.copied += delta
+	p.mu.Unlock()
+
+	if delta > 0 && p.report != nil {
+		p.report(delta)
+	}
+}
+
+// Finished records that layer id was transferred, or did not need to be.
+func (p *Progress) Finished(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.layer(id).done = true
+}
+
+// FinishAll records that all layers seen so far were transferred.
+func (p *Progress) FinishAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, l := range p.layers {
+		l.done = true
+	}
+}
+
+// Layers returns the number of layers transferred so far, and the number of
+// all layers seen.
+func (p *Progress) Layers() (done, all int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, l := range p.layers {
+		if l.done {
+			done++
+		}
+	}
+	return done, len(p.layers)
+}
+
+// Stop stops logging the progress. It is safe to call Stop more than once.
+func (p *Progress) Stop() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+// layer returns the progress of layer id, which is tracked from now on if not
+// seen before. The caller needs to hold the lock.
+func (p *Progress) layer(id string) *layerProgress {
+	l, ok := p.layers[id]
+	if !ok {
+		l = &layerProgress{}
+		p.layers[id] = l
+	}
+	return l
+}
+
+// logProgress logs the current progress, unless there is nothing to report.
+func (p *Progress) logProgress() {
+	if fields := p.fields(); fields != nil {
+		p.log.WithFields(fields).Info("transfer in progress")
+	}
+}
+
+// fields returns the log fields describing the current progress, or nil if no
+// layers are being transferred.
+func (p *Progress) fields() log.Fields {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.layers) == 0 {
+		return nil
+	}
+
+	done := 0
+	var total int64
+	for _, l := range p.layers {
+		if l.done {
+			done++
+		}
+		total += l.total
+	}
+
+	if done == len(p.layers) {
+		return nil
+	}
+
+	ret := log.Fields{"layers": fmt.Sprintf("%d/%d", done, len(p.layers))}
+	if p.copied > 0 {
+		ret["copied"] = byteSize(p.copied)
+	}
+	if total > 0 {
+		ret["total"] = byteSize(total)
+	}
+	return ret
+}
+
+// byteSize formats byte count n for humans, e.g. 1.5GB.
+func byteSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,69 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package relays
+
+import (
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestProgress(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var reported int64
+	opt := &SyncOptions{OnProgress: func(n int64) { reported += n }}
+	p := opt.StartProgress("registry.acme.com/library/busybox:1.35")
+	defer p.Stop()
+
+	th.AssertNil(p.fields())
+
+	p.Started("a")
+	p.Update("b", 500, 2000)
+	p.Update("b", 1500, 2000)
+	th.AssertEqual(int64(1500), reported)
+	th.AssertEqual("0/2", p.fields()["layers"])
+	th.AssertEqual("1.5kB", p.fields()["copied"])
+	th.AssertEqual("2.0kB", p.fields()["total"])
+
+	// a layer starting over is not reported twice
+	p.Update("b", 100, 0)
+	p.Update("b", 600, 0)
+	th.AssertEqual(int64(2000), reported)
+
+	p.Finished("b")
+	th.AssertEqual("1/2", p.fields()["layers"])
+
+	p.FinishAll()
+	th.AssertNil(p.fields())
+
+	p.Stop()
+}
+
+//
+func TestByteSize(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertEqual("0B", byteSize(0))
+	th.AssertEqual("999B", byteSize(999))
+	th.AssertEqual("1.0kB", byteSize(1000))
+	th.AssertEqual("2.5MB", byteSize(2500000))
+	th.AssertEqual("1.2GB", byteSize(1234567890))
+}
@@ -0,0 +1,375 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package skopeo
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	gocrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gocrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// copyPlatforms copies the multi-platform image src to trgt, keeping only the
+// platform images listed in platforms. Skopeo can either copy a single or all
+// platform images, so we use go-containerregistry for this. The trimmed index
+// is written to the target, after all retained platform images have been
+// copied. OCI artifacts other than container images have no platforms, and are
+// copied as is. Copying is aborted when ctx is done.
+func copyPlatforms(ctx context.Context,
+	src, srcCreds, srcCertDir string, srcSkipTLSVerify bool,
+	trgt, trgtCreds, trgtCertDir string, trgtSkipTLSVerify bool,
+	platforms []string) error {
+
+	srcOpts, err := remoteOptions(ctx, srcCreds, srcCertDir, srcSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	trgtOpts, err := remoteOptions(
+		ctx, trgtCreds, trgtCertDir, trgtSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+
+	srcRef, err := parseReference(src, srcSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	trgtRef, err := parseReference(trgt, trgtSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+
+	desc, err := gocrremote.Get(srcRef, srcOpts...)
+	if err != nil {
+		return fmt.Errorf("error getting source image '%s': %v", src, err)
+	}
+
+	typ, err := util.ArtifactType(desc.Manifest)
+	if err != nil {
+		return fmt.Errorf("source image '%s': %v", src, err)
+	}
+	if !util.IsImageType(typ) {
+		log.WithFields(log.Fields{"ref": src, "type": typ}).Debug(
+			"not a container image, copying as is")
+		return copyArtifact(desc, trgtRef, trgtOpts)
+	}
+
+	if !desc.MediaType.IsIndex() {
+		return copySinglePlatform(desc, src, trgtRef, trgtOpts, platforms)
+	}
+
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return err
+	}
+
+	trimmed, err := trimIndex(index, platforms)
+	if err != nil {
+		return fmt.Errorf("cannot trim source image '%s': %v", src, err)
+	}
+
+	if err := gocrremote.WriteIndex(trgtRef, trimmed, trgtOpts...); err != nil {
+		return fmt.Errorf("error writing target image '%s': %v", trgt, err)
+	}
+
+	return nil
+}
+
+// copySinglePlatform copies source image src, which is not a multi-platform
+// image, as is to target trgt if its platform is one of platforms.
+func copySinglePlatform(desc *gocrremote.Descriptor, src string,
+	trgt gocrname.Reference, trgtOpts []gocrremote.Option,
+	platforms []string) error {
+
+	img, err := desc.Image()
+	if err != nil {
+		return err
+	}
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		return fmt.Errorf("error getting config of source image '%s': %v",
+			src, err)
+	}
+
+	// the config uses the same field names for the platform as an index
+	var p gocrv1.Platform
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+
+	if !matchesAnyPlatform(&p, platforms) {
+		return fmt.Errorf("source image '%s' is not a multi-platform image, "+
+			"and its platform %s is not among %v", src, platformString(&p),
+			platforms)
+	}
+
+	if err := gocrremote.Write(trgt, img, trgtOpts...); err != nil {
+		return fmt.Errorf("error writing target image '%s': %v", trgt, err)
+	}
+
+	return nil
+}
+
+// copyArtifact copies the OCI artifact described by desc as is to target trgt,
+// with its manifest and all blobs, regardless of their media types.
+func copyArtifact(desc *gocrremote.Descriptor, trgt gocrname.Reference,
+	trgtOpts []gocrremote.Option) error {
+
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		if err := gocrremote.WriteIndex(trgt, index, trgtOpts...); err != nil {
+			return fmt.Errorf("error writing target '%s': %v", trgt, err)
+		}
+		return nil
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return err
+	}
+	if err := gocrremote.Write(trgt, img, trgtOpts...); err != nil {
+		return fmt.Errorf("error writing target '%s': %v", trgt, err)
+	}
+	return nil
+}
+
+// trimmedIndex is an image index from which only some of the child manifests
+// are retained. Child images are served by the wrapped index.
+type trimmedIndex struct {
+	index    gocrv1.ImageIndex
+	manifest *gocrv1.IndexManifest
+	raw      []byte
+}
+
+//
+func (t *trimmedIndex) MediaType() (gocrtypes.MediaType, error) {
+	return t.index.MediaType()
+}
+
+//
+func (t *trimmedIndex) Image(h gocrv1.Hash) (gocrv1.Image, error) {
+	return t.index.Image(h)
+}
+
+//
+func (t *trimmedIndex) ImageIndex(h gocrv1.Hash) (gocrv1.ImageIndex, error) {
+	return t.index.ImageIndex(h)
+}
+
+//
+func (t *trimmedIndex) IndexManifest() (*gocrv1.IndexManifest, error) {
+	return t.manifest, nil
+}
+
+//
+func (t *trimmedIndex) RawManifest() ([]byte, error) {
+	return t.raw, nil
+}
+
+//
+func (t *trimmedIndex) Digest() (gocrv1.Hash, error) {
+	h, _, err := gocrv1.SHA256(bytes.NewReader(t.raw))
+	return h, err
+}
+
+//
+func (t *trimmedIndex) Size() (int64, error) {
+	return int64(len(t.raw)), nil
+}
+
+// trimIndex creates an index from index, retaining only child manifests for
+// any of platforms. It is an error if none of the platforms match.
+func trimIndex(index gocrv1.ImageIndex, platforms []string) (
+	gocrv1.ImageIndex, error) {
+
+	raw, err := index.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	// we modify the raw manifest as a generic map rather than re-serializing
+	// an IndexManifest, to not lose any fields, e.g. annotations
+	var generic map[string]interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return nil, err
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	rawChildren, ok := generic["manifests"].([]interface{})
+	if !ok || len(rawChildren) != len(manifest.Manifests) {
+		return nil, fmt.Errorf("malformed index manifest")
+	}
+
+	trimmed := *manifest
+	trimmed.Manifests = nil
+	var keep []interface{}
+
+	for ix, m := range manifest.Manifests {
+		if m.Platform != nil && matchesAnyPlatform(m.Platform, platforms) {
+			trimmed.Manifests = append(trimmed.Manifests, m)
+			keep = append(keep, rawChildren[ix])
+		} else {
+			log.WithField("platform", platformString(m.Platform)).Debug(
+				"dropping platform")
+		}
+	}
+
+	if len(keep) == 0 {
+		return nil, fmt.Errorf(
+			"none of the platforms %v are available", platforms)
+	}
+
+	generic["manifests"] = keep
+	if raw, err = json.Marshal(generic); err != nil {
+		return nil, err
+	}
+
+	return &trimmedIndex{index: index, manifest: &trimmed, raw: raw}, nil
+}
+
+// matchesAnyPlatform determines whether p matches any of platforms. When a
+// platform in the list does not specify a variant, any variant matches.
+func matchesAnyPlatform(p *gocrv1.Platform, platforms []string) bool {
+	for _, pl := range platforms {
+		os, arch, variant := util.SplitPlatform(pl)
+		if p.OS == os && p.Architecture == arch &&
+			(variant == "" || p.Variant == variant) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+func platformString(p *gocrv1.Platform) string {
+	if p == nil {
+		return "unknown"
+	}
+	ret := fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	if p.Variant != "" {
+		ret = fmt.Sprintf("%s/%s", ret, p.Variant)
+	}
+	return ret
+}
+
+//
+func parseReference(ref string, insecure bool) (gocrname.Reference, error) {
+	var opts []gocrname.Option
+	if insecure {
+		opts = append(opts, gocrname.Insecure)
+	}
+	ret, err := gocrname.ParseReference(ref, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference '%s': %v", ref, err)
+	}
+	return ret, nil
+}
+
+// remoteOptions creates options for go-containerregistry with credentials
+// creds in `user:password` form, and TLS settings equivalent to what is used
+// with skopeo, i.e. CA certs (*.crt) and client key pair (*.cert & *.key)
+// from certDir are used, if present. Requests are canceled when ctx is done.
+func remoteOptions(ctx context.Context, creds, certDir string,
+	skipTLSVerify bool) ([]gocrremote.Option, error) {
+
+	auth := gocrauthn.Anonymous
+	if creds != "" {
+		parts := strings.SplitN(creds, ":", 2)
+		basic := &gocrauthn.Basic{Username: parts[0]}
+		if len(parts) > 1 {
+			basic.Password = parts[1]
+		}
+		auth = basic
+	}
+
+	conf, err := tlsConfig(certDir, skipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = conf
+
+	return []gocrremote.Option{
+		gocrremote.WithAuth(auth),
+		gocrremote.WithTransport(tr),
+		gocrremote.WithContext(ctx),
+	}, nil
+}
+
+//
+func tlsConfig(certDir string, skipTLSVerify bool) (*tls.Config, error) {
+
+	conf := &tls.Config{InsecureSkipVerify: skipTLSVerify}
+	if certDir == "" {
+		return conf, nil
+	}
+
+	cas, _ := filepath.Glob(filepath.Join(certDir, "*.crt"))
+	if len(cas) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, ca := range cas {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no valid CA certs in '%s'", ca)
+			}
+		}
+		conf.RootCAs = pool
+	}
+
+	certs, _ := filepath.Glob(filepath.Join(certDir, "*.cert"))
+	for _, c := range certs {
+		key := strings.TrimSuffix(c, ".cert") + ".key"
+		pair, err := tls.LoadX509KeyPair(c, key)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error loading client key pair '%s': %v", c, err)
+		}
+		conf.Certificates = append(conf.Certificates, pair)
+	}
+
+	return conf, nil
+}
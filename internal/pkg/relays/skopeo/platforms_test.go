@@ -0,0 +1,91 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package skopeo
+
+import (
+	"encoding/json"
+	"testing"
+
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrempty "github.com/google/go-containerregistry/pkg/v1/empty"
+	gocrmutate "github.com/google/go-containerregistry/pkg/v1/mutate"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestTrimIndex(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var adds []gocrmutate.IndexAddendum
+	for _, p := range []gocrv1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "windows", Architecture: "amd64"},
+	} {
+		img, err := gocrrandom.Image(64, 1)
+		th.AssertNoError(err)
+		plat := p
+		adds = append(adds, gocrmutate.IndexAddendum{
+			Add:        img,
+			Descriptor: gocrv1.Descriptor{Platform: &plat},
+		})
+	}
+	index := gocrmutate.AppendManifests(gocrempty.Index, adds...)
+
+	trimmed, err := trimIndex(index, []string{"linux/amd64", "linux/arm64"})
+	th.AssertNoError(err)
+
+	m, err := trimmed.IndexManifest()
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(m.Manifests))
+	th.AssertEqual("linux/amd64", platformString(m.Manifests[0].Platform))
+	th.AssertEqual("linux/arm64/v8", platformString(m.Manifests[1].Platform))
+
+	// raw manifest needs to be consistent with parsed manifest
+	raw, err := trimmed.RawManifest()
+	th.AssertNoError(err)
+	var parsed gocrv1.IndexManifest
+	th.AssertNoError(json.Unmarshal(raw, &parsed))
+	th.AssertEqual(2, len(parsed.Manifests))
+	th.AssertEqual(m.Manifests[0].Digest, parsed.Manifests[0].Digest)
+	th.AssertEqual(m.Manifests[1].Digest, parsed.Manifests[1].Digest)
+
+	orig, err := index.Digest()
+	th.AssertNoError(err)
+	dig, err := trimmed.Digest()
+	th.AssertNoError(err)
+	th.AssertNotEqual(orig, dig)
+
+	// child images are still accessible
+	_, err = trimmed.Image(m.Manifests[1].Digest)
+	th.AssertNoError(err)
+
+	// variant needs to match when given
+	trimmed, err = trimIndex(index, []string{"linux/arm/v6", "linux/arm/v7"})
+	th.AssertNoError(err)
+	m, err = trimmed.IndexManifest()
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(m.Manifests))
+	th.AssertEqual("linux/arm/v7", platformString(m.Manifests[0].Platform))
+
+	_, err = trimIndex(index, []string{"linux/s390x"})
+	th.AssertError(err, "none of the platforms")
+}
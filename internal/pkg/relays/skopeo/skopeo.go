@@ -18,6 +18,7 @@ package skopeo
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -27,6 +28,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/relays"
 	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
@@ -54,9 +56,11 @@ func CertsDirForRepo(r string) string {
 }
 
 //
-func ListAllTags(ref, creds, certDir string, skipTLSVerify bool) ([]string, error) {
+func ListAllTags(ctx context.Context, ref, creds, certDir string,
+	skipTLSVerify bool) ([]string, error) {
 
-	ret, err := info([]string{"list-tags"}, ref, creds, certDir, skipTLSVerify)
+	ret, err := info(
+		ctx, []string{"list-tags"}, ref, creds, certDir, skipTLSVerify)
 	if err != nil {
 		return nil,
 			fmt.Errorf("error listing image tags for ref '%s': %v", ref, err)
@@ -70,15 +74,16 @@ func ListAllTags(ref, creds, certDir string, skipTLSVerify bool) ([]string, erro
 }
 
 //
-func Inspect(ref, platform, format, creds, certDir string, skipTLSVerify bool) (
-	string, error) {
+func Inspect(ctx context.Context, ref, platform, format, creds, certDir string,
+	skipTLSVerify bool) (string, error) {
 
 	cmd := addPlatformOverrides([]string{"inspect"}, platform)
 	if format != "" {
 		cmd = append(cmd, fmt.Sprintf("--format=%s", format))
 	}
 
-	if insp, err := info(cmd, ref, creds, certDir, skipTLSVerify); err != nil {
+	if insp, err := info(
+		ctx, cmd, ref, creds, certDir, skipTLSVerify); err != nil {
 		return "", fmt.Errorf(
 			"error inspecting image for ref '%s': %v", ref, err)
 	} else {
@@ -87,8 +92,8 @@ func Inspect(ref, platform, format, creds, certDir string, skipTLSVerify bool) (
 }
 
 //
-func info(cmd []string, ref, creds, certDir string, skipTLSVerify bool) (
-	[]byte, error) {
+func info(ctx context.Context, cmd []string, ref, creds, certDir string,
+	skipTLSVerify bool) ([]byte, error) {
 
 	if skipTLSVerify {
 		cmd = append(cmd, "--tls-verify=false")
@@ -107,8 +112,8 @@ func info(cmd []string, ref, creds, certDir string, skipTLSVerify bool) (
 	bufOut := new(bytes.Buffer)
 	bufErr := new(bytes.Buffer)
 
-	if err := runSkopeo(bufOut, bufErr, true, cmd...); err != nil {
-		return nil, fmt.Errorf("%s, %v", bufErr.String(), err)
+	if err := runSkopeo(ctx, bufOut, bufErr, true, cmd...); err != nil {
+		return nil, err
 	}
 
 	return bufOut.Bytes(), nil
@@ -147,25 +152,97 @@ func chooseOutStream(out io.Writer, verbose, isErrorStream bool) io.Writer {
 	return ioutil.Discard
 }
 
-//
-func runSkopeo(outWr, errWr io.Writer, verbose bool, args ...string) error {
+// runSkopeo runs skopeo with args. The skopeo process is killed when ctx is
+// done.
+func runSkopeo(ctx context.Context, outWr, errWr io.Writer, verbose bool,
+	args ...string) error {
+	return run(ctx, chooseOutStream(outWr, verbose, false),
+		chooseOutStream(errWr, verbose, true), args...)
+}
 
-	cmd := exec.Command(skopeoBinary, args...)
+// runSkopeoCopy runs skopeo copy with args like runSkopeo, and tracks the
+// layers being copied with p.
+func runSkopeoCopy(ctx context.Context, outWr io.Writer, verbose bool,
+	p *relays.Progress, args ...string) error {
+	return run(ctx,
+		io.MultiWriter(chooseOutStream(outWr, verbose, false),
+			&progressWriter{progress: p}),
+		chooseOutStream(outWr, verbose, true), args...)
+}
 
-	cmd.Stdout = chooseOutStream(outWr, verbose, false)
-	cmd.Stderr = chooseOutStream(errWr, verbose, true)
+// run runs skopeo with args, writing its output to stdout and stderr. The
+// skopeo process is killed when ctx is done.
+func run(ctx context.Context, stdout, stderr io.Writer, args ...string) error {
+
+	cmd := exec.CommandContext(ctx, skopeoBinary, args...)
+
+	// error output is also captured, so that errors can be told apart
+	bufErr := new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(stderr, bufErr)
 
 	if err := cmd.Start(); err != nil {
 		return err
 	}
 
 	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(bufErr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
 		return err
 	}
 
 	return nil
 }
 
+// progressWriter parses the copy output of skopeo, and records the layers
+// of which skopeo reports that it is copying them. Without a terminal, skopeo
+// does not report any byte counts.
+type progressWriter struct {
+	progress *relays.Progress
+	line     []byte
+}
+
+//
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.line = append(w.line, b...)
+	for {
+		ix := bytes.IndexAny(w.line, "\r\n")
+		if ix < 0 {
+			return len(b), nil
+		}
+		w.parse(strings.TrimSpace(string(w.line[:ix])))
+		w.line = w.line[ix+1:]
+	}
+}
+
+// parse parses a single line of skopeo's copy output, such as
+// `Copying blob sha256:... done`, or `Writing manifest to image destination`.
+func (w *progressWriter) parse(line string) {
+
+	if strings.HasPrefix(line, "Writing manifest") {
+		w.progress.FinishAll()
+		return
+	}
+
+	if !strings.HasPrefix(line, "Copying blob ") {
+		return
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, "Copying blob "))
+	if len(fields) == 0 {
+		return
+	}
+
+	id := fields[0]
+	if len(fields) > 1 &&
+		(fields[1] == "done" || strings.HasPrefix(fields[1], "skipped")) {
+		w.progress.Finished(id)
+	} else {
+		w.progress.Started(id)
+	}
+}
+
 //
 func decodeTagList(tl []byte) (*tagList, error) {
 	var ret tagList
@@ -0,0 +1,82 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package skopeo
+
+import (
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/relays"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestProgressWriter(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	opt := &relays.SyncOptions{}
+	p := opt.StartProgress("registry.acme.com/library/busybox:1.35")
+	defer p.Stop()
+
+	w := &progressWriter{progress: p}
+	_, err := w.Write([]byte("Getting image source signatures\n" +
+		"Copying blob sha256:aaaa skipped: already exists\nCopying blo"))
+	th.AssertNoError(err)
+	_, err = w.Write([]byte("b sha256:bbbb\nCopying blob sha256:cccc done\n"))
+	th.AssertNoError(err)
+
+	// second layer is still being copied
+	done, all := p.Layers()
+	th.AssertEqual(2, done)
+	th.AssertEqual(3, all)
+
+	_, err = w.Write([]byte("Copying config sha256:dddd done\n" +
+		"Writing manifest to image destination\n"))
+	th.AssertNoError(err)
+	done, all = p.Layers()
+	th.AssertEqual(3, done)
+	th.AssertEqual(3, all)
+}
+
+//
+func TestValidateConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	conf := &RelayConfig{
+		Binary: "/opt/skopeo-patched/bin/skopeo",
+		ExtraArgs: []string{
+			"--dest-compress-format=zstd", "--retry-times=3", "-q"},
+	}
+	th.AssertNoError(conf.Validate())
+	th.AssertNoError((&RelayConfig{}).Validate())
+
+	conf = &RelayConfig{Binary: "skopeo; rm -rf /"}
+	th.AssertError(conf.Validate(), "contains invalid characters")
+
+	for arg, err := range map[string]string{
+		"zstd":                        "is not an option",
+		"--dest-creds=$(cat /secret)": "contains invalid characters",
+		"--format=v2s2 && echo pwned": "contains invalid characters",
+		"--dest-compress-format zstd": "contains invalid characters",
+		"--registries-conf=`whoami`":  "contains invalid characters",
+		"--":                          "must not end the list of options",
+	} {
+		conf = &RelayConfig{ExtraArgs: []string{"--all", arg}}
+		th.AssertError(conf.Validate(), err)
+	}
+}
@@ -18,8 +18,13 @@ package skopeo
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -29,10 +34,44 @@ import (
 
 const RelayID = "skopeo"
 
+// shellMeta matches characters with a special meaning to a shell, and white
+// space; skopeo is not run via a shell, but the binary and extra arguments
+// must not contain them anyway, so that they cannot be used for smuggling
+// commands into wrapper scripts
+var shellMeta = regexp.MustCompile("[;&|$`<>(){}\\[\\]*?!~#'\"\\\\\\s]")
+
 //
 type RelayConfig struct {
-	Binary   string `yaml:"binary"`
-	CertsDir string `yaml:"certs-dir"`
+	Binary    string   `yaml:"binary"`
+	CertsDir  string   `yaml:"certs-dir"`
+	ExtraArgs []string `yaml:"extra-args"`
+}
+
+// Validate checks the binary and extra arguments of this config. Each extra
+// argument needs to be an option, with its value given as `--option=value`.
+func (c *RelayConfig) Validate() error {
+
+	if shellMeta.MatchString(c.Binary) {
+		return fmt.Errorf(
+			"skopeo 'binary' '%s' contains invalid characters", c.Binary)
+	}
+
+	for _, a := range c.ExtraArgs {
+		if !strings.HasPrefix(a, "-") {
+			return fmt.Errorf("skopeo 'extra-args' item '%s' is not an "+
+				"option, use '--option=value' for options with values", a)
+		}
+		if shellMeta.MatchString(a) {
+			return fmt.Errorf(
+				"skopeo 'extra-args' item '%s' contains invalid characters", a)
+		}
+		if a == "-" || a == "--" {
+			return errors.New(
+				"skopeo 'extra-args' must not end the list of options")
+		}
+	}
+
+	return nil
 }
 
 //
@@ -43,9 +82,75 @@ func (s *Support) Platform(p string) error {
 	return nil
 }
 
+//
+func (s *Support) Platforms(p []string) error {
+	return nil
+}
+
+//
+func (s *Support) CopySignatures(c bool) error {
+	return nil
+}
+
+//
+func (s *Support) Digest(digest, tag string) error {
+	return nil
+}
+
+//
+func (s *Support) SkipExisting(e bool) error {
+	return nil
+}
+
+//
+func (s *Support) Verify(v bool) error {
+	return nil
+}
+
+//
+func (s *Support) PreserveDigests(p bool) error {
+	return nil
+}
+
+//
+func (s *Support) LocalSource(l bool) error {
+	return nil
+}
+
+//
+func (s *Support) TagConcurrency(n int) error {
+	return nil
+}
+
+//
+func (s *Support) ArtifactTypes(t []string) error {
+	return nil
+}
+
+//
+func (s *Support) SkipImmutable(sk bool) error {
+	return nil
+}
+
+//
+func (s *Support) TagRoutes(r bool) error {
+	return nil
+}
+
+//
+func (s *Support) ArchiveTarget(a bool) error {
+	return nil
+}
+
+//
+func (s *Support) Compression(c string) error {
+	return nil
+}
+
 //
 type SkopeoRelay struct {
-	wrOut io.Writer
+	wrOut     io.Writer
+	extraArgs []string
 }
 
 //
@@ -63,6 +168,7 @@ func NewSkopeoRelay(conf *RelayConfig, out io.Writer) *SkopeoRelay {
 		if conf.CertsDir != "" {
 			certsBaseDir = conf.CertsDir
 		}
+		relay.extraArgs = conf.ExtraArgs
 	}
 
 	return relay
@@ -72,7 +178,8 @@ func NewSkopeoRelay(conf *RelayConfig, out io.Writer) *SkopeoRelay {
 func (r *SkopeoRelay) Prepare() error {
 
 	bufOut := new(bytes.Buffer)
-	if err := runSkopeo(bufOut, nil, true, "--version"); err != nil {
+	if err := runSkopeo(
+		context.Background(), bufOut, nil, true, "--version"); err != nil {
 		return fmt.Errorf("cannot execute skopeo: %v", err)
 	}
 
@@ -90,6 +197,8 @@ func (r *SkopeoRelay) Dispose() error {
 //
 func (r *SkopeoRelay) Sync(opt *relays.SyncOptions) error {
 
+	logger := opt.Logger()
+
 	srcCreds := util.DecodeJSONAuth(opt.SrcAuth)
 	destCreds := util.DecodeJSONAuth(opt.TrgtAuth)
 
@@ -97,6 +206,7 @@ func (r *SkopeoRelay) Sync(opt *relays.SyncOptions) error {
 		"--insecure-policy",
 		"copy",
 	}
+	cmd = append(cmd, r.extraArgs...)
 
 	if opt.SrcSkipTLSVerify {
 		cmd = append(cmd, "--src-tls-verify=false")
@@ -107,14 +217,15 @@ func (r *SkopeoRelay) Sync(opt *relays.SyncOptions) error {
 
 	srcCertDir := ""
 	repo, _, _ := util.SplitRef(opt.SrcRef)
-	if repo != "" {
+	if repo != "" && opt.SrcImage == nil {
 		srcCertDir = CertsDirForRepo(repo)
 		cmd = append(cmd, fmt.Sprintf("--src-cert-dir=%s", srcCertDir))
 	}
+	trgtCertDir := ""
 	repo, _, _ = util.SplitRef(opt.TrgtRef)
-	if repo != "" {
-		cmd = append(cmd, fmt.Sprintf(
-			"--dest-cert-dir=%s/%s", certsBaseDir, withoutPort(repo)))
+	if repo != "" && opt.TrgtArchive == nil {
+		trgtCertDir = CertsDirForRepo(repo)
+		cmd = append(cmd, fmt.Sprintf("--dest-cert-dir=%s", trgtCertDir))
 	}
 
 	if srcCreds != "" {
@@ -124,41 +235,244 @@ func (r *SkopeoRelay) Sync(opt *relays.SyncOptions) error {
 		cmd = append(cmd, fmt.Sprintf("--dest-creds=%s", destCreds))
 	}
 
-	tags, err := opt.Tags.Expand(func() ([]string, error) {
-		return ListAllTags(opt.SrcRef, srcCreds, srcCertDir, opt.SrcSkipTLSVerify)
-	})
+	if opt.Digest != "" {
+		return opt.WithSlot(func() error {
+			return r.syncPinned(cmd, opt, logger)
+		})
+	}
+
+	tags, err := opt.Tags.Expand(opt.Lister(func() ([]string, error) {
+		return ListAllTags(opt.Ctx(),
+			opt.SrcRef, srcCreds, srcCertDir, opt.SrcSkipTLSVerify)
+	}))
 
 	if err != nil {
 		return fmt.Errorf("error expanding tags: %v", err)
 	}
 
-	errs := false
+	// tags may be synced in parallel, so each of them needs to get its own
+	// copy of cmd when appending to it
+	cmd = cmd[:len(cmd):len(cmd)]
+
+	errs := opt.EachTag(tags, func(t string) error {
+
+		tlog := logger.WithField("tag", t)
+		started := time.Now()
+
+		trgtTag, err := opt.TargetTag(t)
+		if err != nil {
+			tlog.Error(err)
+			return err
+		}
+
+		if opt.IsUnchanged(fmt.Sprintf("%s:%s", opt.SrcRef, t),
+			fmt.Sprintf("%s:%s", opt.TrgtRef, trgtTag)) {
+			tlog.Info("target image is up to date, skipping")
+			return nil
+		}
+
+		if skip, err := opt.LacksArtifactType(
+			fmt.Sprintf("%s:%s", opt.SrcRef, t)); err != nil {
+			tlog.Error(err)
+			return err
+		} else if skip {
+			tlog.Info("source artifact type not selected, skipping")
+			return nil
+		}
+
+		if skip, err := opt.LacksManifestType(
+			fmt.Sprintf("%s:%s", opt.SrcRef, t)); err != nil {
+			tlog.Error(err)
+			return err
+		} else if skip {
+			tlog.Debug("source manifest type not selected, skipping")
+			return nil
+		}
 
-	for _, t := range tags {
+		if skip, err := opt.LacksMetadata(
+			fmt.Sprintf("%s:%s", opt.SrcRef, t)); err != nil {
+			tlog.Error(err)
+			return err
+		} else if skip {
+			tlog.Info("source labels or annotations not matched, skipping")
+			return nil
+		}
 
-		log.WithFields(
-			log.Fields{"tag": t, "platform": opt.Platform}).Info("syncing tag")
+		if skip, err := opt.LacksPlatforms(
+			fmt.Sprintf("%s:%s", opt.SrcRef, t)); err != nil {
+			tlog.Error(err)
+			return err
+		} else if skip {
+			tlog.Warn("source image lacks selected platforms, skipping")
+			return nil
+		}
 
-		rc := append(cmd,
-			fmt.Sprintf("docker://%s:%s", opt.SrcRef, t),
-			fmt.Sprintf("docker://%s:%s", opt.TrgtRef, t))
+		if len(opt.Platforms) > 0 {
+			tlog.WithField("platforms", opt.Platforms).Info("syncing tag")
+			if err := opt.Attempt(func() error {
+				return copyPlatforms(opt.Ctx(),
+					fmt.Sprintf("%s:%s", opt.SrcRef, t), srcCreds, srcCertDir,
+					opt.SrcSkipTLSVerify,
+					fmt.Sprintf("%s:%s", opt.TrgtRef, trgtTag), destCreds,
+					trgtCertDir,
+					opt.TrgtSkipTLSVerify, opt.Platforms)
+			}); err != nil {
+				if opt.SkipsImmutable(err) {
+					tlog.Info("target tag exists and is immutable, skipping")
+					return nil
+				}
+				tlog.Error(err)
+				return err
+			}
+			return nil
+		}
 
-		switch opt.Platform {
-		case "":
-		case "all":
-			rc = append(rc, "--all")
-		default:
-			rc = addPlatformOverrides(rc, opt.Platform)
+		tlog.WithField("platform", opt.Platform).Info("syncing tag")
+
+		progress := opt.StartProgress(opt.SourceImage(t))
+		err = opt.Attempt(func() error {
+			return opt.Copy(t, trgtTag, func(src, trgt string) error {
+				rc := append(cmd, src, trgt)
+				if opt.CopyAsIs() {
+					rc = append(rc, "--all", "--preserve-digests")
+				} else {
+					switch opt.Platform {
+					case "":
+					case "all":
+						rc = append(rc, "--all")
+					default:
+						rc = addPlatformOverrides(rc, opt.Platform)
+					}
+					if opt.Compression != "" {
+						rc = append(rc,
+							"--dest-compress-format", opt.Compression)
+					}
+				}
+				return runSkopeoCopy(opt.Ctx(), r.wrOut, opt.Verbose,
+					progress, rc...)
+			})
+		})
+		progress.Stop()
+		if opt.SkipsImmutable(err) {
+			tlog.Info("target tag exists and is immutable, skipping")
+			return nil
+		}
+		if err != nil {
+			tlog.Error(err)
+			return err
 		}
 
-		if err := runSkopeo(r.wrOut, r.wrOut, opt.Verbose, rc...); err != nil {
-			log.Error(err)
-			errs = true
+		if opt.Verify != nil {
+			if err := opt.Verify(fmt.Sprintf("%s:%s", opt.SrcRef, t),
+				fmt.Sprintf("%s:%s", opt.TrgtRef, trgtTag)); err != nil {
+				tlog.Error(err)
+				return err
+			}
 		}
+
+		if opt.CheckDigest != nil {
+			if err := opt.CheckDigest(fmt.Sprintf("%s:%s", opt.SrcRef, t),
+				fmt.Sprintf("%s:%s", opt.TrgtRef, trgtTag)); err != nil {
+				tlog.Error(err)
+				return err
+			}
+		}
+
+		if opt.Referrers != nil {
+			if err := r.copyReferrers(cmd, opt, tlog,
+				fmt.Sprintf("%s:%s", opt.SrcRef, t)); err != nil {
+				tlog.Error(err)
+				return err
+			}
+		}
+
+		opt.Copied(fmt.Sprintf("%s:%s", opt.SrcRef, t),
+			fmt.Sprintf("%s:%s", opt.TrgtRef, trgtTag), started)
+		return nil
+	})
+
+	if len(errs) > 0 {
+		return fmt.Errorf("errors during sync: %w", errs)
 	}
 
-	if errs {
-		return fmt.Errorf("errors during sync")
+	return nil
+}
+
+// syncPinned copies the source image pinned to a digest as is, so that the
+// image at the target has the same digest. cmd is the skopeo command line
+// without source and destination.
+func (r *SkopeoRelay) syncPinned(cmd []string, opt *relays.SyncOptions,
+	logger *log.Entry) error {
+
+	src, trgt := opt.PinnedRefs()
+	dlog := logger.WithField("digest", opt.Digest)
+	started := time.Now()
+
+	if opt.IsUnchanged(src, trgt) {
+		dlog.Info("target image is up to date, skipping")
+		return nil
+	}
+
+	dlog.WithField("tag", opt.DigestTag).Info("syncing digest")
+
+	rc := append(cmd, fmt.Sprintf("docker://%s", src),
+		fmt.Sprintf("docker://%s", trgt), "--all", "--preserve-digests")
+	progress := opt.StartProgress(src)
+	err := opt.Attempt(func() error {
+		return runSkopeoCopy(opt.Ctx(), r.wrOut, opt.Verbose, progress, rc...)
+	})
+	progress.Stop()
+	if opt.SkipsImmutable(err) {
+		dlog.Info("target tag exists and is immutable, skipping")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error during sync: %v", err)
+	}
+
+	if opt.Verify != nil {
+		if err := opt.Verify(src, trgt); err != nil {
+			return fmt.Errorf("error during sync: %v", err)
+		}
+	}
+
+	if opt.CheckDigest != nil {
+		if err := opt.CheckDigest(src, trgt); err != nil {
+			return fmt.Errorf("error during sync: %v", err)
+		}
+	}
+
+	if opt.Referrers != nil {
+		if err := r.copyReferrers(cmd, opt, dlog, src); err != nil {
+			return fmt.Errorf("error during sync: %v", err)
+		}
+	}
+
+	opt.Copied(src, trgt, started)
+	return nil
+}
+
+// copyReferrers copies the signatures, attestations, and SBOMs of source image
+// src to the target repository, keeping their tags and digests. cmd is the
+// skopeo command line without source and destination.
+func (r *SkopeoRelay) copyReferrers(cmd []string, opt *relays.SyncOptions,
+	logger *log.Entry, src string) error {
+
+	refs, err := opt.Referrers(src)
+	if err != nil {
+		return fmt.Errorf("error finding signatures of '%s': %v", src, err)
+	}
+
+	for _, ref := range refs {
+		logger.WithField("ref", ref).Info("syncing signature")
+		rc := append(append([]string{}, cmd...), "--preserve-digests",
+			fmt.Sprintf("docker://%s%s", opt.SrcRef, ref),
+			fmt.Sprintf("docker://%s%s", opt.TrgtRef, ref))
+		if err := opt.Attempt(func() error {
+			return runSkopeo(opt.Ctx(), r.wrOut, r.wrOut, opt.Verbose, rc...)
+		}); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -17,26 +17,378 @@
 package relays
 
 import (
+	"context"
+	"fmt"
+	"regexp"
+	gosync "sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
 	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
+// validTag is the format of a tag as defined by the distribution spec
+var validTag = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// Archive is an OCI layout in object storage, which skopeo cannot access.
+// Images are therefore copied from and to it via a local OCI layout.
+type Archive interface {
+	// Fetch copies the image with tag t into a local OCI layout, and calls
+	// copy with the reference of the image in there.
+	Fetch(ctx context.Context, t string, copy func(src string) error) error
+	// Store calls copy with the reference of an image with tag t in a local
+	// OCI layout, and copies the image written there into the archive.
+	Store(ctx context.Context, t string, copy func(trgt string) error) error
+}
+
 //
 type SyncOptions struct {
 	//
 	SrcRef           string
 	SrcAuth          string
 	SrcSkipTLSVerify bool
+	SrcImage         func(tag string) string
+	SrcArchive       Archive
 	//
 	TrgtRef           string
 	TrgtAuth          string
 	TrgtSkipTLSVerify bool
+	TrgtArchive       Archive
+	//
+	Tags            *tags.TagSet
+	TagLister       func() ([]tags.Tag, error)
+	TagMap          func(tag string) string
+	Referrers       func(ref string) ([]string, error)
+	Unchanged       func(src, trgt string) (bool, error)
+	Verify          func(src, trgt string) error
+	CheckDigest     func(src, trgt string) error
+	HasPlatforms    func(src string) (bool, error)
+	HasArtifactType func(src string) (bool, error)
+	HasMetadata     func(src string) (bool, error)
+	HasManifestType func(src string) (bool, error)
+	Digest          string
+	DigestTag       string
+	Platform        string
+	Platforms       []string
+	Compression     string
+	SkipImmutable   bool
+	Verbose         bool
+	Log             *log.Entry
+	Context         context.Context
 	//
-	Tags     *tags.TagSet
-	Platform string
-	Verbose  bool
+	TagConcurrency int
+	Throttle       func()
+	Retry          func(op func() error) error
+	Slots          *util.Semaphore
+	OnProgress     func(bytes int64)
+	OnCopied       func(src, trgt string, d time.Duration)
+}
+
+// Logger returns the log entry to use when syncing with these options, which
+// carries fields such as task and repository. Without a log entry set in the
+// options, an entry without fields is returned.
+func (o *SyncOptions) Logger() *log.Entry {
+	if o.Log != nil {
+		return o.Log
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// Ctx returns the context for syncing with these options, which is canceled
+// when the task times out. Without a context set in the options, the
+// background context is returned.
+func (o *SyncOptions) Ctx() context.Context {
+	if o.Context != nil {
+		return o.Context
+	}
+	return context.Background()
+}
+
+// Lister returns a function for listing the tags of the source image. When a
+// native tag lister was set in the options, that one is used. Otherwise
+// fallback is called, which cannot provide push times, after waiting for the
+// throttle set in the options, if any, and retried as set in the options.
+func (o *SyncOptions) Lister(fallback func() ([]string, error)) func() (
+	[]tags.Tag, error) {
+
+	if o.TagLister != nil {
+		return o.TagLister
+	}
+
+	return func() ([]tags.Tag, error) {
+		o.WaitThrottle()
+		var names []string
+		err := o.Attempt(func() (err error) {
+			names, err = fallback()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return tags.FromNames(names), nil
+	}
+}
+
+// TargetTag returns the tag under which source tag t is pushed to the target.
+// This is t itself, unless a tag map was set in the options. It is an error
+// when the tag map produces an invalid tag.
+func (o *SyncOptions) TargetTag(t string) (string, error) {
+
+	if o.TagMap == nil {
+		return t, nil
+	}
+
+	mapped := o.TagMap(t)
+	if !IsValidTag(mapped) {
+		return "", fmt.Errorf(
+			"tag '%s' is mapped to invalid tag '%s'", t, mapped)
+	}
+	return mapped, nil
+}
+
+// SourceImage returns the reference of the source image with tag t, including
+// the transport as understood by skopeo. For a registry source, this is a
+// `docker://` reference, unless a source image function was set in the
+// options, e.g. for images in a local layout.
+func (o *SyncOptions) SourceImage(t string) string {
+	if o.SrcImage != nil {
+		return o.SrcImage(t)
+	}
+	return fmt.Sprintf("docker://%s:%s", o.SrcRef, t)
+}
+
+// Copy calls copy with the source image with tag t, and the target image with
+// target tag tt, both including the transport as understood by skopeo. Images
+// in an archive set in the options are copied via a local OCI layout.
+func (o *SyncOptions) Copy(t, tt string,
+	copy func(src, trgt string) error) error {
+
+	toTarget := func(src string) error {
+		if o.TrgtArchive != nil {
+			return o.TrgtArchive.Store(o.Ctx(), tt, func(trgt string) error {
+				return copy(src, trgt)
+			})
+		}
+		return copy(src, fmt.Sprintf("docker://%s:%s", o.TrgtRef, tt))
+	}
+
+	if o.SrcArchive != nil {
+		return o.SrcArchive.Fetch(o.Ctx(), t, toTarget)
+	}
+	return toTarget(o.SourceImage(t))
+}
+
+// PinnedRefs returns the source and target references for a source image that
+// is pinned to a digest. The target reference is tagged with the digest tag if
+// set in the options, and refers to the digest otherwise.
+func (o *SyncOptions) PinnedRefs() (src, trgt string) {
+	src = fmt.Sprintf("%s@%s", o.SrcRef, o.Digest)
+	if o.DigestTag != "" {
+		return src, fmt.Sprintf("%s:%s", o.TrgtRef, o.DigestTag)
+	}
+	return src, fmt.Sprintf("%s@%s", o.TrgtRef, o.Digest)
+}
+
+// IsUnchanged determines whether the image at target reference trgt has the
+// same digest as the image at source reference src, so that copying it can be
+// skipped. This is only checked when a digest comparison was set in the
+// options. When the digests cannot be compared, e.g. because the target image
+// does not exist yet, the image counts as changed.
+func (o *SyncOptions) IsUnchanged(src, trgt string) bool {
+
+	if o.Unchanged == nil {
+		return false
+	}
+
+	same, err := o.Unchanged(src, trgt)
+	if err != nil {
+		o.Logger().WithField("ref", trgt).Debugf(
+			"cannot compare digests: %v", err)
+		return false
+	}
+	return same
+}
+
+// LacksPlatforms determines whether source image src should be skipped
+// because it provides none of the platforms selected in the options. It is an
+// error if src lacks a selected platform and missing platforms are not to be
+// skipped. Without a platform check set in the options, nothing is skipped.
+func (o *SyncOptions) LacksPlatforms(src string) (bool, error) {
+	if o.HasPlatforms == nil {
+		return false, nil
+	}
+	ok, err := o.HasPlatforms(src)
+	return !ok, err
+}
+
+// LacksArtifactType determines whether source image src should be skipped
+// because it is not of an artifact type selected in the options. Without an
+// artifact type check set in the options, nothing is skipped.
+func (o *SyncOptions) LacksArtifactType(src string) (bool, error) {
+	if o.HasArtifactType == nil {
+		return false, nil
+	}
+	ok, err := o.HasArtifactType(src)
+	return !ok, err
+}
+
+// LacksMetadata determines whether source image src should be skipped because
+// its labels or annotations do not match those selected in the options.
+// Without a metadata check set in the options, nothing is skipped.
+func (o *SyncOptions) LacksMetadata(src string) (bool, error) {
+	if o.HasMetadata == nil {
+		return false, nil
+	}
+	ok, err := o.HasMetadata(src)
+	return !ok, err
+}
+
+// LacksManifestType determines whether source image src should be skipped
+// because it is not of the manifest type, image index or single image,
+// selected in the options. Without a manifest type check set in the options,
+// nothing is skipped.
+func (o *SyncOptions) LacksManifestType(src string) (bool, error) {
+	if o.HasManifestType == nil {
+		return false, nil
+	}
+	ok, err := o.HasManifestType(src)
+	return !ok, err
+}
+
+// SkipsImmutable determines whether error err of copying an image can be
+// skipped, because the tag already exists in a target repository with tag
+// immutability, and such conflicts are to be skipped as set in the options.
+func (o *SyncOptions) SkipsImmutable(err error) bool {
+	return o.SkipImmutable && util.IsImmutableTag(err)
+}
+
+// Copied is called by the relays for each image they copied from source
+// reference src to target reference trgt, after having started copying it at
+// started. It passes this on to the callback set in the options, if any.
+func (o *SyncOptions) Copied(src, trgt string, started time.Time) {
+	if o.OnCopied != nil {
+		o.OnCopied(src, trgt, time.Since(started))
+	}
+}
+
+// CopyAsIs determines whether images need to be copied as is, i.e. with all
+// platforms and keeping their digests. This is the case when signatures are
+// copied, which refer to the digest of the source image, and when source and
+// target digests get compared.
+func (o *SyncOptions) CopyAsIs() bool {
+	return o.Referrers != nil || o.Unchanged != nil || o.Verify != nil ||
+		o.CheckDigest != nil
+}
+
+// WithSlot calls copy while holding one of the copy slots set in the options,
+// which are shared by all tasks. Without slots set, copy is called right away.
+// Waiting for a slot ends when the context of the options is done.
+func (o *SyncOptions) WithSlot(copy func() error) error {
+	if err := o.Slots.Acquire(o.Ctx()); err != nil {
+		return err
+	}
+	defer o.Slots.Release()
+	return copy()
+}
+
+// WaitThrottle waits for the throttle set in the options, if any. Relays call
+// this before each request to the source registry.
+func (o *SyncOptions) WaitThrottle() {
+	if o.Throttle != nil {
+		o.Throttle()
+	}
+}
+
+// Attempt calls op, and retries it when it fails, with the retry function set
+// in the options. Without one, op is called once. Relays use this for each
+// single copy, so that a failing tag does not cause others to be copied again.
+// The throttle set in the options is waited for before each further attempt,
+// while waiting before the first one is left to the caller.
+func (o *SyncOptions) Attempt(op func() error) error {
+
+	if o.Retry == nil {
+		return op()
+	}
+
+	first := true
+	return o.Retry(func() error {
+		if !first {
+			o.WaitThrottle()
+		}
+		first = false
+		return op()
+	})
+}
+
+// EachTag calls sync for each tag in names, with up to the tag concurrency set
+// in the options running in parallel. Before each call, the throttle set in
+// the options is waited for, if any, and a copy slot is taken. The errors of
+// all failed tags are returned, in the order of names.
+func (o *SyncOptions) EachTag(names []string,
+	sync func(t string) error) util.Errors {
+
+	workers := o.TagConcurrency
+	if workers > len(names) {
+		workers = len(names)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]error, len(names))
+	next := make(chan int)
+	var wg gosync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ix := range next {
+				o.WaitThrottle()
+				results[ix] = o.WithSlot(func() error {
+					return sync(names[ix])
+				})
+			}
+		}()
+	}
+
+	for ix := range names {
+		next <- ix
+	}
+	close(next)
+	wg.Wait()
+
+	var errs util.Errors
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// IsValidTag checks whether t is a valid tag according to the distribution
+// spec.
+func IsValidTag(t string) bool {
+	return validTag.MatchString(t)
 }
 
 //
 type Support interface {
 	Platform(p string) error
+	Platforms(p []string) error
+	CopySignatures(c bool) error
+	Digest(digest, tag string) error
+	SkipExisting(e bool) error
+	Verify(v bool) error
+	PreserveDigests(p bool) error
+	LocalSource(l bool) error
+	TagConcurrency(n int) error
+	ArtifactTypes(t []string) error
+	SkipImmutable(s bool) error
+	TagRoutes(r bool) error
+	ArchiveTarget(a bool) error
+	Compression(c string) error
 }
@@ -0,0 +1,341 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package relays
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+//
+func TestTargetTag(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	opt := &SyncOptions{}
+	tag, err := opt.TargetTag("1.0")
+	th.AssertNoError(err)
+	th.AssertEqual("1.0", tag)
+
+	opt.TagMap = func(t string) string { return strings.TrimSuffix(t, "-ubi") }
+	tag, err = opt.TargetTag("1.0-ubi")
+	th.AssertNoError(err)
+	th.AssertEqual("1.0", tag)
+
+	opt.TagMap = func(t string) string { return "" }
+	_, err = opt.TargetTag("1.0")
+	th.AssertError(err, "mapped to invalid tag ''")
+
+	opt.TagMap = func(t string) string { return "-" + t }
+	_, err = opt.TargetTag("1.0")
+	th.AssertError(err, "mapped to invalid tag '-1.0'")
+}
+
+//
+func TestPinnedRefs(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	opt := &SyncOptions{
+		SrcRef:  "registry.hub.docker.com/library/busybox",
+		TrgtRef: "localhost:5000/library/busybox",
+		Digest:  "sha256:abc",
+	}
+
+	src, trgt := opt.PinnedRefs()
+	th.AssertEqual("registry.hub.docker.com/library/busybox@sha256:abc", src)
+	th.AssertEqual("localhost:5000/library/busybox@sha256:abc", trgt)
+
+	opt.DigestTag = "tested"
+	src, trgt = opt.PinnedRefs()
+	th.AssertEqual("registry.hub.docker.com/library/busybox@sha256:abc", src)
+	th.AssertEqual("localhost:5000/library/busybox:tested", trgt)
+}
+
+//
+func TestIsUnchanged(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	opt := &SyncOptions{}
+	th.AssertFalse(opt.IsUnchanged("src:1.0", "trgt:1.0"))
+
+	digests := map[string]string{
+		"src:1.0": "sha256:abc", "trgt:1.0": "sha256:abc",
+		"src:2.0": "sha256:def", "trgt:2.0": "sha256:abc"}
+
+	opt.Unchanged = func(src, trgt string) (bool, error) {
+		d, ok := digests[trgt]
+		if !ok {
+			return false, fmt.Errorf("'%s' not found", trgt)
+		}
+		return digests[src] == d, nil
+	}
+
+	th.AssertTrue(opt.IsUnchanged("src:1.0", "trgt:1.0"))
+	th.AssertFalse(opt.IsUnchanged("src:2.0", "trgt:2.0"))
+	th.AssertFalse(opt.IsUnchanged("src:3.0", "trgt:3.0"))
+}
+
+//
+func TestSkipsImmutable(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	conflict := fmt.Errorf("error during sync: %s",
+		"ImageTagAlreadyExistsException: tag 'v1' already exists")
+
+	opt := &SyncOptions{}
+	th.AssertFalse(opt.SkipsImmutable(conflict))
+
+	opt.SkipImmutable = true
+	th.AssertTrue(opt.SkipsImmutable(conflict))
+	th.AssertFalse(opt.SkipsImmutable(fmt.Errorf("manifest unknown")))
+	th.AssertFalse(opt.SkipsImmutable(nil))
+}
+
+//
+func TestCopyAsIs(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	opt := &SyncOptions{}
+	th.AssertFalse(opt.CopyAsIs())
+
+	opt.Verify = func(src, trgt string) error { return nil }
+	th.AssertTrue(opt.CopyAsIs())
+
+	opt = &SyncOptions{
+		Unchanged: func(src, trgt string) (bool, error) { return false, nil }}
+	th.AssertTrue(opt.CopyAsIs())
+
+	opt = &SyncOptions{
+		Referrers: func(ref string) ([]string, error) { return nil, nil }}
+	th.AssertTrue(opt.CopyAsIs())
+
+	opt = &SyncOptions{
+		CheckDigest: func(src, trgt string) error { return nil }}
+	th.AssertTrue(opt.CopyAsIs())
+}
+
+//
+func TestSourceImage(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	opt := &SyncOptions{SrcRef: "registry.hub.docker.com/library/busybox"}
+	th.AssertEqual("docker://registry.hub.docker.com/library/busybox:1.36",
+		opt.SourceImage("1.36"))
+
+	opt.SrcImage = func(t string) string { return "oci:/layout:" + t }
+	th.AssertEqual("oci:/layout:1.36", opt.SourceImage("1.36"))
+}
+
+//
+func TestEachTag(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var mu gosync.Mutex
+	active, maxSeen, throttled := 0, 0, 0
+
+	opt := &SyncOptions{
+		TagConcurrency: 3,
+		Throttle: func() {
+			mu.Lock()
+			throttled++
+			mu.Unlock()
+		},
+	}
+
+	names := []string{"1", "2", "fail-3", "4", "5", "fail-6", "7"}
+	errs := opt.EachTag(names, func(t string) error {
+		mu.Lock()
+		active++
+		if active > maxSeen {
+			maxSeen = active
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		if strings.HasPrefix(t, "fail") {
+			return fmt.Errorf("error syncing %s", t)
+		}
+		return nil
+	})
+
+	th.AssertEqual(3, maxSeen)
+	th.AssertEqual(len(names), throttled)
+	th.AssertEqual(2, len(errs))
+	th.AssertError(errs[0], "error syncing fail-3")
+	th.AssertError(errs[1], "error syncing fail-6")
+
+	// without tag concurrency, tags are synced one after another, and still
+	// throttled each
+	maxSeen, throttled = 0, 0
+	opt = &SyncOptions{Throttle: opt.Throttle}
+	th.AssertEqual(0, len(opt.EachTag(names[:3], func(t string) error {
+		mu.Lock()
+		active++
+		if active > maxSeen {
+			maxSeen = active
+		}
+		active--
+		mu.Unlock()
+		return nil
+	})))
+	th.AssertEqual(1, maxSeen)
+	th.AssertEqual(3, throttled)
+}
+
+//
+func TestLister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	throttled := 0
+	opt := &SyncOptions{Throttle: func() { throttled++ }}
+	list, err := opt.Lister(func() ([]string, error) {
+		return []string{"1.0", "2.0"}, nil
+	})()
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(list))
+	th.AssertEqual("2.0", list[1].Name)
+	th.AssertEqual(1, throttled)
+
+	// a native lister is used as is
+	opt.TagLister = func() ([]tags.Tag, error) {
+		return tags.FromNames([]string{"3.0"}), nil
+	}
+	list, err = opt.Lister(nil)()
+	th.AssertNoError(err)
+	th.AssertEqual("3.0", list[0].Name)
+	th.AssertEqual(1, throttled)
+}
+
+//
+func TestAttempt(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	calls := 0
+	failing := func() error {
+		if calls++; calls < 3 {
+			return fmt.Errorf("failed attempt %d", calls)
+		}
+		return nil
+	}
+
+	// without a retry function, op is called once
+	opt := &SyncOptions{}
+	th.AssertError(opt.Attempt(failing), "failed attempt 1")
+	th.AssertEqual(1, calls)
+
+	throttled := 0
+	opt = &SyncOptions{
+		Throttle: func() { throttled++ },
+		Retry: func(op func() error) error {
+			var err error
+			for i := 0; i < 3; i++ {
+				if err = op(); err == nil {
+					break
+				}
+			}
+			return err
+		},
+	}
+
+	// the first attempt is throttled by the caller, only retries here
+	calls = 0
+	th.AssertNoError(opt.Attempt(failing))
+	th.AssertEqual(3, calls)
+	th.AssertEqual(2, throttled)
+
+	// an op that succeeds is neither repeated nor throttled
+	done := 0
+	th.AssertNoError(opt.Attempt(func() error { done++; return nil }))
+	th.AssertEqual(1, done)
+	th.AssertEqual(2, throttled)
+}
+
+//
+func TestWithSlot(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var mu gosync.Mutex
+	active, maxSeen := 0, 0
+
+	sync := func(t string) error {
+		mu.Lock()
+		active++
+		if active > maxSeen {
+			maxSeen = active
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return nil
+	}
+
+	// slots are shared between options, and limit the tags in flight overall
+	slots := util.NewSemaphore(2)
+	names := []string{"1", "2", "3", "4", "5"}
+
+	var wg gosync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			opt := &SyncOptions{TagConcurrency: 3, Slots: slots}
+			th.AssertEqual(0, len(opt.EachTag(names, sync)))
+		}()
+	}
+	wg.Wait()
+
+	th.AssertEqual(2, maxSeen)
+
+	// waiting for a slot ends with the context
+	full := util.NewSemaphore(1)
+	th.AssertNoError(full.Acquire(context.Background()))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opt := &SyncOptions{Slots: full, Context: ctx}
+	called := false
+	th.AssertError(opt.WithSlot(func() error {
+		called = true
+		return nil
+	}), "context canceled")
+	th.AssertFalse(called)
+}
@@ -0,0 +1,155 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+)
+
+// defaults for the cooldown of a circuit breaker
+const (
+	defaultCooldown    = 10 * time.Minute
+	defaultMaxCooldown = 6 * time.Hour
+)
+
+// CircuitBreaker pauses a task after a number of consecutive failed runs.
+// Runs are then skipped for the cooldown, which doubles each time the breaker
+// opens again, up to the maximum cooldown.
+type CircuitBreaker struct {
+	Failures    int           `yaml:"failures"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+	MaxCooldown time.Duration `yaml:"max-cooldown"`
+}
+
+//
+func (c *CircuitBreaker) validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Failures <= 0 {
+		return errors.New(
+			"circuit breaker requires 'failures' to be a positive integer")
+	}
+
+	if c.Cooldown < 0 {
+		return errors.New("circuit breaker 'cooldown' must not be negative")
+	} else if c.Cooldown == 0 {
+		c.Cooldown = defaultCooldown
+	}
+
+	if c.MaxCooldown < 0 {
+		return errors.New(
+			"circuit breaker 'max-cooldown' must not be negative")
+	} else if c.MaxCooldown == 0 {
+		c.MaxCooldown = defaultMaxCooldown
+		if c.MaxCooldown < c.Cooldown {
+			c.MaxCooldown = c.Cooldown
+		}
+	} else if c.MaxCooldown < c.Cooldown {
+		return errors.New(
+			"circuit breaker 'max-cooldown' must not be less than 'cooldown'")
+	}
+
+	return nil
+}
+
+// breaker tracks the consecutive failed runs of a task for its circuit
+// breaker. A nil breaker never opens.
+type breaker struct {
+	conf     *CircuitBreaker
+	failures int
+	opened   int
+	until    time.Time
+}
+
+// newBreaker creates a breaker for task t, or returns nil if t has no circuit
+// breaker.
+func newBreaker(t *Task) *breaker {
+	if t.CircuitBreaker == nil {
+		return nil
+	}
+	return &breaker{conf: t.CircuitBreaker}
+}
+
+// state returns the state of this breaker at time now. Once the cooldown has
+// passed, an open breaker is half-open, i.e. a trial run is allowed.
+func (b *breaker) state(now time.Time) string {
+	switch {
+	case b == nil || b.opened == 0:
+		return metrics.CircuitClosed
+	case now.Before(b.until):
+		return metrics.CircuitOpen
+	default:
+		return metrics.CircuitHalfOpen
+	}
+}
+
+// allows determines whether a run may start at time now, which is the case
+// unless this breaker is open.
+func (b *breaker) allows(now time.Time) bool {
+	return b.state(now) != metrics.CircuitOpen
+}
+
+// record records the result of a run that ended at time now. A successful run
+// closes the breaker. A failed run opens it, once the number of consecutive
+// failures was reached, or when it was a trial run. Returns the cooldown if
+// the breaker opened, and 0 otherwise.
+func (b *breaker) record(failed bool, now time.Time) time.Duration {
+
+	if b == nil {
+		return 0
+	}
+
+	if !failed {
+		b.failures = 0
+		b.opened = 0
+		b.until = time.Time{}
+		return 0
+	}
+
+	b.failures++
+	if b.failures < b.conf.Failures {
+		return 0
+	}
+
+	cooldown := b.conf.Cooldown
+	for i := 0; i < b.opened && cooldown < b.conf.MaxCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > b.conf.MaxCooldown {
+		cooldown = b.conf.MaxCooldown
+	}
+
+	b.opened++
+	b.until = now.Add(cooldown)
+	return cooldown
+}
+
+// report reports the state of this breaker at time now for task, for the
+// status endpoint. A nil breaker is reported as no breaker.
+func (b *breaker) report(task string, now time.Time) {
+	if b == nil {
+		metrics.TaskCircuit(task, "", time.Time{})
+		return
+	}
+	metrics.TaskCircuit(task, b.state(now), b.until)
+}
@@ -0,0 +1,100 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestBreaker(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var none *breaker
+	now := time.Now()
+	th.AssertTrue(none.allows(now))
+	th.AssertEqual(time.Duration(0), none.record(true, now))
+	th.AssertEqual(metrics.CircuitClosed, none.state(now))
+
+	conf := &CircuitBreaker{Failures: 3, Cooldown: time.Minute,
+		MaxCooldown: 5 * time.Minute}
+	th.AssertNoError(conf.validate())
+	b := newBreaker(&Task{CircuitBreaker: conf})
+
+	// opens after the configured number of consecutive failures
+	th.AssertEqual(time.Duration(0), b.record(true, now))
+	th.AssertEqual(time.Duration(0), b.record(false, now))
+	th.AssertEqual(time.Duration(0), b.record(true, now))
+	th.AssertEqual(time.Duration(0), b.record(true, now))
+	th.AssertTrue(b.allows(now))
+	th.AssertEqual(time.Minute, b.record(true, now))
+	th.AssertEqual(metrics.CircuitOpen, b.state(now))
+	th.AssertFalse(b.allows(now.Add(30 * time.Second)))
+
+	// after the cooldown, a failed trial run opens it again right away, with
+	// exponential backoff up to the maximum cooldown
+	now = now.Add(time.Minute)
+	th.AssertEqual(metrics.CircuitHalfOpen, b.state(now))
+	th.AssertTrue(b.allows(now))
+	th.AssertEqual(2*time.Minute, b.record(true, now))
+	now = now.Add(2 * time.Minute)
+	th.AssertEqual(4*time.Minute, b.record(true, now))
+	now = now.Add(4 * time.Minute)
+	th.AssertEqual(5*time.Minute, b.record(true, now))
+	now = now.Add(5 * time.Minute)
+	th.AssertEqual(5*time.Minute, b.record(true, now))
+
+	// a successful trial run closes it
+	now = now.Add(5 * time.Minute)
+	th.AssertEqual(time.Duration(0), b.record(false, now))
+	th.AssertEqual(metrics.CircuitClosed, b.state(now))
+	th.AssertEqual(time.Duration(0), b.record(true, now))
+	th.AssertEqual(time.Duration(0), b.record(true, now))
+	th.AssertEqual(time.Minute, b.record(true, now))
+}
+
+//
+func TestCircuitBreakerConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	conf := &CircuitBreaker{Failures: 5}
+	th.AssertNoError(conf.validate())
+	th.AssertEqual(defaultCooldown, conf.Cooldown)
+	th.AssertEqual(defaultMaxCooldown, conf.MaxCooldown)
+
+	conf = &CircuitBreaker{Failures: 5, Cooldown: 12 * time.Hour}
+	th.AssertNoError(conf.validate())
+	th.AssertEqual(12*time.Hour, conf.MaxCooldown)
+
+	th.AssertError((&CircuitBreaker{}).validate(),
+		"circuit breaker requires 'failures' to be a positive integer")
+	th.AssertError((&CircuitBreaker{Failures: 1,
+		Cooldown: -time.Minute}).validate(),
+		"circuit breaker 'cooldown' must not be negative")
+	th.AssertError((&CircuitBreaker{Failures: 1,
+		MaxCooldown: -time.Minute}).validate(),
+		"circuit breaker 'max-cooldown' must not be negative")
+	th.AssertError((&CircuitBreaker{Failures: 1, Cooldown: time.Hour,
+		MaxCooldown: time.Minute}).validate(),
+		"circuit breaker 'max-cooldown' must not be less than 'cooldown'")
+}
@@ -0,0 +1,80 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"fmt"
+	gosync "sync"
+)
+
+// errBudgetUsedUp is the result of sync jobs that were not started, since the
+// task had already used up its budget
+var errBudgetUsedUp = errors.New("budget used up")
+
+// budget limits the bytes and the number of images a task copies per run.
+// Limits of 0 mean no limit.
+type budget struct {
+	maxBytes  int64
+	maxImages int
+	bytes     int64
+	images    int
+	mutex     gosync.Mutex
+}
+
+// newBudget creates a budget with the limits of task t, or returns nil if t
+// has no limits.
+func newBudget(t *Task) *budget {
+	if t.MaxBytes == 0 && t.MaxImages == 0 {
+		return nil
+	}
+	return &budget{maxBytes: t.MaxBytes, maxImages: t.MaxImages}
+}
+
+// copied records an image of size bytes as copied.
+func (b *budget) copied(size int64) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.bytes += size
+	b.images++
+}
+
+// usedUp determines whether any of the limits of this budget was reached.
+func (b *budget) usedUp() bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return (b.maxBytes > 0 && b.bytes >= b.maxBytes) ||
+		(b.maxImages > 0 && b.images >= b.maxImages)
+}
+
+//
+func (b *budget) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return fmt.Sprintf("%d images, %d bytes", b.images, b.bytes)
+}
+
+// jobKey identifies sync job j across task runs.
+func jobKey(j *syncJob) string {
+	return j.opt.SrcRef + " -> " + j.opt.TrgtRef
+}
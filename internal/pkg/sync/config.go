@@ -17,50 +17,223 @@
 package sync
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
 	"github.com/xelalexv/dregsy/internal/pkg/relays"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/containerd"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
 //
 const minimumTaskInterval = 30
 const minimumAuthRefreshInterval = time.Hour
+const defaultRetryInterval = 5 * time.Second
 
 //
 type SyncConfig struct {
-	Relay      string              `yaml:"relay"`
-	Docker     *docker.RelayConfig `yaml:"docker"`
-	Skopeo     *skopeo.RelayConfig `yaml:"skopeo"`
-	DockerHost string              `yaml:"dockerhost"`  // DEPRECATED
-	APIVersion string              `yaml:"api-version"` // DEPRECATED
-	Lister     *ListerConfig       `yaml:"lister"`
-	Tasks      []*Task             `yaml:"tasks"`
+	Relay           string                  `yaml:"relay"`
+	Docker          *docker.RelayConfig     `yaml:"docker"`
+	Skopeo          *skopeo.RelayConfig     `yaml:"skopeo"`
+	Containerd      *containerd.RelayConfig `yaml:"containerd"`
+	DockerHost      string                  `yaml:"dockerhost"`  // DEPRECATED
+	APIVersion      string                  `yaml:"api-version"` // DEPRECATED
+	Lister          *ListerConfig           `yaml:"lister"`
+	Metrics         *MetricsConfig          `yaml:"metrics"`
+	Webhook         *WebhookConfig          `yaml:"webhook"`
+	LogFormat       string                  `yaml:"log-format"`
+	MaxRepos        int                     `yaml:"max-repos"`
+	MaxCopies       int                     `yaml:"max-concurrent-copies"`
+	Strict          bool                    `yaml:"strict"`
+	JitterSeed      *int64                  `yaml:"jitter-seed"`
+	StateFile       string                  `yaml:"state-file"`
+	AutoPlatform    string                  `yaml:"auto-platform"`
+	ShutdownTimeout time.Duration           `yaml:"shutdown-timeout"`
+	Tasks           []*Task                 `yaml:"tasks"`
 }
 
 //
 func (c *SyncConfig) ValidateSupport(s relays.Support) error {
+	if errs := c.supportErrors(s); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+//
+func (c *SyncConfig) supportErrors(s relays.Support) []error {
+
+	var errs []error
 
 	for _, t := range c.Tasks {
+		if err := s.TagConcurrency(t.TagConcurrency); err != nil {
+			errs = append(errs, err)
+		}
 		for _, m := range t.Mappings {
+			if m == nil {
+				continue
+			}
 			if err := s.Platform(m.Platform); err != nil {
-				return err
+				errs = append(errs, err)
+			}
+			if err := s.Platforms(m.Platforms); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.CopySignatures(m.CopySignatures); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.Digest(m.digest, m.DigestTag); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.SkipExisting(m.SkipExisting); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.Verify(m.Verify); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.PreserveDigests(m.PreserveDigests); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.LocalSource(m.isLocal()); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.ArtifactTypes(m.ArtifactTypes); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.SkipImmutable(m.skipImmutable()); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.TagRoutes(m.hasTagRoutes()); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.ArchiveTarget(m.isArchived()); err != nil {
+				errs = append(errs, err)
+			}
+			if err := s.Compression(m.Compression); err != nil {
+				errs = append(errs, err)
 			}
 		}
 	}
 
-	return nil
+	return errs
 }
 
 //
 func (c *SyncConfig) validate() error {
+	if errs := c.validateAll(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// validateAll validates this config and returns all errors found, in the order
+// in which they were found.
+func (c *SyncConfig) validateAll() []error {
+
+	var errs []error
+
+	if err := c.validateRelay(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.Lister.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.Metrics.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := c.Webhook.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch c.LogFormat {
+	case "", "json", "text":
+	default:
+		errs = append(errs, fmt.Errorf(
+			"invalid 'log-format' '%s', must be 'json' or 'text'", c.LogFormat))
+	}
+
+	if c.MaxRepos < 0 {
+		errs = append(errs, errors.New("'max-repos' must not be negative"))
+	}
+
+	if c.MaxCopies < 0 {
+		errs = append(errs,
+			errors.New("'max-concurrent-copies' must not be negative"))
+	}
+
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs,
+			errors.New("'shutdown-timeout' must not be negative"))
+	}
+
+	platform, err := c.autoPlatform()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	st := newState(c.StateFile)
+	slots := util.NewSemaphore(c.MaxCopies)
+
+	for _, t := range c.Tasks {
+		t.lister = c.Lister
+		t.state = st
+		t.webhook = c.Webhook
+		t.strict = c.Strict
+		t.maxRepos = c.MaxRepos
+		t.slots = slots
+		t.seed = c.JitterSeed
+		t.platform = platform
+		errs = append(errs, t.validateAll()...)
+	}
+
+	return errs
+}
+
+// autoPlatform returns the platform that 'platform: auto' resolves to, which
+// is the 'auto-platform' setting if present, or else the platform on which
+// dregsy runs. The result is logged if any mapping uses 'platform: auto'.
+func (c *SyncConfig) autoPlatform() (string, error) {
+
+	platform := c.AutoPlatform
+	if platform == "" {
+		platform = hostPlatform()
+	} else if !isValidPlatform(platform) {
+		return "", fmt.Errorf(
+			"invalid 'auto-platform' '%s', must be 'os/arch[/variant]'",
+			platform)
+	}
+
+	for _, t := range c.Tasks {
+		for _, m := range t.Mappings {
+			if m != nil && m.Platform == PlatformAuto {
+				log.WithField("platform", platform).Info(
+					"resolved 'platform: auto'")
+				return platform, nil
+			}
+		}
+	}
+
+	return platform, nil
+}
+
+//
+func (c *SyncConfig) validateRelay() error {
 
 	if c.Relay == "" {
 		c.Relay = docker.RelayID
@@ -99,42 +272,223 @@ func (c *SyncConfig) validate() error {
 			}
 		}
 
-	case skopeo.RelayID:
+	case skopeo.RelayID, containerd.RelayID:
 		if c.DockerHost != "" {
 			return fmt.Errorf(
 				"setting 'dockerhost' implies '%s' relay, but relay is set to '%s'",
 				docker.RelayID, c.Relay)
 		}
+		if c.Relay == skopeo.RelayID && c.Skopeo != nil {
+			return c.Skopeo.Validate()
+		}
 
 	default:
 		return fmt.Errorf(
-			"invalid relay type: '%s', must be either '%s' or '%s'",
-			c.Relay, docker.RelayID, skopeo.RelayID)
+			"invalid relay type: '%s', must be one of '%s', '%s', or '%s'",
+			c.Relay, docker.RelayID, skopeo.RelayID, containerd.RelayID)
 	}
 
-	if err := c.Lister.validate(); err != nil {
-		return err
+	return nil
+}
+
+//
+func LoadConfig(file string) (*SyncConfig, error) {
+
+	config, err := readConfig(file)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, t := range c.Tasks {
-		if err := t.validate(); err != nil {
+	if err = config.validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// ValidateConfig checks the config in file without syncing anything, and
+// returns all errors found. In addition to what is checked when loading a
+// config, this also checks the relay's support for the mappings, and the
+// shape of the credentials of all registries. No registry is contacted.
+func ValidateConfig(file string) []error {
+
+	config, err := readConfig(file)
+	if err != nil {
+		return []error{err}
+	}
+
+	errs := config.validateAll()
+
+	switch config.Relay {
+	case docker.RelayID:
+		errs = append(errs, config.supportErrors(&docker.Support{})...)
+	case skopeo.RelayID:
+		errs = append(errs, config.supportErrors(&skopeo.Support{})...)
+	case containerd.RelayID:
+		errs = append(errs, config.supportErrors(&containerd.Support{})...)
+	}
+
+	for _, t := range config.Tasks {
+		for _, l := range append([]*Location{t.Source}, t.targets()...) {
+			if err := l.checkCredentials(); err != nil {
+				errs = append(errs, fmt.Errorf(
+					"registry '%s' in task '%s': %v", l.Registry, t.Name, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// readConfig reads the config from file. If file is a directory, all `*.yaml`
+// files in it are read in lexical order and merged into one config.
+func readConfig(file string) (*SyncConfig, error) {
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, fmt.Errorf("error loading config file '%s': %v", file, err)
+	}
+
+	if !info.IsDir() {
+		return readConfigFile(file)
+	}
+
+	files, err := filepath.Glob(filepath.Join(file, "*.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing config directory '%s': %v",
+			file, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no config files in directory '%s'", file)
+	}
+	sort.Strings(files)
+
+	config := &SyncConfig{}
+	origins := make(map[string]string)
+
+	for _, f := range files {
+		c, err := readConfigFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := config.merge(c, f, origins); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
+// merge merges config o read from file into this config. Each top-level
+// setting may only be set in one of the merged files, and task names have to
+// be unique across all files. origins tracks where a setting or task came from.
+func (c *SyncConfig) merge(o *SyncConfig, file string,
+	origins map[string]string) error {
+
+	check := func(key string, set bool) error {
+		if !set {
+			return nil
+		}
+		if prev, ok := origins[key]; ok {
+			return fmt.Errorf(
+				"%s is defined in both '%s' and '%s'", key, prev, file)
+		}
+		origins[key] = file
+		return nil
+	}
+
+	for _, s := range []struct {
+		key string
+		set bool
+	}{
+		{"'relay'", o.Relay != ""},
+		{"'docker'", o.Docker != nil},
+		{"'skopeo'", o.Skopeo != nil},
+		{"'containerd'", o.Containerd != nil},
+		{"'dockerhost'", o.DockerHost != ""},
+		{"'api-version'", o.APIVersion != ""},
+		{"'lister'", o.Lister != nil},
+		{"'metrics'", o.Metrics != nil},
+		{"'webhook'", o.Webhook != nil},
+		{"'log-format'", o.LogFormat != ""},
+		{"'max-repos'", o.MaxRepos != 0},
+		{"'max-concurrent-copies'", o.MaxCopies != 0},
+		{"'strict'", o.Strict},
+		{"'jitter-seed'", o.JitterSeed != nil},
+		{"'state-file'", o.StateFile != ""},
+		{"'shutdown-timeout'", o.ShutdownTimeout != 0},
+		{"'auto-platform'", o.AutoPlatform != ""},
+	} {
+		if err := check(s.key, s.set); err != nil {
 			return err
 		}
-		if c.Lister != nil && t.repoList != nil {
-			if c.Lister.MaxItems != 0 {
-				t.repoList.SetMaxItems(c.Lister.MaxItems)
-			}
-			if c.Lister.CacheDuration != 0 {
-				t.repoList.SetCacheDuration(c.Lister.CacheDuration)
-			}
+	}
+
+	for _, t := range o.Tasks {
+		if t == nil {
+			continue
 		}
+		if err := check(fmt.Sprintf("task '%s'", t.Name), true); err != nil {
+			return err
+		}
+	}
+
+	if o.Relay != "" {
+		c.Relay = o.Relay
+	}
+	if o.Docker != nil {
+		c.Docker = o.Docker
+	}
+	if o.Skopeo != nil {
+		c.Skopeo = o.Skopeo
+	}
+	if o.Containerd != nil {
+		c.Containerd = o.Containerd
+	}
+	if o.DockerHost != "" {
+		c.DockerHost = o.DockerHost
+	}
+	if o.APIVersion != "" {
+		c.APIVersion = o.APIVersion
+	}
+	if o.Lister != nil {
+		c.Lister = o.Lister
+	}
+	if o.Metrics != nil {
+		c.Metrics = o.Metrics
+	}
+	if o.Webhook != nil {
+		c.Webhook = o.Webhook
 	}
+	if o.LogFormat != "" {
+		c.LogFormat = o.LogFormat
+	}
+	if o.MaxRepos != 0 {
+		c.MaxRepos = o.MaxRepos
+	}
+	if o.MaxCopies != 0 {
+		c.MaxCopies = o.MaxCopies
+	}
+	if o.JitterSeed != nil {
+		c.JitterSeed = o.JitterSeed
+	}
+	if o.StateFile != "" {
+		c.StateFile = o.StateFile
+	}
+	if o.ShutdownTimeout != 0 {
+		c.ShutdownTimeout = o.ShutdownTimeout
+	}
+	if o.AutoPlatform != "" {
+		c.AutoPlatform = o.AutoPlatform
+	}
+	c.Strict = c.Strict || o.Strict
+	c.Tasks = append(c.Tasks, o.Tasks...)
 
 	return nil
 }
 
 //
-func LoadConfig(file string) (*SyncConfig, error) {
+func readConfigFile(file string) (*SyncConfig, error) {
 
 	data, err := ioutil.ReadFile(file)
 
@@ -142,17 +496,48 @@ func LoadConfig(file string) (*SyncConfig, error) {
 		return nil, fmt.Errorf("error loading config file '%s': %v", file, err)
 	}
 
+	expanded, err := util.ExpandEnv(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("error loading config file '%s': %v", file, err)
+	}
+
 	config := &SyncConfig{}
 
-	if err = yaml.Unmarshal(data, config); err != nil {
+	if err = yaml.Unmarshal([]byte(expanded), config); err != nil {
 		return nil, fmt.Errorf("error parsing config file '%s': %v", file, err)
 	}
 
-	if err = config.validate(); err != nil {
-		return nil, err
+	return config, nil
+}
+
+//
+type MetricsConfig struct {
+	Address     string  `yaml:"address"`
+	GraceFactor float64 `yaml:"grace-factor"`
+}
+
+//
+func (c *MetricsConfig) validate() error {
+
+	if c == nil {
+		return nil
 	}
 
-	return config, nil
+	if c.Address == "" {
+		return errors.New("metrics config requires an 'address'")
+	}
+
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("invalid metrics address '%s': %v", c.Address, err)
+	}
+
+	if c.GraceFactor == 0 {
+		c.GraceFactor = metrics.DefaultGraceFactor
+	} else if c.GraceFactor < 1 {
+		return errors.New("'grace-factor' must be at least 1")
+	}
+
+	return nil
 }
 
 //
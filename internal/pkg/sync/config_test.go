@@ -17,9 +17,12 @@
 package sync
 
 import (
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/xelalexv/dregsy/internal/pkg/test"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
 //
@@ -36,6 +39,103 @@ func TestValidSyncConfigs(t *testing.T) {
 	th.AssertNoError(e)
 	th.AssertNotNil(c)
 	th.AssertEqual("docker", c.Relay)
+
+	c, e = LoadConfig(th.GetFixture("config/containerd-valid.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual("containerd", c.Relay)
+	th.AssertEqual("mirror", c.Containerd.Namespace)
+
+	// repo list is only needed for regex 'from', so lister config is not
+	// validated otherwise
+	c, e = LoadConfig(th.GetFixture("config/source-ecr-unused-lister.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertNil(c.Tasks[0].repoList)
+
+	// no source registry needed when all mappings read from local layouts
+	c, e = LoadConfig(th.GetFixture("config/local-layout.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual("", c.Tasks[0].Source.Registry)
+	th.AssertEqual("/mirror/app", c.Tasks[0].Mappings[0].mapPath(
+		c.Tasks[0].Mappings[0].From))
+
+	// no target registry needed when all mappings sync to object storage
+	c, e = LoadConfig(th.GetFixture("config/archive.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual("", c.Tasks[0].Target.Registry)
+	th.AssertEqual("s3://images/archive/busybox",
+		c.Tasks[0].Mappings[0].destRef(c.Tasks[0].Target, 0, "busybox"))
+	th.AssertEqual("s3://images/archive/busybox",
+		c.Tasks[0].sourceRef(c.Tasks[0].Mappings[1], ""))
+
+	// source host without port in destination path
+	c, e = LoadConfig(th.GetFixture("config/mapping-placeholders.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual("/registry.hub.docker.com/library/nginx",
+		c.Tasks[0].Mappings[0].mapPath(c.Tasks[0].Mappings[0].From))
+
+	c, e = LoadConfig(th.GetFixture("config/location-conn-pool.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual(200, c.Tasks[0].Source.transport.MaxIdleConns)
+	th.AssertEqual(50, c.Tasks[0].Source.transport.MaxIdleConnsPerHost)
+	th.AssertEqual(50, c.Tasks[0].Source.transport.MaxConnsPerHost)
+	th.AssertEqual(5*time.Minute, c.Tasks[0].Source.transport.IdleConnTimeout)
+	th.AssertEqual(util.DefaultMaxIdleConns,
+		c.Tasks[0].Target.transport.MaxIdleConns)
+
+	c, e = LoadConfig(th.GetFixture("config/location-ecr-repository.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertTrue(c.Tasks[0].Target.autoCreate())
+	th.AssertEqual("KMS", c.Tasks[0].Target.ECRRepository.Encryption)
+
+	c, e = LoadConfig(th.GetFixture("config/source-ecr-aws-tags.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertTrue(c.Tasks[0].repoList.CanListResourceTags())
+
+	c, e = LoadConfig(th.GetFixture("config/source-ecr-aws-lifecycle.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertTrue(c.Tasks[0].repoList.CanPreviewLifecycle())
+	th.AssertTrue(c.Tasks[0].Mappings[0].AWSLifecycle)
+
+	c, e = LoadConfig(th.GetFixture("config/source-ecr-only-active.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual(defaultActiveWindow, c.Tasks[0].Mappings[0].activeWindow)
+	th.AssertEqual(72*time.Hour, c.Tasks[0].Mappings[1].activeWindow)
+	th.AssertFalse(c.Tasks[0].Mappings[2].onlyActive())
+
+	// auth command allows refresh also for non-ECR registries
+	c, e = LoadConfig(th.GetFixture("config/source-auth-command.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertNotNil(c.Tasks[0].Source.creds)
+
+	// 'platform: auto' resolves to the host platform, or 'auto-platform'
+	c, e = LoadConfig(th.GetFixture("config/platform-auto.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual(runtime.GOOS+"/"+runtime.GOARCH,
+		c.Tasks[0].Mappings[0].Platform)
+	th.AssertEqual("linux/amd64", c.Tasks[0].Mappings[1].Platform)
+
+	c, e = LoadConfig(th.GetFixture("config/platform-auto-default.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual("linux/arm64/v8", c.Tasks[0].Mappings[0].Platform)
+	th.AssertEqual("linux/amd64", c.Tasks[0].Mappings[1].Platform)
+
+	// non-regex 'to' for regex 'from' is only an error in strict mode
+	c, e = LoadConfig(th.GetFixture("config/mapping-regex-from-plain-to.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
 }
 
 //
@@ -47,6 +147,9 @@ func TestInvalidSyncConfigs(t *testing.T) {
 	tryConfig(th, "config/invalid-relay.yaml", "invalid relay type")
 	tryConfig(th, "config/multiple-relays.yaml",
 		"setting 'dockerhost' implies 'docker' relay")
+	tryConfig(th, "config/skopeo-bad-extra-args.yaml",
+		"skopeo 'extra-args' item '--retry-times 3' contains invalid "+
+			"characters")
 
 	// task
 	tryConfig(th, "config/task-no-name.yaml", "a task requires a name")
@@ -54,18 +157,266 @@ func TestInvalidSyncConfigs(t *testing.T) {
 		"minimum task interval is 30 seconds")
 	tryConfig(th, "config/task-bad-interval.yaml",
 		"task interval needs to be 0 or a positive integer")
+	tryConfig(th, "config/task-bad-max-bytes.yaml",
+		"'max-bytes' must not be negative")
+	tryConfig(th, "config/task-bad-report.yaml",
+		"'report' must end in '.json' or '.csv'")
+	tryConfig(th, "config/task-warm-up-no-state.yaml",
+		"'warm-up' in task 'test' requires a global 'state-file'")
 	tryConfig(th, "config/task-no-source.yaml",
 		"source registry in task 'test' invalid: location is nil")
 	tryConfig(th, "config/task-no-target.yaml",
 		"target registry in task 'test' invalid: location is nil")
+	tryConfig(th, "config/task-target-and-targets.yaml",
+		"'target' and 'targets' cannot both be set in task 'test'")
+	tryConfig(th, "config/task-duplicate-targets.yaml",
+		"target registry 'localhost:5000' appears more than once in task 'test'")
 
 	// source & target locations
 	tryConfig(th, "config/source-no-registry.yaml",
 		"source registry in task 'test' invalid: registry not set")
 	tryConfig(th, "config/source-not-ecr.yaml", "is not an ECR registry")
+	tryConfig(th, "config/source-role-not-ecr.yaml",
+		"wants to assume a role, but is not an ECR registry")
+	tryConfig(th, "config/source-token-and-command.yaml",
+		"'auth-token' and 'auth-command' cannot be used together")
+	tryConfig(th, "config/source-helper-and-token.yaml",
+		"'credential-helper' cannot be combined with 'auth-token'")
+	tryConfig(th, "config/source-token-with-auth.yaml",
+		"cannot be combined with 'auth'")
+	tryConfig(th, "config/source-token-ecr.yaml",
+		"'credential-helper' are not supported")
 
 	// mappings
 	tryConfig(th, "config/mapping-no-from.yaml", "mapping without 'From' path")
+	tryConfig(th, "config/mapping-bad-semver.yaml", "invalid semver filter")
+	tryConfig(th, "config/mapping-bad-tag-regex.yaml",
+		"'tags' uses invalid format")
+	tryConfig(th, "config/mapping-bad-tag-source.yaml",
+		"must be an http or https URL")
+	tryConfig(th, "config/mapping-bad-tags-exclude.yaml",
+		"'tags-exclude' uses invalid format")
+	tryConfig(th, "config/mapping-bad-max-tags.yaml",
+		"'max-tags' must not be negative")
+	tryConfig(th, "config/mapping-bad-tag-map.yaml",
+		"replacement expression missing in 'tag-map'")
+	tryConfig(th, "config/mapping-bad-artifact-type.yaml",
+		"'artifact-types' must contain 'image' or media types, not 'helm'")
+	tryConfig(th, "config/mapping-bad-since.yaml",
+		"'since' must be a date or a positive duration")
+	tryConfig(th, "config/mapping-bad-platform-missing.yaml",
+		"'platform-missing' must be 'skip' or 'fail', not 'ignore'")
+	tryConfig(th, "config/mapping-platform-missing-no-platform.yaml",
+		"'platform-missing' requires 'platform' other than 'all'")
+	tryConfig(th, "config/mapping-bad-on-immutable.yaml",
+		"'on-immutable' must be 'skip' or 'fail', not 'ignore'")
+	tryConfig(th, "config/mapping-bad-tag-prefix.yaml",
+		"invalid 'tag-prefix' 'mirror:'")
+	tryConfig(th, "config/mapping-bad-match-labels.yaml",
+		"'match-labels' cannot contain an empty key")
+	tryConfig(th, "config/mapping-local-match-annotations.yaml",
+		"'match-annotations' cannot be used with a local 'from'")
+	tryConfig(th, "config/mapping-bad-manifest-type.yaml",
+		"'manifest-type' must be 'index', 'image', or 'any', not 'multi'")
+	tryConfig(th, "config/mapping-local-manifest-type.yaml",
+		"'manifest-type' cannot be used with a local 'from'")
+	tryConfig(th, "config/mapping-bad-tag-routes.yaml",
+		"tag route 1 uses invalid pattern 'regex:1.('")
+	tryConfig(th, "config/mapping-bad-until.yaml",
+		"'until' must be a date or a positive duration")
+	tryConfig(th, "config/mapping-until-before-since.yaml",
+		"'until' must not be before 'since'")
+	tryConfig(th, "config/mapping-to-uppercase.yaml",
+		"invalid destination path '/mirror/BusyBox': path must be lowercase")
+	tryConfig(th, "config/mapping-to-empty-segment.yaml",
+		"path contains an empty segment")
+	tryConfig(th, "config/mapping-regex-from-plain-to-strict.yaml",
+		"appends the complete source path to the destination")
+	tryConfig(th, "config/task-cron-and-interval.yaml",
+		"'cron' and 'interval' in task 'nightly' cannot both be set")
+	tryConfig(th, "config/task-bad-cron.yaml",
+		"invalid 'cron' in task 'nightly'")
+	tryConfig(th, "config/task-bad-timezone.yaml",
+		"invalid 'timezone' in task 'nightly'")
+	tryConfig(th, "config/task-timezone-without-cron.yaml",
+		"'timezone' in task 'nightly' requires 'cron'")
+	tryConfig(th, "config/task-bad-jitter.yaml",
+		"'jitter' in task 'test' must not be negative")
+	tryConfig(th, "config/task-jitter-one-off.yaml",
+		"'jitter' in task 'test' requires 'interval' or 'cron'")
+	tryConfig(th, "config/task-jitter-exceeds-interval.yaml",
+		"'jitter' in task 'test' must not exceed half the interval")
+	tryConfig(th, "config/task-bad-retries.yaml",
+		"'retries' must not be negative")
+	tryConfig(th, "config/task-bad-concurrency.yaml",
+		"'concurrency' must not be negative")
+	tryConfig(th, "config/task-bad-tag-concurrency.yaml",
+		"'tag-concurrency' must not be negative")
+	tryConfig(th, "config/task-bad-timeout.yaml",
+		"'timeout' must not be negative")
+	tryConfig(th, "config/task-circuit-breaker-one-off.yaml",
+		"'circuit-breaker' in task 'test' requires 'interval' or 'cron'")
+	tryConfig(th, "config/location-bad-ca-cert.yaml",
+		"invalid 'ca-cert': no certificates found in")
+	tryConfig(th, "config/location-bad-proxy.yaml",
+		"invalid proxy URL 'ftp://proxy.acme.com'")
+	tryConfig(th, "config/location-bad-rate-limit.yaml",
+		"'rate-limit' must not be negative")
+	tryConfig(th, "config/location-bad-max-conns.yaml",
+		"'max-conns-per-host' must not be negative")
+	tryConfig(th, "config/location-bad-idle-conn-timeout.yaml",
+		"'idle-conn-timeout' must not be negative")
+	tryConfig(th, "config/location-bad-ecr-encryption.yaml",
+		"invalid 'encryption' 'DES', must be 'AES256' or 'KMS'")
+	tryConfig(th, "config/location-bad-ecr-repository.yaml",
+		"'localhost:5000' has 'ecr-repository', but is not an ECR registry")
+	tryConfig(th, "config/location-ecr-no-auto-create.yaml",
+		"'ecr-repository' requires 'auto-create'")
+	tryConfig(th, "config/location-target-rate-limit.yaml",
+		"'rate-limit' in task 'test' is only supported for source registry")
+	tryConfig(th, "config/metrics-bad-address.yaml",
+		"invalid metrics address 'localhost'")
+	tryConfig(th, "config/metrics-bad-grace-factor.yaml",
+		"'grace-factor' must be at least 1")
+	tryConfig(th, "config/bad-max-repos.yaml",
+		"'max-repos' must not be negative")
+	tryConfig(th, "config/bad-max-concurrent-copies.yaml",
+		"'max-concurrent-copies' must not be negative")
+	tryConfig(th, "config/bad-auto-platform.yaml",
+		"invalid 'auto-platform' 'arm64', must be 'os/arch[/variant]'")
+	tryConfig(th, "config/bad-shutdown-timeout.yaml",
+		"'shutdown-timeout' must not be negative")
+	tryConfig(th, "config/mapping-bad-max-repos.yaml",
+		"'max-repos' must not be negative")
+	tryConfig(th, "config/bad-log-format.yaml",
+		"invalid 'log-format' 'xml', must be 'json' or 'text'")
+	tryConfig(th, "config/webhook-bad-trigger.yaml",
+		"invalid webhook trigger 'sometimes'")
+	tryConfig(th, "config/task-bad-webhook.yaml",
+		"task 'test': invalid webhook URL 'hooks.example.com'")
+	tryConfig(th, "config/mapping-bad-only-active.yaml",
+		"'only-active' must be a boolean or a positive duration")
+	tryConfig(th, "config/mapping-unsupported-only-active.yaml",
+		"'only-active' in task 'test' is not supported by source registry")
+	tryConfig(th, "config/mapping-prune-without-filter.yaml",
+		"'prune' requires 'since' or 'only-active'")
+	tryConfig(th, "config/mapping-pinned-prune.yaml",
+		"'prune' cannot be used with a digest in 'from'")
+	tryConfig(th, "config/mapping-aws-tags-plain-from.yaml",
+		"'aws-tags' requires a regex or glob 'from'")
+	tryConfig(th, "config/mapping-unsupported-aws-tags.yaml",
+		"'aws-tags' in task 'test' is only supported for ECR sources")
+	tryConfig(th, "config/mapping-unsupported-aws-lifecycle.yaml",
+		"'aws-lifecycle' in task 'test' is only supported for ECR sources")
+	tryConfig(th, "config/mapping-bad-platforms.yaml",
+		"invalid platform 'linux', must be 'os/arch[/variant]'")
+	tryConfig(th, "config/mapping-platform-and-platforms.yaml",
+		"'platform' and 'platforms' cannot both be set")
+	tryConfig(th, "config/mapping-copy-signatures-platform.yaml",
+		"'copy-signatures' requires syncing all platforms")
+	tryConfig(th, "config/mapping-skip-existing-platform.yaml",
+		"'skip-existing' requires syncing all platforms")
+	tryConfig(th, "config/mapping-verify-platform.yaml",
+		"'verify' requires syncing all platforms")
+	tryConfig(th, "config/mapping-preserve-digests-platform.yaml",
+		"'preserve-digests' requires syncing all platforms")
+	tryConfig(th, "config/mapping-local-preserve-digests.yaml",
+		"'preserve-digests' cannot be used with a local 'from'")
+	tryConfig(th, "config/mapping-local-no-to.yaml",
+		"a local 'from' requires a plain path in 'to'")
+	tryConfig(th, "config/mapping-local-since.yaml",
+		"'since' cannot be used with a local 'from'")
+	tryConfig(th, "config/mapping-bad-compression.yaml",
+		"'compression' must be 'gzip', 'zstd', or 'keep', not 'lz4'")
+	tryConfig(th, "config/mapping-compression-verify.yaml",
+		"'compression' 'zstd' recompresses layers, and cannot be combined "+
+			"with 'verify'")
+	tryConfig(th, "config/mapping-archive-regex-from.yaml",
+		"object storage in 'to' requires a single repository in 'from'")
+	tryConfig(th, "config/mapping-archive-skip-existing.yaml",
+		"'skip-existing' cannot be used with object storage in 'to'")
+	tryConfig(th, "config/mapping-archive-no-bucket.yaml",
+		"no bucket for layout 's3:///busybox'")
+}
+
+//
+func TestConfigDir(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	c, e := LoadConfig(th.GetFixture("config/conf.d"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual("skopeo", c.Relay)
+	th.AssertEqual(50, c.Lister.MaxItems)
+	th.AssertEqual(2, len(c.Tasks))
+	th.AssertEqual("team-a", c.Tasks[0].Name)
+	th.AssertEqual("team-b", c.Tasks[1].Name)
+	th.AssertEqual(c.Lister, c.Tasks[1].lister)
+
+	// global settings from one file apply to tasks in others
+	c, e = LoadConfig(th.GetFixture("config/conf.d-globals"))
+	th.AssertNoError(e)
+	th.AssertEqual("/tmp/dregsy-state.json", c.StateFile)
+	th.AssertTrue(c.Tasks[0].WarmUp)
+	th.AssertEqual(45*time.Second, c.ShutdownTimeout)
+	th.AssertEqual("linux/s390x", c.Tasks[0].Mappings[0].Platform)
+
+	tryConfig(th, "config/conf.d-duplicate-task",
+		"task 'team-a' is defined in both")
+	tryConfig(th, "config/conf.d-duplicate-setting",
+		"'relay' is defined in both")
+}
+
+//
+func TestConfigEnv(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	t.Setenv("DREGSY_TEST_TASK", "env-task")
+	t.Setenv("DREGSY_TEST_ACCOUNT", "123456789012")
+	t.Setenv("DREGSY_TEST_TARGET", "")
+
+	c, e := LoadConfig(th.GetFixture("config/env.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+
+	task := c.Tasks[0]
+	th.AssertEqual("env-task-${HOME}", task.Name)
+	th.AssertEqual("123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+		task.Source.Registry)
+	th.AssertEqual("localhost:5000", task.Target.Registry)
+	th.AssertEqual("mirror/app", task.Mappings[0].mapPath("library/app"))
+
+	tryConfig(th, "config/env-unset.yaml", "environment variables not set: "+
+		"DREGSY_TEST_UNSET, DREGSY_TEST_UNSET_TOO")
+}
+
+//
+func TestValidateConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertEqual(0,
+		len(ValidateConfig(th.GetFixture("config/skopeo-valid.yaml"))))
+
+	errs := ValidateConfig(th.GetFixture("config/validate-errors.yaml"))
+	want := []string{
+		"minimum task interval is 30 seconds",
+		"'tags' uses invalid format",
+		"'max-tags' must not be negative",
+		"relay 'docker' does not support mappings with 'platforms'",
+		"registry '123456789012.dkr.ecr.eu-central-1.amazonaws.org' in task " +
+			"'other': looks like an ECR registry, but is not recognized as one",
+	}
+	th.AssertEqual(len(want), len(errs))
+	for ix, e := range errs {
+		th.AssertError(e, want[ix])
+	}
+
+	errs = ValidateConfig(th.GetFixture("config/does-not-exist.yaml"))
+	th.AssertEqual(1, len(errs))
+	th.AssertError(errs[0], "error loading config file")
 }
 
 //
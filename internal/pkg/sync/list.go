@@ -0,0 +1,100 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ListRegistry lists the repositories of registry reg with the same list
+// source that is used when syncing from it, and writes them to w, one per
+// line. With withTags, the tags of each repository are written instead, one
+// line per tag in the form `repo:tag`. Credentials, lister, and TLS settings
+// are taken from the first task in conf whose source is reg. Without such a
+// task, or if conf is nil, the registry is accessed anonymously.
+func ListRegistry(conf *SyncConfig, reg string, withTags bool,
+	w io.Writer) error {
+
+	t, err := listTask(conf, reg)
+	if err != nil {
+		return err
+	}
+
+	list, err := t.getRepoList()
+	if err != nil {
+		return err
+	}
+	// everything is listed, and only once
+	list.SetMaxItems(-1)
+	list.SetCacheDuration(0)
+
+	ctx, cancel := t.runContext(context.Background())
+	defer cancel()
+
+	var repos []string
+	if err := t.retry(ctx, func() error {
+		var err error
+		repos, err = list.Get(ctx)
+		return err
+	}); err != nil {
+		return fmt.Errorf("error listing repositories of '%s': %v", reg, err)
+	}
+
+	for _, r := range repos {
+
+		if !withTags {
+			fmt.Fprintln(w, r)
+			continue
+		}
+
+		tags, err := t.sourceLister(ctx, t.Source.Registry+"/"+r, false)()
+		if err != nil {
+			return fmt.Errorf("error listing tags of '%s': %v", r, err)
+		}
+		for _, tag := range tags {
+			fmt.Fprintf(w, "%s:%s\n", r, tag.Name)
+		}
+	}
+
+	return nil
+}
+
+// listTask returns the task to use for listing registry reg, i.e. the first
+// task in conf with reg as its source, or a task with a plain source location
+// for reg if there is none.
+func listTask(conf *SyncConfig, reg string) (*Task, error) {
+
+	if conf != nil {
+		for _, t := range conf.Tasks {
+			if t.Source != nil && t.Source.Registry == reg {
+				log.WithField("task", t.Name).Info(
+					"using source settings of task")
+				return t, nil
+			}
+		}
+	}
+
+	t := &Task{Name: "list", Source: &Location{Registry: reg}}
+	if err := t.Source.validate(); err != nil {
+		return nil, fmt.Errorf("invalid registry '%s': %v", reg, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,87 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestListRegistry(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/v2/":
+				w.WriteHeader(http.StatusOK)
+			case r.URL.Path == "/v2/_catalog":
+				json.NewEncoder(w).Encode(map[string][]string{
+					"repositories": {"library/alpine", "team/app"}})
+			case strings.HasSuffix(r.URL.Path, "/tags/list"):
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"name": strings.TrimSuffix(strings.TrimPrefix(
+						r.URL.Path, "/v2/"), "/tags/list"),
+					"tags": []string{"1.0", "latest"}})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	// without config, the catalog is used
+	out := new(bytes.Buffer)
+	th.AssertNoError(ListRegistry(nil, host, false, out))
+	th.AssertEqual("library/alpine\nteam/app\n", out.String())
+
+	// lister settings are taken from the task with this source
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: %s
+    lister:
+      type: v2
+  target:
+    registry: localhost:5000
+  mappings:
+  - from: library/alpine
+`, host)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	out.Reset()
+	th.AssertNoError(ListRegistry(c, host, true, out))
+	th.AssertEqual("library/alpine:1.0\nlibrary/alpine:latest\n"+
+		"team/app:1.0\nteam/app:latest\n", out.String())
+
+	th.AssertError(ListRegistry(nil, "", false, out), "registry not set")
+}
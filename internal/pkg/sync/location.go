@@ -19,25 +19,52 @@ package sync
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/ecr"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/xelalexv/dregsy/internal/pkg/auth"
 	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
 //
 type Location struct {
-	Registry      string            `yaml:"registry"`
-	Auth          string            `yaml:"auth"`
-	SkipTLSVerify bool              `yaml:"skip-tls-verify"`
-	AuthRefresh   *time.Duration    `yaml:"auth-refresh"`
-	ListerConfig  map[string]string `yaml:"lister"`
-	ListerType    registry.ListSourceType
+	Registry        string            `yaml:"registry"`
+	Auth            string            `yaml:"auth"`
+	AuthToken       string            `yaml:"auth-token"`
+	AuthCommand     []string          `yaml:"auth-command"`
+	CredHelper      string            `yaml:"credential-helper"`
+	SkipTLSVerify   bool              `yaml:"skip-tls-verify"`
+	CACert          string            `yaml:"ca-cert"`
+	Proxy           string            `yaml:"proxy"`
+	AuthRefresh     *time.Duration    `yaml:"auth-refresh"`
+	RoleARN         string            `yaml:"role-arn"`
+	ExternalID      string            `yaml:"external-id"`
+	ListerConfig    map[string]string `yaml:"lister"`
+	RateLimit       int               `yaml:"rate-limit"`
+	MaxIdleConns    int               `yaml:"max-idle-conns"`
+	MaxConnsPerHost int               `yaml:"max-conns-per-host"`
+	IdleConnTimeout *time.Duration    `yaml:"idle-conn-timeout"`
+	AutoCreate      *bool             `yaml:"auto-create"`
+	ECRRepository   *ECRRepository    `yaml:"ecr-repository"`
+	ListerType      registry.ListSourceType
 	//
-	creds *auth.Credentials
+	creds     *auth.Credentials
+	limiter   *util.RateLimiter
+	transport *http.Transport
+}
+
+// ECRRepository holds the settings for repositories that get created in an
+// ECR target registry.
+type ECRRepository struct {
+	ScanOnPush      bool   `yaml:"scan-on-push"`
+	TagImmutability bool   `yaml:"tag-immutability"`
+	Encryption      string `yaml:"encryption"`
+	KMSKey          string `yaml:"kms-key"`
 }
 
 //
@@ -51,6 +78,28 @@ func (l *Location) validate() error {
 		return errors.New("registry not set")
 	}
 
+	if l.SkipTLSVerify {
+		log.WithField("registry", l.Registry).Warn(
+			"TLS verification is disabled")
+	}
+
+	conf, err := util.TLSConfig(l.CACert, l.SkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf("invalid 'ca-cert': %v", err)
+	}
+	pool, err := l.connPool()
+	if err != nil {
+		return err
+	}
+	if l.transport, err = util.HTTPTransport(conf, l.Proxy, pool); err != nil {
+		return err
+	}
+
+	if l.RateLimit < 0 {
+		return errors.New("'rate-limit' must not be negative")
+	}
+	l.limiter = util.NewRateLimiter(l.RateLimit)
+
 	if l.ListerConfig != nil {
 		if typ, ok := l.ListerConfig["type"]; ok {
 			l.ListerType = registry.ListSourceType(typ)
@@ -79,6 +128,10 @@ func (l *Location) validate() error {
 		l.creds = &auth.Credentials{}
 	}
 
+	if err := l.validateTokenAuth(disableAuth); err != nil {
+		return err
+	}
+
 	var interval time.Duration
 
 	if l.AuthRefresh != nil {
@@ -91,12 +144,27 @@ func (l *Location) validate() error {
 		}
 	}
 
+	if l.ExternalID != "" && l.RoleARN == "" {
+		return errors.New("'external-id' requires 'role-arn' to be set")
+	}
+
 	if l.IsECR() {
 		_, region, account := l.GetECR()
-		l.creds.SetRefresher(auth.NewECRAuthRefresher(account, region, interval))
+		l.creds.SetRefresher(auth.NewECRAuthRefresher(
+			account, region, interval, l.AWSRole(), l.transport))
+	} else if len(l.AuthCommand) > 0 {
+		l.creds.SetRefresher(
+			auth.NewCommandAuthRefresher(l.AuthCommand, interval))
+	} else if l.CredHelper != "" {
+		l.creds.SetRefresher(auth.NewHelperAuthRefresher(
+			l.CredHelper, l.Registry, interval))
 	} else if interval > 0 {
+		return fmt.Errorf("'%s' wants authentication refresh, but is not an "+
+			"ECR registry, and has neither 'auth-command' nor "+
+			"'credential-helper'", l.Registry)
+	} else if l.RoleARN != "" && !l.IsECRPublic() {
 		return fmt.Errorf(
-			"'%s' wants authentication refresh, but is not an ECR registry",
+			"'%s' wants to assume a role, but is not an ECR registry",
 			l.Registry)
 	}
 
@@ -104,6 +172,128 @@ func (l *Location) validate() error {
 		l.creds.SetRefresher(auth.NewGCRAuthRefresher())
 	}
 
+	return l.validateECRRepository()
+}
+
+// validateECRRepository checks the settings for repositories created in this
+// location. Without 'encryption', a 'kms-key' implies KMS encryption.
+func (l *Location) validateECRRepository() error {
+
+	r := l.ECRRepository
+	if r == nil {
+		return nil
+	}
+
+	if !l.IsECR() {
+		return fmt.Errorf("'%s' has 'ecr-repository', but is not an ECR "+
+			"registry", l.Registry)
+	}
+	if !l.autoCreate() {
+		return errors.New("'ecr-repository' requires 'auto-create'")
+	}
+
+	r.Encryption = strings.ToUpper(r.Encryption)
+	if r.Encryption == "" && r.KMSKey != "" {
+		r.Encryption = ecr.EncryptionTypeKms
+	}
+
+	switch r.Encryption {
+	case "", ecr.EncryptionTypeAes256:
+		if r.KMSKey != "" {
+			return errors.New("'kms-key' requires 'encryption: KMS'")
+		}
+	case ecr.EncryptionTypeKms:
+	default:
+		return fmt.Errorf("invalid 'encryption' '%s', must be '%s' or '%s'",
+			r.Encryption, ecr.EncryptionTypeAes256, ecr.EncryptionTypeKms)
+	}
+
+	return nil
+}
+
+// autoCreate determines whether missing repositories get created when this
+// location is an ECR target, which is the default.
+func (l *Location) autoCreate() bool {
+	return l.AutoCreate == nil || *l.AutoCreate
+}
+
+// connPool returns the connection pool settings for the transport of this
+// location, using the defaults for those not set.
+func (l *Location) connPool() (*util.ConnPool, error) {
+
+	if l.MaxIdleConns < 0 {
+		return nil, errors.New("'max-idle-conns' must not be negative")
+	}
+	if l.MaxConnsPerHost < 0 {
+		return nil, errors.New("'max-conns-per-host' must not be negative")
+	}
+
+	pool := util.DefaultConnPool()
+	if l.MaxIdleConns > 0 {
+		pool.MaxIdleConns = l.MaxIdleConns
+	}
+	pool.MaxConnsPerHost = l.MaxConnsPerHost
+
+	if l.IdleConnTimeout != nil {
+		if *l.IdleConnTimeout < 0 {
+			return nil, errors.New("'idle-conn-timeout' must not be negative")
+		}
+		pool.IdleConnTimeout = *l.IdleConnTimeout
+	}
+
+	return pool, nil
+}
+
+// validateTokenAuth checks the bearer token and credential helper settings of
+// this location, and moves a static token into its credentials.
+func (l *Location) validateTokenAuth(disableAuth bool) error {
+
+	if l.AuthToken == "" && len(l.AuthCommand) == 0 && l.CredHelper == "" {
+		return nil
+	}
+
+	switch {
+	case l.CredHelper != "" && (l.AuthToken != "" || len(l.AuthCommand) > 0):
+		return errors.New("'credential-helper' cannot be combined with " +
+			"'auth-token' or 'auth-command'")
+	case l.AuthToken != "" && len(l.AuthCommand) > 0:
+		return errors.New(
+			"'auth-token' and 'auth-command' cannot be used together")
+	case disableAuth || l.creds.Username() != "" || l.creds.Password() != "":
+		return errors.New("'auth-token', 'auth-command', and " +
+			"'credential-helper' cannot be combined with 'auth'")
+	case l.IsECR() || l.IsGCR():
+		return fmt.Errorf("'%s' gets its credentials from the cloud "+
+			"provider, 'auth-token', 'auth-command', and 'credential-helper' "+
+			"are not supported", l.Registry)
+	}
+
+	if l.AuthToken != "" {
+		l.creds.SetToken(auth.NewToken(l.AuthToken))
+		l.AuthToken = ""
+	}
+
+	return nil
+}
+
+// checkCredentials checks the shape of the credentials of this location, after
+// it has been validated. Nothing is checked against the registry.
+func (l *Location) checkCredentials() error {
+
+	if l == nil || l.creds == nil {
+		return nil
+	}
+
+	if strings.Contains(l.Registry, ".dkr.ecr.") && !l.IsECR() {
+		return errors.New(
+			"looks like an ECR registry, but is not recognized as one")
+	}
+
+	if l.creds.Token() == nil &&
+		(l.creds.Username() == "") != (l.creds.Password() == "") {
+		return errors.New("credentials need both user name and password")
+	}
+
 	return nil
 }
 
@@ -125,6 +315,18 @@ func (l *Location) RefreshAuth() error {
 	return l.creds.Refresh()
 }
 
+// RejectAuth is called when the registry rejected the credentials of this
+// location. If they come from a credential helper, they are retrieved anew,
+// and true is returned. Otherwise, nothing is done and false is returned.
+func (l *Location) RejectAuth() (bool, error) {
+	if l == nil || !l.creds.Reject() {
+		return false, nil
+	}
+	log.WithField("registry", l.Registry).Warn(
+		"credentials rejected, running credential helper again")
+	return true, l.creds.Refresh()
+}
+
 //
 func (l *Location) IsECR() bool {
 	ecr, _, _ := l.GetECR()
@@ -136,8 +338,22 @@ func (l *Location) GetECR() (ecr bool, region, account string) {
 	return registry.IsECR(l.Registry)
 }
 
+//
+func (l *Location) IsECRPublic() bool {
+	ecrpublic, _ := registry.IsECRPublic(l.Registry)
+	return ecrpublic
+}
+
+// AWSRole returns the role to assume for accessing the AWS APIs of this
+// location, or nil if no role is configured.
+func (l *Location) AWSRole() *auth.AWSRole {
+	if l.RoleARN == "" {
+		return nil
+	}
+	return &auth.AWSRole{ARN: l.RoleARN, ExternalID: l.ExternalID}
+}
+
 //
 func (l *Location) IsGCR() bool {
-	return strings.HasSuffix(l.Registry, ".gcr.io") ||
-		strings.HasSuffix(l.Registry, "-docker.pkg.dev")
+	return registry.IsGCR(l.Registry)
 }
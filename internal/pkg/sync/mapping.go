@@ -18,9 +18,18 @@ package sync
 
 import (
 	"fmt"
+	"net"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/docker/distribution/reference"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/layout"
+	"github.com/xelalexv/dregsy/internal/pkg/relays"
 	"github.com/xelalexv/dregsy/internal/pkg/tags"
 	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
@@ -28,17 +37,114 @@ import (
 //
 const RegexpPrefix = "regex:"
 
+//
+const GlobPrefix = "glob:"
+
+// placeholders in `to`, replaced with the host of the source registry, and
+// the path of the source repository, respectively
+const (
+	SourceHostVar = "{source_host}"
+	SourcePathVar = "{source_path}"
+)
+
+// PlatformAuto selects the platform on which dregsy runs, or the platform set
+// with the global 'auto-platform'
+const PlatformAuto = "auto"
+
+// policies for source images lacking the platforms selected in a mapping
+const (
+	PlatformMissingSkip = "skip"
+	PlatformMissingFail = "fail"
+)
+
+// policies for tags that already exist in a target repository with tag
+// immutability
+const (
+	OnImmutableSkip = "skip"
+	OnImmutableFail = "fail"
+)
+
+// formats for `compression`; with 'keep', layers are copied as they are,
+// otherwise they get recompressed if not already in that format
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionKeep = "keep"
+)
+
+// manifest types for `manifest-type`, selecting multi-platform images with an
+// image index or manifest list, single images, or both
+const (
+	ManifestTypeIndex = "index"
+	ManifestTypeImage = "image"
+	ManifestTypeAny   = "any"
+)
+
+// ArtifactTypeImage selects container images in `artifact-types`, regardless
+// of their media types
+const ArtifactTypeImage = "image"
+
+// validDigest is the format of a digest in `from`
+var validDigest = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// validTagPrefix and validTagSuffix are the formats of `tag-prefix` and
+// `tag-suffix`, which keep tags valid when added to them
+var validTagPrefix = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]*$`)
+var validTagSuffix = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// defaultActiveWindow is the window used for `only-active: true`
+const defaultActiveWindow = 30 * 24 * time.Hour
+
 //
 type Mapping struct {
-	From     string   `yaml:"from"`
-	To       string   `yaml:"to"`
-	Tags     []string `yaml:"tags"`
-	Platform string   `yaml:"platform"`
+	From            string      `yaml:"from"`
+	FromExclude     []string    `yaml:"from-exclude"`
+	To              string      `yaml:"to"`
+	ToLowercase     bool        `yaml:"to-lowercase"`
+	Tags            []string    `yaml:"tags"`
+	TagsExclude     []string    `yaml:"tags-exclude"`
+	TagMap          string      `yaml:"tag-map"`
+	TagPrefix       string      `yaml:"tag-prefix"`
+	TagSuffix       string      `yaml:"tag-suffix"`
+	MaxTags         int         `yaml:"max-tags"`
+	MaxRepos        int         `yaml:"max-repos"`
+	Since           string      `yaml:"since"`
+	Until           string      `yaml:"until"`
+	OnlyActive      string      `yaml:"only-active"`
+	Prune           bool        `yaml:"prune"`
+	Platform        string      `yaml:"platform"`
+	Platforms       []string    `yaml:"platforms"`
+	PlatformMissing string      `yaml:"platform-missing"`
+	ArtifactTypes   []string    `yaml:"artifact-types"`
+	ManifestType    string      `yaml:"manifest-type"`
+	CopySignatures  bool        `yaml:"copy-signatures"`
+	SkipExisting    bool        `yaml:"skip-existing"`
+	OnImmutable     string      `yaml:"on-immutable"`
+	MutableTags     []string    `yaml:"mutable-tags"`
+	TagRoutes       []*TagRoute `yaml:"tag-routes"`
+	UnroutedTags    string      `yaml:"unrouted-tags"`
+	Verify          bool        `yaml:"verify"`
+	PreserveDigests bool        `yaml:"preserve-digests"`
+	Compression     string      `yaml:"compression"`
+	DigestTag       string      `yaml:"digest-tag"`
+	AWSLifecycle    bool        `yaml:"aws-lifecycle"`
 	//
-	fromFilter *regexp.Regexp
-	toFilter   *regexp.Regexp
-	toReplace  string
-	tagSet     *tags.TagSet
+	AWSTags          map[string]string `yaml:"aws-tags"`
+	MatchLabels      map[string]string `yaml:"match-labels"`
+	MatchAnnotations map[string]string `yaml:"match-annotations"`
+	//
+	digest       string
+	fromFilter   *regexp.Regexp
+	fromExclude  []*regexp.Regexp
+	mutableTags  []*regexp.Regexp
+	toFilter     *regexp.Regexp
+	toReplace    string
+	tagFilter    *regexp.Regexp
+	tagReplace   string
+	tagSet       *tags.TagSet
+	activeWindow time.Duration
+	sourceHost   string
+	destWarned   bool
 }
 
 //
@@ -52,7 +158,18 @@ func (m *Mapping) validate() error {
 		return fmt.Errorf("mapping without 'From' path")
 	}
 
-	if m.isRegexpFrom() {
+	if layout.IsLayout(m.From) {
+		if _, err := layout.New(m.From); err != nil {
+			return err
+		}
+	} else if isGlob(m.From) {
+		glob := m.From[len(GlobPrefix):]
+		var err error
+		if m.fromFilter, err = regexp.Compile(util.GlobToRegex(glob)); err != nil {
+			return fmt.Errorf(
+				"'from' uses invalid glob pattern '%s': %v", glob, err)
+		}
+	} else if m.isRegexpFrom() {
 		regex := m.From[len(RegexpPrefix):]
 		var err error
 		if m.fromFilter, err = util.CompileRegex(regex, true); err != nil {
@@ -60,24 +177,57 @@ func (m *Mapping) validate() error {
 				"'from' uses invalid regular expression '%s': %v", regex, err)
 		}
 	} else {
+		if ix := strings.LastIndex(m.From, "@"); ix >= 0 {
+			m.digest = m.From[ix+1:]
+			if !validDigest.MatchString(m.digest) {
+				return fmt.Errorf("invalid digest '%s' in 'from', must be "+
+					"'sha256:' followed by 64 hex digits", m.digest)
+			}
+			m.From = m.From[:ix]
+		}
 		m.From = normalizePath(m.From)
 	}
 
-	if m.isRegexpTo() {
-		parts := strings.SplitN(m.To[len(RegexpPrefix):], ",", 2)
+	if m.isArchived() {
+		if _, err := layout.New(m.To); err != nil {
+			return err
+		}
+	} else if to, filter, replace, err := compileTo(m.To); err != nil {
+		return err
+	} else {
+		m.To, m.toFilter, m.toReplace = to, filter, replace
+	}
+
+	if m.TagMap != "" {
+		if !isRegexp(m.TagMap) {
+			return fmt.Errorf("'tag-map' must be a regular expression, "+
+				"starting with '%s'", RegexpPrefix)
+		}
+		parts := strings.SplitN(m.TagMap[len(RegexpPrefix):], ",", 2)
 		regex := parts[0]
 		if len(parts) < 2 {
-			return fmt.Errorf("replacement expression missing in 'to'")
+			return fmt.Errorf("replacement expression missing in 'tag-map'")
 		}
-		m.toReplace = parts[1]
+		m.tagReplace = parts[1]
 
 		var err error
-		if m.toFilter, err = util.CompileRegex(regex, false); err != nil {
-			return fmt.Errorf(
-				"'to' uses invalid regular expression '%s': %v", regex, err)
+		if m.tagFilter, err = util.CompileRegex(regex, false); err != nil {
+			return fmt.Errorf("'tag-map' uses invalid regular expression "+
+				"'%s': %v", regex, err)
+		}
+		if err := checkBackrefs(m.tagFilter, m.tagReplace); err != nil {
+			return err
 		}
-	} else if m.To != "" {
-		m.To = normalizePath(m.To)
+	}
+
+	if m.TagPrefix != "" && !validTagPrefix.MatchString(m.TagPrefix) {
+		return fmt.Errorf("invalid 'tag-prefix' '%s', must start with a "+
+			"letter, digit, or '_', followed by letters, digits, '_', '.', "+
+			"or '-'", m.TagPrefix)
+	}
+	if m.TagSuffix != "" && !validTagSuffix.MatchString(m.TagSuffix) {
+		return fmt.Errorf("invalid 'tag-suffix' '%s', may only contain "+
+			"letters, digits, '_', '.', or '-'", m.TagSuffix)
 	}
 
 	if tags, err := tags.NewTagSet(m.Tags); err != nil {
@@ -86,17 +236,437 @@ func (m *Mapping) validate() error {
 		m.tagSet = tags
 	}
 
+	if err := m.tagSet.Exclude(m.TagsExclude); err != nil {
+		return fmt.Errorf("'tags-exclude' uses invalid format: %v", err)
+	}
+
+	if m.isPinned() {
+		if err := m.checkPinned(); err != nil {
+			return err
+		}
+	} else if m.DigestTag != "" {
+		return fmt.Errorf("'digest-tag' requires a digest in 'from'")
+	}
+
+	if m.Platform != "" && len(m.Platforms) > 0 {
+		return fmt.Errorf("'platform' and 'platforms' cannot both be set")
+	}
+	for _, p := range m.Platforms {
+		if !isValidPlatform(p) {
+			return fmt.Errorf(
+				"invalid platform '%s', must be 'os/arch[/variant]'", p)
+		}
+	}
+
+	switch m.PlatformMissing {
+	case "", PlatformMissingSkip, PlatformMissingFail:
+	default:
+		return fmt.Errorf("'platform-missing' must be '%s' or '%s', not '%s'",
+			PlatformMissingSkip, PlatformMissingFail, m.PlatformMissing)
+	}
+	if m.PlatformMissing != "" && m.selectedPlatforms() == nil {
+		return fmt.Errorf(
+			"'platform-missing' requires 'platform' other than 'all', or " +
+				"'platforms'")
+	}
+
+	switch m.OnImmutable {
+	case "", OnImmutableSkip, OnImmutableFail:
+	default:
+		return fmt.Errorf("'on-immutable' must be '%s' or '%s', not '%s'",
+			OnImmutableSkip, OnImmutableFail, m.OnImmutable)
+	}
+
+	for _, t := range m.ArtifactTypes {
+		if t != ArtifactTypeImage && !strings.Contains(t, "/") {
+			return fmt.Errorf("'artifact-types' must contain '%s' or media "+
+				"types, not '%s'", ArtifactTypeImage, t)
+		}
+	}
+
+	switch m.ManifestType {
+	case "", ManifestTypeIndex, ManifestTypeImage, ManifestTypeAny:
+	default:
+		return fmt.Errorf("'manifest-type' must be '%s', '%s', or '%s', "+
+			"not '%s'", ManifestTypeIndex, ManifestTypeImage, ManifestTypeAny,
+			m.ManifestType)
+	}
+
+	for k := range m.MatchLabels {
+		if k == "" {
+			return fmt.Errorf("'match-labels' cannot contain an empty key")
+		}
+	}
+	for k := range m.MatchAnnotations {
+		if k == "" {
+			return fmt.Errorf(
+				"'match-annotations' cannot contain an empty key")
+		}
+	}
+
+	if m.CopySignatures && (len(m.Platforms) > 0 ||
+		(m.Platform != "" && m.Platform != "all")) {
+		return fmt.Errorf("'copy-signatures' requires syncing all platforms, " +
+			"and cannot be combined with 'platform' or 'platforms'")
+	}
+
+	if m.SkipExisting && (len(m.Platforms) > 0 ||
+		(m.Platform != "" && m.Platform != "all")) {
+		return fmt.Errorf("'skip-existing' requires syncing all platforms, " +
+			"and cannot be combined with 'platform' or 'platforms'")
+	}
+
+	if m.Verify && (len(m.Platforms) > 0 ||
+		(m.Platform != "" && m.Platform != "all")) {
+		return fmt.Errorf("'verify' requires syncing all platforms, " +
+			"and cannot be combined with 'platform' or 'platforms'")
+	}
+
+	if m.PreserveDigests && (len(m.Platforms) > 0 ||
+		(m.Platform != "" && m.Platform != "all")) {
+		return fmt.Errorf("'preserve-digests' requires syncing all " +
+			"platforms, and cannot be combined with 'platform' or 'platforms'")
+	}
+
+	if err := m.checkCompression(); err != nil {
+		return err
+	}
+
+	if m.MaxTags < 0 {
+		return fmt.Errorf("'max-tags' must not be negative")
+	}
+	m.tagSet.SetMaxTags(m.MaxTags)
+
+	if m.MaxRepos < 0 {
+		return fmt.Errorf("'max-repos' must not be negative")
+	}
+
+	if m.hasSince() {
+		since, ago, err := parseCutoff("since", m.Since)
+		if err != nil {
+			return err
+		}
+		m.tagSet.SetSince(since, ago)
+	}
+
+	if m.Until != "" {
+		until, ago, err := parseCutoff("until", m.Until)
+		if err != nil {
+			return err
+		}
+		if m.hasSince() {
+			since, sinceAgo, _ := parseCutoff("since", m.Since)
+			now := time.Now()
+			if cutoffTime(now, until, ago).Before(
+				cutoffTime(now, since, sinceAgo)) {
+				return fmt.Errorf("'until' must not be before 'since'")
+			}
+		}
+		m.tagSet.SetUntil(until, ago)
+	}
+
+	if w, err := parseActiveWindow(m.OnlyActive); err != nil {
+		return err
+	} else {
+		m.activeWindow = w
+	}
+
+	if m.Prune && !m.hasSince() && !m.onlyActive() {
+		return fmt.Errorf("'prune' requires 'since' or 'only-active'")
+	}
+
+	if err := m.compileFromExclude(); err != nil {
+		return err
+	}
+
+	if err := m.compileMutableTags(); err != nil {
+		return err
+	}
+
+	if err := m.compileTagRoutes(); err != nil {
+		return err
+	}
+
+	if m.hasAWSTags() {
+		if !m.isRegexpFrom() {
+			return fmt.Errorf("'aws-tags' requires a regex or glob 'from'")
+		}
+		for k := range m.AWSTags {
+			if k == "" {
+				return fmt.Errorf("'aws-tags' must not contain an empty key")
+			}
+		}
+	}
+
+	if m.hasPlaceholders() && m.isLocal() {
+		return fmt.Errorf("'%s' and '%s' in 'to' cannot be used with a "+
+			"local 'from'", SourceHostVar, SourcePathVar)
+	}
+
+	if m.isLocal() {
+		if err := m.checkLocal(); err != nil {
+			return err
+		}
+	}
+
+	if m.isArchived() {
+		return m.checkArchived()
+	}
+
+	// without a regex or glob 'from', the destination path is known up front,
+	// otherwise it's checked once the source repositories are listed
+	if !m.isRegexpFrom() {
+		return m.checkDestPaths([]string{m.From})
+	}
+
+	return nil
+}
+
+// compileTo compiles destination to as given in `to`. For a regular
+// expression, the compiled expression and the replacement are returned along
+// with to. Otherwise, to is returned as normalized path.
+func compileTo(to string) (string, *regexp.Regexp, string, error) {
+
+	if !isRegexp(to) {
+		if to != "" {
+			to = normalizePath(to)
+		}
+		return to, nil, "", nil
+	}
+
+	parts := strings.SplitN(to[len(RegexpPrefix):], ",", 2)
+	regex := parts[0]
+	if len(parts) < 2 {
+		return "", nil, "", fmt.Errorf("replacement expression missing in 'to'")
+	}
+
+	filter, err := util.CompileRegex(regex, false)
+	if err != nil {
+		return "", nil, "", fmt.Errorf(
+			"'to' uses invalid regular expression '%s': %v", regex, err)
+	}
+	if err := checkBackrefs(filter, parts[1]); err != nil {
+		return "", nil, "", err
+	}
+
+	return to, filter, parts[1], nil
+}
+
+// checkArchived checks the settings of a mapping with an OCI layout in object
+// storage in `to`. All images go into that one layout, which is written via a
+// local layout, and has no registry to ask for tags or digests.
+func (m *Mapping) checkArchived() error {
+
+	if m.isRegexpFrom() {
+		return fmt.Errorf("object storage in 'to' requires a single " +
+			"repository in 'from', not a regular expression or glob")
+	}
+
+	for _, s := range []struct {
+		name string
+		set  bool
+	}{
+		{"a digest in 'from'", m.isPinned()},
+		{fmt.Sprintf("'%s' and '%s'", SourceHostVar, SourcePathVar),
+			m.hasPlaceholders()},
+		{"'to-lowercase'", m.ToLowercase},
+		{"'prune'", m.Prune},
+		{"'platforms'", len(m.Platforms) > 0},
+		{"'copy-signatures'", m.CopySignatures},
+		{"'skip-existing'", m.SkipExisting},
+		{"'verify'", m.Verify},
+		{"'preserve-digests'", m.PreserveDigests},
+		{"'on-immutable'", m.OnImmutable != ""},
+		{"'tag-routes'", m.hasTagRoutes()},
+	} {
+		if s.set {
+			return fmt.Errorf(
+				"%s cannot be used with object storage in 'to'", s.name)
+		}
+	}
+
+	return nil
+}
+
+// checkPinned checks the settings of a mapping that is pinned to a digest. The
+// image is copied as is, so settings for selecting and rewriting tags, or for
+// selecting platforms cannot be used.
+func (m *Mapping) checkPinned() error {
+
+	for _, s := range []struct {
+		name string
+		set  bool
+	}{
+		{"tags", len(m.Tags) > 0},
+		{"tags-exclude", len(m.TagsExclude) > 0},
+		{"tag-map", m.TagMap != ""},
+		{"tag-prefix", m.TagPrefix != ""},
+		{"tag-suffix", m.TagSuffix != ""},
+		{"max-tags", m.MaxTags > 0},
+		{"since", m.Since != ""},
+		{"until", m.Until != ""},
+		{"prune", m.Prune},
+		{"platform", m.Platform != "" && m.Platform != "all"},
+		{"platforms", len(m.Platforms) > 0},
+		{"aws-lifecycle", m.AWSLifecycle},
+		{"artifact-types", len(m.ArtifactTypes) > 0},
+		{"manifest-type", m.matchesOnManifestType()},
+		{"match-labels", len(m.MatchLabels) > 0},
+		{"match-annotations", len(m.MatchAnnotations) > 0},
+		{"mutable-tags", len(m.MutableTags) > 0},
+		{"tag-routes", m.hasTagRoutes()},
+	} {
+		if s.set {
+			return fmt.Errorf(
+				"'%s' cannot be used with a digest in 'from'", s.name)
+		}
+	}
+
+	if m.DigestTag != "" && !relays.IsValidTag(m.DigestTag) {
+		return fmt.Errorf("invalid 'digest-tag' '%s'", m.DigestTag)
+	}
+
+	return nil
+}
+
+// checkCompression checks `compression`. Recompressing layers changes the
+// digests of the images, so it cannot be combined with settings that copy
+// images as is. Since zstd is not the compression of most source images, the
+// digests are then hardly ever preserved, which is logged as a warning.
+func (m *Mapping) checkCompression() error {
+
+	switch m.Compression {
+	case "", CompressionKeep:
+		return nil
+	case CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("'compression' must be '%s', '%s', or '%s', not "+
+			"'%s'", CompressionGzip, CompressionZstd, CompressionKeep,
+			m.Compression)
+	}
+
+	for _, s := range []struct {
+		name string
+		set  bool
+	}{
+		{"a digest in 'from'", m.isPinned()},
+		{"'platforms'", len(m.Platforms) > 0},
+		{"'copy-signatures'", m.CopySignatures},
+		{"'skip-existing'", m.SkipExisting},
+		{"'verify'", m.Verify},
+		{"'preserve-digests'", m.PreserveDigests},
+	} {
+		if s.set {
+			return fmt.Errorf("'compression' '%s' recompresses layers, and "+
+				"cannot be combined with %s", m.Compression, s.name)
+		}
+	}
+
+	if m.Compression == CompressionZstd {
+		log.WithField("mapping", m.From).Warn("'compression' 'zstd' " +
+			"recompresses layers, so digests of synced images will differ " +
+			"from their source images")
+	}
+
+	return nil
+}
+
+// recompression returns the format to which layers get recompressed when
+// syncing this mapping, or an empty string if they are kept as they are.
+func (m *Mapping) recompression() string {
+	if m.Compression == CompressionKeep {
+		return ""
+	}
+	return m.Compression
+}
+
+// checkLocal checks the settings of a mapping with a local layout in `from`.
+// There is no repository path to derive the destination from, and no registry
+// to ask for push times or digests of the source images.
+func (m *Mapping) checkLocal() error {
+
+	if m.To == "" || m.isRegexpTo() {
+		return fmt.Errorf("a local 'from' requires a plain path in 'to'")
+	}
+
+	for _, s := range []struct {
+		name string
+		set  bool
+	}{
+		{"since", m.hasSince()},
+		{"until", m.Until != ""},
+		{"only-active", m.onlyActive()},
+		{"max-repos", m.MaxRepos > 0},
+		{"platforms", len(m.Platforms) > 0},
+		{"copy-signatures", m.CopySignatures},
+		{"skip-existing", m.SkipExisting},
+		{"verify", m.Verify},
+		{"preserve-digests", m.PreserveDigests},
+		{"aws-lifecycle", m.AWSLifecycle},
+		{"artifact-types", len(m.ArtifactTypes) > 0},
+		{"manifest-type", m.matchesOnManifestType()},
+		{"match-labels", len(m.MatchLabels) > 0},
+		{"match-annotations", len(m.MatchAnnotations) > 0},
+	} {
+		if s.set {
+			return fmt.Errorf(
+				"'%s' cannot be used with a local 'from'", s.name)
+		}
+	}
+
+	return nil
+}
+
+// appendsSourcePath determines whether this mapping pairs a regex or glob
+// `from` with a non-regex `to`. In that case, the complete source path gets
+// appended to `to`, which is usually not what is intended.
+func (m *Mapping) appendsSourcePath() bool {
+	return m.isRegexpFrom() && m.To != "" && !m.isRegexpTo() &&
+		!m.hasPlaceholders()
+}
+
+// checkDestination returns an error if strict is set and this mapping appends
+// the complete source path to `to`. Without strict, a warning is logged once
+// the matching repositories are known, see warnDestination.
+func (m *Mapping) checkDestination(strict bool) error {
+	if strict && m.appendsSourcePath() {
+		return fmt.Errorf("mapping from '%s' to non-regex '%s' appends the "+
+			"complete source path to the destination; use 'regex:' in 'to' "+
+			"for replacing parts of the path", m.From, m.To)
+	}
 	return nil
 }
 
+// warnDestination logs a warning if this mapping appends the complete source
+// path to `to`, giving the first of the matching repositories in repos as an
+// example. The warning is only logged once for each mapping.
+func (m *Mapping) warnDestination(repos []string) {
+
+	if m.destWarned || len(repos) == 0 || !m.appendsSourcePath() {
+		return
+	}
+
+	m.destWarned = true
+	log.Warn(m.destinationWarning(repos[0]))
+}
+
+// destinationWarning returns the warning about this mapping appending the
+// complete source path to `to`, with source path p as an example.
+func (m *Mapping) destinationWarning(p string) string {
+	return fmt.Sprintf("mapping from '%s' to non-regex '%s' appends the "+
+		"complete source path to the destination, e.g. '%s' is mapped to "+
+		"'%s'; use 'regex:' in 'to' for replacing parts of the path",
+		m.From, m.To, p, m.mapPath(p))
+}
+
 //
 func (m *Mapping) filterRepos(repos []string) []string {
 
 	if m.isRegexpFrom() {
 		ret := make([]string, 0, len(repos))
 		for _, r := range repos {
-			if m.fromFilter.MatchString(r) {
-				ret = append(ret, normalizePath(r))
+			if p, ok := m.matchRepo(r); ok {
+				ret = append(ret, p)
 			}
 		}
 		return ret
@@ -105,12 +675,199 @@ func (m *Mapping) filterRepos(repos []string) []string {
 	return repos
 }
 
-//
+// compileFromExclude compiles the `from-exclude` list of this mapping. Items
+// with prefix `regex:` are regular expressions, all others literal repository
+// paths.
+func (m *Mapping) compileFromExclude() error {
+
+	if len(m.FromExclude) == 0 {
+		return nil
+	}
+
+	if !m.isRegexpFrom() {
+		return fmt.Errorf("'from-exclude' requires a regex or glob 'from'")
+	}
+
+	m.fromExclude = make([]*regexp.Regexp, 0, len(m.FromExclude))
+	for _, e := range m.FromExclude {
+		var expr string
+		if strings.HasPrefix(e, RegexpPrefix) {
+			expr = e[len(RegexpPrefix):]
+		} else {
+			expr = regexp.QuoteMeta(strings.TrimPrefix(e, "/"))
+		}
+		if expr == "" {
+			return fmt.Errorf("'from-exclude' must not contain an empty item")
+		}
+		re, err := util.CompileRegex(expr, true)
+		if err != nil {
+			return fmt.Errorf("'from-exclude' uses invalid regular "+
+				"expression '%s': %v", expr, err)
+		}
+		m.fromExclude = append(m.fromExclude, re)
+	}
+
+	return nil
+}
+
+// compileMutableTags compiles the items of 'mutable-tags', which are either
+// literal tags, or regular expressions with a 'regex:' prefix. The 'latest' tag
+// is always mutable.
+func (m *Mapping) compileMutableTags() error {
+
+	if len(m.MutableTags) == 0 {
+		return nil
+	}
+
+	if !m.SkipExisting {
+		return fmt.Errorf("'mutable-tags' requires 'skip-existing'")
+	}
+
+	m.mutableTags = []*regexp.Regexp{regexp.MustCompile("^latest$")}
+	for _, t := range m.MutableTags {
+		var expr string
+		if strings.HasPrefix(t, RegexpPrefix) {
+			expr = strings.TrimSpace(t[len(RegexpPrefix):])
+		} else {
+			expr = regexp.QuoteMeta(strings.TrimSpace(t))
+		}
+		if expr == "" {
+			return fmt.Errorf("'mutable-tags' must not contain an empty item")
+		}
+		re, err := util.CompileRegex(expr, true)
+		if err != nil {
+			return fmt.Errorf("'mutable-tags' uses invalid regular "+
+				"expression '%s': %v", expr, err)
+		}
+		m.mutableTags = append(m.mutableTags, re)
+	}
+
+	return nil
+}
+
+// isMutable determines whether tag may move to another digest, so that an
+// existing target tag needs to be compared by digest with the source. Without
+// 'mutable-tags', all tags are considered mutable.
+func (m *Mapping) isMutable(tag string) bool {
+	if m.mutableTags == nil {
+		return true
+	}
+	for _, re := range m.mutableTags {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRepo checks whether repository r matches the regex or glob `from` of
+// this mapping without being excluded by `from-exclude`, and returns its
+// normalized path if so.
+func (m *Mapping) matchRepo(r string) (string, bool) {
+	if !m.fromFilter.MatchString(r) {
+		return "", false
+	}
+	p := normalizePath(r)
+	for _, e := range m.fromExclude {
+		if e.MatchString(p[1:]) {
+			log.WithField("repo", p).Debug(
+				"skipping repository excluded by 'from-exclude'")
+			return "", false
+		}
+	}
+	return p, true
+}
+
+// repoLimit returns the maximum number of repositories to which the `from` of
+// this mapping may expand. Unless set for this mapping, global applies. A
+// limit of 0 means no limit.
+func (m *Mapping) repoLimit(global int) int {
+	if m.MaxRepos > 0 {
+		return m.MaxRepos
+	}
+	return global
+}
+
+// mapPath maps source repository path p to its destination path. If set for
+// this mapping, the destination path is converted to lowercase.
 func (m *Mapping) mapPath(p string) string {
+	if m.ToLowercase {
+		return strings.ToLower(m.destPath(p))
+	}
+	return m.destPath(p)
+}
+
+// checkDestPaths checks whether this mapping maps each of the source
+// repository paths in repos to a valid destination path.
+func (m *Mapping) checkDestPaths(repos []string) error {
+	for _, r := range repos {
+		for _, route := range m.routes() {
+			p := m.routePath(route, r)
+			if err := checkDestPath(p); err != nil {
+				if m.isRegexpFrom() {
+					return fmt.Errorf("mapping from '%s' maps '%s' to "+
+						"invalid destination path '%s': %v", m.From, r, p, err)
+				}
+				return fmt.Errorf("mapping from '%s' maps to invalid "+
+					"destination path '%s': %v", m.From, p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDestPath checks whether p is a valid repository path. Empty path
+// segments and uppercase letters are reported separately, since these are
+// what a regex 'to' most commonly gets wrong.
+func checkDestPath(p string) error {
+
+	path := strings.TrimPrefix(p, "/")
+
+	switch {
+	case path == "":
+		return fmt.Errorf("path is empty")
+	case strings.Contains(path, "//") || strings.HasSuffix(path, "/"):
+		return fmt.Errorf("path contains an empty segment")
+	case path != strings.ToLower(path):
+		return fmt.Errorf("path must be lowercase, consider 'to-lowercase'")
+	}
+
+	if _, err := reference.WithName(path); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// tagMapper returns the function for mapping source tags to target tags, or
+// nil if this mapping rewrites no tags.
+func (m *Mapping) tagMapper() func(string) string {
+	if m.tagFilter == nil && m.TagPrefix == "" && m.TagSuffix == "" {
+		return nil
+	}
+	return m.mapTag
+}
+
+// mapTag maps source tag t to its target tag. The tag map is applied first,
+// with tags not matched by it kept as they are, and then the tag prefix and
+// suffix are added.
+func (m *Mapping) mapTag(t string) string {
+	if m.tagFilter != nil {
+		t = m.tagFilter.ReplaceAllString(t, m.tagReplace)
+	}
+	return m.TagPrefix + t + m.TagSuffix
+}
+
+//
+func (m *Mapping) destPath(p string) string {
 	if m.isRegexpTo() {
-		return m.toFilter.ReplaceAllString(p, m.toReplace)
+		return m.expandPlaceholders(
+			m.toFilter.ReplaceAllString(p, m.toReplace), p)
 	}
 	if m.To != "" {
+		if m.hasPlaceholders() {
+			return m.expandPlaceholders(m.To, p)
+		}
 		if m.isRegexpFrom() {
 			return m.To + p
 		}
@@ -119,9 +876,140 @@ func (m *Mapping) mapPath(p string) string {
 	return p
 }
 
-//
+// resolvePlatform replaces 'platform: auto' with platform auto, or with the
+// platform on which dregsy runs if auto is empty.
+func (m *Mapping) resolvePlatform(auto string) {
+	if m == nil || m.Platform != PlatformAuto {
+		return
+	}
+	if auto == "" {
+		auto = hostPlatform()
+	}
+	m.Platform = auto
+}
+
+// selectedPlatforms returns the platforms selected by this mapping, or nil if
+// it syncs images with whatever platforms they provide.
+func (m *Mapping) selectedPlatforms() []string {
+	if len(m.Platforms) > 0 {
+		return m.Platforms
+	}
+	if m.Platform != "" && m.Platform != "all" {
+		return []string{m.Platform}
+	}
+	return nil
+}
+
+// matchesArtifactType determines whether artifact type t is selected by the
+// `artifact-types` of this mapping. Without any, all types are selected.
+func (m *Mapping) matchesArtifactType(t string) bool {
+	if len(m.ArtifactTypes) == 0 {
+		return true
+	}
+	for _, a := range m.ArtifactTypes {
+		if a == t || (a == ArtifactTypeImage && util.IsImageType(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesOnManifestType determines whether this mapping selects images by the
+// type of their manifest.
+func (m *Mapping) matchesOnManifestType() bool {
+	return m.ManifestType != "" && m.ManifestType != ManifestTypeAny
+}
+
+// matchesManifestType determines whether an image, which is multi-platform if
+// index is set, is of the type selected by `manifest-type`.
+func (m *Mapping) matchesManifestType(index bool) bool {
+	switch m.ManifestType {
+	case ManifestTypeIndex:
+		return index
+	case ManifestTypeImage:
+		return !index
+	}
+	return true
+}
+
+// matchesOnMetadata determines whether this mapping selects images by their
+// labels or annotations.
+func (m *Mapping) matchesOnMetadata() bool {
+	return len(m.MatchLabels) > 0 || len(m.MatchAnnotations) > 0
+}
+
+// matchesMetadata determines whether an image with labels and annotations has
+// all labels in `match-labels`, and all annotations in `match-annotations`,
+// with the same values.
+func (m *Mapping) matchesMetadata(labels, annotations map[string]string) bool {
+	for k, v := range m.MatchLabels {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	for k, v := range m.MatchAnnotations {
+		if got, ok := annotations[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// skipImmutable determines whether tags that already exist in a target
+// repository with tag immutability are skipped instead of failing the sync.
+func (m *Mapping) skipImmutable() bool {
+	return m.OnImmutable == OnImmutableSkip
+}
+
+// hasPlaceholders determines whether `to` contains any of the placeholders
+// for the source registry host and repository path.
+func (m *Mapping) hasPlaceholders() bool {
+	return strings.Contains(m.To, SourceHostVar) ||
+		strings.Contains(m.To, SourcePathVar)
+}
+
+// expandPlaceholders replaces the placeholders in destination path d with the
+// host of the source registry, and source repository path p without its
+// leading slash.
+func (m *Mapping) expandPlaceholders(d, p string) string {
+	return strings.NewReplacer(
+		SourceHostVar, m.sourceHost,
+		SourcePathVar, strings.TrimPrefix(p, "/"),
+	).Replace(d)
+}
+
+// isPinned determines whether this mapping is pinned to a digest given in
+// `from`.
+func (m *Mapping) isPinned() bool {
+	return m.digest != ""
+}
+
+// isLocal determines whether `from` refers to a local layout rather than a
+// repository in the source registry.
+func (m *Mapping) isLocal() bool {
+	return layout.IsLayout(m.From)
+}
+
+// isArchived determines whether `to` refers to an OCI layout in object storage
+// rather than a repository in the target registries.
+func (m *Mapping) isArchived() bool {
+	return layout.IsArchive(m.To)
+}
+
+// destRef returns the reference of the destination of source repository r for
+// route in target registry l. For an OCI layout in object storage, this is
+// `to` itself, regardless of target.
+func (m *Mapping) destRef(l *Location, route int, r string) string {
+	if m.isArchived() {
+		return m.To
+	}
+	return l.Registry + m.routePath(route, r)
+}
+
+// isRegexpFrom determines whether `from` is matched against the repository
+// list, which is the case for regular expressions and glob patterns.
 func (m *Mapping) isRegexpFrom() bool {
-	return isRegexp(m.From)
+	return isRegexp(m.From) || isGlob(m.From)
 }
 
 //
@@ -134,6 +1022,205 @@ func isRegexp(expr string) bool {
 	return strings.HasPrefix(expr, RegexpPrefix)
 }
 
+//
+func isGlob(expr string) bool {
+	return strings.HasPrefix(expr, GlobPrefix)
+}
+
+// checkBackrefs verifies that all backreferences in replacement expression
+// repl, such as `$1`, `${1}`, `$name`, or `${name}`, refer to groups that
+// exist in re. This follows the syntax of regexp.Expand, so in `$1x`, the
+// whole `1x` is taken as the group name.
+func checkBackrefs(re *regexp.Regexp, repl string) error {
+
+	groups := make(map[string]bool)
+	for ix, name := range re.SubexpNames() {
+		groups[strconv.Itoa(ix)] = true
+		if name != "" {
+			groups[name] = true
+		}
+	}
+
+	for len(repl) > 0 {
+
+		ix := strings.Index(repl, "$")
+		if ix < 0 {
+			break
+		}
+		repl = repl[ix+1:]
+
+		if strings.HasPrefix(repl, "$") { // escaped `$`
+			repl = repl[1:]
+			continue
+		}
+
+		var name string
+		if strings.HasPrefix(repl, "{") {
+			end := strings.Index(repl, "}")
+			if end < 0 {
+				continue // not a backreference, taken literally
+			}
+			name = repl[1:end]
+			if !isGroupName(name) {
+				continue
+			}
+			repl = repl[end+1:]
+		} else {
+			end := 0
+			for end < len(repl) && isGroupNameChar(rune(repl[end])) {
+				end++
+			}
+			name = repl[:end]
+			repl = repl[end:]
+			if name == "" {
+				continue
+			}
+		}
+
+		if !groups[name] {
+			return fmt.Errorf(
+				"replacement in 'to' refers to group '%s', which does not "+
+					"exist in regular expression '%s'", name, re.String())
+		}
+	}
+
+	return nil
+}
+
+//
+func isGroupName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !isGroupNameChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+//
+func isGroupNameChar(c rune) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' ||
+		'A' <= c && c <= 'Z'
+}
+
+//
+func (m *Mapping) hasSince() bool {
+	return m.Since != ""
+}
+
+// parseCutoff parses s either as an absolute date, in RFC3339 or `2006-01-02`
+// format, or as a duration relative to the time of sync. field is the setting
+// in which s was given, for the error message.
+func parseCutoff(field, s string) (at time.Time, ago time.Duration,
+	err error) {
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if at, err = time.Parse(layout, s); err == nil {
+			return
+		}
+	}
+
+	if ago, err = time.ParseDuration(s); err != nil || ago <= 0 {
+		err = fmt.Errorf(
+			"'%s' must be a date or a positive duration, not '%s'", field, s)
+	}
+
+	return
+}
+
+// cutoffTime returns the time of a cutoff parsed by parseCutoff, relative to
+// now.
+func cutoffTime(now, at time.Time, ago time.Duration) time.Time {
+	if !at.IsZero() {
+		return at
+	}
+	return now.Add(-ago)
+}
+
+// onlyActive determines whether this mapping should only sync repositories to
+// which an image was pushed within the active window.
+func (m *Mapping) onlyActive() bool {
+	return m.activeWindow > 0
+}
+
+// isActive determines whether lastPushed lies within the active window of this
+// mapping. The zero time, i.e. a repository without images, is never active.
+func (m *Mapping) isActive(lastPushed time.Time) bool {
+	return !lastPushed.IsZero() &&
+		!lastPushed.Before(time.Now().Add(-m.activeWindow))
+}
+
+// hasAWSTags determines whether this mapping selects repositories by their AWS
+// resource tags.
+func (m *Mapping) hasAWSTags() bool {
+	return len(m.AWSTags) > 0
+}
+
+// matchesAWSTags determines whether the AWS resource tags res of a repository
+// match all the AWS tags of this mapping. An empty value in the mapping only
+// requires the key to be present.
+func (m *Mapping) matchesAWSTags(res map[string]string) bool {
+	for k, v := range m.AWSTags {
+		if rv, ok := res[k]; !ok || (v != "" && rv != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseActiveWindow parses s either as a boolean, in which case the default
+// active window is used when true, or as a duration.
+func parseActiveWindow(s string) (time.Duration, error) {
+
+	if s == "" {
+		return 0, nil
+	}
+
+	if b, err := strconv.ParseBool(s); err == nil {
+		if b {
+			return defaultActiveWindow, nil
+		}
+		return 0, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d, nil
+	}
+
+	return 0, fmt.Errorf(
+		"'only-active' must be a boolean or a positive duration, not '%s'", s)
+}
+
+//
+func isValidPlatform(p string) bool {
+	parts := strings.Split(p, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" || strings.TrimSpace(part) != part {
+			return false
+		}
+	}
+	return true
+}
+
+// hostPlatform returns the platform on which dregsy runs, as 'os/arch'.
+func hostPlatform() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// registryHost returns the host of registry reg, without any port.
+func registryHost(reg string) string {
+	if h, _, err := net.SplitHostPort(reg); err == nil {
+		return h
+	}
+	return reg
+}
+
 //
 func normalizePath(p string) string {
 	if strings.HasPrefix(p, "/") {
@@ -0,0 +1,594 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestMappingBackrefs(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryBackrefs(th, "regex:team-(.*)/(.*),$2/$1", "/team-a/app", "/app/a", "")
+	tryBackrefs(th, "regex:/(?P<team>[^/]+)/(?P<repo>.+),/${repo}/${team}",
+		"/a/app", "/app/a", "")
+	tryBackrefs(th, "regex:/(?P<repo>.+),/mirror/$repo", "/app",
+		"/mirror/app", "")
+	tryBackrefs(th, "regex:(.*),$0-$$2-${1}", "x", "x-$2-x", "")
+	tryBackrefs(th, "regex:(.*),{$}", "x", "{$}", "")
+
+	tryBackrefs(th, "regex:team-(.*),$2", "", "", "refers to group '2'")
+	tryBackrefs(th, "regex:(.*),${2}", "", "", "refers to group '2'")
+	tryBackrefs(th, "regex:(?P<repo>.*),${team}", "", "", "group 'team'")
+	tryBackrefs(th, "regex:(.*),$1x", "", "", "refers to group '1x'")
+}
+
+//
+func TestMappingToLowercase(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryToLowercase(th, &Mapping{From: "My/Repo"}, "/My/Repo", "/my/repo")
+	tryToLowercase(th, &Mapping{From: "my/repo", To: "Mirror/Repo"},
+		"/my/repo", "/mirror/repo")
+	tryToLowercase(th, &Mapping{From: "regex:.*", To: "Mirror"},
+		"/Team/App", "/mirror/team/app")
+	tryToLowercase(th,
+		&Mapping{From: "regex:.*", To: "regex:/(.*),/Mirror/$1"},
+		"/Team/App", "/mirror/team/app")
+}
+
+//
+func tryToLowercase(th *test.TestHelper, m *Mapping, path, want string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	m.ToLowercase = true
+	th.AssertNoError(m.validate())
+	th.AssertEqual(want, m.mapPath(path))
+
+	m.ToLowercase = false
+	th.AssertNotEqual(want, m.mapPath(path))
+}
+
+//
+func TestMappingDestPaths(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "regex:.*", To: "regex:/team-(.*)/(.*),/mirror/$1/$2"}
+	th.AssertNoError(m.validate())
+	th.AssertNoError(m.checkDestPaths([]string{"/team-a/app", "/team-b/db"}))
+	th.AssertError(m.checkDestPaths([]string{"/team-a/app", "/team-/app"}),
+		"maps '/team-/app' to invalid destination path '/mirror//app': "+
+			"path contains an empty segment")
+	th.AssertError(m.checkDestPaths([]string{"/team-a/App"}),
+		"path must be lowercase")
+	th.AssertError(m.checkDestPaths([]string{"/team-a/app-"}),
+		"invalid reference format")
+
+	m.ToLowercase = true
+	th.AssertNoError(m.checkDestPaths([]string{"/team-a/App"}))
+
+	th.AssertError(checkDestPath("/"), "path is empty")
+	th.AssertError(checkDestPath("/mirror/app/"), "empty segment")
+	th.AssertNoError(checkDestPath("/mirror/team.a/app_x"))
+}
+
+//
+func TestMappingCheckDestination(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "glob:lib/*", To: "mirror"}
+	th.AssertNoError(m.validate())
+	th.AssertTrue(m.appendsSourcePath())
+	th.AssertNoError(m.checkDestination(false))
+	th.AssertError(m.checkDestination(true),
+		"appends the complete source path to the destination")
+
+	// the example is a repository matching 'from'
+	th.AssertEqual("mapping from 'glob:lib/*' to non-regex '/mirror' "+
+		"appends the complete source path to the destination, e.g. "+
+		"'/lib/nginx' is mapped to '/mirror/lib/nginx'; use 'regex:' in "+
+		"'to' for replacing parts of the path",
+		m.destinationWarning("/lib/nginx"))
+
+	// warned once, and only once repositories are known
+	m.warnDestination(nil)
+	th.AssertFalse(m.destWarned)
+	m.warnDestination([]string{"/lib/nginx"})
+	th.AssertTrue(m.destWarned)
+
+	m = &Mapping{From: "glob:lib/*", To: "regex:^/lib/(.*)$,/mirror/$1"}
+	th.AssertNoError(m.validate())
+	th.AssertFalse(m.appendsSourcePath())
+	th.AssertNoError(m.checkDestination(true))
+	m.warnDestination([]string{"/lib/nginx"})
+	th.AssertFalse(m.destWarned)
+}
+
+//
+func TestMappingPlaceholders(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryPlaceholders(th, &Mapping{From: "library/nginx",
+		To: "{source_host}/{source_path}"},
+		"/library/nginx", "/docker.io/library/nginx")
+	tryPlaceholders(th, &Mapping{From: "regex:library/.*",
+		To: "mirror/{source_host}/{source_path}"},
+		"/library/nginx", "/mirror/docker.io/library/nginx")
+	tryPlaceholders(th, &Mapping{From: "glob:team/*",
+		To: "regex:^/team/(.*)$,/{source_host}/$1"},
+		"/team/app", "/docker.io/app")
+
+	m := &Mapping{From: "oci:/var/lib/images/app", To: "{source_path}"}
+	th.AssertError(m.validate(), "cannot be used with a local 'from'")
+
+	th.AssertEqual("localhost", registryHost("localhost:5000"))
+	th.AssertEqual("docker.io", registryHost("docker.io"))
+}
+
+//
+func tryPlaceholders(th *test.TestHelper, m *Mapping, path, want string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	m.sourceHost = "docker.io"
+	th.AssertNoError(m.validate())
+	th.AssertNoError(m.checkDestination(true))
+	th.AssertEqual(want, m.mapPath(path))
+}
+
+//
+func TestMappingGlob(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	repos := []string{
+		"team-a/service-x", "team-a/service-x/sub", "team-b/service-y",
+		"team-b/other", "team-c", "team.a/service-x", "app", "lib/app",
+		"lib/x/y/app", "a+b", "a*b",
+	}
+
+	tryGlob(th, "glob:team-*/service-*", repos,
+		[]string{"/team-a/service-x", "/team-b/service-y"})
+	tryGlob(th, "glob:team-?", repos, []string{"/team-c"})
+	tryGlob(th, "glob:team-a/**", repos,
+		[]string{"/team-a/service-x", "/team-a/service-x/sub"})
+	tryGlob(th, "glob:**/app", repos,
+		[]string{"/app", "/lib/app", "/lib/x/y/app"})
+	tryGlob(th, "glob:lib/**/app", repos,
+		[]string{"/lib/app", "/lib/x/y/app"})
+	tryGlob(th, "glob:team.a/*", repos, []string{"/team.a/service-x"})
+	tryGlob(th, "glob:a+b", repos, []string{"/a+b"})
+	tryGlob(th, `glob:a\*b`, repos, []string{"/a*b"})
+
+	m := &Mapping{From: "glob:team-*", To: "mirror"}
+	th.AssertNoError(m.validate())
+	th.AssertEqual("/mirror/team-c", m.mapPath("/team-c"))
+}
+
+//
+func tryGlob(th *test.TestHelper, from string, repos, want []string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	m := &Mapping{From: from}
+	th.AssertNoError(m.validate())
+	th.AssertTrue(m.isRegexpFrom())
+	th.AssertEqualSlices(want, m.filterRepos(repos))
+}
+
+//
+func TestMappingFromExclude(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	repos := []string{"team-a/app", "team-a/internal-db", "team-a/licensed",
+		"team-a/internal-cache", "team-b/app"}
+
+	m := &Mapping{From: "regex:team-a/.*", FromExclude: []string{
+		"/team-a/licensed", "regex:team-a/internal-.*"}}
+	th.AssertNoError(m.validate())
+	th.AssertEqualSlices([]string{"/team-a/app"}, m.filterRepos(repos))
+
+	m = &Mapping{From: "glob:team-*/app", FromExclude: []string{"team-b/app"}}
+	th.AssertNoError(m.validate())
+	th.AssertEqualSlices([]string{"/team-a/app"}, m.filterRepos(repos))
+
+	// literal names are not patterns
+	m = &Mapping{From: "glob:team-a/*", FromExclude: []string{"team-a/.*"}}
+	th.AssertNoError(m.validate())
+	th.AssertEqual(4, len(m.filterRepos(repos)))
+
+	m = &Mapping{From: "team-a/app", FromExclude: []string{"team-a/app"}}
+	th.AssertError(m.validate(),
+		"'from-exclude' requires a regex or glob 'from'")
+
+	m = &Mapping{From: "regex:team-a/.*", FromExclude: []string{"regex:"}}
+	th.AssertError(m.validate(),
+		"'from-exclude' must not contain an empty item")
+
+	m = &Mapping{From: "regex:team-a/.*", FromExclude: []string{"regex:a("}}
+	th.AssertError(m.validate(),
+		"'from-exclude' uses invalid regular expression 'a('")
+}
+
+//
+func TestMappingMutableTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "app", SkipExisting: true,
+		MutableTags: []string{"stable", "regex: .*-nightly"}}
+	th.AssertNoError(m.validate())
+	for tag, mutable := range map[string]bool{
+		"latest": true, "stable": true, "1.0-nightly": true,
+		"1.0": false, "stable-1": false, "latest-1": false,
+	} {
+		th.AssertEqual(mutable, m.isMutable(tag))
+	}
+
+	// without 'mutable-tags', all tags are mutable
+	m = &Mapping{From: "app", SkipExisting: true}
+	th.AssertNoError(m.validate())
+	th.AssertTrue(m.isMutable("1.0"))
+
+	m = &Mapping{From: "app", MutableTags: []string{"stable"}}
+	th.AssertError(m.validate(), "'mutable-tags' requires 'skip-existing'")
+
+	m = &Mapping{From: "app", SkipExisting: true,
+		MutableTags: []string{"regex: "}}
+	th.AssertError(m.validate(),
+		"'mutable-tags' must not contain an empty item")
+
+	m = &Mapping{From: "app", SkipExisting: true,
+		MutableTags: []string{"regex:a("}}
+	th.AssertError(m.validate(),
+		"'mutable-tags' uses invalid regular expression 'a('")
+}
+
+//
+func TestMappingTagRoutes(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "regex:team-a/.*", To: "regex:team-a/(.*),mirror/$1",
+		TagRoutes: []*TagRoute{
+			{Tags: []string{"regex:.*-rc\\d+", "glob:*-beta*"},
+				To: "regex:team-a/(.*),staging/$1"},
+			{Tags: []string{"1.0"}, To: "pinned"},
+		}}
+	th.AssertNoError(m.validate())
+	th.AssertTrue(m.hasTagRoutes())
+	th.AssertEqual(fmt.Sprint([]int{0, 1, defaultRoute}),
+		fmt.Sprint(m.routes()))
+
+	for tag, route := range map[string]int{
+		"2.0-rc1": 0, "2.0-beta": 0, "2.0-beta.3": 0, "1.0": 1,
+		"1.0.1": defaultRoute, "2.0-rc": defaultRoute,
+		"latest": defaultRoute,
+	} {
+		th.AssertEqual(route, m.routeOf(tag))
+	}
+
+	th.AssertEqual("/staging/app", m.routePath(0, "/team-a/app"))
+	th.AssertEqual("/pinned/team-a/app", m.routePath(1, "/team-a/app"))
+	th.AssertEqual("/mirror/app", m.routePath(defaultRoute, "/team-a/app"))
+
+	all := func() ([]tags.Tag, error) {
+		return tags.FromNames([]string{"1.0", "2.0-rc1", "latest"}), nil
+	}
+	for route, want := range map[int][]string{
+		0: {"2.0-rc1"}, 1: {"1.0"}, defaultRoute: {"latest"},
+	} {
+		list, err := routedLister(m, route, all)()
+		th.AssertNoError(err)
+		th.AssertEqualSlices(want, tags.Names(list))
+	}
+
+	m.UnroutedTags = UnroutedSkip
+	th.AssertNoError(m.validate())
+	th.AssertEqual(fmt.Sprint([]int{0, 1}), fmt.Sprint(m.routes()))
+
+	// without tag routes, all tags go to the destination of the mapping
+	m = &Mapping{From: "app"}
+	th.AssertNoError(m.validate())
+	th.AssertEqual(fmt.Sprint([]int{defaultRoute}), fmt.Sprint(m.routes()))
+	th.AssertEqual(defaultRoute, m.routeOf("1.0"))
+
+	tryTagRoutes(th, &Mapping{From: "app", UnroutedTags: UnroutedSkip},
+		"'unrouted-tags' requires 'tag-routes'")
+	tryTagRoutes(th, &Mapping{From: "app", UnroutedTags: "drop",
+		TagRoutes: []*TagRoute{{Tags: []string{"1.0"}, To: "x"}}},
+		"'unrouted-tags' must be 'sync' or 'skip', not 'drop'")
+	tryTagRoutes(th, &Mapping{From: "app",
+		TagRoutes: []*TagRoute{{Tags: []string{"1.0"}}}},
+		"tag route 1 requires 'tags' and 'to'")
+	tryTagRoutes(th, &Mapping{From: "app",
+		TagRoutes: []*TagRoute{{Tags: []string{"regex:a("}, To: "x"}}},
+		"tag route 1 uses invalid pattern 'regex:a('")
+	tryTagRoutes(th, &Mapping{From: "app",
+		TagRoutes: []*TagRoute{{Tags: []string{"glob: "}, To: "x"}}},
+		"tag route 1 must not contain an empty tag")
+	tryTagRoutes(th, &Mapping{From: "app",
+		TagRoutes: []*TagRoute{{Tags: []string{"1.0"}, To: "regex:x"}}},
+		"tag route 1: replacement expression missing in 'to'")
+}
+
+//
+func TestMappingTagMap(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryTagMap(th, "regex:-ubi$,", "1.0-ubi", "1.0", "")
+	tryTagMap(th, "regex:-ubi$,", "1.0", "1.0", "")
+	tryTagMap(th, "regex:^(.*)$,mirror-$1", "1.0", "mirror-1.0", "")
+	tryTagMap(th, "regex:v(?P<ver>.+),${ver}", "v2.1", "2.1", "")
+
+	tryTagMap(th, "-ubi$,", "", "", "must be a regular expression")
+	tryTagMap(th, "regex:-ubi$", "", "", "replacement expression missing")
+	tryTagMap(th, "regex:(,x", "", "", "invalid regular expression")
+	tryTagMap(th, "regex:(.*),$2", "", "", "refers to group '2'")
+
+	m := &Mapping{From: "test/image"}
+	th.AssertNoError(m.validate())
+	th.AssertNil(m.tagMapper())
+	th.AssertEqual("1.0", m.mapTag("1.0"))
+}
+
+//
+func TestMappingTagPrefixSuffix(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "test/image", TagPrefix: "mirror-"}
+	th.AssertNoError(m.validate())
+	th.AssertNotNil(m.tagMapper())
+	th.AssertEqual("mirror-1.0", m.mapTag("1.0"))
+
+	m = &Mapping{From: "test/image", TagSuffix: "-amd64"}
+	th.AssertNoError(m.validate())
+	th.AssertEqual("1.0-amd64", m.mapTag("1.0"))
+
+	// the tag map is applied first
+	m = &Mapping{From: "test/image", TagMap: "regex:-ubi$,",
+		TagPrefix: "v", TagSuffix: ".mirror"}
+	th.AssertNoError(m.validate())
+	th.AssertEqual("v1.0.mirror", m.mapTag("1.0-ubi"))
+	th.AssertEqual("v2.0.mirror", m.mapTag("2.0"))
+
+	for _, p := range []string{"-x", ".x", "a:b", "a/b", "a b"} {
+		m = &Mapping{From: "test/image", TagPrefix: p}
+		th.AssertError(m.validate(), "invalid 'tag-prefix' '"+p+"'")
+	}
+	for _, s := range []string{"a:b", "a/b", "@x", "a+b"} {
+		m = &Mapping{From: "test/image", TagSuffix: s}
+		th.AssertError(m.validate(), "invalid 'tag-suffix' '"+s+"'")
+	}
+}
+
+//
+func tryTagRoutes(th *test.TestHelper, m *Mapping, err string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	th.AssertError(m.validate(), err)
+}
+
+//
+func tryTagMap(th *test.TestHelper, tagMap, tag, want, err string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	m := &Mapping{From: "test/image", TagMap: tagMap}
+	e := m.validate()
+
+	if err != "" {
+		th.AssertError(e, err)
+		return
+	}
+
+	th.AssertNoError(e)
+	th.AssertNotNil(m.tagMapper())
+	th.AssertEqual(want, m.mapTag(tag))
+}
+
+//
+func tryBackrefs(th *test.TestHelper, to, path, want, err string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	m := &Mapping{From: "regex:.*", To: to}
+	e := m.validate()
+
+	if err != "" {
+		th.AssertError(e, err)
+		return
+	}
+
+	th.AssertNoError(e)
+	th.AssertEqual(want, m.mapPath(path))
+}
+
+//
+func TestMappingDigest(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	digest := "sha256:" + strings.Repeat("0", 64)
+
+	m := &Mapping{From: "library/busybox@" + digest, DigestTag: "tested"}
+	th.AssertNoError(m.validate())
+	th.AssertTrue(m.isPinned())
+	th.AssertEqual("/library/busybox", m.From)
+	th.AssertEqual(digest, m.digest)
+	th.AssertEqual("/library/busybox", m.mapPath(m.From))
+
+	m = &Mapping{From: "library/busybox"}
+	th.AssertNoError(m.validate())
+	th.AssertFalse(m.isPinned())
+
+	tryDigest(th, &Mapping{From: "library/busybox@sha256:abc"},
+		"invalid digest 'sha256:abc' in 'from'")
+	tryDigest(th, &Mapping{From: "library/busybox", DigestTag: "tested"},
+		"'digest-tag' requires a digest in 'from'")
+	tryDigest(th, &Mapping{From: "library/busybox@" + digest,
+		DigestTag: "-tested"}, "invalid 'digest-tag' '-tested'")
+	tryDigest(th, &Mapping{From: "library/busybox@" + digest,
+		Tags: []string{"latest"}}, "'tags' cannot be used with a digest")
+	tryDigest(th, &Mapping{From: "library/busybox@" + digest,
+		TagMap: "regex:a,b"}, "'tag-map' cannot be used with a digest")
+	tryDigest(th, &Mapping{From: "library/busybox@" + digest,
+		TagSuffix: "-x"}, "'tag-suffix' cannot be used with a digest")
+	tryDigest(th, &Mapping{From: "library/busybox@" + digest,
+		Platform: "linux/amd64"}, "'platform' cannot be used with a digest")
+	tryDigest(th, &Mapping{From: "library/busybox@" + digest,
+		Platform: "all"}, "")
+}
+
+//
+func TestMappingAWSTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "regex:team-a/.*",
+		AWSTags: map[string]string{"mirror": "true", "owner": ""}}
+	th.AssertNoError(m.validate())
+	th.AssertTrue(m.hasAWSTags())
+
+	th.AssertTrue(m.matchesAWSTags(
+		map[string]string{"mirror": "true", "owner": "team-a"}))
+	th.AssertTrue(m.matchesAWSTags(
+		map[string]string{"mirror": "true", "owner": "", "other": "x"}))
+	th.AssertFalse(m.matchesAWSTags(
+		map[string]string{"mirror": "false", "owner": "team-a"}))
+	th.AssertFalse(m.matchesAWSTags(map[string]string{"mirror": "true"}))
+	th.AssertFalse(m.matchesAWSTags(nil))
+
+	m = &Mapping{From: "regex:team-a/.*", AWSTags: map[string]string{"": "x"}}
+	th.AssertError(m.validate(), "'aws-tags' must not contain an empty key")
+
+	m = &Mapping{From: "library/busybox"}
+	th.AssertNoError(m.validate())
+	th.AssertFalse(m.hasAWSTags())
+}
+
+//
+func TestMappingManifestType(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "library/busybox"}
+	th.AssertNoError(m.validate())
+	th.AssertFalse(m.matchesOnManifestType())
+	th.AssertTrue(m.matchesManifestType(true))
+	th.AssertTrue(m.matchesManifestType(false))
+
+	m = &Mapping{From: "library/busybox", ManifestType: ManifestTypeAny}
+	th.AssertNoError(m.validate())
+	th.AssertFalse(m.matchesOnManifestType())
+
+	m = &Mapping{From: "library/busybox", ManifestType: ManifestTypeIndex}
+	th.AssertNoError(m.validate())
+	th.AssertTrue(m.matchesOnManifestType())
+	th.AssertTrue(m.matchesManifestType(true))
+	th.AssertFalse(m.matchesManifestType(false))
+
+	m = &Mapping{From: "library/busybox", ManifestType: ManifestTypeImage}
+	th.AssertNoError(m.validate())
+	th.AssertFalse(m.matchesManifestType(true))
+	th.AssertTrue(m.matchesManifestType(false))
+
+	m = &Mapping{From: "library/busybox", ManifestType: "list"}
+	th.AssertError(m.validate(),
+		"'manifest-type' must be 'index', 'image', or 'any', not 'list'")
+
+	tryDigest(th, &Mapping{From: "library/busybox@sha256:" +
+		strings.Repeat("0", 64), ManifestType: ManifestTypeIndex},
+		"'manifest-type' cannot be used with a digest")
+}
+
+//
+func TestMappingCompression(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "library/busybox"}
+	th.AssertNoError(m.validate())
+	th.AssertEqual("", m.recompression())
+
+	m = &Mapping{From: "library/busybox", Compression: CompressionKeep,
+		PreserveDigests: true}
+	th.AssertNoError(m.validate())
+	th.AssertEqual("", m.recompression())
+
+	m = &Mapping{From: "library/busybox", Compression: CompressionZstd,
+		Platform: "all"}
+	th.AssertNoError(m.validate())
+	th.AssertEqual(CompressionZstd, m.recompression())
+
+	m = &Mapping{From: "library/busybox", Compression: CompressionGzip}
+	th.AssertNoError(m.validate())
+	th.AssertEqual(CompressionGzip, m.recompression())
+
+	m = &Mapping{From: "library/busybox", Compression: "xz"}
+	th.AssertError(m.validate(),
+		"'compression' must be 'gzip', 'zstd', or 'keep', not 'xz'")
+
+	m = &Mapping{From: "library/busybox", Compression: CompressionZstd,
+		PreserveDigests: true}
+	th.AssertError(m.validate(), "'compression' 'zstd' recompresses layers, "+
+		"and cannot be combined with 'preserve-digests'")
+
+	m = &Mapping{From: "library/busybox", Compression: CompressionGzip,
+		Platforms: []string{"linux/amd64"}}
+	th.AssertError(m.validate(), "cannot be combined with 'platforms'")
+
+	m = &Mapping{From: "library/busybox@sha256:" + strings.Repeat("0", 64),
+		Compression: CompressionZstd}
+	th.AssertError(m.validate(),
+		"cannot be combined with a digest in 'from'")
+}
+
+//
+func tryDigest(th *test.TestHelper, m *Mapping, err string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	if e := m.validate(); err != "" {
+		th.AssertError(e, err)
+	} else {
+		th.AssertNoError(e)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	gosync "sync"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+)
+
+// maxCachedMetadata is the number of images whose labels and annotations a
+// task keeps cached
+const maxCachedMetadata = 10000
+
+// imageMetadata holds the labels and annotations of an image
+type imageMetadata struct {
+	labels      map[string]string
+	annotations map[string]string
+}
+
+// metadataCache caches the labels and annotations of source images by the
+// digest of their manifest, which they cannot change without. Each lookup
+// still resolves the digest of the image, but the config is only fetched for
+// digests not seen before. Once full, the cache is emptied.
+type metadataCache struct {
+	entries map[string]*imageMetadata
+	mutex   gosync.Mutex
+}
+
+//
+func newMetadataCache() *metadataCache {
+	return &metadataCache{entries: make(map[string]*imageMetadata)}
+}
+
+// get returns the labels and annotations of image ref in registry l.
+func (c *metadataCache) get(ctx context.Context, ref string, l *Location) (
+	*imageMetadata, error) {
+
+	digest, err := registry.ManifestDigest(ctx, ref, l.creds, l.transport)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	md, ok := c.entries[digest]
+	c.mutex.Unlock()
+	if ok {
+		return md, nil
+	}
+
+	labels, annotations, err := registry.ImageMetadata(
+		ctx, ref, l.creds, l.transport)
+	if err != nil {
+		return nil, err
+	}
+	md = &imageMetadata{labels: labels, annotations: annotations}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.entries) >= maxCachedMetadata {
+		c.entries = make(map[string]*imageMetadata)
+	}
+	c.entries[digest] = md
+	return md, nil
+}
@@ -0,0 +1,83 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// PlanMapping resolves mapping m in the same way as a dry run, and writes the
+// images it would sync to w, as JSON lines followed by the total. Source and
+// target settings are taken from the task named task in conf, whose own
+// mappings are replaced by m. When conf has a single task, task may be empty.
+// With force, m may exceed its 'max-repos' limit. Nothing is synced.
+func PlanMapping(conf *SyncConfig, task string, m *Mapping, force bool,
+	w io.Writer) error {
+
+	t, err := planTask(conf, task)
+	if err != nil {
+		return err
+	}
+
+	if !m.isLocal() && t.Source == nil {
+		return fmt.Errorf("task '%s' has no source", t.Name)
+	}
+	if t.Source != nil {
+		m.sourceHost = registryHost(t.Source.Registry)
+	}
+	m.resolvePlatform(t.platform)
+	if err := m.validate(); err != nil {
+		return fmt.Errorf("invalid mapping: %v", err)
+	}
+	if err := m.checkDestination(t.strict); err != nil {
+		return fmt.Errorf("invalid mapping: %v", err)
+	}
+	t.Mappings = []*Mapping{m}
+
+	enc := json.NewEncoder(w)
+	n, err := (&Sync{force: force}).dryRunTask(t, enc)
+	if e := enc.Encode(&DryRunTotal{Total: n}); e != nil {
+		return e
+	}
+	if err != nil {
+		return fmt.Errorf("mapping had errors, please see log for details")
+	}
+	return nil
+}
+
+// planTask returns the task named task from conf. When task is empty, conf
+// needs to have a single task, which is returned.
+func planTask(conf *SyncConfig, task string) (*Task, error) {
+
+	if task == "" {
+		if len(conf.Tasks) != 1 {
+			return nil, fmt.Errorf(
+				"config has %d tasks, a task needs to be selected",
+				len(conf.Tasks))
+		}
+		return conf.Tasks[0], nil
+	}
+
+	for _, t := range conf.Tasks {
+		if t.Name == task {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("task '%s' not found in config", task)
+}
@@ -0,0 +1,110 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestPlanMapping(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/v2/":
+				w.WriteHeader(http.StatusOK)
+			case r.URL.Path == "/v2/_catalog":
+				json.NewEncoder(w).Encode(map[string][]string{
+					"repositories": {"team/app", "team/db", "other/app"}})
+			case strings.HasSuffix(r.URL.Path, "/tags/list"):
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"name": strings.TrimSuffix(strings.TrimPrefix(
+						r.URL.Path, "/v2/"), "/tags/list"),
+					"tags": []string{"1.0", "1.1", "latest"}})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: %s
+    lister:
+      type: v2
+  target:
+    registry: localhost:5000
+  mappings:
+  - from: other/app
+`, host)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	out := new(bytes.Buffer)
+	th.AssertNoError(PlanMapping(c, "", &Mapping{
+		From: "regex:team/.*", To: "regex:team/,mirror/",
+		Tags: []string{"semver: >=1.1"}}, false, out))
+
+	var plan []DryRunItem
+	var total DryRunTotal
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for _, l := range lines[:len(lines)-1] {
+		var item DryRunItem
+		th.AssertNoError(json.Unmarshal([]byte(l), &item))
+		plan = append(plan, item)
+	}
+	th.AssertNoError(json.Unmarshal([]byte(lines[len(lines)-1]), &total))
+
+	th.AssertEqual(2, total.Total)
+	th.AssertEqual(2, len(plan))
+	th.AssertEqual(host+"/team/app", plan[0].Source)
+	th.AssertEqual("localhost:5000/mirror/app", plan[0].Target)
+	th.AssertEqual("1.1", plan[0].Tag)
+	th.AssertEqual(host+"/team/db", plan[1].Source)
+	th.AssertEqual("localhost:5000/mirror/db", plan[1].Target)
+
+	// the mapping of the task is replaced
+	th.AssertEqual(1, len(c.Tasks[0].Mappings))
+	th.AssertEqual("regex:team/.*", c.Tasks[0].Mappings[0].From)
+
+	th.AssertError(PlanMapping(c, "other", &Mapping{From: "team/app"},
+		false, out), "task 'other' not found")
+	th.AssertError(PlanMapping(c, "test", &Mapping{From: "team/app",
+		Tags: []string{"semver: >>1"}}, false, out), "invalid mapping")
+
+	c.Tasks = append(c.Tasks, &Task{Name: "second"})
+	th.AssertError(PlanMapping(c, "", &Mapping{From: "team/app"}, false, out),
+		"config has 2 tasks")
+}
@@ -0,0 +1,544 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/layout"
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/relays"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// kinds of drift found by a reconcile run
+const (
+	DriftMissing  = "missing"
+	DriftMismatch = "mismatch"
+	DriftExtra    = "extra"
+)
+
+// ReconcileItem is written to stdout for each image found to drift during a
+// reconcile run, as a single line JSON object. Digest and TargetDigest are
+// only set for mismatches, and Fixed when the image was synced successfully,
+// and found in the target afterwards.
+type ReconcileItem struct {
+	Task         string `json:"task"`
+	From         string `json:"from"`
+	Source       string `json:"source,omitempty"`
+	Target       string `json:"target"`
+	Tag          string `json:"tag,omitempty"`
+	TargetTag    string `json:"target-tag,omitempty"`
+	Drift        string `json:"drift"`
+	Digest       string `json:"digest,omitempty"`
+	TargetDigest string `json:"target-digest,omitempty"`
+	Fixed        bool   `json:"fixed,omitempty"`
+	// target image, and the digest it needs to have if known, for checking
+	// whether syncing fixed the drift
+	ref  string
+	want string
+}
+
+// ReconcileTotal is written to stdout at the end of a reconcile run, as a
+// single line JSON object. Checked is the number of images compared.
+type ReconcileTotal struct {
+	Checked  int `json:"checked"`
+	Missing  int `json:"missing"`
+	Mismatch int `json:"mismatch"`
+	Extra    int `json:"extra"`
+	Fixed    int `json:"fixed"`
+}
+
+// add counts drifted item.
+func (rt *ReconcileTotal) add(item *ReconcileItem) {
+	switch item.Drift {
+	case DriftMissing:
+		rt.Missing++
+	case DriftMismatch:
+		rt.Mismatch++
+	case DriftExtra:
+		rt.Extra++
+	}
+	if item.Fixed {
+		rt.Fixed++
+	}
+}
+
+// drifted returns the number of images that drifted and were not fixed.
+func (rt *ReconcileTotal) drifted() int {
+	return rt.Missing + rt.Mismatch + rt.Extra - rt.Fixed
+}
+
+// reconcileTasks runs a reconcile for all tasks matching task filter tf. It
+// fails when any image drifted and was not fixed.
+func (s *Sync) reconcileTasks(conf *SyncConfig, tf *util.Regex) error {
+
+	if s.fixDrift {
+		log.Info("reconciling, syncing images that drifted")
+	} else {
+		log.Info("reconciling, nothing will be synced")
+	}
+
+	enc := json.NewEncoder(s.dryRunOut)
+	total := &ReconcileTotal{}
+	errs := false
+
+	for _, t := range conf.Tasks {
+		if tf.Matches(t.Name) {
+			err := s.reconcileTask(t, enc, total)
+			errs = errs || err != nil
+		}
+	}
+
+	if err := enc.Encode(total); err != nil {
+		return err
+	}
+
+	if errs {
+		return fmt.Errorf(
+			"one or more tasks had errors, please see log for details")
+	}
+
+	if n := total.drifted(); n > 0 {
+		return fmt.Errorf("%d image(s) drifted from their source", n)
+	}
+
+	log.Info("all done, no drift found")
+	return nil
+}
+
+// reconcileTask compares the images that task t would sync with those in its
+// target registries, syncs the ones that drifted if set to fix drift, and
+// writes the drifted images to enc, adding them to total.
+func (s *Sync) reconcileTask(t *Task, enc *json.Encoder,
+	total *ReconcileTotal) error {
+
+	logger := log.WithField("task", t.Name)
+	logger.WithFields(log.Fields{
+		"source": t.Source.Registry,
+		"target": t.targetRegistries()}).Info("reconciling task")
+	t.force = s.force
+
+	// fixing drift syncs, so it must not overlap with a regular run
+	if s.fixDrift {
+		unlock, err := t.lock()
+		if err != nil {
+			logger.Error(err)
+			return err
+		}
+		defer unlock()
+	}
+
+	ctx, cancel := t.runContext(s.stopper.context())
+	defer cancel()
+
+	for _, l := range t.targets() {
+		if err := l.RefreshAuth(); err != nil {
+			logger.Error(err)
+			return err
+		}
+	}
+	if err := s.preflight(ctx, t); err != nil {
+		logger.WithField("failure", registry.FailureOf(err)).Error(err)
+		return err
+	}
+
+	var ret error
+	var items []*ReconcileItem
+	var jobs []*syncJob
+
+	for _, m := range t.Mappings {
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		mlog := logger.WithField("mapping", m.From)
+
+		if m.isArchived() {
+			mlog.Warn("cannot reconcile object storage in 'to', skipping")
+			continue
+		}
+
+		if err := t.refreshSourceAuth(m); err != nil {
+			mlog.Error(err)
+			ret = err
+			continue
+		}
+
+		repos, _, err := t.mappingRepos(ctx, m)
+		if err != nil {
+			mlog.Error(err)
+			ret = err
+			continue
+		}
+
+		for _, r := range repos {
+			found, fixes, err := s.reconcileRepo(ctx, t, m, r, mlog, total)
+			if err != nil {
+				mlog.WithField("repo", t.sourceRef(m, r)).Error(err)
+				ret = err
+			}
+			items = append(items, found...)
+			jobs = append(jobs, fixes...)
+		}
+	}
+
+	if len(jobs) > 0 {
+		logger.Infof("syncing %d repositories with drifted images", len(jobs))
+		for ix, err := range s.syncRefs(t, jobs) {
+			if err != nil {
+				jobs[ix].opt.Logger().Error(err)
+				ret = err
+				continue
+			}
+			for _, item := range jobs[ix].drift {
+				item.Fixed = isFixed(ctx, jobs[ix].target, item)
+				if !item.Fixed {
+					jobs[ix].opt.Logger().WithField("ref", item.ref).Warn(
+						"image still drifted after syncing")
+				}
+			}
+		}
+	}
+
+	for _, item := range items {
+		total.add(item)
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+	}
+
+	if err := t.timedOut(ctx); err != nil {
+		logger.Error(err)
+		ret = err
+	}
+
+	return ret
+}
+
+// reconcileRepo compares the images of source repository r of mapping m with
+// those in each target registry of task t, and returns the images that
+// drifted. When set to fix drift, it also returns a sync job for each target
+// repository with images that are missing or differ.
+func (s *Sync) reconcileRepo(ctx context.Context, t *Task, m *Mapping,
+	r string, mlog *log.Entry, total *ReconcileTotal) ([]*ReconcileItem,
+	[]*syncJob, error) {
+
+	if m.isPinned() {
+		return s.reconcilePinned(ctx, t, m, r, mlog, total)
+	}
+
+	src := t.sourceRef(m, r)
+
+	var srcImage func(tag string) string
+	if m.isLocal() {
+		lo, err := layout.New(m.From)
+		if err != nil {
+			return nil, nil, err
+		}
+		srcImage = lo.Ref
+	}
+
+	list, err := t.expandTags(ctx, m, src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// only tags the relay would not skip are expected in the destination
+	var expected []string
+	checks := []func(src string) (bool, error){t.platformChecker(ctx, m),
+		t.artifactChecker(ctx, m), t.metadataChecker(ctx, m),
+		t.manifestTypeChecker(ctx, m)}
+	for _, tag := range list {
+		if route := m.routeOf(tag); route == defaultRoute &&
+			m.UnroutedTags == UnroutedSkip {
+			continue
+		}
+		selected, err := allow(checks, fmt.Sprintf("%s:%s", src, tag))
+		if err != nil {
+			return nil, nil, err
+		}
+		if selected {
+			expected = append(expected, tag)
+		}
+	}
+
+	compare := s.comparesDigests(m)
+
+	var items []*ReconcileItem
+	var jobs []*syncJob
+
+	for _, l := range t.targets() {
+
+		listed := map[string]map[string]bool{}
+		wanted := map[string]map[string]bool{}
+		drifted := map[string][]*ReconcileItem{}
+		var order []string
+
+		lookup := func(trgt string) (map[string]bool, error) {
+			if existing, ok := listed[trgt]; ok {
+				return existing, nil
+			}
+			list, _, err := registry.RepoTags(ctx, trgt, l.creds, l.transport)
+			if err != nil {
+				return nil, err
+			}
+			existing := map[string]bool{}
+			for _, tag := range list {
+				existing[tag] = true
+			}
+			listed[trgt] = existing
+			wanted[trgt] = map[string]bool{}
+			order = append(order, trgt)
+			return existing, nil
+		}
+
+		if s.findExtra {
+			for _, route := range m.routes() {
+				if _, err := lookup(m.destRef(l, route, r)); err != nil {
+					return items, jobs, err
+				}
+			}
+		}
+
+		for _, tag := range expected {
+
+			trgt := m.destRef(l, m.routeOf(tag), r)
+			existing, err := lookup(trgt)
+			if err != nil {
+				return items, jobs, err
+			}
+
+			trgtTag := m.mapTag(tag)
+			wanted[trgt][trgtTag] = true
+			total.Checked++
+
+			item := &ReconcileItem{Task: t.Name, From: m.From, Source: src,
+				Target: trgt, Tag: tag,
+				ref: fmt.Sprintf("%s:%s", trgt, trgtTag)}
+			if trgtTag != tag {
+				item.TargetTag = trgtTag
+			}
+
+			if !existing[trgtTag] {
+				item.Drift = DriftMissing
+			} else if compare {
+				srcDigest, trgtDigest, err := t.digests(ctx, l,
+					fmt.Sprintf("%s:%s", src, tag),
+					fmt.Sprintf("%s:%s", trgt, trgtTag))
+				if err != nil {
+					return items, jobs, err
+				}
+				if srcDigest == trgtDigest {
+					continue
+				}
+				item.Drift = DriftMismatch
+				item.Digest, item.TargetDigest = srcDigest, trgtDigest
+				item.want = srcDigest
+			} else {
+				continue
+			}
+
+			items = append(items, item)
+			drifted[trgt] = append(drifted[trgt], item)
+		}
+
+		for _, trgt := range order {
+
+			if s.findExtra {
+				var extra []string
+				for tag := range listed[trgt] {
+					if !wanted[trgt][tag] && !isSignatureTag(m, tag) {
+						extra = append(extra, tag)
+					}
+				}
+				sort.Strings(extra)
+				for _, tag := range extra {
+					items = append(items, &ReconcileItem{Task: t.Name,
+						From: m.From, Target: trgt, TargetTag: tag,
+						Drift: DriftExtra})
+				}
+			}
+
+			if !s.fixDrift || len(drifted[trgt]) == 0 {
+				continue
+			}
+			var fix []string
+			for _, item := range drifted[trgt] {
+				fix = append(fix, item.Tag)
+			}
+			ts, err := tags.NewTagSet(fix)
+			if err != nil {
+				return items, jobs, err
+			}
+			opt := forceCopy(
+				t.syncOptions(ctx, m, l, src, trgt, ts, nil, mlog))
+			opt.SrcImage = srcImage
+			jobs = append(jobs, &syncJob{target: l, opt: opt,
+				drift: drifted[trgt]})
+		}
+	}
+
+	return items, jobs, nil
+}
+
+// reconcilePinned compares the image that mapping m pins by digest in source
+// repository r with those in each target registry of task t, like
+// reconcileRepo does for tags. Since the image is copied as is, its digest is
+// always compared.
+func (s *Sync) reconcilePinned(ctx context.Context, t *Task, m *Mapping,
+	r string, mlog *log.Entry, total *ReconcileTotal) ([]*ReconcileItem,
+	[]*syncJob, error) {
+
+	src := t.sourceRef(m, r)
+
+	var items []*ReconcileItem
+	var jobs []*syncJob
+
+	for _, l := range t.targets() {
+
+		trgt := m.destRef(l, defaultRoute, r)
+		ref := fmt.Sprintf("%s@%s", trgt, m.digest)
+		if m.DigestTag != "" {
+			ref = fmt.Sprintf("%s:%s", trgt, m.DigestTag)
+		}
+
+		digest, exists, err := registry.ManifestExists(ctx, ref, l.creds,
+			l.transport)
+		if err != nil {
+			return items, jobs, err
+		}
+		total.Checked++
+
+		item := &ReconcileItem{Task: t.Name, From: m.From, Source: src,
+			Target: trgt, TargetTag: m.DigestTag, ref: ref, want: m.digest}
+		switch {
+		case !exists:
+			item.Drift = DriftMissing
+		case digest != m.digest:
+			item.Drift = DriftMismatch
+			item.Digest, item.TargetDigest = m.digest, digest
+		default:
+			continue
+		}
+
+		items = append(items, item)
+		if s.fixDrift {
+			jobs = append(jobs, &syncJob{target: l, drift: items[len(items)-1:],
+				opt: forceCopy(t.syncOptions(
+					ctx, m, l, src, trgt, m.tagSet, nil, mlog))})
+		}
+	}
+
+	return items, jobs, nil
+}
+
+// forceCopy sets options opt of a sync job that fixes drifted images to copy
+// all of them. Otherwise, the relay would skip images that exist in the target,
+// for `skip-existing` with a tag that is not mutable, or for tag immutability.
+// Like in a warm-up run, images still get copied as is.
+func forceCopy(opt *relays.SyncOptions) *relays.SyncOptions {
+	if opt.Unchanged != nil {
+		opt.Unchanged = func(src, trgt string) (bool, error) {
+			return false, nil
+		}
+	}
+	opt.SkipImmutable = false
+	return opt
+}
+
+// isFixed determines whether the target image of drifted item exists in
+// registry l after syncing, with the wanted digest if known.
+func isFixed(ctx context.Context, l *Location, item *ReconcileItem) bool {
+	digest, exists, err := registry.ManifestExists(ctx, item.ref, l.creds,
+		l.transport)
+	if err != nil {
+		log.WithField("ref", item.ref).Warnf(
+			"cannot check whether image was fixed: %v", err)
+		return false
+	}
+	return exists && (item.want == "" || digest == item.want)
+}
+
+// comparesDigests determines whether images synced by mapping m keep their
+// digests, so that a target image with a different digest than its source
+// drifted. This is only the case with the skopeo relay, when it copies images
+// with all platforms from a registry.
+func (s *Sync) comparesDigests(m *Mapping) bool {
+	if _, ok := s.support().(*skopeo.Support); !ok {
+		return false
+	}
+	if m.isLocal() || len(m.Platforms) > 0 {
+		return false
+	}
+	return m.Platform == "all" || m.CopySignatures || m.SkipExisting ||
+		m.Verify || m.PreserveDigests
+}
+
+// digests returns the digests of source image src, and of target image trgt
+// in registry l.
+func (t *Task) digests(ctx context.Context, l *Location, src,
+	trgt string) (string, string, error) {
+
+	var srcDigest string
+	if err := t.retry(ctx, func() error {
+		var err error
+		srcDigest, err = registry.ManifestDigest(ctx,
+			src, t.Source.creds, t.Source.transport)
+		return err
+	}); err != nil {
+		return "", "", err
+	}
+
+	trgtDigest, err := registry.ManifestDigest(ctx, trgt, l.creds,
+		l.transport)
+	if err != nil {
+		return "", "", err
+	}
+
+	return srcDigest, trgtDigest, nil
+}
+
+// allow determines whether all of checks that are set accept source image src.
+func allow(checks []func(src string) (bool, error), src string) (bool,
+	error) {
+	for _, check := range checks {
+		if check == nil {
+			continue
+		}
+		if ok, err := check(src); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// isSignatureTag determines whether tag is one of the tags cosign uses for
+// signatures, attestations, and SBOMs, which mapping m copies along with the
+// images, rather than from the source tags.
+func isSignatureTag(m *Mapping, tag string) bool {
+	return m.CopySignatures && strings.HasPrefix(tag, "sha256-")
+}
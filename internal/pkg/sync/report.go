@@ -0,0 +1,170 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// placeholders in the path of the report file of a task, replaced with the
+// task name, and the start time of the run, respectively
+const (
+	ReportTaskVar = "{task}"
+	ReportTimeVar = "{time}"
+)
+
+// reportTimeFormat is the format of the start time in report file paths
+const reportTimeFormat = "20060102T150405Z"
+
+// results of the items in a report
+const (
+	ReportCopied   = "copied"
+	ReportFailed   = "failed"
+	ReportDeferred = "deferred"
+)
+
+// ReportItem is an image in the report of a task run. For failed and deferred
+// items, source and target are the repositories, without tag, and there is no
+// digest, size, or duration.
+type ReportItem struct {
+	Source   string  `json:"source"`
+	Target   string  `json:"target"`
+	Digest   string  `json:"digest,omitempty"`
+	Size     int64   `json:"size,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Result   string  `json:"result"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Report is the content of a report file in JSON format. Besides the items,
+// it has the same fields as a webhook notification.
+type Report struct {
+	*WebhookPayload
+	Items []*ReportItem `json:"items"`
+}
+
+// report collects the items for the report file of a task run
+type report struct {
+	path  string
+	items []*ReportItem
+	mutex gosync.Mutex
+}
+
+// validateReportPath checks that the format of report path p is known.
+func validateReportPath(p string) error {
+	switch filepath.Ext(p) {
+	case ".json", ".csv":
+		return nil
+	}
+	return fmt.Errorf("'report' must end in '.json' or '.csv', not '%s'", p)
+}
+
+// newReport creates the report for a run of task t started at start, or
+// returns nil if t writes no reports.
+func newReport(t *Task, start time.Time) *report {
+	if t.Report == "" {
+		return nil
+	}
+	return &report{path: strings.NewReplacer(
+		ReportTaskVar, t.Name,
+		ReportTimeVar, start.UTC().Format(reportTimeFormat),
+	).Replace(t.Report)}
+}
+
+// add adds item to this report.
+func (r *report) add(item *ReportItem) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.items = append(r.items, item)
+}
+
+// write writes this report to its file, with the run's outcome taken from p.
+// Items are sorted by source and target, since they get added in the order in
+// which parallel syncs finish.
+func (r *report) write(p *WebhookPayload) error {
+
+	if r == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sort.SliceStable(r.items, func(i, j int) bool {
+		if r.items[i].Source != r.items[j].Source {
+			return r.items[i].Source < r.items[j].Source
+		}
+		return r.items[i].Target < r.items[j].Target
+	})
+
+	var data []byte
+	var err error
+	if filepath.Ext(r.path) == ".csv" {
+		data, err = r.csv()
+	} else {
+		items := r.items
+		if items == nil {
+			items = []*ReportItem{}
+		}
+		data, err = json.MarshalIndent(
+			&Report{WebhookPayload: p, Items: items}, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("error encoding report: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return fmt.Errorf("error creating report directory: %v", err)
+	}
+	if err := ioutil.WriteFile(r.path, data, 0644); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+
+	return nil
+}
+
+// csv encodes the items of this report as CSV, with a header line.
+func (r *report) csv() ([]byte, error) {
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{
+		"source", "target", "digest", "size", "duration", "result", "error"})
+	for _, i := range r.items {
+		w.Write([]string{i.Source, i.Target, i.Digest,
+			strconv.FormatInt(i.Size, 10),
+			strconv.FormatFloat(i.Duration, 'f', 3, 64), i.Result, i.Error})
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
@@ -0,0 +1,182 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// policies for tags that match none of the tag routes of a mapping
+const (
+	UnroutedSync = "sync"
+	UnroutedSkip = "skip"
+)
+
+// defaultRoute is the index of the destination given by `to` of a mapping,
+// which receives the tags not matched by any tag route
+const defaultRoute = -1
+
+// TagRoute sends the tags of a mapping matching any of Tags to destination To
+// instead of the destination of the mapping. To has the same format as `to`
+// of a mapping.
+type TagRoute struct {
+	Tags []string `yaml:"tags"`
+	To   string   `yaml:"to"`
+	//
+	match     []*regexp.Regexp
+	toFilter  *regexp.Regexp
+	toReplace string
+}
+
+// compileTagRoutes compiles the tag routes of this mapping. Items in `tags` of
+// a route are literal tags, or glob or regex patterns with prefix `glob:` and
+// `regex:`, respectively, matched against the whole source tag.
+func (m *Mapping) compileTagRoutes() error {
+
+	switch m.UnroutedTags {
+	case "":
+	case UnroutedSync, UnroutedSkip:
+		if len(m.TagRoutes) == 0 {
+			return fmt.Errorf("'unrouted-tags' requires 'tag-routes'")
+		}
+	default:
+		return fmt.Errorf("'unrouted-tags' must be '%s' or '%s', not '%s'",
+			UnroutedSync, UnroutedSkip, m.UnroutedTags)
+	}
+
+	for ix, r := range m.TagRoutes {
+
+		if r == nil || len(r.Tags) == 0 || r.To == "" {
+			return fmt.Errorf(
+				"tag route %d requires 'tags' and 'to'", ix+1)
+		}
+
+		r.match = make([]*regexp.Regexp, 0, len(r.Tags))
+		for _, t := range r.Tags {
+			var expr string
+			switch {
+			case strings.HasPrefix(t, RegexpPrefix):
+				expr = strings.TrimSpace(t[len(RegexpPrefix):])
+			case strings.HasPrefix(t, GlobPrefix):
+				expr = strings.TrimSpace(t[len(GlobPrefix):])
+			default:
+				expr = strings.TrimSpace(t)
+			}
+			if expr == "" {
+				return fmt.Errorf(
+					"tag route %d must not contain an empty tag", ix+1)
+			}
+			switch {
+			case strings.HasPrefix(t, GlobPrefix):
+				expr = util.GlobToRegex(expr)
+			case !strings.HasPrefix(t, RegexpPrefix):
+				expr = regexp.QuoteMeta(expr)
+			}
+			re, err := util.CompileRegex(expr, true)
+			if err != nil {
+				return fmt.Errorf("tag route %d uses invalid pattern '%s': %v",
+					ix+1, t, err)
+			}
+			r.match = append(r.match, re)
+		}
+
+		to, filter, replace, err := compileTo(r.To)
+		if err != nil {
+			return fmt.Errorf("tag route %d: %v", ix+1, err)
+		}
+		r.To, r.toFilter, r.toReplace = to, filter, replace
+	}
+
+	return nil
+}
+
+// hasTagRoutes determines whether this mapping routes tags to destinations
+// other than its own.
+func (m *Mapping) hasTagRoutes() bool {
+	return len(m.TagRoutes) > 0
+}
+
+// routes returns the indexes of the destinations to which this mapping syncs,
+// in the order of its tag routes, followed by defaultRoute for its own
+// destination, unless unrouted tags are skipped.
+func (m *Mapping) routes() []int {
+	ret := make([]int, 0, len(m.TagRoutes)+1)
+	for ix := range m.TagRoutes {
+		ret = append(ret, ix)
+	}
+	if m.UnroutedTags != UnroutedSkip {
+		ret = append(ret, defaultRoute)
+	}
+	return ret
+}
+
+// routeOf returns the index of the first tag route of this mapping that
+// matches source tag t, or defaultRoute if there is none.
+func (m *Mapping) routeOf(t string) int {
+	for ix, r := range m.TagRoutes {
+		for _, re := range r.match {
+			if re.MatchString(t) {
+				return ix
+			}
+		}
+	}
+	return defaultRoute
+}
+
+// routePath maps source repository path p to its destination path for the
+// tag route with index route, or for defaultRoute to the destination of this
+// mapping.
+func (m *Mapping) routePath(route int, p string) string {
+	if route == defaultRoute {
+		return m.mapPath(p)
+	}
+	// the route destination is evaluated just like `to` of the mapping
+	r := m.TagRoutes[route]
+	c := *m
+	c.To, c.toFilter, c.toReplace = r.To, r.toFilter, r.toReplace
+	return c.mapPath(p)
+}
+
+// routedLister wraps tag lister l of mapping m so that it only lists the tags
+// which m syncs to the destination with index route. Without tag routes, l is
+// returned as is.
+func routedLister(m *Mapping, route int,
+	l func() ([]tags.Tag, error)) func() ([]tags.Tag, error) {
+
+	if !m.hasTagRoutes() || l == nil {
+		return l
+	}
+
+	return func() ([]tags.Tag, error) {
+		all, err := l()
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]tags.Tag, 0, len(all))
+		for _, t := range all {
+			if m.routeOf(t.Name) == route {
+				ret = append(ret, t)
+			}
+		}
+		return ret, nil
+	}
+}
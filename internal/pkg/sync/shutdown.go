@@ -0,0 +1,160 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"os"
+	gosync "sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultShutdownTimeout is how long in-flight copies may take to finish on
+// shutdown, unless set with `shutdown-timeout`. It is shorter than the default
+// termination grace period of Kubernetes pods.
+const defaultShutdownTimeout = 20 * time.Second
+
+// errShuttingDown is the result of sync jobs that were not started, since
+// dregsy was shutting down
+var errShuttingDown = errors.New("shutting down")
+
+// stopper coordinates a graceful shutdown. Once stopped, no new work is to be
+// started, while work in progress may finish within the shutdown timeout.
+// After that, the context of the stopper gets canceled, which aborts all task
+// runs. A nil stopper never stops.
+type stopper struct {
+	stopping chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	//
+	mu      gosync.Mutex
+	once    gosync.Once
+	timeout time.Duration
+	timer   *time.Timer
+	aborted bool
+}
+
+//
+func newStopper() *stopper {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &stopper{
+		stopping: make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		timeout:  defaultShutdownTimeout,
+	}
+}
+
+// context returns the context from which all task runs derive their context.
+func (st *stopper) context() context.Context {
+	if st == nil {
+		return context.Background()
+	}
+	return st.ctx
+}
+
+// setTimeout sets the shutdown timeout to d, or to the default if d is 0.
+// This only affects shutdowns started afterwards.
+func (st *stopper) setTimeout(d time.Duration) {
+	if d == 0 {
+		d = defaultShutdownTimeout
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.timeout = d
+}
+
+// stop starts a graceful shutdown, and arms the shutdown timeout. Stopping
+// again has no effect.
+func (st *stopper) stop() {
+	st.once.Do(func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		log.WithField("timeout", st.timeout).Info(
+			"shutting down, waiting for in-flight copies to finish")
+		close(st.stopping)
+		st.timer = time.AfterFunc(st.timeout, func() {
+			log.Warn("shutdown timeout exceeded, canceling in-flight copies")
+			st.abort()
+		})
+	})
+}
+
+// abort cancels all task runs right away.
+func (st *stopper) abort() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.aborted = true
+	st.cancel()
+}
+
+// release disarms the shutdown timeout, once everything has finished.
+func (st *stopper) release() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+}
+
+// isStopping determines whether a shutdown was started.
+func (st *stopper) isStopping() bool {
+	if st == nil {
+		return false
+	}
+	select {
+	case <-st.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// result returns the result of a sync that ended with err, which is an error
+// if a shutdown had to cancel work in progress.
+func (st *stopper) result(err error) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.aborted {
+		return errors.New(
+			"shutdown was not clean, in-flight copies were canceled")
+	}
+	return err
+}
+
+// watch stops gracefully on the first signal received on sigs, and aborts on
+// a second one. It returns once done is closed.
+func (st *stopper) watch(sigs <-chan os.Signal, done <-chan struct{}) {
+	for {
+		select {
+		case sig := <-sigs:
+			if st.isStopping() {
+				log.WithField("signal", sig).Warn(
+					"received another signal, canceling in-flight copies")
+				st.abort()
+			} else {
+				log.WithField("signal", sig).Info("received signal, stopping")
+				st.stop()
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+)
+
+// taskState is the state of a task kept across runs and restarts
+type taskState struct {
+	LastRun     *time.Time `json:"last-run,omitempty"`
+	LastResult  string     `json:"last-result,omitempty"`
+	LastSuccess *time.Time `json:"last-success,omitempty"`
+	WarmedUp    *time.Time `json:"warmed-up,omitempty"`
+}
+
+// state is the state file shared by all tasks, holding a JSON object with the
+// state of each task, keyed by task name. The file is read and rewritten on
+// each change, so that it always reflects the latest state.
+type state struct {
+	path  string
+	mutex gosync.Mutex
+}
+
+//
+func newState(path string) *state {
+	if path == "" {
+		return nil
+	}
+	return &state{path: path}
+}
+
+// load reads the state of all tasks. A missing state file means no state.
+func (s *state) load() (map[string]*taskState, error) {
+
+	ret := map[string]*taskState{}
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, fmt.Errorf("invalid state file '%s': %v", s.path, err)
+	}
+	return ret, nil
+}
+
+// get returns the state of task, or nil if there is none.
+func (s *state) get(task string) (*taskState, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return st[task], nil
+}
+
+// warmedUp determines whether task completed its warm-up run.
+func (s *state) warmedUp(task string) (bool, error) {
+	ts, err := s.get(task)
+	if err != nil {
+		return false, err
+	}
+	return ts != nil && ts.WarmedUp != nil, nil
+}
+
+// setWarmedUp records that task completed its warm-up run at time at.
+func (s *state) setWarmedUp(task string, at time.Time) error {
+	return s.update(task, func(ts *taskState) {
+		at = at.UTC()
+		ts.WarmedUp = &at
+	})
+}
+
+// setLastRun records that a run of task started at time at, and ended with
+// result.
+func (s *state) setLastRun(task string, at time.Time, result string) error {
+	return s.update(task, func(ts *taskState) {
+		at = at.UTC()
+		ts.LastRun = &at
+		ts.LastResult = result
+		if result == metrics.ResultSuccess {
+			ts.LastSuccess = &at
+		}
+	})
+}
+
+// update changes the state of task with change, and writes the state file.
+// The file is replaced atomically, so that it never gets corrupted by a crash
+// while writing.
+func (s *state) update(task string, change func(ts *taskState)) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, err := s.load()
+	if err != nil {
+		return err
+	}
+	ts, ok := st[task]
+	if !ok {
+		ts = &taskState{}
+		st[task] = ts
+	}
+	change(ts)
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state: %v", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating state directory: %v", err)
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+
+	return nil
+}
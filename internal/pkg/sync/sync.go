@@ -17,17 +17,27 @@
 package sync
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	gosync "sync"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/layout"
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
 	"github.com/xelalexv/dregsy/internal/pkg/relays"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/containerd"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
 	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
@@ -42,7 +52,45 @@ type Relay interface {
 type Sync struct {
 	relay    Relay
 	shutdown chan bool
+	reloads  chan bool
 	ticks    chan bool
+	//
+	configFile    string
+	dryRun        bool
+	deepDryRun    bool
+	dryRunOut     io.Writer
+	force         bool
+	once          bool
+	preflightOnly bool
+	reconcile     bool
+	fixDrift      bool
+	findExtra     bool
+	// checks the registries of a task before each run
+	preflight func(ctx context.Context, t *Task) error
+	// graceful shutdown on interrupt signals
+	stopper *stopper
+}
+
+// DryRunItem is written to stdout for each image that would be synced during
+// a dry run, as a single line JSON object. TargetExists, AutoCreate, and
+// Unchanged are only set in a deep dry run.
+type DryRunItem struct {
+	Task         string `json:"task"`
+	From         string `json:"from"`
+	Source       string `json:"source"`
+	Target       string `json:"target"`
+	Tag          string `json:"tag,omitempty"`
+	TargetTag    string `json:"target-tag,omitempty"`
+	Digest       string `json:"digest,omitempty"`
+	TargetExists *bool  `json:"target-exists,omitempty"`
+	AutoCreate   bool   `json:"auto-create,omitempty"`
+	Unchanged    bool   `json:"unchanged,omitempty"`
+}
+
+// DryRunTotal is written to stdout at the end of a dry run, as a single line
+// JSON object.
+type DryRunTotal struct {
+	Total int `json:"total"`
 }
 
 //
@@ -67,6 +115,12 @@ func New(conf *SyncConfig) (*Sync, error) {
 				conf.Skopeo, log.StandardLogger().WriterLevel(log.DebugLevel))
 		}
 
+	case containerd.RelayID:
+		if err = conf.ValidateSupport(&containerd.Support{}); err == nil {
+			relay = containerd.NewContainerdRelay(conf.Containerd,
+				log.StandardLogger().WriterLevel(log.DebugLevel))
+		}
+
 	default:
 		err = fmt.Errorf("relay type '%s' not supported", conf.Relay)
 	}
@@ -76,12 +130,90 @@ func New(conf *SyncConfig) (*Sync, error) {
 	}
 
 	sync.relay = relay
+	sync.preflight = func(ctx context.Context, t *Task) error {
+		return t.preflight(ctx)
+	}
+	sync.stopper = newStopper()
+	sync.stopper.setTimeout(conf.ShutdownTimeout)
 	sync.shutdown = make(chan bool)
+	sync.reloads = make(chan bool, 1)
 	sync.ticks = make(chan bool, 1)
 
 	return sync, nil
 }
 
+// SetDryRun switches dry run mode on or off. In dry run mode, all matching
+// tasks are run once, regardless of their interval. Instead of syncing, each
+// image that would be synced is written to stdout, followed by the total count.
+func (s *Sync) SetDryRun(dryRun bool) {
+	s.dryRun = dryRun
+	s.dryRunOut = os.Stdout
+}
+
+// SetDeepDryRun switches deep dry run mode on or off. A deep dry run is a dry
+// run that additionally checks the target registries with read-only requests,
+// i.e. whether they accept the credentials, whether the target repositories
+// exist, and which images would be skipped as unchanged. Switching it off
+// leaves a plain dry run as set with SetDryRun untouched.
+func (s *Sync) SetDeepDryRun(deep bool) {
+	s.deepDryRun = deep
+	if deep {
+		s.SetDryRun(true)
+	}
+}
+
+// SetReconcile switches reconcile mode on or off. In reconcile mode, all
+// matching tasks are run once, regardless of their interval. For each image a
+// task would sync, source and destination are compared, and each image that
+// is missing in the destination, or has a different digest there, is written
+// to stdout, followed by the totals. With fix, these images get synced. With
+// extra, tags in the destination repositories that the task would not sync
+// are listed as well, but never removed.
+func (s *Sync) SetReconcile(reconcile, fix, extra bool) {
+	s.reconcile = reconcile
+	s.fixDrift = reconcile && fix
+	s.findExtra = reconcile && extra
+	s.dryRunOut = os.Stdout
+}
+
+// SetOnce switches one-off mode on or off. In one-off mode, all matching tasks
+// are run once, one after another, regardless of their interval or cron
+// schedule, and syncing returns once they are done.
+func (s *Sync) SetOnce(once bool) {
+	s.once = once
+}
+
+// SetPreflight switches preflight mode on or off. In preflight mode, the
+// registries of all matching tasks are only checked for connectivity and
+// credentials, and nothing is synced.
+func (s *Sync) SetPreflight(preflight bool) {
+	s.preflightOnly = preflight
+}
+
+// SetForce switches forced mode on or off. In forced mode, mappings are synced
+// even when they exceed their repo limit.
+func (s *Sync) SetForce(force bool) {
+	s.force = force
+}
+
+// SetConfigFile sets the file or directory from which the config is re-read
+// when reloading. Unless set, reloading is not possible, and SIGHUP is not
+// handled.
+func (s *Sync) SetConfigFile(file string) {
+	s.configFile = file
+}
+
+// Reload flags a config reload, which also happens on SIGHUP. Reloading only
+// concerns periodic tasks. It happens in between tasks, so a currently running
+// task finishes first. If the new config is invalid, the current config is
+// kept.
+func (s *Sync) Reload() {
+	select {
+	case s.reloads <- true:
+	default:
+	}
+}
+
 //
 func (s *Sync) Shutdown() {
 	s.shutdown <- true
@@ -118,63 +250,245 @@ func (s *Sync) SyncFromConfig(conf *SyncConfig, taskFilter string) error {
 		return fmt.Errorf("invalid task filter: %v", err)
 	}
 
+	if s.dryRun {
+		return s.dryRunTasks(conf, tf)
+	}
+
+	if s.reconcile {
+		return s.reconcileTasks(conf, tf)
+	}
+
+	if s.preflightOnly {
+		return s.preflightTasks(conf, tf)
+	}
+
 	if err := s.relay.Prepare(); err != nil {
 		return err
 	}
 
+	// on an interrupt signal, no new work is started, and work in progress
+	// gets canceled only if it doesn't finish within the shutdown timeout
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	watching := make(chan struct{})
+	defer close(watching)
+	go s.stopper.watch(sigs, watching)
+	defer s.stopper.release()
+
+	metrics.TrackTasks(taskPeriods(conf, tf))
+
+	if conf.Metrics != nil {
+		srv, err := metrics.Serve(
+			conf.Metrics.Address, conf.Metrics.GraceFactor)
+		if err != nil {
+			return fmt.Errorf("cannot serve metrics: %v", err)
+		}
+		defer srv.Close()
+	}
+
+	if s.once {
+		return s.stopper.result(s.runOnce(conf, tf))
+	}
+
 	// one-off tasks
 	for _, t := range conf.Tasks {
-		if t.Interval == 0 && tf.Matches(t.Name) {
+		if !t.isPeriodic() && tf.Matches(t.Name) {
 			s.syncTask(t)
 		}
 	}
 
 	// periodic tasks
 	c := make(chan *Task)
-	ticking := false
+	ticking := startTasks(conf, nil, tf, c) && !s.stopper.isStopping()
+	errs := false
 
-	for _, t := range conf.Tasks {
-		if t.Interval > 0 && tf.Matches(t.Name) {
-			t.startTicking(c)
-			ticking = true
-		}
+	hup := make(chan os.Signal, 1)
+	if s.configFile != "" {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
 	for ticking {
 		log.Info("waiting for next sync task...")
 		select {
 		case t := <-c: // actual task
 			s.syncTask(t)
 			s.tick() // send a tick
-		case sig := <-sigs: // interrupt signal
-			log.WithField("signal", sig).Info("received signal, stopping ...")
+		case sig := <-hup: // reload signal
+			log.WithField("signal", sig).Info("received signal, reloading ...")
+			s.Reload()
+		case <-s.reloads: // reload flagged
+			if nc, err := s.reloadConfig(conf); err != nil {
+				log.Errorf("not reloading, keeping current config: %v", err)
+			} else {
+				errs = stopTasks(conf.Tasks, c) || errs
+				ticking = startTasks(nc, conf, tf, c)
+				metrics.TrackTasks(taskPeriods(nc, tf))
+				s.stopper.setTimeout(nc.ShutdownTimeout)
+				conf = nc
+				log.Info("config reloaded")
+			}
+			s.tick() // send a tick
+		case <-s.stopper.stopping: // interrupt signal
 			ticking = false
 		case <-s.shutdown: // shutdown flagged
 			log.Info("shutdown flagged, stopping ...")
+			s.stopper.stop()
 			ticking = false
 			s.tick() // send a final tick to release shutdown client
 		}
 	}
 
 	log.Debug("stopping tasks")
-	errs := false
+	errs = stopTasks(conf.Tasks, c) || errs
+
+	if errs {
+		return s.stopper.result(fmt.Errorf(
+			"one or more tasks had errors, please see log for details"))
+	}
+
+	if err := s.stopper.result(nil); err != nil {
+		return err
+	}
+
+	log.Info("all done")
+	return nil
+}
+
+// runOnce runs all tasks matching task filter tf once, including periodic
+// tasks. It is an error if any of them failed.
+func (s *Sync) runOnce(conf *SyncConfig, tf *util.Regex) error {
+
+	failed, total := 0, 0
+
 	for _, t := range conf.Tasks {
-		t.stopTicking()
-		errs = errs || t.failed
+		if !tf.Matches(t.Name) {
+			continue
+		}
+		if s.stopper.isStopping() {
+			log.WithField("task", t.Name).Info("shutting down, skipping task")
+			continue
+		}
+		total++
+		s.syncTask(t)
+		if t.failed {
+			failed++
+		}
 	}
 
-	if errs {
-		return fmt.Errorf(
-			"one or more tasks had errors, please see log for details")
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tasks had errors, please see log for "+
+			"details", failed, total)
 	}
 
 	log.Info("all done")
 	return nil
 }
 
+// reloadConfig loads the config again, and checks whether it can replace conf.
+func (s *Sync) reloadConfig(conf *SyncConfig) (*SyncConfig, error) {
+
+	if s.configFile == "" {
+		return nil, fmt.Errorf("no config file set for reloading")
+	}
+
+	nc, err := LoadConfig(s.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if nc.Relay != conf.Relay {
+		return nil, fmt.Errorf("changing the relay requires a restart")
+	}
+
+	if err := nc.ValidateSupport(s.support()); err != nil {
+		return nil, err
+	}
+
+	return nc, nil
+}
+
+// support returns the support checker for the relay of this sync
+func (s *Sync) support() relays.Support {
+	switch s.relay.(type) {
+	case *docker.DockerRelay:
+		return &docker.Support{}
+	case *containerd.ContainerdRelay:
+		return &containerd.Support{}
+	}
+	return &skopeo.Support{}
+}
+
+// startTasks starts ticking for all periodic tasks in conf matching task filter
+// tf, sending fired tasks to c. Tasks that were present in prev with the same
+// interval keep their last tick. Returns whether any task was started.
+func startTasks(conf, prev *SyncConfig, tf *util.Regex, c chan *Task) bool {
+
+	last := make(map[string]*Task)
+	if prev != nil {
+		for _, t := range prev.Tasks {
+			last[t.Name] = t
+		}
+	}
+
+	ticking := false
+
+	for _, t := range conf.Tasks {
+		if t.isPeriodic() && tf.Matches(t.Name) {
+			t.breaker.report(t.Name, time.Now())
+			t.startTicking(c)
+			if p, ok := last[t.Name]; ok {
+				if p.Interval == t.Interval {
+					t.lastTick = p.lastTick
+				}
+				// runs that used up their budget are resumed after reload
+				t.synced = p.synced
+			}
+			ticking = true
+		}
+	}
+
+	return ticking
+}
+
+// taskPeriods returns the expected periods of all periodic tasks in conf
+// matching task filter tf, by task name.
+func taskPeriods(conf *SyncConfig, tf *util.Regex) map[string]time.Duration {
+	ret := make(map[string]time.Duration)
+	for _, t := range conf.Tasks {
+		if t.isPeriodic() && tf.Matches(t.Name) {
+			ret[t.Name] = t.period()
+		}
+	}
+	return ret
+}
+
+// stopTasks stops ticking for tasks, discarding any fired tasks still pending
+// on c. Returns whether any of the tasks had failed.
+func stopTasks(tasks []*Task, c chan *Task) bool {
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-c:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	failed := false
+	for _, t := range tasks {
+		t.stopTicking()
+		failed = failed || t.failed
+	}
+
+	close(done)
+	return failed
+}
+
 //
 func (s *Sync) syncTask(t *Task) {
 
@@ -183,60 +497,654 @@ func (s *Sync) syncTask(t *Task) {
 		return
 	}
 
-	log.WithFields(log.Fields{
-		"task":   t.Name,
+	if s.stopper.isStopping() {
+		log.WithField("task", t.Name).Info("shutting down, skipping task")
+		return
+	}
+
+	logger := log.WithField("task", t.Name)
+
+	if !t.breaker.allows(time.Now()) {
+		logger.WithField("until", t.breaker.until.Round(time.Second)).Info(
+			"circuit breaker open, skipping run")
+		return
+	}
+
+	unlock, err := t.lock()
+	if errors.Is(err, util.ErrLocked) {
+		logger.Warn("previous run of task still in progress, skipping")
+		metrics.TaskSkipped(t.Name)
+		return
+	}
+	if err != nil {
+		logger.Error(err)
+		t.fail(err)
+		metrics.TaskStarted(t.Name)
+		metrics.TaskRun(t.Name, 0, err)
+		return
+	}
+	defer unlock()
+
+	logger.WithFields(log.Fields{
 		"source": t.Source.Registry,
-		"target": t.Target.Registry}).Info("syncing task")
+		"target": t.targetRegistries()}).Info("syncing task")
 	t.failed = false
+	t.lastErr = nil
+	t.force = s.force
+	t.budget = newBudget(t)
+	if t.budget == nil {
+		t.synced = nil
+	}
+	start := time.Now()
+	t.report = newReport(t, start)
+	if t.warming = t.isWarmingUp(); t.warming {
+		logger.Info("warm-up run, copying all images")
+	}
+	metrics.TaskStarted(t.Name)
 
-	for _, m := range t.Mappings {
+	// everything the task does from here on is canceled once it times out
+	ctx, cancel := t.runContext(s.stopper.context())
+	defer cancel()
 
-		log.WithFields(log.Fields{"from": m.From, "to": m.To}).Info("mapping")
+	// a task whose registries cannot be accessed fails right away, rather
+	// than after syncing part of its mappings
+	mappings := t.Mappings
+	if err := s.preflight(ctx, t); err != nil {
+		logger.WithField("failure", registry.FailureOf(err)).Error(err)
+		t.fail(err)
+		mappings = nil
+	}
 
-		if err := t.Source.RefreshAuth(); err != nil {
-			log.Error(err)
-			t.fail(true)
-			continue
+	// auth refresh and resolving refs are done up front, and only the actual
+	// syncing happens in parallel, so credentials are not refreshed while in
+	// use by a relay
+	var jobs []*syncJob
+	var prunes []*syncJob
+
+	for _, m := range mappings {
+
+		if ctx.Err() != nil {
+			break
 		}
-		if err := t.Target.RefreshAuth(); err != nil {
-			log.Error(err)
-			t.fail(true)
+
+		mlog := logger.WithField("mapping", m.From)
+		mlog.WithField("to", m.To).Info("mapping")
+
+		if err := t.refreshSourceAuth(m); err != nil {
+			mlog.Error(err)
+			t.fail(err)
 			continue
 		}
 
-		refs, err := t.mappingRefs(m)
+		// source repos and tags are listed once, for all targets
+		repos, inactive, err := t.mappingRepos(ctx, m)
 		if err != nil {
-			log.Error(err)
-			t.fail(true)
+			mlog.Error(err)
+			t.fail(err)
 			continue
 		}
 
-		for _, ref := range refs {
+		// inactive repos are only visited for pruning their tags
+		inactiveListers := make([]func() ([]tags.Tag, error), len(inactive))
+		if m.Prune {
+			for ix, r := range inactive {
+				inactiveListers[ix] = listOnce(
+					t.sourceLister(ctx, t.sourceRef(m, r),
+						m.tagSet.NeedsPushTimes()))
+			}
+		}
+
+		// pruning needs all source tags, syncing only the retained ones
+		listers := make([]func() ([]tags.Tag, error), len(repos))
+		retained := make([]func() ([]tags.Tag, error), len(repos))
+		var srcImage func(string) string
+		var srcArchive, trgtArchive relays.Archive
 
-			src := ref[0]
-			trgt := ref[1]
+		if m.isArchived() {
+			lo, err := layout.New(m.To)
+			if err != nil {
+				mlog.Error(err)
+				t.fail(err)
+				continue
+			}
+			trgtArchive = lo.Archive()
+		}
+
+		if m.isLocal() {
+			lo, err := layout.New(m.From)
+			if err != nil {
+				mlog.Error(err)
+				t.fail(err)
+				continue
+			}
+			listers[0] = listOnce(layoutLister(lo))
+			retained[0] = listers[0]
+			srcImage = lo.Ref
+			srcArchive = lo.Archive()
+		} else {
+			for ix, r := range repos {
+				listers[ix] = listOnce(t.tagLister(ctx, t.sourceRef(m, r),
+					m.tagSet.NeedsPushTimes()))
+				retained[ix] = listOnce(t.retainedLister(ctx, m,
+					t.sourceRef(m, r), listers[ix]))
+				// routing tags needs a tag list even without native listing
+				if retained[ix] == nil && m.hasTagRoutes() {
+					listers[ix] = listOnce(t.sourceLister(ctx,
+						t.sourceRef(m, r), m.tagSet.NeedsPushTimes()))
+					retained[ix] = listers[ix]
+				}
+			}
+		}
+
+		for _, l := range t.destinations(m) {
 
-			if err := t.ensureTargetExists(trgt); err != nil {
-				log.Error(err)
-				t.fail(true)
-				break
+			if err := l.RefreshAuth(); err != nil {
+				mlog.Error(err)
+				t.fail(err)
+				continue
 			}
 
-			if err := s.relay.Sync(&relays.SyncOptions{
-				SrcRef:            src,
-				SrcAuth:           t.Source.GetAuth(),
-				SrcSkipTLSVerify:  t.Source.SkipTLSVerify,
-				TrgtRef:           trgt,
-				TrgtAuth:          t.Target.GetAuth(),
-				TrgtSkipTLSVerify: t.Target.SkipTLSVerify,
-				Tags:              m.tagSet,
-				Platform:          m.Platform,
-				Verbose:           t.Verbose}); err != nil {
-				log.Error(err)
-				t.fail(true)
+			for ix, r := range repos {
+				for _, route := range m.routes() {
+
+					src := t.sourceRef(m, r)
+					trgt := m.destRef(l, route, r)
+					opt := t.syncOptions(ctx, m, l, src, trgt, m.tagSet,
+						routedLister(m, route, retained[ix]), mlog)
+					opt.SrcImage = srcImage
+					opt.SrcArchive = srcArchive
+					opt.TrgtArchive = trgtArchive
+
+					jobs = append(jobs, &syncJob{target: l, opt: opt,
+						prune: t.pruner(ctx, m, l, trgt,
+							routedLister(m, route, listers[ix]), false)})
+				}
+			}
+
+			for ix, r := range inactive {
+				for _, route := range m.routes() {
+					src := t.sourceRef(m, r)
+					trgt := m.destRef(l, route, r)
+					if p := t.pruner(ctx, m, l, trgt,
+						routedLister(m, route, inactiveListers[ix]),
+						true); p != nil {
+						prunes = append(prunes, &syncJob{target: l, prune: p,
+							opt: &relays.SyncOptions{
+								SrcRef:  src,
+								TrgtRef: trgt,
+								Log: mlog.WithFields(log.Fields{
+									"repo": src, "target": l.Registry}),
+								Context: ctx}})
+					}
+				}
 			}
 		}
 	}
 
+	// with a budget, runs that used it up are resumed by the next run
+	jobs, resumed := t.resumeJobs(jobs)
+	if resumed > 0 {
+		logger.Infof("resuming previous run, skipping %d images synced "+
+			"already", resumed)
+	}
+
+	// a failing image does not stop the run, the failures are summed up at
+	// the end instead
+	failed, deferred := 0, 0
+	var failures []*WebhookFailure
+	for ix, err := range s.syncRefs(t, jobs) {
+		switch {
+		case err == nil:
+			if t.budget != nil {
+				if t.synced == nil {
+					t.synced = make(map[string]bool)
+				}
+				t.synced[jobKey(jobs[ix])] = true
+			}
+		case errors.Is(err, errBudgetUsedUp), errors.Is(err, errShuttingDown):
+			t.report.add(&ReportItem{Source: jobs[ix].opt.SrcRef,
+				Target: jobs[ix].opt.TrgtRef, Result: ReportDeferred})
+			deferred++
+		default:
+			jobs[ix].opt.Logger().Error(err)
+			t.report.add(&ReportItem{Source: jobs[ix].opt.SrcRef,
+				Target: jobs[ix].opt.TrgtRef, Result: ReportFailed,
+				Error: err.Error()})
+			failures = append(failures, &WebhookFailure{
+				Source: jobs[ix].opt.SrcRef, Target: jobs[ix].opt.TrgtRef,
+				Error: err.Error()})
+			failed++
+		}
+	}
+	if failed > 0 {
+		err := fmt.Errorf("%d of %d images failed to sync", failed, len(jobs))
+		logger.Error(err)
+		for _, f := range failures {
+			logger.Errorf(" - %s -> %s: %s", f.Source, f.Target, f.Error)
+		}
+		t.fail(err)
+	}
+	if deferred > 0 && s.stopper.isStopping() {
+		logger.Warnf("shutting down, deferring %d of %d images to next run",
+			deferred, len(jobs))
+	} else if deferred > 0 {
+		logger.WithField("used", t.budget.String()).Warnf(
+			"budget used up, deferring %d of %d images to next run",
+			deferred, len(jobs))
+	} else {
+		t.synced = nil
+	}
+
+	pruneFailed := 0
+	for _, j := range prunes {
+		if ctx.Err() != nil || s.stopper.isStopping() {
+			break
+		}
+		if err := j.prune(); err != nil {
+			j.opt.Logger().Error(err)
+			pruneFailed++
+		}
+	}
+	if pruneFailed > 0 {
+		err := fmt.Errorf("pruning failed for %d of %d inactive repositories",
+			pruneFailed, len(prunes))
+		logger.Error(err)
+		t.fail(err)
+	}
+	if err := t.timedOut(ctx); err != nil {
+		logger.Error(err)
+		t.fail(err)
+	}
+
 	t.lastTick = time.Now()
+	partial := deferred > 0 && !t.failed
+
+	// only a complete run ends the warm-up
+	if t.warming && !t.failed && !partial {
+		if err := t.state.setWarmedUp(t.Name, t.lastTick); err != nil {
+			logger.Error(err)
+		} else {
+			logger.Info("warm-up complete, following runs skip " +
+				"existing images")
+		}
+	}
+
+	if partial {
+		metrics.TaskRunPartial(t.Name, t.lastTick.Sub(start))
+	} else {
+		metrics.TaskRun(t.Name, t.lastTick.Sub(start), t.lastErr)
+	}
+
+	// persistently failing tasks are paused for a while
+	if cooldown := t.breaker.record(t.failed, t.lastTick); cooldown > 0 {
+		logger.WithFields(log.Fields{"cooldown": cooldown,
+			"until": t.breaker.until.Round(time.Second)}).Warnf(
+			"task failed %d times in a row, opening circuit breaker",
+			t.breaker.failures)
+	}
+	t.breaker.report(t.Name, t.lastTick)
+
+	p := &WebhookPayload{
+		Task:           t.Name,
+		Start:          start,
+		End:            t.lastTick,
+		Result:         metrics.ResultSuccess,
+		ImagesCopied:   len(jobs) - failed - deferred,
+		ImagesFailed:   failed,
+		ImagesDeferred: deferred,
+		Failures:       failures,
+	}
+	if partial {
+		p.Result = metrics.ResultPartial
+	} else if t.failed {
+		p.Result = metrics.ResultFailure
+		if t.lastErr != nil {
+			p.Error = t.lastErr.Error()
+		}
+	}
+	if t.state != nil {
+		if err := t.state.setLastRun(t.Name, start, p.Result); err != nil {
+			logger.Error(err)
+		}
+	}
+	if err := t.webhook.notify(p); err != nil {
+		logger.Errorf("error sending webhook notification: %v", err)
+	}
+	if err := t.report.write(p); err != nil {
+		logger.Error(err)
+	}
+}
+
+// syncOptions returns the options for syncing the tags in ts of source
+// reference src of mapping m to target reference trgt in registry l. lister,
+// if set, lists the source tags natively. Images in local layouts or object
+// storage are left for the caller to set.
+func (t *Task) syncOptions(ctx context.Context, m *Mapping, l *Location,
+	src, trgt string, ts *tags.TagSet, lister func() ([]tags.Tag, error),
+	mlog *log.Entry) *relays.SyncOptions {
+
+	return &relays.SyncOptions{
+		SrcRef:            src,
+		SrcAuth:           t.Source.GetAuth(),
+		SrcSkipTLSVerify:  t.Source.SkipTLSVerify,
+		TrgtRef:           trgt,
+		TrgtAuth:          l.GetAuth(),
+		TrgtSkipTLSVerify: l.SkipTLSVerify,
+		Tags:              ts,
+		TagLister:         lister,
+		TagMap:            m.tagMapper(),
+		Referrers:         t.referrers(ctx, m),
+		Unchanged:         t.unchanged(ctx, m, l),
+		Verify:            t.verifier(ctx, m, l),
+		CheckDigest:       t.digestChecker(ctx, m, l),
+		HasPlatforms:      t.platformChecker(ctx, m),
+		HasArtifactType:   t.artifactChecker(ctx, m),
+		HasMetadata:       t.metadataChecker(ctx, m),
+		HasManifestType:   t.manifestTypeChecker(ctx, m),
+		Digest:            m.digest,
+		DigestTag:         m.DigestTag,
+		Platform:          m.Platform,
+		Platforms:         m.Platforms,
+		Compression:       m.recompression(),
+		SkipImmutable:     m.skipImmutable(),
+		Verbose:           t.Verbose,
+		TagConcurrency:    t.TagConcurrency,
+		Throttle:          t.tagThrottle(),
+		Retry:             t.copyRetrier(ctx),
+		Slots:             t.slots,
+		OnProgress:        t.progressReporter(),
+		OnCopied:          t.copiedReporter(ctx, l),
+		Log: mlog.WithFields(log.Fields{
+			"repo": src, "target": l.Registry}),
+		Context: ctx}
+}
+
+// syncJob is the sync of one source repository to one target registry
+type syncJob struct {
+	opt    *relays.SyncOptions
+	target *Location
+	// prune, if set, deletes tags no longer synced from the target, and is
+	// only run once the image was synced successfully
+	prune func() error
+	// drifted images a reconcile run fixes with this job
+	drift []*ReconcileItem
+}
+
+// syncRefs syncs jobs with up to the configured number of concurrent workers
+// for task t. The returned errors correspond to jobs, with nil for successful
+// ones.
+func (s *Sync) syncRefs(t *Task, jobs []*syncJob) []error {
+
+	errs := make([]error, len(jobs))
+	next := make(chan int)
+	var wg gosync.WaitGroup
+
+	workers := t.Concurrency
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ix := range next {
+				// once the task was canceled, remaining jobs are skipped
+				if err := jobs[ix].opt.Ctx().Err(); err != nil {
+					errs[ix] = err
+					continue
+				}
+				// once the budget is used up, no further jobs are started
+				if t.budget.usedUp() {
+					errs[ix] = errBudgetUsedUp
+					continue
+				}
+				// when shutting down, jobs in progress finish, but no new
+				// ones are started
+				if s.stopper.isStopping() {
+					errs[ix] = errShuttingDown
+					continue
+				}
+				errs[ix] = s.syncRef(t, jobs[ix].target, jobs[ix].opt)
+				if errs[ix] == nil && jobs[ix].prune != nil {
+					errs[ix] = jobs[ix].prune()
+				}
+			}
+		}()
+	}
+
+	for ix := range jobs {
+		next <- ix
+	}
+	close(next)
+	wg.Wait()
+
+	return errs
+}
+
+//
+func (s *Sync) syncRef(t *Task, l *Location, opt *relays.SyncOptions) error {
+
+	if err := t.ensureTargetExists(opt.Ctx(), l, opt.TrgtRef); err != nil {
+		return err
+	}
+
+	// retries happen for each copy within the relay, so that tags already
+	// synced are not copied again
+	err := s.relay.Sync(opt)
+
+	// credentials from a credential helper are retrieved anew and tried once
+	// more when rejected
+	if util.IsUnauthorized(err) {
+		if renewed, rerr := t.renewAuth(l, opt); rerr != nil {
+			opt.Logger().Error(rerr)
+		} else if renewed {
+			err = s.relay.Sync(opt)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	metrics.ImageCopied(t.Name)
+	return nil
+}
+
+// preflightTasks checks the registries of all tasks matching task filter tf,
+// without syncing anything.
+func (s *Sync) preflightTasks(conf *SyncConfig, tf *util.Regex) error {
+
+	failed := 0
+
+	for _, t := range conf.Tasks {
+		if !tf.Matches(t.Name) {
+			continue
+		}
+		logger := log.WithField("task", t.Name)
+		ctx, cancel := t.runContext(s.stopper.context())
+		err := s.preflight(ctx, t)
+		cancel()
+		if err != nil {
+			logger.WithField("failure", registry.FailureOf(err)).Error(err)
+			failed++
+			continue
+		}
+		logger.Info("preflight check passed")
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("preflight check failed for %d task(s)", failed)
+	}
+
+	log.Info("all preflight checks passed")
+	return nil
+}
+
+// dryRunTasks runs a dry run for all tasks matching task filter tf.
+func (s *Sync) dryRunTasks(conf *SyncConfig, tf *util.Regex) error {
+
+	if s.deepDryRun {
+		log.Info("deep dry run, nothing will be synced, checking targets")
+	} else {
+		log.Info("dry run, nothing will be synced")
+	}
+
+	enc := json.NewEncoder(s.dryRunOut)
+	total := 0
+	errs := false
+
+	for _, t := range conf.Tasks {
+		if tf.Matches(t.Name) {
+			n, err := s.dryRunTask(t, enc)
+			total += n
+			errs = errs || err != nil
+		}
+	}
+
+	if err := enc.Encode(&DryRunTotal{Total: total}); err != nil {
+		return err
+	}
+
+	if errs {
+		return fmt.Errorf(
+			"one or more tasks had errors, please see log for details")
+	}
+
+	log.Info("all done")
+	return nil
+}
+
+// dryRunTask resolves the images that task t would sync, and writes them to
+// enc. It returns the number of images written.
+func (s *Sync) dryRunTask(t *Task, enc *json.Encoder) (int, error) {
+
+	logger := log.WithField("task", t.Name)
+	logger.WithFields(log.Fields{
+		"source": t.Source.Registry,
+		"target": t.targetRegistries()}).Info("dry run for task")
+	t.force = s.force
+
+	ctx, cancel := t.runContext(s.stopper.context())
+	defer cancel()
+
+	count := 0
+	var ret error
+
+	// a deep dry run checks the target registries like a sync would, and
+	// fails right away if they cannot be accessed
+	var probed map[string]bool
+	if s.deepDryRun {
+		for _, l := range t.targets() {
+			if err := l.RefreshAuth(); err != nil {
+				logger.Error(err)
+				return count, err
+			}
+		}
+		if err := s.preflight(ctx, t); err != nil {
+			logger.WithField("failure", registry.FailureOf(err)).Error(err)
+			return count, err
+		}
+		probed = make(map[string]bool)
+	}
+
+	for _, m := range t.Mappings {
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		mlog := logger.WithField("mapping", m.From)
+
+		if err := t.refreshSourceAuth(m); err != nil {
+			mlog.Error(err)
+			ret = err
+			continue
+		}
+
+		repos, _, err := t.mappingRepos(ctx, m)
+		if err != nil {
+			mlog.Error(err)
+			ret = err
+			continue
+		}
+
+		for _, r := range repos {
+
+			src := t.sourceRef(m, r)
+
+			if m.isPinned() {
+				for _, l := range t.targets() {
+					item := &DryRunItem{
+						Task:      t.Name,
+						From:      m.From,
+						Source:    src,
+						Target:    m.destRef(l, defaultRoute, r),
+						TargetTag: m.DigestTag,
+						Digest:    m.digest,
+					}
+					if probed != nil {
+						if err := t.probeTarget(ctx, m, l, item,
+							probed); err != nil {
+							mlog.WithField("repo", src).Error(err)
+							ret = err
+						}
+					}
+					if err := enc.Encode(item); err != nil {
+						return count, err
+					}
+					count++
+				}
+				continue
+			}
+
+			tags, err := t.expandTags(ctx, m, src)
+			if err != nil {
+				mlog.WithField("repo", src).Error(err)
+				ret = err
+				continue
+			}
+
+			for _, l := range t.destinations(m) {
+				for _, tag := range tags {
+					route := m.routeOf(tag)
+					if route == defaultRoute &&
+						m.UnroutedTags == UnroutedSkip {
+						continue
+					}
+					item := &DryRunItem{
+						Task:   t.Name,
+						From:   m.From,
+						Source: src,
+						Target: m.destRef(l, route, r),
+						Tag:    tag,
+					}
+					if m.tagMapper() != nil {
+						item.TargetTag = m.mapTag(tag)
+					}
+					if probed != nil && !m.isArchived() {
+						if err := t.probeTarget(ctx, m, l, item,
+							probed); err != nil {
+							mlog.WithField("repo", src).Error(err)
+							ret = err
+						}
+					}
+					if err := enc.Encode(item); err != nil {
+						return count, err
+					}
+					count++
+				}
+			}
+		}
+	}
+
+	if err := t.timedOut(ctx); err != nil {
+		logger.Error(err)
+		ret = err
+	}
+
+	return count, ret
 }
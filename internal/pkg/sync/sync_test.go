@@ -17,11 +17,828 @@
 package sync
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	gosync "sync"
 	"testing"
+	"time"
 
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/relays"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
 	"github.com/xelalexv/dregsy/internal/pkg/test"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
+//
+type fakeRelay struct {
+	synced chan string
+}
+
+//
+func (r *fakeRelay) Prepare() error { return nil }
+
+//
+func (r *fakeRelay) Dispose() error { return nil }
+
+//
+func (r *fakeRelay) Sync(opt *relays.SyncOptions) error {
+	r.synced <- opt.SrcRef
+	return nil
+}
+
+// parallelRelay records how many syncs run at the same time, and fails syncs
+// of images whose name contains 'fail'
+type parallelRelay struct {
+	mu      gosync.Mutex
+	active  int
+	maxSeen int
+	synced  []string
+}
+
+//
+func (r *parallelRelay) Prepare() error { return nil }
+
+//
+func (r *parallelRelay) Dispose() error { return nil }
+
+//
+func (r *parallelRelay) Sync(opt *relays.SyncOptions) error {
+
+	r.mu.Lock()
+	r.active++
+	if r.active > r.maxSeen {
+		r.maxSeen = r.active
+	}
+	r.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active--
+	r.synced = append(r.synced, opt.SrcRef)
+
+	if strings.Contains(opt.SrcRef, "fail") {
+		return fmt.Errorf("failed to sync %s", opt.SrcRef)
+	}
+	return nil
+}
+
+// hangingRelay never completes a sync unless it gets canceled
+type hangingRelay struct {
+	synced int
+}
+
+//
+func (r *hangingRelay) Prepare() error { return nil }
+
+//
+func (r *hangingRelay) Dispose() error { return nil }
+
+//
+func (r *hangingRelay) Sync(opt *relays.SyncOptions) error {
+	r.synced++
+	<-opt.Ctx().Done()
+	return opt.Ctx().Err()
+}
+
+// targetsRelay records the target references of syncs
+type targetsRelay struct {
+	synced []string
+}
+
+//
+func (r *targetsRelay) Prepare() error { return nil }
+
+//
+func (r *targetsRelay) Dispose() error { return nil }
+
+//
+func (r *targetsRelay) Sync(opt *relays.SyncOptions) error {
+	r.synced = append(r.synced, opt.TrgtRef)
+	return nil
+}
+
+// mirrorRelay records the target references of syncs, and calls copy for
+// each tag that the options do not find unchanged
+type mirrorRelay struct {
+	synced []string
+	copy   func(src, trgt string)
+}
+
+//
+func (r *mirrorRelay) Prepare() error { return nil }
+
+//
+func (r *mirrorRelay) Dispose() error { return nil }
+
+//
+func (r *mirrorRelay) Sync(opt *relays.SyncOptions) error {
+	r.synced = append(r.synced, opt.TrgtRef)
+	list, err := opt.Tags.Expand(nil)
+	if err != nil {
+		return err
+	}
+	for _, t := range list {
+		trgtTag, err := opt.TargetTag(t)
+		if err != nil {
+			return err
+		}
+		src := fmt.Sprintf("%s:%s", opt.SrcRef, t)
+		trgt := fmt.Sprintf("%s:%s", opt.TrgtRef, trgtTag)
+		if !opt.IsUnchanged(src, trgt) && r.copy != nil {
+			r.copy(src, trgt)
+		}
+	}
+	return nil
+}
+
+// stoppingRelay starts a shutdown during its first sync; when told to, it
+// then waits for the sync to get canceled
+type stoppingRelay struct {
+	stopper *stopper
+	hang    bool
+	synced  int
+}
+
+//
+func (r *stoppingRelay) Prepare() error { return nil }
+
+//
+func (r *stoppingRelay) Dispose() error { return nil }
+
+//
+func (r *stoppingRelay) Sync(opt *relays.SyncOptions) error {
+	r.synced++
+	r.stopper.stop()
+	if r.hang {
+		<-opt.Ctx().Done()
+		return opt.Ctx().Err()
+	}
+	return nil
+}
+
+// routesRelay records the tags listed for each target reference
+type routesRelay struct {
+	synced map[string][]string
+}
+
+//
+func (r *routesRelay) Prepare() error { return nil }
+
+//
+func (r *routesRelay) Dispose() error { return nil }
+
+//
+func (r *routesRelay) Sync(opt *relays.SyncOptions) error {
+	list, err := opt.TagLister()
+	if err != nil {
+		return err
+	}
+	r.synced[opt.TrgtRef] = tags.Names(list)
+	return nil
+}
+
+// copyingRelay reports two copied images for each sync, and records the
+// target references. Syncs to target reference fail report only the first
+// image, and then fail.
+type copyingRelay struct {
+	synced []string
+	fail   string
+}
+
+//
+func (r *copyingRelay) Prepare() error { return nil }
+
+//
+func (r *copyingRelay) Dispose() error { return nil }
+
+//
+func (r *copyingRelay) Sync(opt *relays.SyncOptions) error {
+	r.synced = append(r.synced, opt.TrgtRef)
+	opt.Copied(opt.SrcRef+":1", opt.TrgtRef+":1", time.Now())
+	if opt.TrgtRef == r.fail {
+		return errors.New("copy failed")
+	}
+	opt.Copied(opt.SrcRef+":2", opt.TrgtRef+":2", time.Now())
+	return nil
+}
+
+// unchangedRelay records whether images count as unchanged, and fails syncs
+// while fail is set
+type unchangedRelay struct {
+	unchanged []bool
+	fail      bool
+}
+
+//
+func (r *unchangedRelay) Prepare() error { return nil }
+
+//
+func (r *unchangedRelay) Dispose() error { return nil }
+
+//
+func (r *unchangedRelay) Sync(opt *relays.SyncOptions) error {
+	r.unchanged = append(r.unchanged,
+		opt.IsUnchanged(opt.SrcRef+":1", opt.TrgtRef+":1"))
+	if r.fail {
+		return errors.New("copy failed")
+	}
+	return nil
+}
+
+// layoutRelay records the source images of syncs
+type layoutRelay struct {
+	images []string
+	synced []string
+}
+
+//
+func (r *layoutRelay) Prepare() error { return nil }
+
+//
+func (r *layoutRelay) Dispose() error { return nil }
+
+//
+func (r *layoutRelay) Sync(opt *relays.SyncOptions) error {
+	tags, err := opt.Tags.Expand(opt.TagLister)
+	if err != nil {
+		return err
+	}
+	for _, t := range tags {
+		r.images = append(r.images, opt.SourceImage(t))
+	}
+	r.synced = append(r.synced, opt.TrgtRef)
+	return nil
+}
+
+//
+func TestConcurrency(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, _ := trySync(th, "config/concurrency.yaml", "")
+	c, e := LoadConfig(th.GetFixture("config/concurrency.yaml"))
+	th.AssertNoError(e)
+
+	relay := &parallelRelay{}
+	s.relay = relay
+
+	task := c.Tasks[0]
+	s.syncTask(task)
+
+	th.AssertEqual(2, relay.maxSeen)
+	th.AssertEqual(5, len(relay.synced))
+	th.AssertTrue(task.failed)
+}
+
+//
+func TestTimeout(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, _ := trySync(th, "config/timeout.yaml", "")
+	c, e := LoadConfig(th.GetFixture("config/timeout.yaml"))
+	th.AssertNoError(e)
+
+	relay := &hangingRelay{}
+	s.relay = relay
+
+	task := c.Tasks[0]
+	th.AssertEqual(200*time.Millisecond, task.Timeout)
+
+	start := time.Now()
+	s.syncTask(task)
+
+	th.AssertTrue(time.Since(start) < 5*time.Second)
+	th.AssertEqual(1, relay.synced)
+	th.AssertTrue(task.failed)
+	th.AssertError(task.lastErr, "task 'test' timed out after 200ms")
+}
+
+//
+func TestTargets(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, _ := trySync(th, "config/targets.yaml", "")
+	c, e := LoadConfig(th.GetFixture("config/targets.yaml"))
+	th.AssertNoError(e)
+
+	relay := &targetsRelay{}
+	s.relay = relay
+
+	task := c.Tasks[0]
+	s.syncTask(task)
+
+	th.AssertFalse(task.failed)
+	th.AssertEqualSlices([]string{
+		"primary.example.com/mirror/busybox",
+		"dr.example.com/mirror/busybox",
+		"primary.example.com/library/alpine",
+		"dr.example.com/library/alpine",
+	}, relay.synced)
+}
+
+//
+func TestGracefulShutdown(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// the copy in progress finishes, remaining ones are deferred
+	s, _ := trySync(th, "config/targets.yaml", "")
+	c, e := LoadConfig(th.GetFixture("config/targets.yaml"))
+	th.AssertNoError(e)
+
+	relay := &stoppingRelay{stopper: s.stopper}
+	s.relay = relay
+	task := c.Tasks[0]
+	s.syncTask(task)
+
+	th.AssertEqual(1, relay.synced)
+	th.AssertFalse(task.failed)
+	th.AssertNoError(s.stopper.result(nil))
+
+	// no further tasks are run
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+	th.AssertEqual(1, relay.synced)
+
+	// a copy exceeding the shutdown timeout gets canceled
+	s, _ = trySync(th, "config/targets.yaml", "")
+	s.stopper.setTimeout(50 * time.Millisecond)
+	relay = &stoppingRelay{stopper: s.stopper, hang: true}
+	s.relay = relay
+	task = c.Tasks[0]
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+
+	th.AssertEqual(1, relay.synced)
+	th.AssertTrue(task.failed)
+	th.AssertError(s.stopper.result(nil), "shutdown was not clean")
+}
+
+//
+func TestTagRoutes(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/v2/":
+				w.WriteHeader(http.StatusOK)
+			case strings.HasSuffix(r.URL.Path, "/tags/list"):
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"name": "library/app",
+					"tags": []string{"1.0", "1.1-rc1", "2.0-rc1", "latest"}})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(unrouted string) *SyncConfig {
+		th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: %s
+    lister:
+      type: v2
+  target:
+    registry: mirror.example.com
+  mappings:
+  - from: library/app
+    to: stable/app
+    tag-routes:
+    - tags: ['regex:.*-rc\d+']
+      to: staging/app
+    - tags: ['latest']
+      to: edge/app
+    unrouted-tags: %s
+`, host, unrouted)), 0644))
+		c, e := LoadConfig(file)
+		th.AssertNoError(e)
+		return c
+	}
+
+	c := write(UnroutedSync)
+	s, e := New(c)
+	th.AssertNoError(e)
+	s.preflight = noPreflight
+	relay := &routesRelay{synced: make(map[string][]string)}
+	s.relay = relay
+
+	s.syncTask(c.Tasks[0])
+	th.AssertFalse(c.Tasks[0].failed)
+	th.AssertEqual(3, len(relay.synced))
+	th.AssertEqualSlices([]string{"1.1-rc1", "2.0-rc1"},
+		relay.synced["mirror.example.com/staging/app"])
+	th.AssertEqualSlices([]string{"latest"},
+		relay.synced["mirror.example.com/edge/app"])
+	th.AssertEqualSlices([]string{"1.0"},
+		relay.synced["mirror.example.com/stable/app"])
+
+	// unrouted tags are not synced at all
+	c = write(UnroutedSkip)
+	relay.synced = make(map[string][]string)
+	s.syncTask(c.Tasks[0])
+	th.AssertFalse(c.Tasks[0].failed)
+	th.AssertEqual(2, len(relay.synced))
+	_, ok := relay.synced["mirror.example.com/stable/app"]
+	th.AssertFalse(ok)
+}
+
+//
+func TestBudget(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, _ := trySync(th, "config/budget.yaml", "")
+	c, e := LoadConfig(th.GetFixture("config/budget.yaml"))
+	th.AssertNoError(e)
+
+	relay := &copyingRelay{}
+	s.relay = relay
+	task := c.Tasks[0]
+
+	// budget of three images is used up after the second sync
+	s.syncTask(task)
+	th.AssertFalse(task.failed)
+	th.AssertEqualSlices([]string{
+		"primary.example.com/mirror/busybox",
+		"dr.example.com/mirror/busybox",
+	}, relay.synced)
+
+	// next run resumes with the remaining images
+	relay.synced = nil
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+	th.AssertFalse(task.failed)
+	th.AssertEqualSlices([]string{
+		"primary.example.com/library/alpine",
+		"dr.example.com/library/alpine",
+	}, relay.synced)
+
+	// once all images were synced, runs start from the beginning again
+	relay.synced = nil
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+	th.AssertEqualSlices([]string{
+		"primary.example.com/mirror/busybox",
+		"dr.example.com/mirror/busybox",
+	}, relay.synced)
+
+	// without budget, everything is synced
+	task.MaxImages = 0
+	relay.synced = nil
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+	th.AssertEqual(4, len(relay.synced))
+}
+
+//
+func TestReport(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	manifest := `{"schemaVersion":2,"mediaType":` +
+		`"application/vnd.oci.image.manifest.v1+json",` +
+		`"config":{"size":100},"layers":[{"size":1000}]}`
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type",
+				"application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+			if r.Method == http.MethodGet {
+				w.Write([]byte(manifest))
+			}
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  max-images: 3
+  report: %s/{task}-{time}.json
+  source:
+    registry: registry.example.com
+  target:
+    registry: %s
+  mappings:
+  - from: library/busybox
+  - from: library/alpine
+  - from: library/nginx
+`, dir, host)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	s, e := New(c)
+	th.AssertNoError(e)
+	s.preflight = noPreflight
+	relay := &copyingRelay{fail: host + "/library/alpine"}
+	s.relay = relay
+
+	task := c.Tasks[0]
+	s.syncTask(task)
+	th.AssertTrue(task.failed)
+
+	files, err := filepath.Glob(filepath.Join(dir, "test-*.json"))
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(files))
+
+	data, err := ioutil.ReadFile(files[0])
+	th.AssertNoError(err)
+	var r Report
+	th.AssertNoError(json.Unmarshal(data, &r))
+	th.AssertEqual("test", r.Task)
+	th.AssertEqual("failure", r.Result)
+	th.AssertEqual(1, r.ImagesFailed)
+
+	var results []string
+	for _, i := range r.Items {
+		results = append(results, i.Source+" "+i.Result)
+		if i.Result == ReportCopied {
+			th.AssertEqual(digest, i.Digest)
+			th.AssertEqual(int64(len(manifest)+1100), i.Size)
+		}
+	}
+	th.AssertEqualSlices([]string{
+		"registry.example.com/library/alpine failed",
+		"registry.example.com/library/alpine:1 copied",
+		"registry.example.com/library/busybox:1 copied",
+		"registry.example.com/library/busybox:2 copied",
+		"registry.example.com/library/nginx deferred",
+	}, results)
+
+	// same for CSV, without budget
+	task.Report = filepath.Join(dir, "report.csv")
+	task.MaxImages = 0
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+
+	data, err = ioutil.ReadFile(task.Report)
+	th.AssertNoError(err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	th.AssertEqual(7, len(lines))
+	th.AssertEqual("source,target,digest,size,duration,result,error", lines[0])
+	th.AssertEqual("registry.example.com/library/alpine,"+host+
+		"/library/alpine,,0,0.000,failed,copy failed", lines[1])
+}
+
+//
+func TestWarmUp(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	manifest := `{"schemaVersion":2,"mediaType":` +
+		`"application/vnd.oci.image.manifest.v1+json","config":{},"layers":[]}`
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type",
+				"application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest",
+				fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest))))
+			w.Write([]byte(manifest))
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	stateFile := filepath.Join(dir, "state", "dregsy.json")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+state-file: %s
+tasks:
+- name: test
+  warm-up: true
+  source:
+    registry: %s
+  target:
+    registry: %s/mirror
+  mappings:
+  - from: library/busybox
+    skip-existing: true
+`, stateFile, host, host)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	s, e := New(c)
+	th.AssertNoError(e)
+	s.preflight = noPreflight
+	relay := &unchangedRelay{fail: true}
+	s.relay = relay
+	task := c.Tasks[0]
+
+	// a failed warm-up run is repeated
+	s.syncTask(task)
+	th.AssertTrue(task.failed)
+	th.AssertTrue(task.warming)
+	done, err := task.state.warmedUp("test")
+	th.AssertNoError(err)
+	th.AssertFalse(done)
+
+	relay.fail = false
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+	th.AssertFalse(task.failed)
+	th.AssertTrue(task.warming)
+	done, err = task.state.warmedUp("test")
+	th.AssertNoError(err)
+	th.AssertTrue(done)
+
+	// after warm-up, existing images are skipped, also after a restart
+	c, e = LoadConfig(file)
+	th.AssertNoError(e)
+	task = c.Tasks[0]
+	s.syncTask(task)
+	th.AssertFalse(task.warming)
+	th.AssertEqual(3, len(relay.unchanged))
+	th.AssertFalse(relay.unchanged[0])
+	th.AssertFalse(relay.unchanged[1])
+	th.AssertTrue(relay.unchanged[2])
+
+	// an unreadable state file means warming up again
+	th.AssertNoError(ioutil.WriteFile(stateFile, []byte("{"), 0644))
+	th.AssertTrue(task.isWarmingUp())
+	task.WarmUp = false
+	th.AssertFalse(task.isWarmingUp())
+}
+
+//
+func TestOnce(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// periodic task is run once, and syncing returns
+	s, _ := trySync(th, "config/targets.yaml", "")
+	c, e := LoadConfig(th.GetFixture("config/targets.yaml"))
+	th.AssertNoError(e)
+
+	relay := &targetsRelay{}
+	s.relay = relay
+	s.SetOnce(true)
+
+	th.AssertTrue(c.Tasks[0].isPeriodic())
+	th.AssertNoError(s.SyncFromConfig(c, ""))
+	th.AssertEqual(4, len(relay.synced))
+
+	s, _ = trySync(th, "config/concurrency.yaml", "")
+	c, e = LoadConfig(th.GetFixture("config/concurrency.yaml"))
+	th.AssertNoError(e)
+
+	s.relay = &parallelRelay{}
+	s.SetOnce(true)
+	th.AssertError(s.SyncFromConfig(c, ""), "1 of 1 tasks had errors")
+}
+
+//
+func TestLocalLayout(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir := t.TempDir()
+	th.AssertNoError(ioutil.WriteFile(filepath.Join(dir, "index.json"),
+		[]byte(`{"schemaVersion":2,"manifests":[
+			{"annotations":{"org.opencontainers.image.ref.name":"1.0"}},
+			{"annotations":{"org.opencontainers.image.ref.name":"latest"}}
+			]}`), 0644))
+
+	file := filepath.Join(dir, "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  interval: 60
+  target:
+    registry: localhost:5000
+  mappings:
+  - from: oci:%s
+    to: mirror/app
+    tags: ['latest']
+`, dir)), 0644))
+
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+	s, e := New(c)
+	th.AssertNoError(e)
+	s.preflight = noPreflight
+
+	relay := &layoutRelay{}
+	s.relay = relay
+
+	task := c.Tasks[0]
+	s.syncTask(task)
+
+	th.AssertFalse(task.failed)
+	th.AssertEqualSlices([]string{"localhost:5000/mirror/app"}, relay.synced)
+	th.AssertEqualSlices([]string{"oci:" + dir + ":latest"}, relay.images)
+}
+
+//
+func TestCircuitBreaker(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, _ := trySync(th, "config/targets.yaml", "")
+	c, e := LoadConfig(th.GetFixture("config/targets.yaml"))
+	th.AssertNoError(e)
+
+	relay := &copyingRelay{fail: "dr.example.com/library/alpine"}
+	s.relay = relay
+
+	task := c.Tasks[0]
+	task.CircuitBreaker = &CircuitBreaker{Failures: 2, Cooldown: time.Hour}
+	th.AssertNoError(task.validate())
+
+	s.syncTask(task)
+	th.AssertTrue(task.failed)
+	th.AssertEqual(metrics.CircuitClosed, task.breaker.state(time.Now()))
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+	th.AssertTrue(task.failed)
+	th.AssertEqual(metrics.CircuitOpen, task.breaker.state(time.Now()))
+	th.AssertEqual(8, len(relay.synced))
+
+	// runs are skipped while the breaker is open
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+	th.AssertEqual(8, len(relay.synced))
+
+	// a successful trial run after the cooldown closes it
+	task.breaker.until = time.Now()
+	relay.fail = ""
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+	th.AssertFalse(task.failed)
+	th.AssertEqual(12, len(relay.synced))
+	th.AssertEqual(metrics.CircuitClosed, task.breaker.state(time.Now()))
+}
+
+//
+func TestOverlappingRuns(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, _ := trySync(th, "config/targets.yaml", "")
+	c, e := LoadConfig(th.GetFixture("config/targets.yaml"))
+	th.AssertNoError(e)
+
+	relay := &targetsRelay{}
+	s.relay = relay
+
+	task := c.Tasks[0]
+	dir := t.TempDir()
+	task.LockFile = filepath.Join(dir, "test.lock")
+
+	// run in progress in this process
+	task.running.Lock()
+	s.syncTask(task)
+	task.running.Unlock()
+	th.AssertEqual(0, len(relay.synced))
+
+	// run in progress in another process
+	l, err := util.LockFile(task.LockFile)
+	th.AssertNoError(err)
+	s.syncTask(task)
+	th.AssertEqual(0, len(relay.synced))
+	th.AssertFalse(task.failed)
+	th.AssertNoError(l.Release())
+
+	s.syncTask(task)
+	th.AssertEqual(4, len(relay.synced))
+	th.AssertFalse(task.failed)
+
+	task.LockFile = filepath.Join(dir, "missing", "test.lock")
+	task.lastTick = time.Time{}
+	s.syncTask(task)
+	th.AssertEqual(4, len(relay.synced))
+	th.AssertTrue(task.failed)
+	th.AssertError(task.lastErr, "cannot lock")
+}
+
 //
 func TestInvalidSync(t *testing.T) {
 
@@ -30,6 +847,552 @@ func TestInvalidSync(t *testing.T) {
 	// mappings
 	trySync(th, "config/docker-platform-all.yaml",
 		"relay 'docker' does not support mappings with 'platform: all'")
+	trySync(th, "config/docker-platforms.yaml",
+		"relay 'docker' does not support mappings with 'platforms'")
+	trySync(th, "config/docker-copy-signatures.yaml",
+		"relay 'docker' does not support mappings with 'copy-signatures'")
+	trySync(th, "config/docker-skip-existing.yaml",
+		"relay 'docker' does not support mappings with 'skip-existing'")
+	trySync(th, "config/docker-verify.yaml",
+		"relay 'docker' does not support mappings with 'verify'")
+	trySync(th, "config/docker-artifact-types.yaml",
+		"relay 'docker' does not support mappings with 'artifact-types'")
+	trySync(th, "config/docker-on-immutable.yaml",
+		"relay 'docker' does not support mappings with 'on-immutable: skip'")
+	trySync(th, "config/docker-tag-routes.yaml",
+		"relay 'docker' does not support mappings with 'tag-routes'")
+	trySync(th, "config/docker-tag-concurrency.yaml",
+		"relay 'docker' does not support tasks with 'tag-concurrency'")
+	trySync(th, "config/docker-local.yaml",
+		"relay 'docker' does not support mappings with a local 'from'")
+	trySync(th, "config/docker-archive-to.yaml", "relay 'docker' does "+
+		"not support mappings with object storage in 'to'")
+	trySync(th, "config/docker-compression.yaml",
+		"relay 'docker' does not support setting 'compression'")
+	trySync(th, "config/containerd-compression.yaml",
+		"relay 'containerd' does not support 'compression' 'zstd', only 'keep'")
+	trySync(th, "config/containerd-platforms.yaml",
+		"relay 'containerd' does not support mappings with 'platforms'")
+	trySync(th, "config/docker-digest.yaml",
+		"relay 'docker' does not support mappings with a digest in 'from'")
+	trySync(th, "config/containerd-digest-no-tag.yaml",
+		"relay 'containerd' requires 'digest-tag' for mappings with a digest")
+}
+
+//
+func TestDryRun(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, _ := trySync(th, "config/dry-run.yaml", "")
+	c, e := LoadConfig(th.GetFixture("config/dry-run.yaml"))
+	th.AssertNoError(e)
+
+	var out bytes.Buffer
+	s.SetDryRun(true)
+	s.dryRunOut = &out
+
+	th.AssertNoError(s.SyncFromConfig(c, "test"))
+
+	dec := json.NewDecoder(&out)
+	for _, tag := range []string{"1.35.0", "latest"} {
+		var item DryRunItem
+		th.AssertNoError(dec.Decode(&item))
+		th.AssertEqual(DryRunItem{
+			Task:   "test",
+			From:   "/library/busybox",
+			Source: "registry.example.com/library/busybox",
+			Target: "localhost:5000/mirror/busybox",
+			Tag:    tag,
+		}, item)
+	}
+
+	var total DryRunTotal
+	th.AssertNoError(dec.Decode(&total))
+	th.AssertEqual(2, total.Total)
+	th.AssertFalse(dec.More())
+}
+
+//
+func TestDeepDryRun(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	manifest := func(layer string) string {
+		return `{"schemaVersion":2,"mediaType":` +
+			`"application/vnd.oci.image.manifest.v1+json","config":{},` +
+			`"layers":[],"annotations":{"layer":"` + layer + `"}}`
+	}
+	manifests := map[string]string{
+		"/v2/library/app/manifests/1.0":    manifest("a"),
+		"/v2/library/app/manifests/latest": manifest("b"),
+		"/v2/mirror/app/manifests/1.0":     manifest("a"),
+		"/v2/mirror/app/manifests/latest":  manifest("c"),
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v2/" {
+				return
+			}
+			if r.URL.Path == "/v2/mirror/app/tags/list" {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"name": "mirror/app", "tags": []string{"1.0", "latest"}})
+				return
+			}
+			m, ok := manifests[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type",
+				"application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest",
+				fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(m))))
+			w.Write([]byte(m))
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: %s
+  target:
+    registry: %s
+  mappings:
+  - from: library/app
+    to: mirror/app
+    tags: ['1.0', 'latest']
+    skip-existing: true
+  - from: library/new
+    to: mirror/new
+    tags: ['1.0']
+`, host, host)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	s, e := New(c)
+	th.AssertNoError(e)
+	var out bytes.Buffer
+	s.SetDeepDryRun(true)
+	th.AssertTrue(s.dryRun)
+	s.dryRunOut = &out
+
+	th.AssertNoError(s.SyncFromConfig(c, "test"))
+
+	dec := json.NewDecoder(&out)
+	for _, want := range []struct {
+		target    string
+		tag       string
+		exists    bool
+		unchanged bool
+	}{
+		{"mirror/app", "1.0", true, true},
+		{"mirror/app", "latest", true, false},
+		{"mirror/new", "1.0", false, false},
+	} {
+		var item DryRunItem
+		th.AssertNoError(dec.Decode(&item))
+		th.AssertEqual(host+"/"+want.target, item.Target)
+		th.AssertEqual(want.tag, item.Tag)
+		th.AssertNotNil(item.TargetExists)
+		th.AssertEqual(want.exists, *item.TargetExists)
+		th.AssertEqual(want.unchanged, item.Unchanged)
+		th.AssertFalse(item.AutoCreate)
+	}
+
+	var total DryRunTotal
+	th.AssertNoError(dec.Decode(&total))
+	th.AssertEqual(3, total.Total)
+	th.AssertFalse(dec.More())
+
+	// a target that cannot be accessed fails the task before resolving it
+	s.preflight = func(ctx context.Context, t *Task) error {
+		return fmt.Errorf("preflight check failed")
+	}
+	out.Reset()
+	th.AssertError(s.SyncFromConfig(c, "test"),
+		"one or more tasks had errors")
+	dec = json.NewDecoder(&out)
+	th.AssertNoError(dec.Decode(&total))
+	th.AssertEqual(0, total.Total)
+}
+
+//
+func TestReconcile(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	manifest := func(layer string) string {
+		return `{"schemaVersion":2,"mediaType":` +
+			`"application/vnd.oci.image.manifest.v1+json","config":{},` +
+			`"layers":[],"annotations":{"layer":"` + layer + `"}}`
+	}
+	manifests := map[string]string{
+		"/v2/library/app/manifests/1.0":    manifest("a"),
+		"/v2/library/app/manifests/1.1":    manifest("e"),
+		"/v2/library/app/manifests/2.0":    manifest("b"),
+		"/v2/library/app/manifests/latest": manifest("c"),
+		"/v2/library/new/manifests/1.0":    manifest("d"),
+		"/v2/mirror/app/manifests/1.0":     manifest("a"),
+		"/v2/mirror/app/manifests/1.1":     manifest("y"),
+		"/v2/mirror/app/manifests/latest":  manifest("x"),
+	}
+	var mu gosync.Mutex
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v2/" {
+				return
+			}
+			if r.URL.Path == "/v2/mirror/app/tags/list" {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"name": "mirror/app",
+					"tags": []string{"1.0", "1.1", "latest", "old"}})
+				return
+			}
+			mu.Lock()
+			m, ok := manifests[r.URL.Path]
+			mu.Unlock()
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type",
+				"application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest",
+				fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(m))))
+			w.Write([]byte(m))
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: %s
+  target:
+    registry: %s
+  mappings:
+  - from: library/app
+    to: mirror/app
+    tags: ['1.0', '1.1', '2.0', 'latest']
+    skip-existing: true
+    mutable-tags: ['2.0']
+  - from: library/new
+    to: mirror/new
+    tags: ['1.0']
+`, host, host)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	s, e := New(c)
+	th.AssertNoError(e)
+	relay := &mirrorRelay{}
+	s.relay = relay
+	var out bytes.Buffer
+	s.SetReconcile(true, false, true)
+	s.dryRunOut = &out
+
+	th.AssertError(s.SyncFromConfig(c, "test"),
+		"5 image(s) drifted from their source")
+	th.AssertEqual(0, len(relay.synced))
+
+	dec := json.NewDecoder(&out)
+	for _, want := range []struct {
+		target string
+		tag    string
+		drift  string
+	}{
+		{"mirror/app", "1.1", DriftMismatch},
+		{"mirror/app", "2.0", DriftMissing},
+		{"mirror/app", "latest", DriftMismatch},
+		{"mirror/app", "old", DriftExtra},
+		{"mirror/new", "1.0", DriftMissing},
+	} {
+		var item ReconcileItem
+		th.AssertNoError(dec.Decode(&item))
+		th.AssertEqual(host+"/"+want.target, item.Target)
+		th.AssertEqual(want.drift, item.Drift)
+		if want.drift == DriftExtra {
+			th.AssertEqual("", item.Source)
+			th.AssertEqual(want.tag, item.TargetTag)
+		} else {
+			th.AssertEqual(want.tag, item.Tag)
+		}
+		th.AssertEqual(want.drift == DriftMismatch, item.Digest != "")
+		th.AssertEqual(want.drift == DriftMismatch, item.TargetDigest != "")
+		th.AssertFalse(item.Fixed)
+	}
+
+	var total ReconcileTotal
+	th.AssertNoError(dec.Decode(&total))
+	th.AssertEqual(ReconcileTotal{Checked: 5, Missing: 2, Mismatch: 2,
+		Extra: 1}, total)
+	th.AssertFalse(dec.More())
+
+	// images the relay did not copy are not fixed
+	out.Reset()
+	s.SetReconcile(true, true, false)
+	s.dryRunOut = &out
+	th.AssertError(s.SyncFromConfig(c, "test"),
+		"4 image(s) drifted from their source")
+	th.AssertEqualSlices([]string{host + "/mirror/app", host + "/mirror/new"},
+		relay.synced)
+
+	dec = json.NewDecoder(&out)
+	for ix := 0; ix < 4; ix++ {
+		var item ReconcileItem
+		th.AssertNoError(dec.Decode(&item))
+		th.AssertFalse(item.Fixed)
+	}
+	th.AssertNoError(dec.Decode(&total))
+	th.AssertEqual(0, total.Fixed)
+
+	// fixing syncs missing and differing images, but leaves extra ones; the
+	// mismatched 1.1 is copied even though 'skip-existing' does not compare
+	// digests for tags that are not mutable
+	path := func(ref string) string {
+		ix := strings.LastIndex(ref, ":")
+		return fmt.Sprintf("/v2%s/manifests/%s",
+			strings.TrimPrefix(ref[:ix], host), ref[ix+1:])
+	}
+	var copied []string
+	relay.copy = func(src, trgt string) {
+		mu.Lock()
+		defer mu.Unlock()
+		manifests[path(trgt)] = manifests[path(src)]
+		copied = append(copied, trgt)
+	}
+	relay.synced = nil
+	out.Reset()
+	th.AssertNoError(s.SyncFromConfig(c, "test"))
+	th.AssertEqualSlices([]string{host + "/mirror/app", host + "/mirror/new"},
+		relay.synced)
+	th.AssertEqualSlices([]string{host + "/mirror/app:1.1",
+		host + "/mirror/app:2.0", host + "/mirror/app:latest",
+		host + "/mirror/new:1.0"}, copied)
+
+	dec = json.NewDecoder(&out)
+	for ix := 0; ix < 4; ix++ {
+		var item ReconcileItem
+		th.AssertNoError(dec.Decode(&item))
+		th.AssertTrue(item.Fixed)
+	}
+	th.AssertNoError(dec.Decode(&total))
+	th.AssertEqual(ReconcileTotal{Checked: 5, Missing: 2, Mismatch: 2,
+		Fixed: 4}, total)
+	th.AssertFalse(dec.More())
+}
+
+//
+func TestReload(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	task := `
+- name: %s
+  interval: 30
+  source:
+    registry: registry.example.com
+  target:
+    registry: localhost:5000
+  mappings:
+  - from: library/%s
+`
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(tasks string) {
+		th.AssertNoError(ioutil.WriteFile(
+			file, []byte("relay: skopeo\ntasks:"+tasks), 0644))
+	}
+
+	relay := &fakeRelay{synced: make(chan string, 10)}
+	expect := func(ref string) {
+		select {
+		case r := <-relay.synced:
+			th.AssertEqual(ref, r)
+		case <-time.After(5 * time.Second):
+			th.AssertEqual(ref, "")
+		}
+	}
+
+	write(fmt.Sprintf(task, "a", "busybox"))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	s, e := New(c)
+	th.AssertNoError(e)
+	s.preflight = noPreflight
+	s.relay = relay
+	s.SetConfigFile(file)
+
+	done := make(chan error)
+	go func() { done <- s.SyncFromConfig(c, "") }()
+	expect("registry.example.com/library/busybox")
+	s.WaitForTick()
+
+	// invalid config is not loaded
+	write(fmt.Sprintf(task, "", "busybox"))
+	s.Reload()
+	s.WaitForTick()
+
+	// task 'a' keeps its schedule, so only 'b' syncs right away
+	write(fmt.Sprintf(task, "a", "busybox") + fmt.Sprintf(task, "b", "alpine"))
+	s.Reload()
+	expect("registry.example.com/library/alpine")
+
+	select {
+	case r := <-relay.synced:
+		th.AssertEqual("", r)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	s.Shutdown()
+	th.AssertNoError(<-done)
+}
+
+//
+func TestPreflight(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v2/" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer srv.Close()
+	reachable := strings.TrimPrefix(srv.URL, "http://")
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	unreachable := strings.TrimPrefix(down.URL, "http://")
+	down.Close()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(source, target string) *SyncConfig {
+		th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: %s
+  target:
+    registry: %s
+  mappings:
+  - from: library/busybox
+`, source, target)), 0644))
+		c, e := LoadConfig(file)
+		th.AssertNoError(e)
+		return c
+	}
+
+	ctx := context.Background()
+
+	c := write(reachable, reachable)
+	th.AssertNoError(c.Tasks[0].preflight(ctx))
+
+	c = write(unreachable, reachable)
+	e := c.Tasks[0].preflight(ctx)
+	th.AssertError(e,
+		"preflight check of source registry '"+unreachable+"' failed")
+	th.AssertEqual(registry.FailureConnectivity, registry.FailureOf(e))
+
+	c = write(reachable, unreachable)
+	th.AssertError(c.Tasks[0].preflight(ctx),
+		"preflight check of target registry '"+unreachable+"' failed")
+
+	// a failed check fails the run before anything is synced
+	s, e := New(c)
+	th.AssertNoError(e)
+	relay := &targetsRelay{}
+	s.relay = relay
+
+	task := c.Tasks[0]
+	s.syncTask(task)
+	th.AssertTrue(task.failed)
+	th.AssertError(task.lastErr, "preflight check of target registry")
+	th.AssertEqual(0, len(relay.synced))
+
+	// in preflight mode, only the checks are run
+	s.SetPreflight(true)
+	th.AssertError(s.SyncFromConfig(c, ""),
+		"preflight check failed for 1 task(s)")
+	th.AssertEqual(0, len(relay.synced))
+
+	c = write(reachable, reachable)
+	th.AssertNoError(s.SyncFromConfig(c, ""))
+}
+
+// noPreflight skips the registry checks before task runs, for tests using
+// registries that do not exist
+func noPreflight(ctx context.Context, t *Task) error {
+	return nil
+}
+
+//
+func TestPreflightRetries(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var mu gosync.Mutex
+	status := []int{http.StatusServiceUnavailable, http.StatusOK}
+	pings := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			code := status[len(status)-1]
+			if pings < len(status) {
+				code = status[pings]
+			}
+			pings++
+			if code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			}
+			w.WriteHeader(code)
+		}))
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  retries: 2
+  retry-interval: 1ms
+  source:
+    registry: %s
+  target:
+    registry: %s
+  mappings:
+  - from: library/busybox
+`, reg, reg)), 0644))
+	c, err := LoadConfig(file)
+	th.AssertNoError(err)
+
+	// connectivity failures are retried, the first request fails
+	ctx := context.Background()
+	th.AssertNoError(c.Tasks[0].preflight(ctx))
+
+	// auth failures are not
+	mu.Lock()
+	status, pings = []int{http.StatusUnauthorized}, 0
+	mu.Unlock()
+	err = c.Tasks[0].preflight(ctx)
+	th.AssertError(err, "auth error: ")
+	th.AssertEqual(registry.FailureAuth, registry.FailureOf(err))
+	// a single ping takes up to two requests, for the auth challenge
+	th.AssertTrue(pings <= 2)
 }
 
 //
@@ -44,6 +1407,7 @@ func trySync(th *test.TestHelper, file, err string) (*Sync, error) {
 
 	s, e := New(c)
 	if s != nil {
+		s.preflight = noPreflight
 		defer func() { s.Dispose() }()
 	}
 
@@ -17,33 +17,83 @@
 package sync
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	gosync "sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/layout"
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
 	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/relays"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
 	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
 //
 type Task struct {
-	Name     string     `yaml:"name"`
-	Interval int        `yaml:"interval"`
-	Source   *Location  `yaml:"source"`
-	Target   *Location  `yaml:"target"`
-	Mappings []*Mapping `yaml:"mappings"`
-	Verbose  bool       `yaml:"verbose"`
+	Name           string          `yaml:"name"`
+	Interval       int             `yaml:"interval"`
+	Cron           string          `yaml:"cron"`
+	Timezone       string          `yaml:"timezone"`
+	Jitter         time.Duration   `yaml:"jitter"`
+	Source         *Location       `yaml:"source"`
+	Target         *Location       `yaml:"target"`
+	Targets        []*Location     `yaml:"targets"`
+	Mappings       []*Mapping      `yaml:"mappings"`
+	Verbose        bool            `yaml:"verbose"`
+	Retries        int             `yaml:"retries"`
+	Concurrency    int             `yaml:"concurrency"`
+	TagConcurrency int             `yaml:"tag-concurrency"`
+	RetryInterval  time.Duration   `yaml:"retry-interval"`
+	Timeout        time.Duration   `yaml:"timeout"`
+	MaxBytes       int64           `yaml:"max-bytes"`
+	MaxImages      int             `yaml:"max-images"`
+	LockFile       string          `yaml:"lock-file"`
+	Report         string          `yaml:"report"`
+	WarmUp         bool            `yaml:"warm-up"`
+	Webhook        *WebhookConfig  `yaml:"webhook"`
+	CircuitBreaker *CircuitBreaker `yaml:"circuit-breaker"`
 	//
+	lister   *ListerConfig
+	webhook  *WebhookConfig
+	strict   bool
+	maxRepos int
+	slots    *util.Semaphore
+	force    bool
+	seed     *int64
+	platform string
+	jitter   *rand.Rand
 	repoList *registry.RepoList
+	listMu   gosync.Mutex
+	authMu   gosync.Mutex
+	running  gosync.Mutex
+	schedule cron.Schedule
+	location *time.Location
 	ticker   *time.Ticker
 	lastTick time.Time
 	failed   bool
+	lastErr  error
+	budget   *budget
+	synced   map[string]bool
+	report   *report
+	state    *state
+	warming  bool
+	breaker  *breaker
+	metadata *metadataCache
 	//
 	exit chan bool
 	done chan bool
@@ -51,57 +101,470 @@ type Task struct {
 
 //
 func (t *Task) validate() error {
+	if errs := t.validateAll(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// validateAll validates this task and returns all errors found, in the order
+// in which they were found. Validation continues after an error wherever the
+// remaining checks do not depend on the failed one.
+func (t *Task) validateAll() []error {
+
+	var errs []error
 
 	if len(t.Name) == 0 {
-		return errors.New("a task requires a name")
+		errs = append(errs, errors.New("a task requires a name"))
 	}
 
 	if 0 < t.Interval && t.Interval < minimumTaskInterval {
-		return fmt.Errorf(
-			"minimum task interval is %d seconds", minimumTaskInterval)
+		errs = append(errs, fmt.Errorf(
+			"minimum task interval is %d seconds", minimumTaskInterval))
+	} else if t.Interval < 0 {
+		errs = append(errs,
+			errors.New("task interval needs to be 0 or a positive integer"))
 	}
 
-	if t.Interval < 0 {
-		return errors.New("task interval needs to be 0 or a positive integer")
+	if err := t.validateSchedule(); err != nil {
+		errs = append(errs, err)
 	}
 
-	if err := t.Source.validate(); err != nil {
-		return fmt.Errorf(
-			"source registry in task '%s' invalid: %v", t.Name, err)
+	if err := t.validateJitter(); err != nil {
+		errs = append(errs, err)
 	}
 
-	if err := t.Target.validate(); err != nil {
-		return fmt.Errorf(
-			"target registry in task '%s' invalid: %v", t.Name, err)
+	if t.Concurrency < 0 {
+		errs = append(errs, errors.New("'concurrency' must not be negative"))
+	} else if t.Concurrency == 0 {
+		t.Concurrency = 1
+	}
+
+	if t.MaxBytes < 0 {
+		errs = append(errs, errors.New("'max-bytes' must not be negative"))
+	}
+	if t.MaxImages < 0 {
+		errs = append(errs, errors.New("'max-images' must not be negative"))
+	}
+
+	if t.Report != "" {
+		if err := validateReportPath(t.Report); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if t.WarmUp && t.state == nil {
+		errs = append(errs, fmt.Errorf(
+			"'warm-up' in task '%s' requires a global 'state-file'", t.Name))
+	}
+
+	if t.TagConcurrency < 0 {
+		errs = append(errs,
+			errors.New("'tag-concurrency' must not be negative"))
+	} else if t.TagConcurrency == 0 {
+		t.TagConcurrency = 1
+	}
+
+	if t.Retries < 0 {
+		errs = append(errs, errors.New("'retries' must not be negative"))
+	}
+	if t.RetryInterval < 0 {
+		errs = append(errs, errors.New("'retry-interval' must not be negative"))
+	} else if t.RetryInterval == 0 {
+		t.RetryInterval = defaultRetryInterval
+	}
+	if t.Timeout < 0 {
+		errs = append(errs, errors.New("'timeout' must not be negative"))
+	}
+
+	if t.Webhook != nil {
+		if err := t.Webhook.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("task '%s': %v", t.Name, err))
+		} else {
+			t.webhook = t.Webhook
+		}
+	}
+
+	if err := t.CircuitBreaker.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("task '%s': %v", t.Name, err))
+	} else if t.CircuitBreaker != nil && !t.isPeriodic() {
+		errs = append(errs, fmt.Errorf("'circuit-breaker' in task '%s' "+
+			"requires 'interval' or 'cron'", t.Name))
+	} else {
+		t.breaker = newBreaker(t)
+	}
+
+	// tasks syncing only from local layouts need no source registry
+	if t.Source == nil && t.onlyLocal() {
+		t.Source = &Location{}
+	}
+
+	sourceValid := true
+	if t.onlyLocal() && t.Source.Registry == "" {
+		sourceValid = false
+	} else if err := t.Source.validate(); err != nil {
+		errs = append(errs, fmt.Errorf(
+			"source registry in task '%s' invalid: %v", t.Name, err))
+		sourceValid = false
+	}
+
+	if t.Target != nil && len(t.Targets) > 0 {
+		errs = append(errs, fmt.Errorf(
+			"'target' and 'targets' cannot both be set in task '%s'", t.Name))
+	}
+
+	// tasks syncing only to object storage need no target registry
+	if t.Target == nil && len(t.Targets) == 0 && t.onlyArchived() {
+		t.Target = &Location{}
+	}
+
+	registries := map[string]bool{}
+	for _, l := range t.targets() {
+		if t.onlyArchived() && l.Registry == "" {
+			continue
+		}
+		if err := l.validate(); err != nil {
+			errs = append(errs, fmt.Errorf(
+				"target registry in task '%s' invalid: %v", t.Name, err))
+			continue
+		}
+		if l.RateLimit != 0 {
+			errs = append(errs, fmt.Errorf(
+				"'rate-limit' in task '%s' is only supported for source "+
+					"registry", t.Name))
+		}
+		if registries[l.Registry] {
+			errs = append(errs, fmt.Errorf(
+				"target registry '%s' appears more than once in task '%s'",
+				l.Registry, t.Name))
+		}
+		registries[l.Registry] = true
 	}
 
 	hasRegexp := false
+	onlyActive := false
+	awsTags := false
+	lifecycle := false
 	for _, m := range t.Mappings {
+		if m != nil && t.Source != nil {
+			m.sourceHost = registryHost(t.Source.Registry)
+		}
+		m.resolvePlatform(t.platform)
 		if err := m.validate(); err != nil {
-			return err
+			errs = append(errs, err)
+			continue
+		}
+		if err := m.checkDestination(t.strict); err != nil {
+			errs = append(errs, err)
 		}
 		hasRegexp = hasRegexp || m.isRegexpFrom()
+		onlyActive = onlyActive || m.onlyActive()
+		awsTags = awsTags || m.hasAWSTags()
+		lifecycle = lifecycle || m.AWSLifecycle
 	}
 
-	if hasRegexp {
-		var err error
-		s := t.Source
-		if t.repoList, err = registry.NewRepoList(s.Registry, s.SkipTLSVerify,
-			s.ListerType, s.ListerConfig, s.creds); err != nil {
+	if sourceValid && (hasRegexp || onlyActive || lifecycle) {
+		list, err := t.getRepoList()
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			if onlyActive && !list.CanCheckActivity() {
+				errs = append(errs, fmt.Errorf("'only-active' in task '%s' "+
+					"is not supported by source registry", t.Name))
+			}
+			if awsTags && !list.CanListResourceTags() {
+				errs = append(errs, fmt.Errorf("'aws-tags' in task '%s' "+
+					"is only supported for ECR sources", t.Name))
+			}
+			if lifecycle && !list.CanPreviewLifecycle() {
+				errs = append(errs, fmt.Errorf("'aws-lifecycle' in task '%s' "+
+					"is only supported for ECR sources", t.Name))
+			}
+		}
+	}
+
+	return errs
+}
+
+// onlyLocal determines whether all mappings of this task sync from a local
+// layout.
+func (t *Task) onlyLocal() bool {
+	for _, m := range t.Mappings {
+		if m == nil || !m.isLocal() {
+			return false
+		}
+	}
+	return len(t.Mappings) > 0
+}
+
+// onlyArchived determines whether all mappings of this task sync to OCI
+// layouts in object storage.
+func (t *Task) onlyArchived() bool {
+	for _, m := range t.Mappings {
+		if m == nil || !m.isArchived() {
+			return false
+		}
+	}
+	return len(t.Mappings) > 0
+}
+
+// sourceRef returns the reference of source repository r of mapping m. For a
+// local layout, this is `from` itself.
+func (t *Task) sourceRef(m *Mapping, r string) string {
+	if m.isLocal() {
+		return m.From
+	}
+	return t.Source.Registry + r
+}
+
+// refreshSourceAuth refreshes the source registry credentials, unless mapping
+// m reads from a local layout, which needs none.
+func (t *Task) refreshSourceAuth(m *Mapping) error {
+	if m.isLocal() {
+		return nil
+	}
+	return t.Source.RefreshAuth()
+}
+
+// targets returns the target registries of this task, i.e. either `target`,
+// or the list in `targets`.
+func (t *Task) targets() []*Location {
+	if len(t.Targets) > 0 {
+		return t.Targets
+	}
+	return []*Location{t.Target}
+}
+
+// destinations returns the target registries to which mapping m syncs. For an
+// OCI layout in object storage in `to`, this is a single location without
+// registry settings, named after the layout.
+func (t *Task) destinations(m *Mapping) []*Location {
+	if m.isArchived() {
+		return []*Location{{Registry: m.To}}
+	}
+	return t.targets()
+}
+
+// targetRegistries returns the target registries of this task for logging.
+func (t *Task) targetRegistries() string {
+	var ret []string
+	for _, l := range t.targets() {
+		ret = append(ret, l.Registry)
+	}
+	return strings.Join(ret, ", ")
+}
+
+// getRepoList returns the repo list for the source of this task. The list is
+// created on first use.
+func (t *Task) getRepoList() (*registry.RepoList, error) {
+
+	if t.repoList != nil {
+		return t.repoList, nil
+	}
+
+	s := t.Source
+	list, err := registry.NewRepoList(s.Registry, s.transport,
+		s.ListerType, s.ListerConfig, s.creds, s.AWSRole())
+	if err != nil {
+		return nil, fmt.Errorf(
+			"cannot create repo list for task '%s': %v", t.Name, err)
+	}
+
+	if t.lister != nil {
+		if t.lister.MaxItems != 0 {
+			list.SetMaxItems(t.lister.MaxItems)
+		}
+		if t.lister.CacheDuration != 0 {
+			list.SetCacheDuration(t.lister.CacheDuration)
+		}
+	}
+
+	t.repoList = list
+	return list, nil
+}
+
+// validateSchedule validates the cron schedule of this task, if set.
+func (t *Task) validateSchedule() error {
+
+	if t.Cron == "" {
+		if t.Timezone != "" {
+			return fmt.Errorf("'timezone' in task '%s' requires 'cron'", t.Name)
+		}
+		return nil
+	}
+
+	if t.Interval != 0 {
+		return fmt.Errorf(
+			"'cron' and 'interval' in task '%s' cannot both be set", t.Name)
+	}
+
+	t.location = time.Local
+	if t.Timezone != "" {
+		loc, err := time.LoadLocation(t.Timezone)
+		if err != nil {
 			return fmt.Errorf(
-				"cannot create repo list for task '%s': %v", t.Name, err)
+				"invalid 'timezone' in task '%s': %v", t.Name, err)
 		}
+		t.location = loc
+	}
+
+	sched, err := cron.ParseStandard(t.Cron)
+	if err != nil {
+		return fmt.Errorf("invalid 'cron' in task '%s': %v", t.Name, err)
+	}
+	t.schedule = sched
+
+	return nil
+}
+
+// validateJitter validates the jitter of this task, if set. For interval based
+// tasks, jitter may not exceed half the interval, since consecutive runs could
+// otherwise be skipped as fired too soon.
+func (t *Task) validateJitter() error {
+
+	if t.Jitter < 0 {
+		return fmt.Errorf("'jitter' in task '%s' must not be negative", t.Name)
+	}
+
+	if t.Jitter == 0 {
+		return nil
+	}
+
+	if !t.isPeriodic() {
+		return fmt.Errorf(
+			"'jitter' in task '%s' requires 'interval' or 'cron'", t.Name)
+	}
+
+	if t.Interval > 0 && t.Jitter > time.Duration(t.Interval)*time.Second/2 {
+		return fmt.Errorf(
+			"'jitter' in task '%s' must not exceed half the interval", t.Name)
 	}
 
 	return nil
 }
 
+// isPeriodic determines whether this task is run repeatedly, either at a fixed
+// interval or according to a cron schedule.
+func (t *Task) isPeriodic() bool {
+	return t.Interval > 0 || t.Cron != ""
+}
+
+// period returns the expected time between two runs of this task. For cron
+// schedules, this is the time between the next two scheduled runs. For one-off
+// tasks, it is 0.
+func (t *Task) period() time.Duration {
+	if t.Interval > 0 {
+		return time.Duration(t.Interval) * time.Second
+	}
+	if t.Cron != "" {
+		next := t.nextRun(time.Now())
+		return t.nextRun(next).Sub(next)
+	}
+	return 0
+}
+
+// nextRun returns the next time after from at which this task should run
+// according to its cron schedule.
+func (t *Task) nextRun(from time.Time) time.Time {
+	return t.schedule.Next(from.In(t.location))
+}
+
+// initJitter sets up the source of random delays for this task. With a jitter
+// seed, delays are based on the seed and the task name, so they are the same
+// each time dregsy is started.
+func (t *Task) initJitter() {
+
+	if t.Jitter <= 0 {
+		t.jitter = nil
+		return
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(t.Name))
+	seed := int64(h.Sum64())
+	if t.seed != nil {
+		seed ^= *t.seed
+	} else {
+		seed ^= time.Now().UnixNano()
+	}
+	t.jitter = rand.New(rand.NewSource(seed))
+}
+
+// jitterDelay returns a random delay for the next firing of this task, which
+// is 0 if no jitter is set.
+func (t *Task) jitterDelay() time.Duration {
+	if t.jitter == nil {
+		return 0
+	}
+	return time.Duration(t.jitter.Int63n(int64(t.Jitter) + 1))
+}
+
+// waitJitter waits for a random delay before this task fires, and returns
+// false if the task exits in the meantime.
+func (t *Task) waitJitter(logger *log.Entry) bool {
+
+	d := t.jitterDelay()
+	if d == 0 {
+		return true
+	}
+
+	logger.WithField("delay", d).Debug("delaying task firing")
+	return t.wait(d)
+}
+
+// wait waits for duration d, and returns false if the task exits in the
+// meantime.
+func (t *Task) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+		return true
+	case <-t.exit:
+		timer.Stop()
+		return false
+	}
+}
+
+// resumeDelay returns how long an interval based task has to wait for its
+// first run, so that it keeps its interval across restarts. This is what is
+// left of the interval since the last run recorded in the state file, or 0 if
+// there is none.
+func (t *Task) resumeDelay() time.Duration {
+
+	if t.state == nil || t.Interval <= 0 {
+		return 0
+	}
+
+	ts, err := t.state.get(t.Name)
+	if err != nil {
+		log.WithField("task", t.Name).Errorf(
+			"cannot determine last run of task: %v", err)
+		return 0
+	}
+	if ts == nil || ts.LastRun == nil {
+		return 0
+	}
+
+	d := time.Until(ts.LastRun.Add(time.Duration(t.Interval) * time.Second))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
 //
 func (t *Task) startTicking(c chan *Task) {
 
 	logger := log.WithField("task", t.Name)
 	logger.Debug("task starts ticking")
 
+	t.initJitter()
+
+	if t.schedule != nil {
+		t.startCron(c)
+		return
+	}
+
 	i := time.Duration(t.Interval)
 	if i == 0 {
 		i = 3
@@ -113,17 +576,66 @@ func (t *Task) startTicking(c chan *Task) {
 	t.exit = make(chan bool, 1)
 	t.done = make(chan bool, 1)
 
+	resume := t.resumeDelay()
+
 	go func() {
 
+		defer close(t.done)
+
+		if resume > 0 {
+			logger.WithField("next", time.Now().Add(resume).Round(
+				time.Second)).Info("resuming interval of previous run")
+			if !t.wait(resume) {
+				logger.Debug("task exiting")
+				return
+			}
+			t.ticker.Reset(time.Second * i)
+		}
+
+		if !t.waitJitter(logger) {
+			logger.Debug("task exiting")
+			return
+		}
 		logger.Debug("sending initial fire")
 		c <- t
 
 		for {
 			select {
 			case <-t.ticker.C:
+				if !t.waitJitter(logger) {
+					logger.Debug("task exiting")
+					return
+				}
+				logger.Debug("task firing")
+				c <- t
+			case <-t.exit:
+				logger.Debug("task exiting")
+				return
+			}
+		}
+	}()
+}
+
+// startCron starts firing this task according to its cron schedule. Contrary
+// to interval based tasks, there is no initial fire.
+func (t *Task) startCron(c chan *Task) {
+
+	logger := log.WithField("task", t.Name)
+
+	t.exit = make(chan bool, 1)
+	t.done = make(chan bool, 1)
+
+	go func() {
+		for {
+			next := t.nextRun(time.Now()).Add(t.jitterDelay())
+			logger.WithField("next", next).Info("next scheduled run")
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
 				logger.Debug("task firing")
 				c <- t
 			case <-t.exit:
+				timer.Stop()
 				logger.Debug("task exiting")
 				close(t.done)
 				return
@@ -145,99 +657,1060 @@ func (t *Task) tooSoon() bool {
 func (t *Task) stopTicking() {
 	if t.ticker != nil {
 		t.ticker.Stop()
+	}
+	if t.exit != nil {
 		close(t.exit)
 		<-t.done
 	}
 	log.WithField("task", t.Name).Debug("task exited")
 }
 
-//
-func (t *Task) fail(f bool) {
-	t.failed = t.failed || f
+// lock acquires the locks for a run of this task, i.e. the in-process lock,
+// and the lock file if configured. The returned function releases them. If
+// either lock is held by another run, util.ErrLocked is returned.
+func (t *Task) lock() (func(), error) {
+
+	if !t.running.TryLock() {
+		return nil, util.ErrLocked
+	}
+
+	if t.LockFile == "" {
+		return t.running.Unlock, nil
+	}
+
+	l, err := util.LockFile(t.LockFile)
+	if err != nil {
+		t.running.Unlock()
+		if errors.Is(err, util.ErrLocked) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("cannot lock '%s': %v", t.LockFile, err)
+	}
+
+	return func() {
+		if err := l.Release(); err != nil {
+			log.WithField("task", t.Name).Errorf(
+				"error releasing lock file: %v", err)
+		}
+		t.running.Unlock()
+	}, nil
 }
 
-//
-func (t *Task) mappingRefs(m *Mapping) ([][2]string, error) {
+// runContext returns the context for a run of this task, derived from parent.
+// It is canceled when the task timeout is exceeded, if set. The returned cancel
+// function needs to be called once the run is done.
+func (t *Task) runContext(parent context.Context) (context.Context,
+	context.CancelFunc) {
 
-	var ret [][2]string
+	if t.Timeout > 0 {
+		return context.WithTimeout(parent, t.Timeout)
+	}
+	return context.WithCancel(parent)
+}
 
-	if m != nil {
+// timedOut returns an error if ctx of a run of this task exceeded the task
+// timeout, and nil otherwise.
+func (t *Task) timedOut(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("task '%s' timed out after %v", t.Name, t.Timeout)
+	}
+	return nil
+}
 
-		if m.isRegexpFrom() {
+// fail marks the current run of this task as failed, with err as the last
+// error encountered.
+func (t *Task) fail(err error) {
+	t.failed = true
+	t.lastErr = err
+	// credentials from credential helpers are retrieved anew on the next run
+	if util.IsUnauthorized(err) {
+		t.Source.creds.Reject()
+		for _, l := range t.targets() {
+			l.creds.Reject()
+		}
+	}
+}
 
-			repos, err := t.repoList.Get()
-			if err != nil {
-				return nil, err
-			}
+// renewAuth renews the source credentials and those of target l for sync
+// options opt, after they have been rejected. Credentials that were already
+// renewed by another sync since opt was created are only updated in opt.
+// Returns whether any credentials have changed.
+func (t *Task) renewAuth(l *Location, opt *relays.SyncOptions) (bool,
+	error) {
 
-			for _, r := range m.filterRepos(repos) {
-				ret = append(ret, [2]string{
-					t.Source.Registry + r,
-					t.Target.Registry + m.mapPath(r),
-				})
-			}
+	t.authMu.Lock()
+	defer t.authMu.Unlock()
 
-		} else {
-			ret = append(ret, [2]string{
-				t.Source.Registry + m.From,
-				t.Target.Registry + m.mapPath(m.From),
-			})
+	src, trgt := t.Source.GetAuth(), l.GetAuth()
+	if src == opt.SrcAuth && trgt == opt.TrgtAuth {
+		srcRenewed, err := t.Source.RejectAuth()
+		if err != nil {
+			return false, err
 		}
+		trgtRenewed, err := l.RejectAuth()
+		if err != nil {
+			return false, err
+		}
+		if !srcRenewed && !trgtRenewed {
+			return false, nil
+		}
+		src, trgt = t.Source.GetAuth(), l.GetAuth()
 	}
 
-	return ret, nil
+	opt.SrcAuth, opt.TrgtAuth = src, trgt
+	return true, nil
 }
 
-//
-func (t *Task) ensureTargetExists(ref string) error {
+// mappingRepos returns the source repositories of mapping m. This is either
+// just `from`, or the repositories matching a regex or glob `from`. With
+// `only-active`, only the active ones among them are returned, and the
+// inactive ones separately.
+func (t *Task) mappingRepos(ctx context.Context, m *Mapping) (
+	repos, inactive []string, err error) {
 
-	isEcr, region, account := t.Target.GetECR()
+	if m == nil {
+		return nil, nil, nil
+	}
 
-	if isEcr {
+	if m.isRegexpFrom() {
 
-		_, path, _ := util.SplitRef(ref)
-		if len(path) == 0 {
-			return nil
+		list, err := t.getRepoList()
+		if err != nil {
+			return nil, nil, err
 		}
 
-		sess, err := session.NewSession()
-		if err != nil {
-			return err
+		if repos, err = t.matchingRepos(ctx, list, m); err != nil {
+			return nil, nil, err
+		}
+		if m.hasAWSTags() {
+			if repos, err = t.taggedRepos(ctx, list, m, repos); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := t.checkRepoLimit(m, repos); err != nil {
+			return nil, nil, err
 		}
+		if err := m.checkDestPaths(repos); err != nil {
+			return nil, nil, err
+		}
+		m.warnDestination(repos)
 
-		svc := ecr.New(sess, &aws.Config{
-			Region: aws.String(region),
-		})
+	} else {
+		repos = []string{m.From}
+	}
 
-		inpDescr := &ecr.DescribeRepositoriesInput{
-			RegistryId:      aws.String(account),
-			RepositoryNames: []*string{aws.String(path)},
-		}
+	if m.onlyActive() {
+		return t.activeRepos(ctx, m, repos)
+	}
 
-		out, err := svc.DescribeRepositories(inpDescr)
-		if err == nil && len(out.Repositories) > 0 {
-			log.WithField("ref", ref).Info("target already exists")
-			return nil
-		}
+	return repos, nil, nil
+}
 
-		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok {
-				if aerr.Code() != ecr.ErrCodeRepositoryNotFoundException {
-					return err
-				}
-			} else {
-				return err
+// matchingRepos returns the repositories in list that match the regex or glob
+// `from` of mapping m. They are matched while being listed, so the complete
+// list is not kept in memory for list sources that support streaming, unless
+// it gets cached.
+func (t *Task) matchingRepos(ctx context.Context, list *registry.RepoList,
+	m *Mapping) ([]string, error) {
+
+	var ret []string
+
+	err := t.retry(ctx, func() error {
+
+		ret = nil
+		repos := make(chan string)
+		done := make(chan error, 1)
+
+		go func() {
+			done <- list.Stream(ctx, repos)
+			close(repos)
+		}()
+
+		for r := range repos {
+			if p, ok := m.matchRepo(r); ok {
+				ret = append(ret, p)
 			}
 		}
+		return <-done
+	})
 
-		log.WithField("ref", ref).Info("creating target")
-		inpCrea := &ecr.CreateRepositoryInput{
-			RepositoryName: aws.String(path),
-		}
+	return ret, err
+}
+
+// taggedRepos returns those of repos in list whose AWS resource tags match the
+// AWS tags of mapping m.
+func (t *Task) taggedRepos(ctx context.Context, list *registry.RepoList,
+	m *Mapping, repos []string) ([]string, error) {
 
-		if _, err := svc.CreateRepository(inpCrea); err != nil {
+	ret := make([]string, 0, len(repos))
+
+	for _, r := range repos {
+		var res map[string]string
+		if err := t.retry(ctx, func() error {
+			var err error
+			res, err = list.ResourceTags(ctx, r)
 			return err
+		}); err != nil {
+			return nil, err
+		}
+		if m.matchesAWSTags(res) {
+			ret = append(ret, r)
+		} else {
+			log.WithField("repo", r).Debug(
+				"skipping repository not matching 'aws-tags'")
+		}
+	}
+
+	return ret, nil
+}
+
+// checkRepoLimit checks whether repos, as expanded from the `from` of mapping
+// m, exceed the repo limit that applies to m. If so, an error is returned,
+// unless this task is forced, in which case only a warning is logged.
+func (t *Task) checkRepoLimit(m *Mapping, repos []string) error {
+
+	limit := m.repoLimit(t.maxRepos)
+	if limit == 0 || len(repos) <= limit {
+		return nil
+	}
+
+	if t.force {
+		log.WithFields(log.Fields{"task": t.Name, "mapping": m.From}).Warnf(
+			"mapping matches %d repositories, exceeding limit of %d, "+
+				"syncing anyway since forced", len(repos), limit)
+		return nil
+	}
+
+	return fmt.Errorf("mapping '%s' in task '%s' matches %d repositories, "+
+		"exceeding limit of %d; use -force to sync anyway",
+		m.From, t.Name, len(repos), limit)
+}
+
+// activeRepos returns those of repos to which an image was pushed within the
+// active window of mapping m, and the remaining inactive ones.
+func (t *Task) activeRepos(ctx context.Context, m *Mapping, repos []string) (
+	ret, inactive []string, err error) {
+
+	list, err := t.getRepoList()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ret = make([]string, 0, len(repos))
+
+	for _, r := range repos {
+		last, err := list.LastPushed(ctx, r)
+		if errors.Is(err, registry.ErrPushTimeUnknown) {
+			log.WithField("repo", r).Warn("push time not known, " +
+				"only checked that repository has images for 'only-active'")
+			ret = append(ret, r)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if m.isActive(last) {
+			ret = append(ret, r)
+		} else {
+			log.WithField("repo", r).Info("skipping inactive repository")
+			inactive = append(inactive, r)
+		}
+	}
+
+	return ret, inactive, nil
+}
+
+// tagLister returns a function for listing the tags of source reference ref
+// via the task's list source, if that supports native tag listing. Otherwise
+// nil is returned, and relays fall back to their own means. With withTimes
+// set, push times are retrieved even if that takes extra requests.
+func (t *Task) tagLister(ctx context.Context, ref string,
+	withTimes bool) func() ([]tags.Tag, error) {
+
+	list, err := t.getRepoList()
+	if err != nil {
+		log.Debugf("no native tag listing, using relay: %v", err)
+		return nil
+	}
+
+	if !list.CanListTags() {
+		return nil
+	}
+
+	return func() ([]tags.Tag, error) {
+		// list sources are not safe for concurrent use
+		t.listMu.Lock()
+		defer t.listMu.Unlock()
+		_, path, _ := util.SplitRef(ref)
+		var ret []tags.Tag
+		err := t.retry(ctx, func() error {
+			var err error
+			if withTimes {
+				ret, err = list.ListTimedTags(ctx, path)
+			} else {
+				ret, err = list.ListTags(ctx, path)
+			}
+			return err
+		})
+		return ret, err
+	}
+}
+
+// retainedLister wraps tag lister l for source reference src so that it drops
+// the tags which the lifecycle policy of the source repository would expire,
+// if mapping m asks for that. Otherwise, l is returned as is.
+func (t *Task) retainedLister(ctx context.Context, m *Mapping, src string,
+	l func() ([]tags.Tag, error)) func() ([]tags.Tag, error) {
+
+	if !m.AWSLifecycle {
+		return l
+	}
+
+	if l == nil {
+		l = t.sourceLister(ctx, src, m.tagSet.NeedsPushTimes())
+	}
+
+	return func() ([]tags.Tag, error) {
+
+		list, err := t.getRepoList()
+		if err != nil {
+			return nil, err
+		}
+
+		all, err := l()
+		if err != nil {
+			return nil, err
+		}
+
+		_, path, _ := util.SplitRef(src)
+		var expiring []string
+		// list sources are not safe for concurrent use
+		t.listMu.Lock()
+		err = t.retry(ctx, func() error {
+			var err error
+			expiring, err = list.ExpiringTags(ctx, path)
+			return err
+		})
+		t.listMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		drop := make(map[string]bool, len(expiring))
+		for _, tag := range expiring {
+			drop[tag] = true
+		}
+
+		ret := make([]tags.Tag, 0, len(all))
+		for _, tag := range all {
+			if !drop[tag.Name] {
+				ret = append(ret, tag)
+			}
+		}
+
+		if len(ret) < len(all) {
+			log.WithField("repo", src).Infof("skipping %d tags expired by "+
+				"lifecycle policy", len(all)-len(ret))
+		}
+
+		return ret, nil
+	}
+}
+
+// isWarmingUp determines whether the next run of this task is its warm-up run,
+// i.e. the first one to complete since the task was set to warm up. When the
+// state cannot be read, the run is a warm-up run, so that nothing gets missed.
+func (t *Task) isWarmingUp() bool {
+
+	if !t.WarmUp || t.state == nil {
+		return false
+	}
+
+	done, err := t.state.warmedUp(t.Name)
+	if err != nil {
+		log.WithField("task", t.Name).Errorf(
+			"cannot determine whether task is warmed up: %v", err)
+		return true
+	}
+	return !done
+}
+
+// listOnce wraps tag lister l so that tags are only listed on the first call,
+// and later calls get the same result. This way, the tags of a source image
+// synced to several targets are listed only once. If l is nil, nil is
+// returned.
+func listOnce(l func() ([]tags.Tag, error)) func() ([]tags.Tag, error) {
+
+	if l == nil {
+		return nil
+	}
+
+	var once gosync.Once
+	var ret []tags.Tag
+	var err error
+
+	return func() ([]tags.Tag, error) {
+		once.Do(func() { ret, err = l() })
+		// each caller gets its own copy, since relays may reorder the tags
+		return append([]tags.Tag(nil), ret...), err
+	}
+}
+
+// layoutLister returns a function for listing the tags of the images in local
+// layout lo.
+func layoutLister(lo *layout.Layout) func() ([]tags.Tag, error) {
+	return func() ([]tags.Tag, error) {
+		names, err := lo.Tags()
+		if err != nil {
+			return nil, err
+		}
+		return tags.FromNames(names), nil
+	}
+}
+
+// referrers returns a function for finding the signatures, attestations, and
+// SBOMs of a source image, if mapping m copies signatures. Otherwise, nil is
+// returned.
+func (t *Task) referrers(ctx context.Context, m *Mapping) func(string) (
+	[]string, error) {
+
+	if !m.CopySignatures {
+		return nil
+	}
+
+	return func(ref string) ([]string, error) {
+		var ret []string
+		err := t.retry(ctx, func() error {
+			var err error
+			ret, err = registry.FindReferrers(ctx,
+				ref, t.Source.creds, t.Source.transport)
+			return err
+		})
+		return ret, err
+	}
+}
+
+// unchanged returns a function for checking whether source image and target
+// image in registry l have the same digest, if mapping m skips existing
+// images. Otherwise, nil is returned. During a warm-up run, no image counts as
+// unchanged. Tags that m does not declare mutable only need to be present in
+// the target. Only the source lookup is retried, since a missing target image
+// is the common case when the image has not been synced yet.
+func (t *Task) unchanged(ctx context.Context, m *Mapping,
+	l *Location) func(src, trgt string) (bool, error) {
+
+	if !m.SkipExisting {
+		return nil
+	}
+
+	// a warm-up run copies everything, for a complete mirror; images still
+	// get copied as is, so that later runs find the same digests
+	if t.warming {
+		return func(src, trgt string) (bool, error) {
+			return false, nil
+		}
+	}
+
+	return func(src, trgt string) (bool, error) {
+		if _, _, tag := util.SplitRef(src); !m.isMutable(tag) {
+			_, err := registry.ManifestDigest(ctx, trgt, l.creds, l.transport)
+			return err == nil, err
+		}
+		var srcDigest string
+		if err := t.retry(ctx, func() error {
+			var err error
+			srcDigest, err = registry.ManifestDigest(ctx,
+				src, t.Source.creds, t.Source.transport)
+			return err
+		}); err != nil {
+			return false, err
+		}
+		trgtDigest, err := registry.ManifestDigest(ctx,
+			trgt, l.creds, l.transport)
+		if err != nil {
+			return false, err
+		}
+		return srcDigest == trgtDigest, nil
+	}
+}
+
+// verifier returns a function for verifying that a target image in registry l
+// has the same digest as its source image, and contains all the platform
+// manifests of the source, if mapping m verifies copies. Otherwise, nil is
+// returned.
+func (t *Task) verifier(ctx context.Context, m *Mapping,
+	l *Location) func(src, trgt string) error {
+
+	if !m.Verify {
+		return nil
+	}
+
+	return func(src, trgt string) error {
+		var want []string
+		if err := t.retry(ctx, func() error {
+			var err error
+			want, err = registry.ManifestDigests(ctx,
+				src, t.Source.creds, t.Source.transport)
+			return err
+		}); err != nil {
+			return fmt.Errorf("cannot verify copy of '%s': %v", src, err)
+		}
+		return registry.VerifyDigests(ctx, trgt, want, l.creds, l.transport)
+	}
+}
+
+// pruner returns a function for deleting the tags that mapping m no longer
+// syncs from target reference trgt in registry l, if m prunes. Otherwise, nil
+// is returned. These are the source tags listed by lister that were pushed
+// before `since`, or with inactive set, all matching tags of a repository that
+// is not active anymore. Nothing gets deleted when listing the source tags
+// fails, so that a transient error cannot wipe the target.
+func (t *Task) pruner(ctx context.Context, m *Mapping, l *Location,
+	trgt string, lister func() ([]tags.Tag, error),
+	inactive bool) func() error {
+
+	if !m.Prune || lister == nil {
+		return nil
+	}
+
+	return func() error {
+
+		list, err := lister()
+		if err != nil {
+			return fmt.Errorf(
+				"not pruning '%s', cannot list source tags: %v", trgt, err)
+		}
+
+		var stale []string
+		if inactive {
+			for _, tag := range list {
+				if m.tagSet.Matches(tag.Name) {
+					stale = append(stale, m.mapTag(tag.Name))
+				}
+			}
+		} else {
+			for _, tag := range m.tagSet.Expired(list) {
+				stale = append(stale, m.mapTag(tag))
+			}
+		}
+
+		pruned, err := registry.PruneTags(ctx, trgt, stale, l.creds,
+			l.transport)
+		if len(pruned) > 0 {
+			log.WithFields(log.Fields{"task": t.Name, "target": trgt}).Infof(
+				"pruned tags %v", pruned)
+		}
+		if err != nil {
+			return fmt.Errorf("error pruning '%s': %v", trgt, err)
+		}
+		return nil
+	}
+}
+
+// digestChecker returns a function for checking that a target image in
+// registry l has the same digest as its source image, if mapping m preserves
+// digests. Otherwise, nil is returned.
+func (t *Task) digestChecker(ctx context.Context, m *Mapping,
+	l *Location) func(src, trgt string) error {
+
+	if !m.PreserveDigests {
+		return nil
+	}
+
+	return func(src, trgt string) error {
+		var want string
+		if err := t.retry(ctx, func() error {
+			var err error
+			want, err = registry.ManifestDigest(ctx,
+				src, t.Source.creds, t.Source.transport)
+			return err
+		}); err != nil {
+			return fmt.Errorf("cannot check digest of '%s': %v", trgt, err)
+		}
+		got, err := registry.ManifestDigest(ctx, trgt, l.creds, l.transport)
+		if err != nil {
+			return fmt.Errorf("cannot check digest of '%s': %v", trgt, err)
+		}
+		if got != want {
+			return fmt.Errorf("digest of '%s' was not preserved: expected "+
+				"%s, got %s", trgt, want, got)
+		}
+		return nil
+	}
+}
+
+// platformChecker returns a function for checking whether a source image
+// provides the platforms selected by mapping m, or nil if m selects none, or
+// reads from a local layout. A source image providing only some of several
+// selected platforms passes, and just those get synced. When none are
+// provided, the image is skipped, unless m is set to fail for missing
+// platforms. In that case, any missing platform is an error. OCI artifacts
+// other than container images always pass.
+func (t *Task) platformChecker(ctx context.Context,
+	m *Mapping) func(src string) (bool, error) {
+
+	want := m.selectedPlatforms()
+	if want == nil || m.isLocal() {
+		return nil
+	}
+
+	return func(src string) (bool, error) {
+
+		var have []string
+		if err := t.retry(ctx, func() error {
+			var err error
+			have, err = registry.ImagePlatforms(ctx,
+				src, t.Source.creds, t.Source.transport)
+			return err
+		}); err != nil {
+			return false, fmt.Errorf(
+				"cannot determine platforms of '%s': %v", src, err)
+		}
+
+		// platforms do not apply to artifacts other than container images
+		if have == nil {
+			return true, nil
+		}
+
+		var missing []string
+		for _, w := range want {
+			found := false
+			for _, h := range have {
+				if util.MatchPlatform(w, h) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = append(missing, w)
+			}
+		}
+
+		if len(missing) > 0 && m.PlatformMissing == PlatformMissingFail {
+			return false, fmt.Errorf(
+				"source image '%s' lacks platforms %v", src, missing)
+		}
+		return len(missing) < len(want), nil
+	}
+}
+
+// artifactChecker returns a function for checking whether a source image is of
+// an artifact type selected by mapping m, or nil if m selects all types.
+func (t *Task) artifactChecker(ctx context.Context,
+	m *Mapping) func(src string) (bool, error) {
+
+	if len(m.ArtifactTypes) == 0 {
+		return nil
+	}
+
+	return func(src string) (bool, error) {
+		var typ string
+		if err := t.retry(ctx, func() error {
+			var err error
+			typ, err = registry.ArtifactType(ctx,
+				src, t.Source.creds, t.Source.transport)
+			return err
+		}); err != nil {
+			return false, fmt.Errorf(
+				"cannot determine artifact type of '%s': %v", src, err)
+		}
+		return m.matchesArtifactType(typ), nil
+	}
+}
+
+// manifestTypeChecker returns a function for checking whether a source image
+// is of the manifest type selected by mapping m, or nil if m selects any type.
+func (t *Task) manifestTypeChecker(ctx context.Context,
+	m *Mapping) func(src string) (bool, error) {
+
+	if !m.matchesOnManifestType() {
+		return nil
+	}
+
+	return func(src string) (bool, error) {
+		var index bool
+		if err := t.retry(ctx, func() error {
+			var err error
+			index, err = registry.IsImageIndex(ctx,
+				src, t.Source.creds, t.Source.transport)
+			return err
+		}); err != nil {
+			return false, fmt.Errorf(
+				"cannot determine manifest type of '%s': %v", src, err)
+		}
+		return m.matchesManifestType(index), nil
+	}
+}
+
+// metadataChecker returns a function for checking whether a source image has
+// the labels and annotations selected by mapping m, or nil if m does not select
+// images by them. Labels and annotations are cached by digest across runs.
+func (t *Task) metadataChecker(ctx context.Context,
+	m *Mapping) func(src string) (bool, error) {
+
+	if !m.matchesOnMetadata() {
+		return nil
+	}
+
+	if t.metadata == nil {
+		t.metadata = newMetadataCache()
+	}
+
+	return func(src string) (bool, error) {
+		var md *imageMetadata
+		if err := t.retry(ctx, func() error {
+			var err error
+			md, err = t.metadata.get(ctx, src, t.Source)
+			return err
+		}); err != nil {
+			return false, fmt.Errorf("cannot determine labels and "+
+				"annotations of '%s': %v", src, err)
+		}
+		return m.matchesMetadata(md.labels, md.annotations), nil
+	}
+}
+
+// preflight checks that the source and target registries of this task can be
+// reached, and accept the configured credentials, so that a broken setup is
+// detected before anything gets synced. For the source, the repo list is also
+// checked when the task uses one. The source is not checked when all mappings
+// read from local layouts.
+func (t *Task) preflight(ctx context.Context) error {
+
+	if !t.onlyLocal() {
+		s := t.Source
+		if err := t.retryPing(ctx, func() error {
+			return registry.Ping(ctx, s.Registry, s.creds, s.transport)
+		}); err != nil {
+			return fmt.Errorf(
+				"preflight check of source registry '%s' failed: %w",
+				s.Registry, err)
+		}
+		if t.repoList != nil {
+			if err := t.retryPing(ctx, func() error {
+				return t.repoList.Ping(ctx)
+			}); err != nil {
+				return fmt.Errorf(
+					"preflight check of repo list for source registry '%s' "+
+						"failed: %w", s.Registry, err)
+			}
+		}
+	}
+
+	for _, l := range t.targets() {
+		if t.onlyArchived() && l.Registry == "" {
+			continue
+		}
+		if err := t.retryPing(ctx, func() error {
+			return registry.Ping(ctx, l.Registry, l.creds, l.transport)
+		}); err != nil {
+			return fmt.Errorf(
+				"preflight check of target registry '%s' failed: %w",
+				l.Registry, err)
+		}
+	}
+
+	return nil
+}
+
+// retryPing runs preflight check op with the retry settings of this task.
+// Only connectivity and throttling failures are retried, so that a task with
+// wrong credentials fails right away.
+func (t *Task) retryPing(ctx context.Context, op func() error) error {
+	return util.Retry(t.Retries, t.RetryInterval, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return op()
+	})
+}
+
+// progressReporter returns the function relays call with the number of layer
+// bytes transferred, for recording them in the metrics of this task.
+func (t *Task) progressReporter() func(int64) {
+	return func(n int64) {
+		metrics.BytesTransferred(t.Name, n)
+	}
+}
+
+// copiedReporter returns the callback for images the relay copied to target l,
+// which counts them against the budget of the current run, and adds them to
+// its report. Image sizes are only determined when the budget limits bytes,
+// or for the report, which also gets the digests. Without budget and report,
+// nil is returned.
+func (t *Task) copiedReporter(ctx context.Context,
+	l *Location) func(string, string, time.Duration) {
+
+	b, rep := t.budget, t.report
+	if b == nil && rep == nil {
+		return nil
+	}
+
+	return func(src, trgt string, d time.Duration) {
+
+		flog := log.WithFields(log.Fields{"task": t.Name, "ref": trgt})
+
+		var size int64
+		if (b != nil && b.maxBytes > 0) || rep != nil {
+			var err error
+			if size, err = registry.ImageSize(
+				ctx, trgt, l.creds, l.transport); err != nil {
+				flog.Warnf("cannot determine image size: %v", err)
+			}
+		}
+		b.copied(size)
+
+		if rep != nil {
+			item := &ReportItem{Source: src, Target: trgt, Size: size,
+				Duration: d.Seconds(), Result: ReportCopied}
+			digest, err := registry.ManifestDigest(
+				ctx, trgt, l.creds, l.transport)
+			if err != nil {
+				flog.Warnf("cannot determine image digest for report: %v", err)
+			}
+			item.Digest = digest
+			rep.add(item)
+		}
+	}
+}
+
+// resumeJobs removes those of jobs that were already synced by previous runs
+// which used up their budget, so that the next run resumes where they stopped.
+// Returns the remaining jobs, and the number of removed ones.
+func (t *Task) resumeJobs(jobs []*syncJob) ([]*syncJob, int) {
+
+	if len(t.synced) == 0 {
+		return jobs, 0
+	}
+
+	var ret []*syncJob
+	for _, j := range jobs {
+		if !t.synced[jobKey(j)] {
+			ret = append(ret, j)
+		}
+	}
+	return ret, len(jobs) - len(ret)
+}
+
+// tagThrottle returns the function relays wait for before each request they
+// make to the source registry, i.e. before syncing each tag of a repository,
+// and before listing tags. Each of these counts against the rate limit of the
+// source registry, whether tags are synced in parallel or not.
+func (t *Task) tagThrottle() func() {
+	return t.Source.limiter.Wait
+}
+
+// retry runs op with the retry settings of this task. Each attempt counts
+// against the rate limit of the source registry. There are no further attempts
+// once ctx is done.
+func (t *Task) retry(ctx context.Context, op func() error) error {
+	return util.Retry(t.Retries, t.RetryInterval, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t.Source.limiter.Wait()
+		return op()
+	})
+}
+
+// copyRetrier returns the function with which the relays retry each single
+// copy, with the retry settings of this task. Attempts are not counted against
+// the rate limit of the source registry here, since the relays wait for it
+// themselves. There are no further attempts once ctx is done.
+func (t *Task) copyRetrier(ctx context.Context) func(op func() error) error {
+	return func(op func() error) error {
+		return util.Retry(t.Retries, t.RetryInterval, func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return op()
+		})
+	}
+}
+
+// expandTags expands the tag set of mapping m for source reference src, in the
+// same way as the relays do.
+func (t *Task) expandTags(ctx context.Context, m *Mapping, src string) (
+	[]string, error) {
+
+	if m.isLocal() {
+		lo, err := layout.New(m.From)
+		if err != nil {
+			return nil, err
+		}
+		tags, err := m.tagSet.Expand(layoutLister(lo))
+		if err != nil {
+			return nil, fmt.Errorf("error expanding tags: %v", err)
+		}
+		return tags, nil
+	}
+
+	tags, err := m.tagSet.Expand(t.retainedLister(ctx, m, src,
+		t.sourceLister(ctx, src, m.tagSet.NeedsPushTimes())))
+	if err != nil {
+		return nil, fmt.Errorf("error expanding tags: %v", err)
+	}
+	return tags, nil
+}
+
+// sourceLister returns a function for listing the tags of source reference
+// src, with the task's list source if that supports native tag listing, or
+// with skopeo otherwise. withTimes requests push times from the list source.
+func (t *Task) sourceLister(ctx context.Context, src string,
+	withTimes bool) func() ([]tags.Tag, error) {
+
+	certDir := ""
+	if repo, _, _ := util.SplitRef(src); repo != "" {
+		certDir = skopeo.CertsDirForRepo(repo)
+	}
+
+	opt := &relays.SyncOptions{
+		TagLister: t.tagLister(ctx, src, withTimes)}
+	return opt.Lister(func() ([]string, error) {
+		t.Source.limiter.Wait()
+		return skopeo.ListAllTags(ctx, src,
+			util.DecodeJSONAuth(t.Source.GetAuth()), certDir,
+			t.Source.SkipTLSVerify)
+	})
+}
+
+// probeTarget fills in the findings of a deep dry run for dry run item in
+// registry l, which is a target of mapping m: whether the target repository
+// exists, whether it would get created, and whether the image would be skipped
+// as unchanged. repos caches the existence of target repositories across
+// items. Only read-only requests are made.
+func (t *Task) probeTarget(ctx context.Context, m *Mapping, l *Location,
+	item *DryRunItem, repos map[string]bool) error {
+
+	exists, ok := repos[item.Target]
+	if !ok {
+		var err error
+		if exists, err = registry.RepoExists(ctx, item.Target, l.creds,
+			l.transport); err != nil {
+			return err
+		}
+		repos[item.Target] = exists
+	}
+	item.TargetExists = &exists
+
+	if !exists {
+		isEcr, _, _ := l.GetECR()
+		item.AutoCreate = isEcr && l.autoCreate()
+		return nil
+	}
+
+	unchanged := t.unchanged(ctx, m, l)
+	if unchanged == nil {
+		return nil
+	}
+
+	var src, trgt string
+	switch {
+	case item.Digest != "" && item.TargetTag != "":
+		src = fmt.Sprintf("%s@%s", item.Source, item.Digest)
+		trgt = fmt.Sprintf("%s:%s", item.Target, item.TargetTag)
+	case item.Digest != "":
+		src = fmt.Sprintf("%s@%s", item.Source, item.Digest)
+		trgt = fmt.Sprintf("%s@%s", item.Target, item.Digest)
+	default:
+		tag := item.Tag
+		if item.TargetTag != "" {
+			tag = item.TargetTag
+		}
+		src = fmt.Sprintf("%s:%s", item.Source, item.Tag)
+		trgt = fmt.Sprintf("%s:%s", item.Target, tag)
+	}
+
+	// like when syncing, images whose digests cannot be compared count as
+	// changed
+	same, err := unchanged(src, trgt)
+	item.Unchanged = err == nil && same
+	return nil
+}
+
+// ensureTargetExists creates the repository for target reference ref in
+// registry l, if that is an ECR registry with 'auto-create', and the repository
+// does not exist yet.
+func (t *Task) ensureTargetExists(ctx context.Context, l *Location,
+	ref string) error {
+
+	isEcr, region, account := l.GetECR()
+	if !isEcr || !l.autoCreate() {
+		return nil
+	}
+
+	_, path, _ := util.SplitRef(ref)
+	if len(path) == 0 {
+		return nil
+	}
+
+	sess, err := auth.NewAWSSession(region, l.AWSRole(), l.transport)
+	if err != nil {
+		return err
+	}
+
+	return createECRRepo(ctx, ecr.New(sess), account, path, ref,
+		l.ECRRepository)
+}
+
+// createECRRepo creates repository path in the ECR registry of account with
+// settings conf, unless it exists already. ref is the target reference, for
+// logging. A repository that was created concurrently in the meantime does not
+// count as an error.
+func createECRRepo(ctx context.Context, svc ecriface.ECRAPI, account, path,
+	ref string, conf *ECRRepository) error {
+
+	inpDescr := &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(account),
+		RepositoryNames: []*string{aws.String(path)},
+	}
+
+	out, err := svc.DescribeRepositoriesWithContext(ctx, inpDescr)
+	if err == nil && len(out.Repositories) > 0 {
+		log.WithField("ref", ref).Info("target already exists")
+		return nil
+	}
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			if aerr.Code() != ecr.ErrCodeRepositoryNotFoundException {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	log.WithField("ref", ref).Info("creating target")
+	inpCrea := &ecr.CreateRepositoryInput{
+		RepositoryName: aws.String(path),
+	}
+
+	if conf != nil {
+		inpCrea.ImageScanningConfiguration = &ecr.ImageScanningConfiguration{
+			ScanOnPush: aws.Bool(conf.ScanOnPush),
+		}
+		if conf.TagImmutability {
+			inpCrea.ImageTagMutability = aws.String(
+				ecr.ImageTagMutabilityImmutable)
+		}
+		if conf.Encryption != "" {
+			inpCrea.EncryptionConfiguration = &ecr.EncryptionConfiguration{
+				EncryptionType: aws.String(conf.Encryption),
+			}
+			if conf.KMSKey != "" {
+				inpCrea.EncryptionConfiguration.KmsKey = aws.String(conf.KMSKey)
+			}
+		}
+	}
+
+	if _, err := svc.CreateRepositoryWithContext(ctx, inpCrea); err != nil {
+		if aerr, ok := err.(awserr.Error); ok &&
+			aerr.Code() == ecr.ErrCodeRepositoryAlreadyExistsException {
+			log.WithField("ref", ref).Info("target was created meanwhile")
+			return nil
 		}
+		return err
 	}
 
 	return nil
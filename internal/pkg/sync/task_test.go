@@ -0,0 +1,803 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/relays"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestTagLister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryTagLister(th, "config/source-ecr-public.yaml",
+		"public.ecr.aws/my-alias/busybox", true)
+	tryTagLister(th, "config/source-ecr.yaml",
+		"123456789012.dkr.ecr.eu-central-1.amazonaws.com/library/busybox",
+		true)
+	tryTagLister(th, "config/source-ecr-unused-lister.yaml",
+		"123456789012.dkr.ecr.eu-central-1.amazonaws.com/library/busybox",
+		false)
+	tryTagLister(th, "config/source-artifactory.yaml",
+		"acme.jfrog.io/docker-local/busybox", true)
+	tryTagLister(th, "config/source-quay.yaml", "quay.io/acme/web", true)
+	tryTagLister(th, "config/source-harbor.yaml",
+		"harbor.example.com/team-a/web", true)
+	tryTagLister(th, "config/source-gitlab.yaml",
+		"registry.gitlab.com/acme/infra/web", true)
+	tryTagLister(th, "config/skopeo-valid.yaml",
+		"registry.hub.docker.com/library/busybox", false)
+}
+
+//
+func TestListOnce(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNil(listOnce(nil))
+
+	calls := 0
+	l := listOnce(func() ([]tags.Tag, error) {
+		calls++
+		return tags.FromNames([]string{"1.0", "2.0"}), nil
+	})
+
+	first, err := l()
+	th.AssertNoError(err)
+	first[0] = tags.Tag{Name: "changed"}
+
+	second, err := l()
+	th.AssertNoError(err)
+	th.AssertEqual(1, calls)
+	th.AssertEqual("1.0", second[0].Name)
+	th.AssertEqual(2, len(second))
+}
+
+//
+func TestSchedule(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	c, e := LoadConfig(th.GetFixture("config/task-cron.yaml"))
+	th.AssertNoError(e)
+
+	nightly := c.Tasks[0]
+	th.AssertTrue(nightly.isPeriodic())
+	th.AssertFalse(c.Tasks[1].isPeriodic())
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	th.AssertNoError(err)
+
+	// Friday evening in Berlin, next run is Monday 02:00 Berlin time
+	from := time.Date(2022, 6, 3, 22, 0, 0, 0, berlin)
+	next := nightly.nextRun(from.UTC())
+	th.AssertTrue(time.Date(2022, 6, 6, 2, 0, 0, 0, berlin).Equal(next))
+
+	// Tuesday 01:59 Berlin time is 23:59 UTC on Monday
+	from = time.Date(2022, 6, 6, 23, 59, 0, 0, time.UTC)
+	next = nightly.nextRun(from)
+	th.AssertTrue(time.Date(2022, 6, 7, 0, 0, 0, 0, time.UTC).Equal(next))
+}
+
+//
+func TestJitter(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	delays := func() ([5]time.Duration, [5]time.Duration) {
+		c, e := LoadConfig(th.GetFixture("config/task-jitter.yaml"))
+		th.AssertNoError(e)
+		var ret [2][5]time.Duration
+		for ix, t := range c.Tasks {
+			t.initJitter()
+			for i := range ret[ix] {
+				d := t.jitterDelay()
+				th.AssertTrue(0 <= d && d <= 30*time.Second)
+				ret[ix][i] = d
+			}
+		}
+		return ret[0], ret[1]
+	}
+
+	// same seed and task name give same delays, different names do not
+	a1, b1 := delays()
+	a2, b2 := delays()
+	th.AssertEqual(a1, a2)
+	th.AssertEqual(b1, b2)
+	th.AssertNotEqual(a1, b1)
+
+	// no jitter
+	none := &Task{Name: "none"}
+	none.initJitter()
+	th.AssertEqual(time.Duration(0), none.jitterDelay())
+}
+
+//
+func TestResumeDelay(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	st := newState(filepath.Join(t.TempDir(), "state.json"))
+	task := &Task{Name: "test", Interval: 600, state: st}
+
+	// no previous run
+	th.AssertEqual(time.Duration(0), task.resumeDelay())
+
+	th.AssertNoError(st.setLastRun("test", time.Now().Add(-4*time.Minute),
+		metrics.ResultFailure))
+	d := task.resumeDelay()
+	th.AssertTrue(5*time.Minute < d && d <= 6*time.Minute)
+
+	ts, err := st.get("test")
+	th.AssertNoError(err)
+	th.AssertEqual(metrics.ResultFailure, ts.LastResult)
+	th.AssertNil(ts.LastSuccess)
+
+	th.AssertNoError(st.setLastRun("test", time.Now().Add(-time.Hour),
+		metrics.ResultSuccess))
+	th.AssertEqual(time.Duration(0), task.resumeDelay())
+	ts, err = st.get("test")
+	th.AssertNoError(err)
+	th.AssertNotNil(ts.LastSuccess)
+
+	// other tasks are not affected, nor are tasks without interval
+	th.AssertEqual(time.Duration(0),
+		(&Task{Name: "other", Interval: 600, state: st}).resumeDelay())
+	task.Interval = 0
+	th.AssertEqual(time.Duration(0), task.resumeDelay())
+}
+
+//
+func TestPruner(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	c, e := LoadConfig(th.GetFixture("config/mapping-prune.yaml"))
+	th.AssertNoError(e)
+	task := c.Tasks[0]
+	m := task.Mappings[0]
+	l := task.Target
+	ctx := context.Background()
+	trgt := l.Registry + "/library/busybox"
+
+	listed := 0
+	lister := func() ([]tags.Tag, error) {
+		listed++
+		return []tags.Tag{{Name: "1.0", Pushed: time.Now()}}, nil
+	}
+
+	th.AssertNil(task.pruner(ctx, m, l, trgt, nil, false))
+
+	// nothing expired, so target is not contacted
+	p := task.pruner(ctx, m, l, trgt, lister, false)
+	th.AssertNotNil(p)
+	th.AssertNoError(p())
+	th.AssertEqual(1, listed)
+
+	// source listing fails
+	p = task.pruner(ctx, m, l, trgt, func() ([]tags.Tag, error) {
+		return nil, errors.New("throttled")
+	}, true)
+	th.AssertError(p(), "not pruning 'localhost:5000/library/busybox', "+
+		"cannot list source tags: throttled")
+
+	m.Prune = false
+	th.AssertNil(task.pruner(ctx, m, l, trgt, lister, false))
+}
+
+//
+func TestDigestChecker(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	digests := map[string]string{
+		"1.0": "sha256:" + strings.Repeat("a", 64),
+		"1.1": "sha256:" + strings.Repeat("a", 64),
+		"2.0": "sha256:" + strings.Repeat("b", 64),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			d, ok := digests[path.Base(r.URL.Path)]
+			if r.URL.Path != "/v2/" && !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type",
+				"application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", d)
+			w.Header().Set("Content-Length", "2")
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: %s
+  target:
+    registry: %s
+  mappings:
+  - from: app
+    preserve-digests: true
+`, host, host)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	task := c.Tasks[0]
+	m := task.Mappings[0]
+	ctx := context.Background()
+
+	check := task.digestChecker(ctx, m, task.Target)
+	th.AssertNotNil(check)
+	th.AssertNoError(check(host+"/app:1.0", host+"/app:1.1"))
+	th.AssertError(check(host+"/app:1.0", host+"/app:2.0"),
+		"was not preserved: expected "+digests["1.0"])
+	th.AssertError(check(host+"/app:1.0", host+"/app:3.0"),
+		"cannot check digest of '"+host+"/app:3.0'")
+
+	m.PreserveDigests = false
+	th.AssertNil(task.digestChecker(ctx, m, task.Target))
+}
+
+//
+func TestUnchanged(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	a, b := "sha256:"+strings.Repeat("a", 64), "sha256:"+strings.Repeat("b", 64)
+	digests := map[string]string{
+		"/v2/src/manifests/latest": a, "/v2/dst/manifests/latest": b,
+		"/v2/src/manifests/1.0": a, "/v2/dst/manifests/1.0": b,
+		"/v2/src/manifests/edge": b, "/v2/dst/manifests/edge": b,
+		"/v2/src/manifests/2.0": a,
+	}
+	var mu gosync.Mutex
+	var lookups []string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			d, ok := digests[r.URL.Path]
+			if r.URL.Path != "/v2/" && !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if ok {
+				mu.Lock()
+				lookups = append(lookups, r.URL.Path)
+				mu.Unlock()
+			}
+			w.Header().Set("Content-Type",
+				"application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", d)
+			w.Header().Set("Content-Length", "2")
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: %s
+  target:
+    registry: %s
+  mappings:
+  - from: src
+    to: dst
+    skip-existing: true
+    mutable-tags: ['regex: ^ed.*']
+`, host, host)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	task := c.Tasks[0]
+	m := task.Mappings[0]
+	unchanged := task.unchanged(context.Background(), m, task.Target)
+	th.AssertNotNil(unchanged)
+
+	try := func(tag string, want bool, lookedUp ...string) {
+		lookups = nil
+		same, _ := unchanged(host+"/src:"+tag, host+"/dst:"+tag)
+		th.AssertEqual(want, same)
+		th.AssertEqualSlices(lookedUp, lookups)
+	}
+
+	// mutable tags are compared by digest, latest is always mutable
+	try("latest", false,
+		"/v2/src/manifests/latest", "/v2/dst/manifests/latest")
+	try("edge", true, "/v2/src/manifests/edge", "/v2/dst/manifests/edge")
+
+	// other tags only need to exist in the target
+	try("1.0", true, "/v2/dst/manifests/1.0")
+	try("2.0", false)
+
+	// without 'mutable-tags', all tags are compared by digest
+	m.mutableTags = nil
+	try("1.0", false, "/v2/src/manifests/1.0", "/v2/dst/manifests/1.0")
+}
+
+//
+func TestPlatformChecker(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	index := func(platforms ...string) string {
+		var descs []string
+		for _, p := range platforms {
+			parts := strings.Split(p, "/")
+			descs = append(descs, fmt.Sprintf(`{"mediaType":`+
+				`"application/vnd.oci.image.manifest.v1+json","digest":`+
+				`"sha256:%s","size":2,"platform":{"os":"%s",`+
+				`"architecture":"%s"}}`,
+				strings.Repeat("a", 64), parts[0], parts[1]))
+		}
+		return fmt.Sprintf(`{"schemaVersion":2,"mediaType":`+
+			`"application/vnd.oci.image.index.v1+json","manifests":[%s]}`,
+			strings.Join(descs, ","))
+	}
+	manifests := map[string]string{
+		"multi": index("linux/amd64", "linux/arm64"),
+		"amd64": index("linux/amd64"),
+		"chart": `{"schemaVersion":2,"config":{"mediaType":` +
+			`"application/vnd.cncf.helm.config.v1+json"}}`,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			m, ok := manifests[path.Base(r.URL.Path)]
+			if r.URL.Path != "/v2/" && !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type",
+				"application/vnd.oci.image.index.v1+json")
+			w.Header().Set("Docker-Content-Digest",
+				fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(m))))
+			w.Write([]byte(m))
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: %s
+  target:
+    registry: %s
+  mappings:
+  - from: app
+    platform: linux/arm64
+`, host, host)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	task := c.Tasks[0]
+	m := task.Mappings[0]
+	ctx := context.Background()
+
+	check := task.platformChecker(ctx, m)
+	th.AssertNotNil(check)
+	ok, err := check(host + "/app:multi")
+	th.AssertNoError(err)
+	th.AssertTrue(ok)
+	ok, err = check(host + "/app:amd64")
+	th.AssertNoError(err)
+	th.AssertFalse(ok)
+	_, err = check(host + "/app:missing")
+	th.AssertError(err, "cannot determine platforms")
+
+	// platforms do not apply to artifacts other than container images
+	ok, err = check(host + "/app:chart")
+	th.AssertNoError(err)
+	th.AssertTrue(ok)
+
+	m.PlatformMissing = PlatformMissingFail
+	_, err = check(host + "/app:amd64")
+	th.AssertError(err, "lacks platforms [linux/arm64]")
+
+	// only some of multiple platforms present
+	m.Platform = ""
+	m.Platforms = []string{"linux/amd64", "linux/arm64"}
+	check = task.platformChecker(ctx, m)
+	_, err = check(host + "/app:amd64")
+	th.AssertError(err, "lacks platforms [linux/arm64]")
+	m.PlatformMissing = PlatformMissingSkip
+	ok, err = check(host + "/app:amd64")
+	th.AssertNoError(err)
+	th.AssertTrue(ok)
+
+	m.Platforms = nil
+	m.Platform = "all"
+	th.AssertNil(task.platformChecker(ctx, m))
+
+	th.AssertNil(task.artifactChecker(ctx, m))
+
+	m.ArtifactTypes = []string{"application/vnd.cncf.helm.config.v1+json"}
+	check = task.artifactChecker(ctx, m)
+	th.AssertNotNil(check)
+	ok, err = check(host + "/app:chart")
+	th.AssertNoError(err)
+	th.AssertTrue(ok)
+	ok, err = check(host + "/app:multi")
+	th.AssertNoError(err)
+	th.AssertFalse(ok)
+	_, err = check(host + "/app:missing")
+	th.AssertError(err, "cannot determine artifact type")
+
+	m.ArtifactTypes = []string{ArtifactTypeImage}
+	ok, err = check(host + "/app:multi")
+	th.AssertNoError(err)
+	th.AssertTrue(ok)
+	ok, err = check(host + "/app:chart")
+	th.AssertNoError(err)
+	th.AssertFalse(ok)
+
+	th.AssertNil(task.manifestTypeChecker(ctx, m))
+	m.ManifestType = ManifestTypeAny
+	th.AssertNil(task.manifestTypeChecker(ctx, m))
+
+	m.ManifestType = ManifestTypeIndex
+	check = task.manifestTypeChecker(ctx, m)
+	th.AssertNotNil(check)
+	ok, err = check(host + "/app:multi")
+	th.AssertNoError(err)
+	th.AssertTrue(ok)
+	_, err = check(host + "/app:missing")
+	th.AssertError(err, "cannot determine manifest type")
+
+	m.ManifestType = ManifestTypeImage
+	ok, err = check(host + "/app:multi")
+	th.AssertNoError(err)
+	th.AssertFalse(ok)
+}
+
+//
+func TestMetadataChecker(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	image := func(config, channel string) (string, string) {
+		return fmt.Sprintf(`{"schemaVersion":2,"mediaType":`+
+			`"application/vnd.oci.image.manifest.v1+json","config":`+
+			`{"mediaType":"application/vnd.oci.image.config.v1+json",`+
+			`"digest":"sha256:%x","size":%d},"layers":[],"annotations":`+
+			`{"org.opencontainers.image.channel":"%s"}}`,
+			sha256.Sum256([]byte(config)), len(config), channel), config
+	}
+	content := map[string]string{}
+	for tag, labels := range map[string][]string{
+		"stable": {`{"config":{"Labels":{"team":"infra"}}}`, "stable"},
+		"beta":   {`{"config":{"Labels":{"team":"infra"}}}`, "beta"},
+		"other":  {`{"config":{"Labels":{"team":"apps"}}}`, "stable"},
+	} {
+		m, c := image(labels[0], labels[1])
+		content[tag] = m
+		content[fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(c)))] = c
+	}
+
+	var mu gosync.Mutex
+	configs := 0
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			c, ok := content[path.Base(r.URL.Path)]
+			if r.URL.Path != "/v2/" && !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if strings.Contains(r.URL.Path, "/blobs/") {
+				mu.Lock()
+				configs++
+				mu.Unlock()
+			}
+			w.Header().Set("Content-Type",
+				"application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest",
+				fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(c))))
+			w.Write([]byte(c))
+		}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: %s
+  target:
+    registry: %s
+  mappings:
+  - from: app
+    match-labels:
+      team: infra
+    match-annotations:
+      org.opencontainers.image.channel: stable
+`, host, host)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	task := c.Tasks[0]
+	m := task.Mappings[0]
+	ctx := context.Background()
+
+	check := task.metadataChecker(ctx, m)
+	th.AssertNotNil(check)
+	for tag, want := range map[string]bool{
+		"stable": true, "beta": false, "other": false} {
+		ok, err := check(host + "/app:" + tag)
+		th.AssertNoError(err)
+		th.AssertEqual(want, ok)
+	}
+	_, err := check(host + "/app:missing")
+	th.AssertError(err, "cannot determine labels and annotations")
+	th.AssertEqual(3, configs)
+
+	// configs are only fetched once per digest
+	ok, err := check(host + "/app:stable")
+	th.AssertNoError(err)
+	th.AssertTrue(ok)
+	th.AssertEqual(3, configs)
+
+	m.MatchLabels = nil
+	m.MatchAnnotations = nil
+	th.AssertNil(task.metadataChecker(ctx, m))
+}
+
+//
+func TestRenewAuth(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// helper returns a new secret on each run, and records the server
+	dir := t.TempDir()
+	helper := filepath.Join(dir, "helper")
+	th.AssertNoError(ioutil.WriteFile(helper, []byte(fmt.Sprintf(`#!/bin/sh
+[ "$1" = get ] || exit 1
+cat > %[1]s/server
+printf x >> %[1]s/count
+printf '{"Username": "robot", "Secret": "s%%s"}' "$(cat %[1]s/count)"
+`, dir)), 0755))
+
+	file := filepath.Join(dir, "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+relay: skopeo
+tasks:
+- name: test
+  source:
+    registry: registry.example.com
+    credential-helper: %s
+  target:
+    registry: localhost:5000
+  mappings:
+  - from: app
+`, helper)), 0644))
+	c, e := LoadConfig(file)
+	th.AssertNoError(e)
+
+	task := c.Tasks[0]
+	th.AssertNoError(task.Source.RefreshAuth())
+	th.AssertEqual("robot", task.Source.creds.Username())
+	th.AssertEqual("sx", task.Source.creds.Password())
+
+	server, err := ioutil.ReadFile(filepath.Join(dir, "server"))
+	th.AssertNoError(err)
+	th.AssertEqual("registry.example.com", string(server))
+
+	// cached until rejected
+	th.AssertNoError(task.Source.RefreshAuth())
+	th.AssertEqual("sx", task.Source.creds.Password())
+
+	opt1 := &relays.SyncOptions{SrcAuth: task.Source.GetAuth()}
+	opt2 := &relays.SyncOptions{SrcAuth: task.Source.GetAuth()}
+
+	renewed, err := task.renewAuth(task.Target, opt1)
+	th.AssertNoError(err)
+	th.AssertTrue(renewed)
+	th.AssertEqual("sxx", task.Source.creds.Password())
+	th.AssertEqual(task.Source.GetAuth(), opt1.SrcAuth)
+
+	// already renewed for another sync, so helper is not run again
+	renewed, err = task.renewAuth(task.Target, opt2)
+	th.AssertNoError(err)
+	th.AssertTrue(renewed)
+	th.AssertEqual("sxx", task.Source.creds.Password())
+	th.AssertEqual(task.Source.GetAuth(), opt2.SrcAuth)
+
+	// failing with rejected credentials retrieves them on the next refresh
+	task.fail(errors.New("unauthorized: authentication required"))
+	th.AssertNoError(task.Source.RefreshAuth())
+	th.AssertEqual("sxxx", task.Source.creds.Password())
+
+	// without credential helper, there is nothing to renew
+	opt := &relays.SyncOptions{SrcAuth: task.Source.GetAuth()}
+	task.Source.creds.SetRefresher(nil)
+	renewed, err = task.renewAuth(task.Target, opt)
+	th.AssertNoError(err)
+	th.AssertFalse(renewed)
+}
+
+//
+func TestRepoLimit(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	repos := []string{"/a", "/b", "/c"}
+
+	tryRepoLimit(th, 0, 0, false, repos, "")
+	tryRepoLimit(th, 3, 0, false, repos, "")
+	tryRepoLimit(th, 0, 3, false, repos, "")
+	tryRepoLimit(th, 2, 0, false, repos,
+		"matches 3 repositories, exceeding limit of 2")
+	tryRepoLimit(th, 0, 2, false, repos,
+		"matches 3 repositories, exceeding limit of 2")
+	tryRepoLimit(th, 2, 5, false, repos,
+		"matches 3 repositories, exceeding limit of 2")
+	tryRepoLimit(th, 5, 2, false, repos, "")
+	tryRepoLimit(th, 2, 0, true, repos, "")
+}
+
+//
+func TestCreateECRRepo(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ctx := context.Background()
+	ref := "123456789012.dkr.ecr.eu-central-1.amazonaws.com/team/app"
+
+	f := &fakeECR{exists: true}
+	th.AssertNoError(createECRRepo(ctx, f, "123456789012", "team/app", ref,
+		nil))
+	th.AssertNil(f.created)
+
+	f = &fakeECR{}
+	th.AssertNoError(createECRRepo(ctx, f, "123456789012", "team/app", ref,
+		nil))
+	th.AssertNotNil(f.created)
+	th.AssertEqual("team/app", aws.StringValue(f.created.RepositoryName))
+	th.AssertNil(f.created.ImageScanningConfiguration)
+	th.AssertNil(f.created.ImageTagMutability)
+	th.AssertNil(f.created.EncryptionConfiguration)
+
+	f = &fakeECR{}
+	th.AssertNoError(createECRRepo(ctx, f, "123456789012", "team/app", ref,
+		&ECRRepository{ScanOnPush: true, TagImmutability: true,
+			Encryption: ecr.EncryptionTypeKms, KMSKey: "alias/mirror"}))
+	th.AssertTrue(
+		aws.BoolValue(f.created.ImageScanningConfiguration.ScanOnPush))
+	th.AssertEqual(ecr.ImageTagMutabilityImmutable,
+		aws.StringValue(f.created.ImageTagMutability))
+	th.AssertEqual(ecr.EncryptionTypeKms,
+		aws.StringValue(f.created.EncryptionConfiguration.EncryptionType))
+	th.AssertEqual("alias/mirror",
+		aws.StringValue(f.created.EncryptionConfiguration.KmsKey))
+
+	f = &fakeECR{createErr: awserr.New(
+		ecr.ErrCodeRepositoryAlreadyExistsException, "exists", nil)}
+	th.AssertNoError(createECRRepo(ctx, f, "123456789012", "team/app", ref,
+		nil))
+
+	f = &fakeECR{createErr: awserr.New(
+		ecr.ErrCodeLimitExceededException, "too many repositories", nil)}
+	th.AssertError(createECRRepo(ctx, f, "123456789012", "team/app", ref,
+		nil), "too many repositories")
+
+	f = &fakeECR{describeErr: awserr.New(
+		"AccessDeniedException", "not allowed", nil)}
+	th.AssertError(createECRRepo(ctx, f, "123456789012", "team/app", ref,
+		nil), "not allowed")
+	th.AssertNil(f.created)
+}
+
+//
+type fakeECR struct {
+	ecriface.ECRAPI
+	exists      bool
+	describeErr error
+	createErr   error
+	created     *ecr.CreateRepositoryInput
+}
+
+//
+func (f *fakeECR) DescribeRepositoriesWithContext(ctx aws.Context,
+	input *ecr.DescribeRepositoriesInput,
+	opts ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+	if f.describeErr != nil {
+		return nil, f.describeErr
+	}
+	if !f.exists {
+		return nil, awserr.New(
+			ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+	}
+	return &ecr.DescribeRepositoriesOutput{
+		Repositories: []*ecr.Repository{
+			{RepositoryName: input.RepositoryNames[0]}},
+	}, nil
+}
+
+//
+func (f *fakeECR) CreateRepositoryWithContext(ctx aws.Context,
+	input *ecr.CreateRepositoryInput,
+	opts ...request.Option) (*ecr.CreateRepositoryOutput, error) {
+	f.created = input
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	return &ecr.CreateRepositoryOutput{}, nil
+}
+
+//
+func tryRepoLimit(th *test.TestHelper, max, global int, force bool,
+	repos []string, err string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	t := &Task{Name: "test", maxRepos: global, force: force}
+	m := &Mapping{From: "regex:.*", MaxRepos: max}
+	th.AssertNoError(m.validate())
+
+	if e := t.checkRepoLimit(m, repos); err != "" {
+		th.AssertError(e, err)
+	} else {
+		th.AssertNoError(e)
+	}
+}
+
+//
+func tryTagLister(th *test.TestHelper, file, ref string, native bool) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	c, e := LoadConfig(th.GetFixture(file))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+
+	th.AssertEqual(native,
+		c.Tasks[0].tagLister(context.Background(), ref, false) != nil)
+}
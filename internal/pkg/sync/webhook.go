@@ -0,0 +1,169 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+)
+
+// triggers for sending webhook notifications
+const (
+	TriggerAlways    = "always"
+	TriggerOnSuccess = "on-success"
+	TriggerOnFailure = "on-failure"
+)
+
+//
+const defaultWebhookRetries = 3
+const webhookTimeout = 10 * time.Second
+
+//
+type WebhookConfig struct {
+	URL           string        `yaml:"url"`
+	Trigger       string        `yaml:"trigger"`
+	Retries       int           `yaml:"retries"`
+	RetryInterval time.Duration `yaml:"retry-interval"`
+}
+
+// WebhookPayload is posted as JSON to the webhook URL when a task finishes.
+type WebhookPayload struct {
+	Task           string            `json:"task"`
+	Start          time.Time         `json:"start"`
+	End            time.Time         `json:"end"`
+	Result         string            `json:"result"`
+	ImagesCopied   int               `json:"images-copied"`
+	ImagesFailed   int               `json:"images-failed"`
+	ImagesDeferred int               `json:"images-deferred,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	Failures       []*WebhookFailure `json:"failures,omitempty"`
+}
+
+// WebhookFailure is an image that failed to sync during a task run, given by
+// its source and target repository
+type WebhookFailure struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Error  string `json:"error"`
+}
+
+//
+func (c *WebhookConfig) validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.URL == "" {
+		return errors.New("webhook config requires a 'url'")
+	}
+	if u, err := url.Parse(c.URL); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf(
+			"invalid webhook URL '%s', must be an http(s) URL", c.URL)
+	}
+
+	switch c.Trigger {
+	case "":
+		c.Trigger = TriggerAlways
+	case TriggerAlways, TriggerOnSuccess, TriggerOnFailure:
+	default:
+		return fmt.Errorf("invalid webhook trigger '%s', must be one of "+
+			"'%s', '%s', or '%s'", c.Trigger, TriggerAlways, TriggerOnSuccess,
+			TriggerOnFailure)
+	}
+
+	if c.Retries < 0 {
+		return errors.New("webhook 'retries' must not be negative")
+	} else if c.Retries == 0 {
+		c.Retries = defaultWebhookRetries
+	}
+
+	if c.RetryInterval < 0 {
+		return errors.New("webhook 'retry-interval' must not be negative")
+	} else if c.RetryInterval == 0 {
+		c.RetryInterval = defaultRetryInterval
+	}
+
+	return nil
+}
+
+// triggers determines whether a notification is sent for a task run with
+// result.
+func (c *WebhookConfig) triggers(result string) bool {
+	switch c.Trigger {
+	case TriggerOnSuccess:
+		return result == metrics.ResultSuccess
+	case TriggerOnFailure:
+		return result == metrics.ResultFailure
+	}
+	return true
+}
+
+// notify posts p to the webhook URL, if the trigger matches the result. When
+// the post fails or the response status is not 2xx, it is retried up to the
+// configured number of times, with a fixed delay.
+func (c *WebhookConfig) notify(p *WebhookPayload) error {
+
+	if c == nil || !c.triggers(p.Result) {
+		return nil
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+
+	for attempt := 0; ; attempt++ {
+
+		err = post(client, c.URL, body)
+		if err == nil || attempt >= c.Retries {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"attempt": attempt + 1, "delay": c.RetryInterval}).Warnf(
+			"retrying webhook: %v", err)
+		time.Sleep(c.RetryInterval)
+	}
+}
+
+//
+func post(client *http.Client, url string, body []byte) error {
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// newWebhookServer creates a test webhook which responds with status code
+// 503 to the first failures posts, and records all payloads it receives.
+func newWebhookServer(failures int) (*httptest.Server, *[]WebhookPayload) {
+
+	var payloads []WebhookPayload
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var p WebhookPayload
+			json.NewDecoder(r.Body).Decode(&p)
+			payloads = append(payloads, p)
+			if len(payloads) <= failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+
+	return s, &payloads
+}
+
+//
+func TestWebhookValidate(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	c := &WebhookConfig{URL: "https://hooks.example.com/dregsy"}
+	th.AssertNoError(c.validate())
+	th.AssertEqual(TriggerAlways, c.Trigger)
+	th.AssertEqual(defaultWebhookRetries, c.Retries)
+	th.AssertEqual(defaultRetryInterval, c.RetryInterval)
+
+	tryWebhookConfig(th, &WebhookConfig{}, "requires a 'url'")
+	tryWebhookConfig(th, &WebhookConfig{URL: "hooks.example.com"},
+		"invalid webhook URL")
+	tryWebhookConfig(th, &WebhookConfig{URL: "ftp://hooks.example.com"},
+		"invalid webhook URL")
+	tryWebhookConfig(th,
+		&WebhookConfig{URL: "http://hooks.example.com", Trigger: "never"},
+		"invalid webhook trigger 'never'")
+	tryWebhookConfig(th,
+		&WebhookConfig{URL: "http://hooks.example.com", Retries: -1},
+		"'retries' must not be negative")
+	tryWebhookConfig(th,
+		&WebhookConfig{URL: "http://hooks.example.com", RetryInterval: -1},
+		"'retry-interval' must not be negative")
+}
+
+//
+func tryWebhookConfig(th *test.TestHelper, c *WebhookConfig, err string) {
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+	th.AssertError(c.validate(), err)
+}
+
+//
+func TestWebhookNotify(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, payloads := newWebhookServer(2)
+	defer s.Close()
+
+	c := &WebhookConfig{URL: s.URL, RetryInterval: time.Millisecond}
+	th.AssertNoError(c.validate())
+
+	th.AssertNoError(c.notify(&WebhookPayload{
+		Task: "test", Result: metrics.ResultSuccess}))
+	th.AssertEqual(3, len(*payloads))
+
+	c.Trigger = TriggerOnFailure
+	th.AssertNoError(c.notify(&WebhookPayload{
+		Task: "test", Result: metrics.ResultSuccess}))
+	th.AssertEqual(3, len(*payloads))
+	th.AssertNoError(c.notify(&WebhookPayload{
+		Task: "test", Result: metrics.ResultFailure}))
+	th.AssertEqual(4, len(*payloads))
+
+	c.Trigger = TriggerOnSuccess
+	th.AssertNoError(c.notify(&WebhookPayload{
+		Task: "test", Result: metrics.ResultFailure}))
+	th.AssertEqual(4, len(*payloads))
+
+	failing, failed := newWebhookServer(10)
+	defer failing.Close()
+
+	c = &WebhookConfig{URL: failing.URL, Retries: 1,
+		RetryInterval: time.Millisecond}
+	th.AssertNoError(c.validate())
+	th.AssertError(c.notify(&WebhookPayload{
+		Task: "test", Result: metrics.ResultSuccess}),
+		"webhook responded with status 503")
+	th.AssertEqual(2, len(*failed))
+}
+
+//
+func TestWebhookSyncTask(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	hook, payloads := newWebhookServer(0)
+	defer hook.Close()
+
+	s, _ := trySync(th, "config/concurrency.yaml", "")
+	c, e := LoadConfig(th.GetFixture("config/concurrency.yaml"))
+	th.AssertNoError(e)
+
+	s.relay = &parallelRelay{}
+	task := c.Tasks[0]
+	task.webhook = &WebhookConfig{URL: hook.URL}
+	th.AssertNoError(task.webhook.validate())
+
+	s.syncTask(task)
+
+	th.AssertEqual(1, len(*payloads))
+	p := (*payloads)[0]
+	th.AssertEqual("test", p.Task)
+	th.AssertEqual(metrics.ResultFailure, p.Result)
+	th.AssertEqual(3, p.ImagesCopied)
+	th.AssertEqual(2, p.ImagesFailed)
+	th.AssertEqual("2 of 5 images failed to sync", p.Error)
+	th.AssertFalse(p.End.Before(p.Start))
+
+	// the failed images are listed, while the others were synced anyway
+	th.AssertEqual(2, len(p.Failures))
+	th.AssertEqual("registry.example.com/library/fail-a", p.Failures[0].Source)
+	th.AssertEqual("localhost:5000/library/fail-a", p.Failures[0].Target)
+	th.AssertEqual("failed to sync registry.example.com/library/fail-a",
+		p.Failures[0].Error)
+	th.AssertEqual("registry.example.com/library/fail-b", p.Failures[1].Source)
+}
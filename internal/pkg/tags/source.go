@@ -0,0 +1,123 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tags
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// sourceTimeout is the timeout for fetching tags from a URL tag source
+var sourceTimeout = 30 * time.Second
+
+//
+func (ts *TagSet) addSource(s string) error {
+
+	if strings.HasPrefix(s, URLPrefix) {
+		u, err := url.Parse(strings.TrimSpace(s[len(URLPrefix):]))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" {
+			return fmt.Errorf(
+				"invalid tag source '%s', must be an http or https URL", s)
+		}
+	} else if strings.TrimSpace(s[len(FilePrefix):]) == "" {
+		return fmt.Errorf("invalid tag source '%s', file path is empty", s)
+	}
+
+	ts.sources = append(ts.sources, s)
+	return nil
+}
+
+// readSources reads the tags from all tag sources of this tag set, and
+// remembers them for matching. Sources are read anew on each call.
+func (ts *TagSet) readSources() ([]string, error) {
+
+	var ret []string
+
+	for _, src := range ts.sources {
+		data, err := readSource(src)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"failed reading tags from '%s': %v", src, err)
+		}
+		tags, err := parseTags(data)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"failed parsing tags from '%s': %v", src, err)
+		}
+		ret = append(ret, tags...)
+	}
+
+	ts.srcMu.Lock()
+	ts.sourced = ret
+	ts.srcMu.Unlock()
+
+	return ret, nil
+}
+
+//
+func readSource(src string) ([]byte, error) {
+
+	if strings.HasPrefix(src, FilePrefix) {
+		return ioutil.ReadFile(strings.TrimSpace(src[len(FilePrefix):]))
+	}
+
+	client := &http.Client{Timeout: sourceTimeout}
+	resp, err := client.Get(strings.TrimSpace(src[len(URLPrefix):]))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parseTags parses the tags in data, which is either a JSON array of strings,
+// or a list of tags with one tag per line. Empty lines and lines starting with
+// `#` are ignored.
+func parseTags(data []byte) ([]string, error) {
+
+	var ret []string
+
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &ret); err != nil {
+			return nil, err
+		}
+		for _, t := range ret {
+			if strings.TrimSpace(t) == "" {
+				return nil, fmt.Errorf("empty tag in list")
+			}
+		}
+		return ret, nil
+	}
+
+	for _, l := range strings.Split(string(data), "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "#") {
+			ret = append(ret, l)
+		}
+	}
+	return ret, nil
+}
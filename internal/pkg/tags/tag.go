@@ -0,0 +1,46 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tags
+
+import (
+	"time"
+)
+
+// Tag describes a single image tag as reported by a registry. Pushed is the
+// zero time if the registry does not provide push times.
+type Tag struct {
+	Name   string
+	Pushed time.Time
+}
+
+// FromNames creates tags without push times from tag names.
+func FromNames(names []string) []Tag {
+	ret := make([]Tag, 0, len(names))
+	for _, n := range names {
+		ret = append(ret, Tag{Name: n})
+	}
+	return ret
+}
+
+//
+func Names(tags []Tag) []string {
+	ret := make([]string, 0, len(tags))
+	for _, t := range tags {
+		ret = append(ret, t.Name)
+	}
+	return ret
+}
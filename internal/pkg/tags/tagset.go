@@ -19,7 +19,10 @@ package tags
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/blang/semver/v4"
 	log "github.com/sirupsen/logrus"
@@ -31,6 +34,9 @@ import (
 const SemverPrefix = "semver:"
 const RegexpPrefix = "regex:"
 const KeepPrefix = "keep:"
+const LatestPrefix = "latest:"
+const FilePrefix = "file:"
+const URLPrefix = "url:"
 
 //
 func NewTagSet(tags []string) (*TagSet, error) {
@@ -44,9 +50,101 @@ func NewTagSet(tags []string) (*TagSet, error) {
 //
 type TagSet struct {
 	verbatim []string
+	sources  []string
+	sourced  []string
+	srcMu    sync.RWMutex
 	semver   []semver.Range
 	regex    []*util.Regex
 	keep     []*util.Regex
+	latest   int
+	exclude  *TagSet
+	maxTags  int
+	since    time.Time
+	sinceAgo time.Duration
+	until    time.Time
+	untilAgo time.Duration
+}
+
+// Exclude sets the tags to exclude from this tag set. Entries can be verbatim
+// tags, or semver and regex filters. Keep and latest filters, and tag sources
+// are not supported here.
+func (ts *TagSet) Exclude(tags []string) error {
+
+	if len(tags) == 0 {
+		ts.exclude = nil
+		return nil
+	}
+
+	ex, err := NewTagSet(tags)
+	if err != nil {
+		return err
+	}
+	if len(ex.keep) > 0 {
+		return fmt.Errorf("keep filters cannot be used for excluding tags")
+	}
+	if ex.latest > 0 {
+		return fmt.Errorf("latest filters cannot be used for excluding tags")
+	}
+	if len(ex.sources) > 0 {
+		return fmt.Errorf("tag sources cannot be used for excluding tags")
+	}
+
+	ts.exclude = ex
+	return nil
+}
+
+// SetMaxTags limits the expanded tag set to the max most recent tags. When
+// max is 0, there is no limit.
+func (ts *TagSet) SetMaxTags(max int) {
+	ts.maxTags = max
+}
+
+// SetSince limits the expanded tag set to tags pushed at or after since. When
+// since is the zero time, ago is used instead for a cutoff relative to the
+// time of expansion. When both are zero, there is no limit.
+func (ts *TagSet) SetSince(since time.Time, ago time.Duration) {
+	ts.since = since
+	ts.sinceAgo = ago
+}
+
+// SetUntil limits the expanded tag set to tags pushed at or before until. When
+// until is the zero time, ago is used instead for a cutoff relative to the
+// time of expansion. When both are zero, there is no limit.
+func (ts *TagSet) SetUntil(until time.Time, ago time.Duration) {
+	ts.until = until
+	ts.untilAgo = ago
+}
+
+// NeedsPushTimes determines whether expanding this tag set requires push times
+// of the listed tags.
+func (ts *TagSet) NeedsPushTimes() bool {
+	return ts != nil && (ts.hasSince() || ts.hasUntil())
+}
+
+//
+func (ts *TagSet) hasSince() bool {
+	return !ts.since.IsZero() || ts.sinceAgo > 0
+}
+
+//
+func (ts *TagSet) hasUntil() bool {
+	return !ts.until.IsZero() || ts.untilAgo > 0
+}
+
+//
+func (ts *TagSet) cutoff() time.Time {
+	if !ts.since.IsZero() {
+		return ts.since
+	}
+	return time.Now().Add(-ts.sinceAgo)
+}
+
+//
+func (ts *TagSet) upperCutoff() time.Time {
+	if !ts.until.IsZero() {
+		return ts.until
+	}
+	return time.Now().Add(-ts.untilAgo)
 }
 
 //
@@ -64,6 +162,14 @@ func (ts *TagSet) add(tags []string) error {
 			if err := ts.addKeep(t); err != nil {
 				return err
 			}
+		} else if isLatest(t) {
+			if err := ts.addLatest(t); err != nil {
+				return err
+			}
+		} else if isSource(t) {
+			if err := ts.addSource(t); err != nil {
+				return err
+			}
 		} else {
 			ts.addVerbatim(t)
 		}
@@ -78,14 +184,46 @@ func (ts *TagSet) addVerbatim(v string) {
 
 //
 func (ts *TagSet) addSemver(s string) error {
-	if r, e := semver.ParseRange(s[len(SemverPrefix):]); e != nil {
-		return e
+	expr := normalizeRange(s[len(SemverPrefix):])
+	if r, e := semver.ParseRange(expr); e != nil {
+		return fmt.Errorf("invalid semver filter '%s': %v", s, e)
 	} else {
 		ts.semver = append(ts.semver, r)
 		return nil
 	}
 }
 
+// normalizeRange rewrites the versions in semver range expression expr such
+// that they get accepted by the range parser: a `v` prefix is removed, and
+// partial versions such as `1.20` are completed to `1.20.0`. Wild cards are
+// left as is.
+func normalizeRange(expr string) string {
+
+	fields := strings.Fields(expr)
+
+	for ix, f := range fields {
+
+		op := strings.IndexAny(f, "0123456789vV")
+		if op < 0 || strings.ContainsAny(f, "xX*") {
+			continue
+		}
+
+		core := strings.TrimLeft(f[op:], "vV")
+		var suffix string
+		if end := strings.IndexAny(core, "-+"); end > -1 {
+			core, suffix = core[:end], core[end:]
+		}
+
+		for n := strings.Count(core, "."); n < 2; n++ {
+			core += ".0"
+		}
+
+		fields[ix] = f[:op] + core + suffix
+	}
+
+	return strings.Join(fields, " ")
+}
+
 //
 func (ts *TagSet) addRegex(r string) (err error) {
 	ts.regex, err = ts.addFilter(r, RegexpPrefix, ts.regex)
@@ -98,6 +236,20 @@ func (ts *TagSet) addKeep(r string) (err error) {
 	return
 }
 
+//
+func (ts *TagSet) addLatest(l string) error {
+	if ts.latest > 0 {
+		return fmt.Errorf("only one latest filter allowed, got '%s'", l)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(l[len(LatestPrefix):]))
+	if err != nil || n < 1 {
+		return fmt.Errorf(
+			"invalid latest filter '%s', must be a positive number", l)
+	}
+	ts.latest = n
+	return nil
+}
+
 //
 func (ts *TagSet) addFilter(regex, prefix string, list []*util.Regex) (
 	[]*util.Regex, error) {
@@ -117,7 +269,7 @@ func (ts *TagSet) IsEmpty() bool {
 
 //
 func (ts *TagSet) HasVerbatim() bool {
-	return len(ts.verbatim) > 0
+	return len(ts.verbatim) > 0 || len(ts.sources) > 0
 }
 
 //
@@ -130,25 +282,39 @@ func (ts *TagSet) HasRegex() bool {
 	return len(ts.regex) > 0
 }
 
+// IsUnrestricted determines whether this tag set selects all tags, i.e. it
+// is empty and there is no pruning, exclusion, or limit.
+func (ts *TagSet) IsUnrestricted() bool {
+	return ts.IsEmpty() && len(ts.keep) == 0 && ts.latest == 0 &&
+		ts.exclude == nil && ts.maxTags == 0 && !ts.NeedsPushTimes()
+}
+
 //
 func (ts *TagSet) NeedsExpansion() bool {
-	return ts.IsEmpty() || ts.HasSemver() || ts.HasRegex()
+	return ts.IsEmpty() || ts.HasSemver() || ts.HasRegex() ||
+		ts.NeedsPushTimes()
 }
 
 //
-func (ts *TagSet) Expand(lister func() ([]string, error)) ([]string, error) {
+func (ts *TagSet) Expand(lister func() ([]Tag, error)) ([]string, error) {
 
 	set := make(map[string]string)
+	listed := make(map[string]*Tag)
 
 	if ts.NeedsExpansion() {
 
-		tags, err := lister()
+		list, err := lister()
 		if err != nil {
 			return nil, fmt.Errorf(
 				"failed listing tags during tag set expansion: %v", err)
 		}
 
-		if !ts.HasSemver() && !ts.HasRegex() { // tag set is completely empty
+		for ix := range list {
+			listed[list[ix].Name] = &list[ix]
+		}
+		tags := Names(list)
+
+		if ts.IsEmpty() {
 			addToSet(set, tags)
 
 		} else {
@@ -166,6 +332,15 @@ func (ts *TagSet) Expand(lister func() ([]string, error)) ([]string, error) {
 		addToSet(set, ts.verbatim)
 	}
 
+	if len(ts.sources) > 0 {
+		sourced, err := ts.readSources()
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("tags read from sources: %v", sourced)
+		addToSet(set, sourced)
+	}
+
 	ret := make([]string, 0, len(set))
 	var pruned []string
 
@@ -181,6 +356,18 @@ func (ts *TagSet) Expand(lister func() ([]string, error)) ([]string, error) {
 
 	log.Debugf("pruned tags: %v", pruned)
 
+	if ts.latest > 0 {
+		ret = ts.highestVersions(ret)
+	}
+
+	if ts.NeedsPushTimes() {
+		ret = ts.pushedWithin(ret, listed)
+	}
+
+	if ts.maxTags > 0 && len(ret) > ts.maxTags {
+		ret = ts.mostRecent(ret, listed)
+	}
+
 	sort.Strings(ret)
 	log.Debugf("expanded tags: %v", ret)
 
@@ -190,25 +377,10 @@ func (ts *TagSet) Expand(lister func() ([]string, error)) ([]string, error) {
 //
 func (ts *TagSet) expandSemver(tags []string) []string {
 
-	var vers semver.Versions
-	var used []string
-
-	for _, t := range tags {
-		if v, err := semver.ParseTolerant(t); err != nil {
-			log.Debugf("skipping tag '%s', not a valid semver: %v", t, err)
-		} else {
-			vers = append(vers, v)
-			used = append(used, t)
-		}
-	}
-
 	var ret []string
-	for ix, v := range vers {
-		for _, r := range ts.semver {
-			if r(v) {
-				ret = append(ret, used[ix])
-				break
-			}
+	for _, t := range tags {
+		if ts.matchesSemver(t) {
+			ret = append(ret, t)
 		}
 	}
 
@@ -221,11 +393,8 @@ func (ts *TagSet) expandRegex(tags []string) []string {
 
 	var ret []string
 	for _, t := range tags {
-		for _, regex := range ts.regex {
-			if regex.Matches(t) {
-				ret = append(ret, t)
-				break
-			}
+		if ts.matchesRegex(t) {
+			ret = append(ret, t)
 		}
 	}
 
@@ -233,8 +402,241 @@ func (ts *TagSet) expandRegex(tags []string) []string {
 	return ret
 }
 
+// Matches determines whether tag t is selected by this tag set, i.e. whether
+// it is one of the verbatim tags, or satisfies any of the semver or regex
+// filters, and is not pruned by any of the keep filters. An empty tag set
+// matches all tags. Tags from tag sources are those read during the most
+// recent expansion. The latest filter is not considered, since it depends on
+// the other tags.
+func (ts *TagSet) Matches(t string) bool {
+
+	if !ts.keepTag(t) {
+		return false
+	}
+
+	if ts.IsEmpty() {
+		return true
+	}
+
+	return ts.isVerbatim(t) || ts.matchesSemver(t) || ts.matchesRegex(t)
+}
+
+//
+func (ts *TagSet) matchesSemver(t string) bool {
+
+	if !ts.HasSemver() {
+		return false
+	}
+
+	v, err := semver.ParseTolerant(t)
+	if err != nil {
+		log.Debugf("skipping tag '%s', not a valid semver: %v", t, err)
+		return false
+	}
+
+	for _, r := range ts.semver {
+		if r(v) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+func (ts *TagSet) matchesRegex(t string) bool {
+	for _, regex := range ts.regex {
+		if regex.Matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// highestVersions returns the tags with the highest semver versions from tags,
+// up to the limit of the latest filter. Verbatim tags are always retained,
+// other tags that are not a valid semver are dropped.
+func (ts *TagSet) highestVersions(tags []string) []string {
+
+	var ret, versioned, dropped []string
+	vers := make(map[string]semver.Version)
+
+	for _, t := range tags {
+		if ts.isVerbatim(t) {
+			ret = append(ret, t)
+		} else if v, err := semver.ParseTolerant(t); err == nil {
+			vers[t] = v
+			versioned = append(versioned, t)
+		} else {
+			dropped = append(dropped, t)
+		}
+	}
+
+	// ties between equal versions such as `1.2` and `1.2.0` are broken by
+	// reverse lexical order, for a stable result
+	sort.Slice(versioned, func(i, j int) bool {
+		a, b := versioned[i], versioned[j]
+		if va, vb := vers[a], vers[b]; !va.EQ(vb) {
+			return va.GT(vb)
+		}
+		return a > b
+	})
+
+	if len(versioned) > ts.latest {
+		dropped = append(dropped, versioned[ts.latest:]...)
+		versioned = versioned[:ts.latest]
+	}
+
+	log.Debugf("limiting to %d highest versions, dropping: %v",
+		ts.latest, dropped)
+	return append(ret, versioned...)
+}
+
+//
+func (ts *TagSet) isVerbatim(t string) bool {
+	for _, v := range ts.verbatim {
+		if v == t {
+			return true
+		}
+	}
+	ts.srcMu.RLock()
+	defer ts.srcMu.RUnlock()
+	for _, v := range ts.sourced {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// pushedWithin returns the tags from tags that were pushed at or after the
+// cutoff time, and at or before the upper cutoff time, as far as these are
+// set. Tags for which the push time is not known are retained.
+func (ts *TagSet) pushedWithin(tags []string, listed map[string]*Tag) []string {
+
+	var cutoff, upper time.Time
+	if ts.hasSince() {
+		cutoff = ts.cutoff()
+	}
+	if ts.hasUntil() {
+		upper = ts.upperCutoff()
+	}
+
+	ret := make([]string, 0, len(tags))
+	var dropped, later, unknown []string
+
+	for _, t := range tags {
+		l, ok := listed[t]
+		switch {
+		case !ok || l.Pushed.IsZero():
+			unknown = append(unknown, t)
+			ret = append(ret, t)
+		case !cutoff.IsZero() && l.Pushed.Before(cutoff):
+			dropped = append(dropped, t)
+		case !upper.IsZero() && l.Pushed.After(upper):
+			later = append(later, t)
+		default:
+			ret = append(ret, t)
+		}
+	}
+
+	if len(unknown) > 0 {
+		log.Warnf("push time not known for tags %v, cannot apply 'since' "+
+			"or 'until'", unknown)
+	}
+	if !cutoff.IsZero() {
+		log.Debugf("dropping tags pushed before %v: %v", cutoff, dropped)
+	}
+	if !upper.IsZero() {
+		log.Debugf("dropping tags pushed after %v: %v", upper, later)
+	}
+
+	return ret
+}
+
+// Expired returns the tags from list that match this tag set, but were pushed
+// before the cutoff time, sorted. Tags for which the push time is not known
+// never expire. Without a cutoff time, nil is returned.
+func (ts *TagSet) Expired(list []Tag) []string {
+
+	if !ts.hasSince() {
+		return nil
+	}
+
+	cutoff := ts.cutoff()
+	var ret []string
+
+	for _, t := range list {
+		if !t.Pushed.IsZero() && t.Pushed.Before(cutoff) && ts.Matches(t.Name) {
+			ret = append(ret, t.Name)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// mostRecent returns the maxTags most recent tags from tags. Tags with a known
+// push time rank higher than those without, and are ordered by push time. Tags
+// without push time, or with equal ones, are compared by semver, with a valid
+// semver ranking higher than an invalid one. Remaining ties are broken by
+// reverse lexical order. Comparing all tags by the same keys keeps the order
+// consistent when only some tags have push times.
+func (ts *TagSet) mostRecent(tags []string, listed map[string]*Tag) []string {
+
+	vers := make(map[string]*semver.Version)
+	for _, t := range tags {
+		if v, err := semver.ParseTolerant(t); err == nil {
+			vers[t] = &v
+		}
+	}
+
+	pushed := func(t string) time.Time {
+		if l, ok := listed[t]; ok {
+			return l.Pushed
+		}
+		return time.Time{}
+	}
+
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+
+		a, b := sorted[i], sorted[j]
+
+		pa, pb := pushed(a), pushed(b)
+		switch {
+		case !pa.IsZero() && pb.IsZero():
+			return true
+		case pa.IsZero() && !pb.IsZero():
+			return false
+		case !pa.Equal(pb):
+			return pa.After(pb)
+		}
+
+		va, vb := vers[a], vers[b]
+		switch {
+		case va != nil && vb != nil && !va.EQ(*vb):
+			return va.GT(*vb)
+		case va != nil && vb == nil:
+			return true
+		case va == nil && vb != nil:
+			return false
+		}
+
+		return a > b
+	})
+
+	log.Debugf("limiting to %d most recent tags, dropping: %v",
+		ts.maxTags, sorted[ts.maxTags:])
+	return sorted[:ts.maxTags]
+}
+
 //
 func (ts *TagSet) keepTag(t string) bool {
+	if ts.exclude != nil && ts.exclude.Matches(t) {
+		return false
+	}
 	for _, regex := range ts.keep {
 		if !regex.Matches(t) {
 			return false
@@ -264,3 +666,14 @@ func isRegex(tag string) bool {
 func isKeep(tag string) bool {
 	return strings.HasPrefix(tag, KeepPrefix)
 }
+
+//
+func isSource(tag string) bool {
+	return strings.HasPrefix(tag, FilePrefix) ||
+		strings.HasPrefix(tag, URLPrefix)
+}
+
+//
+func isLatest(tag string) bool {
+	return strings.HasPrefix(tag, LatestPrefix)
+}
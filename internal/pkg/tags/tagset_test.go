@@ -0,0 +1,527 @@
+/*
+	Copyright 2021 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tags
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+var testTags = []string{
+	"0.9.1", "1.19.3", "1.20", "v1.21.1", "1.22.0-rc.1", "2.0.0",
+	"1.21.0-alpine", "latest", "stable", "1.20.5-rc",
+}
+
+//
+func TestNormalizeRange(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, tc := range [][2]string{
+		{">=1.20", ">=1.20.0"},
+		{">=1", ">=1.0.0"},
+		{">=v1.2.0 <V2", ">=1.2.0 <2.0.0"},
+		{" >=1.2.0   <2 ", ">=1.2.0 <2.0.0"},
+		{">=1.2-rc.1 || <1", ">=1.2.0-rc.1 || <1.0.0"},
+		{"!1.2", "!1.2.0"},
+		{"1.2.x", "1.2.x"},
+		{"<=1.*", "<=1.*"},
+	} {
+		th.AssertEqual(tc[1], normalizeRange(tc[0]))
+	}
+}
+
+//
+func TestSemver(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// note that suffixes are treated as pre-release versions
+	trySemver(th, "semver: >=1.20", []string{"1.20", "1.20.5-rc",
+		"1.21.0-alpine", "1.22.0-rc.1", "2.0.0", "v1.21.1"})
+	trySemver(th, "semver: >=v1.20.0 <2", []string{"1.20", "1.20.5-rc",
+		"1.21.0-alpine", "1.22.0-rc.1", "v1.21.1"})
+	trySemver(th, "semver: <1.20 || >=2", []string{"0.9.1", "1.19.3", "2.0.0"})
+	trySemver(th, "semver: >=1.22.0-rc.0 <1.22.0", []string{"1.22.0-rc.1"})
+	trySemver(th, "semver: >=3", nil)
+
+	_, err := NewTagSet([]string{"semver: >=1.20 <=two"})
+	th.AssertError(err, "invalid semver filter")
+}
+
+//
+func trySemver(th *test.TestHelper, filter string, want []string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	ts, err := NewTagSet([]string{filter})
+	th.AssertNoError(err)
+
+	got, err := ts.Expand(lister(testTags))
+	th.AssertNoError(err)
+	th.AssertEqualSlices(want, got)
+}
+
+//
+func lister(tags []string) func() ([]Tag, error) {
+	return func() ([]Tag, error) {
+		return FromNames(tags), nil
+	}
+}
+
+//
+func TestMatches(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// empty set matches everything
+	tryMatches(th, nil, map[string]bool{"latest": true, "1.0.0": true})
+
+	// verbatim OR regex OR semver
+	tryMatches(th, []string{"latest", "regex: 1\\.2[0-9]", "semver: >=2"},
+		map[string]bool{
+			"latest": true, "1.20": true, "1.29": true, "2.1.0": true,
+			"stable": false, "1.30": false, "1.2": false, "lates": false,
+		})
+
+	// inverted regex
+	tryMatches(th, []string{"regex: !.+-rc"},
+		map[string]bool{"1.0": true, "1.0-rc": false})
+
+	// keep filters prune, also with empty set and verbatim tags
+	tryMatches(th, []string{"keep: .+-alpine"},
+		map[string]bool{"1.0-alpine": true, "1.0": false})
+	tryMatches(th, []string{"latest", "semver: >=1", "keep: !latest"},
+		map[string]bool{"latest": false, "1.0.0": true})
+}
+
+//
+func tryMatches(th *test.TestHelper, tags []string, want map[string]bool) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	ts, err := NewTagSet(tags)
+	th.AssertNoError(err)
+
+	for tag, w := range want {
+		if ts.Matches(tag) != w {
+			th.Errorf("tag set %v: want match for '%s' to be %v",
+				tags, tag, w)
+		}
+	}
+}
+
+//
+func TestExclude(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	all := []string{"1.0", "1.1-rc", "2.0", "2.1-rc", "latest"}
+
+	// all except latest and release candidates
+	tryExclude(th, nil, []string{"latest", "regex: .+-rc"}, all,
+		[]string{"1.0", "2.0"})
+
+	// exclusion also drops verbatim tags, and supports semver
+	tryExclude(th, []string{"latest", "semver: >=1"},
+		[]string{"latest", "semver: <2"}, all, []string{"2.0"})
+
+	// exclusion together with keep filters
+	tryExclude(th, []string{"keep: .+-rc"}, []string{"1.1-rc"}, all,
+		[]string{"2.1-rc"})
+
+	// keep filters are not supported in exclusions
+	ts, err := NewTagSet(nil)
+	th.AssertNoError(err)
+	th.AssertError(ts.Exclude([]string{"keep: .*"}), "keep filters cannot")
+}
+
+//
+func tryExclude(th *test.TestHelper, include, exclude, tags, want []string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	ts, err := NewTagSet(include)
+	th.AssertNoError(err)
+	th.AssertNoError(ts.Exclude(exclude))
+	th.AssertFalse(ts.IsUnrestricted())
+
+	got, err := ts.Expand(lister(tags))
+	th.AssertNoError(err)
+	th.AssertEqualSlices(want, got)
+
+	for _, t := range tags {
+		th.AssertEqual(contains(want, t), ts.Matches(t))
+	}
+}
+
+//
+func TestIsUnrestricted(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, tc := range []struct {
+		include []string
+		exclude []string
+		want    bool
+	}{
+		{nil, nil, true},
+		{[]string{"latest"}, nil, false},
+		{[]string{"keep: .+-alpine"}, nil, false},
+		{nil, []string{"latest"}, false},
+	} {
+		ts, err := NewTagSet(tc.include)
+		th.AssertNoError(err)
+		th.AssertNoError(ts.Exclude(tc.exclude))
+		th.AssertEqual(tc.want, ts.IsUnrestricted())
+	}
+}
+
+//
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+//
+func TestMaxTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	t0 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return t0.Add(time.Duration(h) * time.Hour) }
+
+	// by push time
+	tryMaxTags(th, nil, 2, []Tag{
+		{"1.0.0", at(3)}, {"0.9.0", at(4)}, {"2.0.0", at(1)}, {"x", at(2)},
+	}, []string{"0.9.0", "1.0.0"})
+
+	// same push time, ties broken by semver, then name; results are stable
+	same := []Tag{{"a", at(1)}, {"b", at(1)}, {"c", at(1)}, {"d", at(1)}}
+	for i := 0; i < 20; i++ {
+		tryMaxTags(th, nil, 1, same, []string{"d"})
+	}
+	tryMaxTags(th, nil, 2, []Tag{
+		{"latest", at(1)}, {"1.2.3", at(1)}, {"1.2.2", at(0)},
+		{"1.10.0", at(1)},
+	}, []string{"1.10.0", "1.2.3"})
+
+	// no push times, by semver, with invalid semver ranking lowest
+	tryMaxTags(th, nil, 3, FromNames([]string{
+		"latest", "1.9.0", "1.10.0", "v1.11.0", "stable", "0.1.0"}),
+		[]string{"1.10.0", "1.9.0", "v1.11.0"})
+	tryMaxTags(th, nil, 3, FromNames([]string{"c", "a", "b", "d"}),
+		[]string{"b", "c", "d"})
+
+	// a verbatim tag that was not listed has no push time, and ranks below
+	// listed tags with push times
+	tryMaxTags(th, []string{"regex: .*", "9.9.9"}, 2, []Tag{
+		{"1.0.0", at(3)}, {"0.9.0", at(4)}, {"2.0.0", at(1)},
+	}, []string{"0.9.0", "1.0.0"})
+	tryMaxTags(th, []string{"regex: .*", "9.9.9"}, 4, []Tag{
+		{"1.0.0", at(3)}, {"0.9.0", at(4)}, {"2.0.0", at(1)},
+	}, []string{"0.9.0", "1.0.0", "2.0.0", "9.9.9"})
+
+	// only some tags with push times; these rank first, regardless of the
+	// order in which tags are listed
+	mixed := []Tag{{"1.0", at(2)}, {"2.0", at(1)}, {"1.5", time.Time{}},
+		{"3.0", time.Time{}}}
+	for i := 0; i < len(mixed); i++ {
+		rotated := append(append([]Tag{}, mixed[i:]...), mixed[:i]...)
+		tryMaxTags(th, nil, 2, rotated, []string{"1.0", "2.0"})
+		tryMaxTags(th, nil, 3, rotated, []string{"1.0", "2.0", "3.0"})
+	}
+
+	// limit applies after filtering
+	tryMaxTags(th, []string{"semver: <2", "keep: !0.9.0"}, 1, []Tag{
+		{"1.0.0", at(3)}, {"0.9.0", at(4)}, {"2.0.0", at(5)},
+	}, []string{"1.0.0"})
+}
+
+//
+func TestLatest(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// highest versions among all tags, non-semver tags are dropped
+	tryLatest(th, []string{"latest: 3"}, []string{
+		"1.9.0", "1.10.0", "v1.11.0", "0.1.0", "stable", "1.2"},
+		[]string{"1.10.0", "1.9.0", "v1.11.0"})
+
+	// combined with filters, exclusion, and verbatim tags, which are retained
+	tryLatest(th, []string{"regex: ^v.*", "latest:2", "edge"}, []string{
+		"v1.0.0", "v1.1.0", "v2.0.0", "3.0.0", "vnext", "edge"},
+		[]string{"edge", "v1.1.0", "v2.0.0"})
+
+	// fewer tags than the limit
+	tryLatest(th, []string{"semver: >=2", "latest: 5"}, []string{
+		"1.0.0", "2.0.0", "2.1.0"}, []string{"2.0.0", "2.1.0"})
+
+	// equal versions are ordered by name, for a stable result
+	for i := 0; i < 20; i++ {
+		tryLatest(th, []string{"latest: 1"}, []string{"1.2", "1.2.0"},
+			[]string{"1.2.0"})
+	}
+
+	for _, l := range []string{"latest: 0", "latest: -1", "latest: x"} {
+		_, err := NewTagSet([]string{l})
+		th.AssertError(err, "must be a positive number")
+	}
+
+	_, err := NewTagSet([]string{"latest: 1", "latest: 2"})
+	th.AssertError(err, "only one latest filter allowed")
+
+	ts, err := NewTagSet([]string{"latest: 1"})
+	th.AssertNoError(err)
+	th.AssertFalse(ts.IsUnrestricted())
+	th.AssertError(ts.Exclude([]string{"latest: 1"}), "latest filters cannot")
+}
+
+//
+func tryLatest(th *test.TestHelper, include, tags, want []string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	ts, err := NewTagSet(include)
+	th.AssertNoError(err)
+
+	got, err := ts.Expand(lister(tags))
+	th.AssertNoError(err)
+	th.AssertEqualSlices(want, got)
+}
+
+//
+func TestSince(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	t0 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return t0.Add(time.Duration(h) * time.Hour) }
+	listed := []Tag{
+		{"a", at(1)}, {"b", at(2)}, {"c", at(3)}, {"d", time.Time{}},
+	}
+
+	// absolute cutoff is inclusive, unknown push times are retained
+	trySince(th, nil, at(2), 0, 0, listed, []string{"b", "c", "d"})
+
+	// relative cutoff
+	recent := []Tag{
+		{"old", time.Now().Add(-48 * time.Hour)},
+		{"new", time.Now().Add(-time.Hour)},
+	}
+	trySince(th, nil, time.Time{}, 24*time.Hour, 0, recent, []string{"new"})
+
+	// verbatim tags are expanded, so push times are known for them
+	trySince(th, []string{"a", "c"}, at(2), 0, 0, listed, []string{"c"})
+
+	// since is applied before max-tags
+	trySince(th, nil, at(2), 0, 1, listed[:3], []string{"c"})
+	trySince(th, nil, at(3), 0, 2, listed[:3], []string{"c"})
+}
+
+//
+func TestUntil(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	t0 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return t0.Add(time.Duration(h) * time.Hour) }
+	listed := []Tag{
+		{"a", at(1)}, {"b", at(2)}, {"c", at(3)}, {"d", time.Time{}},
+	}
+	expand := func(ts *TagSet) []string {
+		th.AssertTrue(ts.NeedsPushTimes())
+		th.AssertFalse(ts.IsUnrestricted())
+		got, err := ts.Expand(func() ([]Tag, error) { return listed, nil })
+		th.AssertNoError(err)
+		return got
+	}
+
+	// absolute upper cutoff is inclusive, unknown push times are retained
+	ts, err := NewTagSet(nil)
+	th.AssertNoError(err)
+	ts.SetUntil(at(2), 0)
+	th.AssertEqualSlices([]string{"a", "b", "d"}, expand(ts))
+
+	// window with both ends
+	ts.SetSince(at(2), 0)
+	th.AssertEqualSlices([]string{"b", "d"}, expand(ts))
+	ts.SetUntil(at(3), 0)
+	th.AssertEqualSlices([]string{"b", "c", "d"}, expand(ts))
+
+	// relative upper cutoff
+	recent := []Tag{
+		{"old", time.Now().Add(-48 * time.Hour)},
+		{"new", time.Now().Add(-time.Hour)},
+	}
+	ts, err = NewTagSet(nil)
+	th.AssertNoError(err)
+	ts.SetUntil(time.Time{}, 24*time.Hour)
+	got, err := ts.Expand(func() ([]Tag, error) { return recent, nil })
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"old"}, got)
+
+	// until has no effect on expiry
+	ts.SetSince(time.Time{}, 72*time.Hour)
+	th.AssertEqual(0, len(ts.Expired(recent)))
+}
+
+//
+func TestExpired(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	t0 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return t0.Add(time.Duration(h) * time.Hour) }
+	listed := []Tag{
+		{"c", at(1)}, {"a", at(1)}, {"b", at(3)}, {"d", time.Time{}},
+		{"x-1", at(1)},
+	}
+
+	ts, err := NewTagSet(nil)
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(ts.Expired(listed)))
+
+	ts.SetSince(at(2), 0)
+	th.AssertEqualSlices([]string{"a", "c", "x-1"}, ts.Expired(listed))
+
+	// only matching tags expire
+	ts, err = NewTagSet([]string{"regex: [a-d]"})
+	th.AssertNoError(err)
+	th.AssertNoError(ts.Exclude([]string{"c"}))
+	ts.SetSince(at(2), 0)
+	th.AssertEqualSlices([]string{"a"}, ts.Expired(listed))
+}
+
+//
+func trySince(th *test.TestHelper, include []string, since time.Time,
+	ago time.Duration, max int, tags []Tag, want []string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	ts, err := NewTagSet(include)
+	th.AssertNoError(err)
+	ts.SetSince(since, ago)
+	ts.SetMaxTags(max)
+	th.AssertFalse(ts.IsUnrestricted())
+	th.AssertTrue(ts.NeedsExpansion())
+
+	got, err := ts.Expand(func() ([]Tag, error) { return tags, nil })
+	th.AssertNoError(err)
+	th.AssertEqualSlices(want, got)
+}
+
+//
+func tryMaxTags(th *test.TestHelper, include []string, max int, tags []Tag,
+	want []string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	ts, err := NewTagSet(include)
+	th.AssertNoError(err)
+	ts.SetMaxTags(max)
+	th.AssertFalse(ts.IsUnrestricted())
+
+	got, err := ts.Expand(func() ([]Tag, error) { return tags, nil })
+	th.AssertNoError(err)
+	th.AssertEqualSlices(want, got)
+}
+
+//
+func TestSources(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "tags.txt")
+	th.AssertNoError(ioutil.WriteFile(file,
+		[]byte("# approved\n1.0\n\n  1.1  \n"), 0644))
+
+	body := `["2.0", "latest"]`
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/tags" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(body))
+		}))
+	defer srv.Close()
+
+	ts, err := NewTagSet([]string{
+		"file: " + file, "url: " + srv.URL + "/tags", "edge", "keep: [0-9e].*"})
+	th.AssertNoError(err)
+	th.AssertTrue(ts.HasVerbatim())
+	th.AssertFalse(ts.NeedsExpansion())
+
+	got, err := ts.Expand(nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"1.0", "1.1", "2.0", "edge"}, got)
+	th.AssertTrue(ts.Matches("1.1"))
+	th.AssertFalse(ts.Matches("1.2"))
+
+	// sources are re-read on each expansion
+	body = "3.0\n"
+	got, err = ts.Expand(nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"1.0", "1.1", "3.0", "edge"}, got)
+	th.AssertFalse(ts.Matches("2.0"))
+
+	// unreadable sources fail the expansion
+	ts, err = NewTagSet([]string{"url: " + srv.URL + "/missing"})
+	th.AssertNoError(err)
+	_, err = ts.Expand(nil)
+	th.AssertError(err, "unexpected status")
+
+	ts, err = NewTagSet([]string{"file: " + filepath.Join(dir, "none")})
+	th.AssertNoError(err)
+	_, err = ts.Expand(nil)
+	th.AssertError(err, "failed reading tags")
+
+	body = `["2.0", 3]`
+	ts, err = NewTagSet([]string{"url: " + srv.URL + "/tags"})
+	th.AssertNoError(err)
+	_, err = ts.Expand(nil)
+	th.AssertError(err, "failed parsing tags")
+
+	// invalid sources
+	_, err = NewTagSet([]string{"url: ftp://example.com/tags"})
+	th.AssertError(err, "must be an http or https URL")
+	_, err = NewTagSet([]string{"file: "})
+	th.AssertError(err, "file path is empty")
+
+	ts, err = NewTagSet(nil)
+	th.AssertNoError(err)
+	th.AssertError(ts.Exclude([]string{"file: " + file}), "tag sources cannot")
+}
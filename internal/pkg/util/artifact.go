@@ -0,0 +1,66 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// media types of container images, i.e. of image configs and indexes
+var imageTypes = map[string]bool{
+	"application/vnd.docker.container.image.v1+json":            true,
+	"application/vnd.oci.image.config.v1+json":                  true,
+	"application/vnd.docker.distribution.manifest.list.v2+json": true,
+	"application/vnd.oci.image.index.v1+json":                   true,
+}
+
+//
+type artifactManifest struct {
+	MediaType    string `json:"mediaType"`
+	ArtifactType string `json:"artifactType"`
+	Config       struct {
+		MediaType string `json:"mediaType"`
+	} `json:"config"`
+}
+
+// ArtifactType returns the type of the artifact described by manifest, which
+// is an image manifest or index. This is the `artifactType` of the manifest if
+// set, otherwise the media type of its config, or for an index, the media type
+// of the index itself.
+func ArtifactType(manifest []byte) (string, error) {
+
+	var m artifactManifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return "", fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	switch {
+	case m.ArtifactType != "":
+		return m.ArtifactType, nil
+	case m.Config.MediaType != "":
+		return m.Config.MediaType, nil
+	}
+	return m.MediaType, nil
+}
+
+// IsImageType determines whether artifact type t, as returned by ArtifactType,
+// belongs to a container image, as opposed to other OCI artifacts such as Helm
+// charts or WASM modules.
+func IsImageType(t string) bool {
+	return imageTypes[t]
+}
@@ -0,0 +1,58 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestArtifactType(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, c := range []struct {
+		manifest string
+		want     string
+		image    bool
+	}{
+		{`{"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"config": {"mediaType": "application/vnd.oci.image.config.v1+json"}}`,
+			"application/vnd.oci.image.config.v1+json", true},
+		{`{"config": {"mediaType":
+			"application/vnd.docker.container.image.v1+json"}}`,
+			"application/vnd.docker.container.image.v1+json", true},
+		{`{"mediaType": "application/vnd.oci.image.index.v1+json"}`,
+			"application/vnd.oci.image.index.v1+json", true},
+		{`{"config": {"mediaType":
+			"application/vnd.cncf.helm.config.v1+json"}}`,
+			"application/vnd.cncf.helm.config.v1+json", false},
+		{`{"artifactType": "application/vnd.wasm.content.layer.v1+wasm",
+			"config": {"mediaType": "application/vnd.oci.empty.v1+json"}}`,
+			"application/vnd.wasm.content.layer.v1+wasm", false},
+	} {
+		typ, err := ArtifactType([]byte(c.manifest))
+		th.AssertNoError(err)
+		th.AssertEqual(c.want, typ)
+		th.AssertEqual(c.image, IsImageType(typ))
+	}
+
+	_, err := ArtifactType([]byte("{"))
+	th.AssertError(err, "invalid manifest")
+}
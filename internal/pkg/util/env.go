@@ -0,0 +1,66 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// envRef matches `${NAME}` and `${NAME:-default}`, as well as the escaped form
+// `$${`. Only upper case names are considered, so that named backreferences in
+// regular expression replacements such as `${repo}` are left alone.
+var envRef = regexp.MustCompile(`\$\$\{|\$\{([A-Z_][A-Z0-9_]*)(:-([^}]*))?\}`)
+
+// ExpandEnv replaces all references to environment variables of the form
+// `${NAME}` in s with their values. With `${NAME:-default}`, default is used
+// when the variable is not set or empty. `$${` is replaced with a literal `${`.
+// If any referenced variable without default is not set, an error listing all
+// such variables is returned.
+func ExpandEnv(s string) (string, error) {
+
+	var missing []string
+
+	ret := envRef.ReplaceAllStringFunc(s, func(ref string) string {
+
+		if ref == "$${" {
+			return "${"
+		}
+
+		m := envRef.FindStringSubmatch(ref)
+		name, hasDefault, def := m[1], m[2] != "", m[3]
+
+		if val, ok := os.LookupEnv(name); ok && (val != "" || !hasDefault) {
+			return val
+		}
+		if hasDefault {
+			return def
+		}
+
+		missing = append(missing, name)
+		return ref
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variables not set: %s",
+			strings.Join(missing, ", "))
+	}
+
+	return ret, nil
+}
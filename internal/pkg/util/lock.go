@@ -0,0 +1,62 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// ErrLocked is returned by LockFile when the file is locked already
+var ErrLocked = errors.New("locked by another run")
+
+// FileLock is an exclusive lock on a file, held until released or until the
+// process exits. Other processes, or other FileLocks on the same file within
+// this process, cannot acquire the lock in the meantime.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile acquires the lock on the file at path, creating the file if it does
+// not exist yet. It does not wait for the lock, but returns ErrLocked if the
+// file is locked already.
+func LockFile(path string) (*FileLock, error) {
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(
+		int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	return &FileLock{file: f}, nil
+}
+
+// Release releases the lock. The file itself is kept, since removing it could
+// let another process lock a new file of the same name while the old one is
+// still locked.
+func (l *FileLock) Release() error {
+	return l.file.Close()
+}
@@ -0,0 +1,47 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestLockFile(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	path := filepath.Join(t.TempDir(), "task.lock")
+
+	l, err := LockFile(path)
+	th.AssertNoError(err)
+
+	_, err = LockFile(path)
+	th.AssertEqual(ErrLocked, err)
+
+	th.AssertNoError(l.Release())
+
+	l, err = LockFile(path)
+	th.AssertNoError(err)
+	th.AssertNoError(l.Release())
+
+	_, err = LockFile(filepath.Join(t.TempDir(), "missing", "task.lock"))
+	th.AssertError(err, "no such file or directory")
+}
@@ -0,0 +1,53 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestRateLimiter(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNil(NewRateLimiter(0))
+	var none *RateLimiter
+	none.Wait()
+
+	// 1200 per minute means one request every 50ms
+	r := NewRateLimiter(1200)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Wait()
+		}()
+	}
+	wg.Wait()
+
+	// first request passes right away, the other four are spaced out
+	th.AssertTrue(time.Since(start) >= 200*time.Millisecond)
+	th.AssertTrue(time.Since(start) < 2*time.Second)
+}
@@ -35,6 +35,46 @@ func CompileRegex(v string, lineMatch bool) (*regexp.Regexp, error) {
 	return regexp.Compile(v)
 }
 
+// GlobToRegex translates glob pattern glob into an anchored regular expression.
+// `*` and `?` match any sequence of characters, or any single character, other
+// than `/`, while `**` also matches across `/`. A `**/` may match nothing at
+// all, so `a/**/b` also matches `a/b`. Any character can be escaped with `\`.
+// All other characters are matched literally.
+func GlobToRegex(glob string) string {
+
+	var b strings.Builder
+	b.WriteString("^")
+
+	for ix := 0; ix < len(glob); ix++ {
+		switch c := glob[ix]; c {
+		case '*':
+			if ix+1 < len(glob) && glob[ix+1] == '*' {
+				ix++
+				if ix+1 < len(glob) && glob[ix+1] == '/' {
+					ix++
+					b.WriteString("(.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '\\':
+			if ix+1 < len(glob) {
+				ix++
+			}
+			b.WriteString(regexp.QuoteMeta(glob[ix : ix+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+	return b.String()
+}
+
 //
 func NewRegex(r string) (*Regex, error) {
 
@@ -0,0 +1,230 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const maxRetryDelay = 5 * time.Minute
+
+// Errors collects several errors into one
+type Errors []error
+
+//
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// messages of errors that should not be retried, in lower case
+var permanentErrors = []string{
+	"unauthorized", "authentication required", "denied", "forbidden",
+	"not found", "manifest unknown", "name unknown", "context canceled",
+	"context deadline exceeded",
+}
+
+// messages of errors that may go away when retrying, in lower case
+var transientErrors = []string{
+	"throttl", "toomanyrequests", "too many requests", "rate exceeded",
+	"internal server error", "bad gateway", "service unavailable",
+	"gateway timeout", "timeout", "timed out", "connection reset",
+	"connection refused", "unexpected eof",
+}
+
+// retryable is implemented by errors that know whether they are transient
+type retryable interface {
+	Retryable() bool
+}
+
+//
+var transientStatus = regexp.MustCompile(`status(?: code)?:? (?:429|5\d\d)\b`)
+
+// IsRetryable determines whether err is a transient error, such as a timeout,
+// throttling, or a 5xx server error, which may go away when retrying. Errors
+// that are not known to be transient, in particular authentication errors and
+// missing images, are not retryable. For Errors, all contained errors need to
+// be retryable.
+func IsRetryable(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	// canceled operations, e.g. of a task that timed out, are not retried
+	if errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var re retryable
+	if errors.As(err, &re) {
+		return re.Retryable()
+	}
+
+	var errs Errors
+	if errors.As(err, &errs) && len(errs) > 0 {
+		for _, e := range errs {
+			if !IsRetryable(e) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// AWS throttling errors come with status code 400
+	var ae awserr.Error
+	if errors.As(err, &ae) {
+		switch ae.Code() {
+		case "ThrottlingException", "Throttling", "ThrottledException",
+			"TooManyRequestsException", "RequestLimitExceeded":
+			return true
+		}
+	}
+
+	var rf awserr.RequestFailure
+	if errors.As(err, &rf) {
+		return rf.StatusCode() == 429 || rf.StatusCode() >= 500
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	for _, p := range permanentErrors {
+		if strings.Contains(msg, p) {
+			return false
+		}
+	}
+
+	for _, p := range transientErrors {
+		if strings.Contains(msg, p) {
+			return true
+		}
+	}
+
+	return transientStatus.MatchString(msg)
+}
+
+//
+var unauthorizedStatus = regexp.MustCompile(`status(?: code)?:? 401\b`)
+
+// IsUnauthorized determines whether err indicates that the registry rejected
+// the credentials, i.e. a 401 response. For Errors, any contained error may
+// indicate this.
+func IsUnauthorized(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	var errs Errors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			if IsUnauthorized(e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unauthorized") ||
+		strings.Contains(msg, "authentication required") ||
+		unauthorizedStatus.MatchString(msg)
+}
+
+// messages of errors from pushing an existing tag to a repository with tag
+// immutability, in lower case; the first is the code of the ECR API, the
+// second the message of the ECR registry API
+var immutableTagErrors = []string{
+	"imagetagalreadyexistsexception",
+	"cannot be overwritten because the repository is immutable",
+}
+
+// IsImmutableTag determines whether err indicates that a tag could not be
+// pushed, because it already exists in a target repository with tag
+// immutability. For Errors, all contained errors need to indicate this.
+func IsImmutableTag(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	var errs Errors
+	if errors.As(err, &errs) && len(errs) > 0 {
+		for _, e := range errs {
+			if !IsImmutableTag(e) {
+				return false
+			}
+		}
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, p := range immutableTagErrors {
+		if strings.Contains(msg, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry runs op, and retries it up to retries times for as long as it fails
+// with a retryable error. The delay before the first retry is interval, and
+// doubles with each further retry, up to a maximum of five minutes. A random
+// jitter of up to half the delay is added.
+func Retry(retries int, interval time.Duration, op func() error) error {
+
+	delay := interval
+
+	for attempt := 0; ; attempt++ {
+
+		err := op()
+		if err == nil || attempt >= retries || !IsRetryable(err) {
+			return err
+		}
+
+		wait := delay
+		if wait > 0 {
+			wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		}
+		log.WithFields(log.Fields{
+			"attempt": attempt + 1, "delay": wait}).Warnf("retrying: %v", err)
+		time.Sleep(wait)
+
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
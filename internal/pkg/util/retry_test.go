@@ -0,0 +1,179 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestIsRetryable(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, msg := range []string{
+		"ThrottlingException: Rate exceeded",
+		"toomanyrequests: You have reached your pull rate limit",
+		"GET https://registry/v2/: unsupported status code 503",
+		"received unexpected HTTP status: 502 Bad Gateway",
+		"net/http: TLS handshake timeout",
+		"read: connection reset by peer",
+	} {
+		th.AssertTrue(IsRetryable(errors.New(msg)))
+	}
+
+	for _, msg := range []string{
+		"unauthorized: authentication required",
+		"denied: requested access to the resource is denied",
+		"manifest unknown: manifest unknown",
+		"repository not found",
+		"GET https://registry/v2/: unsupported status code 404",
+		"exit status 1",
+		"error listing ECR repositories: RequestCanceled: request context " +
+			"canceled\ncaused by: context deadline exceeded",
+	} {
+		th.AssertFalse(IsRetryable(errors.New(msg)))
+	}
+
+	th.AssertFalse(IsRetryable(nil))
+	th.AssertFalse(IsRetryable(context.Canceled))
+	th.AssertFalse(IsRetryable(
+		fmt.Errorf("Get \"https://registry/v2/\": %w",
+			context.DeadlineExceeded)))
+
+	// AWS request failures by status code
+	th.AssertTrue(IsRetryable(awserr.NewRequestFailure(
+		awserr.New("ServiceUnavailable", "", nil), 503, "")))
+	th.AssertFalse(IsRetryable(awserr.NewRequestFailure(
+		awserr.New("AccessDenied", "", nil), 403, "")))
+	th.AssertTrue(IsRetryable(awserr.NewRequestFailure(
+		awserr.New("ThrottlingException", "", nil), 400, "")))
+
+	// collected errors are only retryable if all of them are
+	timeout := errors.New("timeout")
+	th.AssertTrue(IsRetryable(
+		fmt.Errorf("errors during sync: %w", Errors{timeout, timeout})))
+	th.AssertFalse(IsRetryable(fmt.Errorf("errors during sync: %w",
+		Errors{timeout, errors.New("unauthorized")})))
+
+	// errors that know whether they are retryable
+	th.AssertTrue(IsRetryable(fmt.Errorf("ping: %w", classified(true))))
+	th.AssertFalse(IsRetryable(fmt.Errorf("ping: %w", classified(false))))
+}
+
+//
+type classified bool
+
+//
+func (c classified) Error() string {
+	return "timeout"
+}
+
+//
+func (c classified) Retryable() bool {
+	return bool(c)
+}
+
+//
+func TestIsUnauthorized(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, msg := range []string{
+		"unauthorized: authentication required",
+		"GET https://registry/v2/: UNAUTHORIZED: authentication required",
+		"GET https://registry/v2/: unsupported status code 401",
+	} {
+		th.AssertTrue(IsUnauthorized(errors.New(msg)))
+	}
+
+	for _, msg := range []string{
+		"denied: requested access to the resource is denied",
+		"GET https://registry/v2/: unsupported status code 403",
+		"GET https://registry/v2/: unsupported status code 4010",
+	} {
+		th.AssertFalse(IsUnauthorized(errors.New(msg)))
+	}
+
+	th.AssertFalse(IsUnauthorized(nil))
+	th.AssertTrue(IsUnauthorized(fmt.Errorf("errors during sync: %w",
+		Errors{errors.New("timeout"), errors.New("unauthorized")})))
+}
+
+//
+func TestIsImmutableTag(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, msg := range []string{
+		"ImageTagAlreadyExistsException: The image tag 'v1' already exists",
+		"writing manifest: uploading manifest v1 to registry/app: " +
+			"TAG_INVALID: The image tag 'v1' already exists in the 'app' " +
+			"repository and cannot be overwritten because the repository " +
+			"is immutable.",
+	} {
+		th.AssertTrue(IsImmutableTag(errors.New(msg)))
+	}
+
+	th.AssertFalse(IsImmutableTag(nil))
+	th.AssertFalse(IsImmutableTag(errors.New("manifest unknown")))
+	th.AssertTrue(IsImmutableTag(fmt.Errorf("errors during sync: %w",
+		Errors{errors.New("ImageTagAlreadyExistsException")})))
+	th.AssertFalse(IsImmutableTag(fmt.Errorf("errors during sync: %w",
+		Errors{errors.New("ImageTagAlreadyExistsException"),
+			errors.New("timeout")})))
+}
+
+//
+func TestRetry(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	transient := errors.New("503 service unavailable")
+	permanent := errors.New("unauthorized")
+
+	tryRetry(th, 3, []error{transient, transient, nil}, nil, 3)
+	tryRetry(th, 1, []error{transient, transient, nil}, transient, 2)
+	tryRetry(th, 3, []error{transient, permanent, nil}, permanent, 2)
+	tryRetry(th, 0, []error{transient, nil}, transient, 1)
+	tryRetry(th, 3, []error{nil}, nil, 1)
+}
+
+//
+func tryRetry(th *test.TestHelper, retries int, results []error, want error,
+	calls int) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	n := 0
+	err := Retry(retries, time.Millisecond, func() error {
+		n++
+		return results[n-1]
+	})
+
+	th.AssertEqual(want, err)
+	th.AssertEqual(calls, n)
+}
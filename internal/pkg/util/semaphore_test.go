@@ -0,0 +1,72 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestSemaphore(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNil(NewSemaphore(0))
+	var none *Semaphore
+	th.AssertNoError(none.Acquire(context.Background()))
+	none.Release()
+
+	s := NewSemaphore(2)
+	var active, max int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			th.AssertNoError(s.Acquire(context.Background()))
+			defer s.Release()
+			n := atomic.AddInt32(&active, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+		}()
+	}
+	wg.Wait()
+
+	th.AssertTrue(max <= 2)
+	th.AssertTrue(max > 0)
+
+	// waiting for a slot ends with the context
+	th.AssertNoError(s.Acquire(context.Background()))
+	th.AssertNoError(s.Acquire(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+	th.AssertError(s.Acquire(ctx), "deadline exceeded")
+}
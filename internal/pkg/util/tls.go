@@ -0,0 +1,56 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig creates the TLS config for connecting to a registry. CA certs
+// from PEM bundle caCert, if set, are trusted in addition to the system roots.
+// With skipVerify, server certificates are not verified at all. If neither is
+// requested, nil is returned, so that defaults apply.
+func TLSConfig(caCert string, skipVerify bool) (*tls.Config, error) {
+
+	if caCert == "" && !skipVerify {
+		return nil, nil
+	}
+
+	conf := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caCert == "" {
+		return conf, nil
+	}
+
+	pem, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in '%s'", caCert)
+	}
+
+	conf.RootCAs = pool
+	return conf, nil
+}
@@ -0,0 +1,71 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestTLSConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	get := func(caCert string, skipVerify bool) error {
+		conf, err := TLSConfig(caCert, skipVerify)
+		th.AssertNoError(err)
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = conf
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	conf, err := TLSConfig("", false)
+	th.AssertNoError(err)
+	th.AssertNil(conf)
+	th.AssertNotNil(get("", false))
+
+	th.AssertNoError(get("", true))
+
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	th.AssertNoError(ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644))
+	th.AssertNoError(get(ca, false))
+
+	bad := filepath.Join(dir, "bad.pem")
+	th.AssertNoError(ioutil.WriteFile(bad, []byte("not a cert"), 0644))
+	_, err = TLSConfig(bad, false)
+	th.AssertError(err, "no certificates found")
+
+	_, err = TLSConfig(filepath.Join(dir, "missing.pem"), false)
+	th.AssertError(err, "no such file")
+}
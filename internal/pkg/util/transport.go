@@ -0,0 +1,92 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultMaxIdleConns    = 100
+	DefaultIdleConnTimeout = 90 * time.Second
+)
+
+// ConnPool holds the connection pool settings of a transport. A zero
+// `MaxConnsPerHost` means no limit, a zero `IdleConnTimeout` means idle
+// connections are kept open indefinitely.
+type ConnPool struct {
+	MaxIdleConns    int
+	MaxConnsPerHost int
+	IdleConnTimeout time.Duration
+}
+
+// DefaultConnPool returns the default connection pool settings.
+func DefaultConnPool() *ConnPool {
+	return &ConnPool{
+		MaxIdleConns:    DefaultMaxIdleConns,
+		IdleConnTimeout: DefaultIdleConnTimeout,
+	}
+}
+
+// HTTPTransport creates the transport for connecting to a registry with TLS
+// config tlsConf, which may be nil. Requests go through proxy if set, and
+// otherwise through the proxy given by environment variables `HTTP_PROXY`,
+// `HTTPS_PROXY`, and `NO_PROXY`. Connections are pooled as set in pool, or
+// with the defaults if pool is nil. Since a transport is used for a single
+// registry, all idle connections may be kept for the same host.
+func HTTPTransport(tlsConf *tls.Config, proxy string, pool *ConnPool) (
+	*http.Transport, error) {
+
+	if pool == nil {
+		pool = DefaultConnPool()
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConf
+	tr.Proxy = http.ProxyFromEnvironment
+	tr.MaxIdleConns = pool.MaxIdleConns
+	tr.MaxIdleConnsPerHost = pool.MaxIdleConns
+	if pool.MaxConnsPerHost > 0 && pool.MaxConnsPerHost < pool.MaxIdleConns {
+		tr.MaxIdleConnsPerHost = pool.MaxConnsPerHost
+	}
+	tr.MaxConnsPerHost = pool.MaxConnsPerHost
+	tr.IdleConnTimeout = pool.IdleConnTimeout
+
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL '%s': %v", proxy, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf(
+				"invalid proxy URL '%s': scheme must be http, https, or socks5",
+				proxy)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL '%s': no host", proxy)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+
+	return tr, nil
+}
@@ -0,0 +1,83 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestHTTPTransport(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	proxyFor := func(proxy, target string) string {
+		tr, err := HTTPTransport(nil, proxy, nil)
+		th.AssertNoError(err)
+		req, err := http.NewRequest("GET", target, nil)
+		th.AssertNoError(err)
+		u, err := tr.Proxy(req)
+		th.AssertNoError(err)
+		if u == nil {
+			return ""
+		}
+		return u.String()
+	}
+
+	// explicit proxy is used for all registries; proxy from environment is
+	// not tested here, since net/http reads it only once per process
+	th.AssertEqual("http://proxy.acme.com:8080",
+		proxyFor("http://proxy.acme.com:8080", "https://registry.acme.com/v2/"))
+	th.AssertEqual("http://proxy.acme.com:8080",
+		proxyFor("http://proxy.acme.com:8080", "https://internal.acme.com/v2/"))
+
+	for _, p := range []string{"proxy.acme.com:8080", "ftp://proxy.acme.com",
+		"http://", "http://%zz"} {
+		_, err := HTTPTransport(nil, p, nil)
+		th.AssertError(err, "invalid proxy URL")
+	}
+}
+
+//
+func TestHTTPTransportConnPool(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tr, err := HTTPTransport(nil, "", nil)
+	th.AssertNoError(err)
+	th.AssertEqual(DefaultMaxIdleConns, tr.MaxIdleConns)
+	th.AssertEqual(DefaultMaxIdleConns, tr.MaxIdleConnsPerHost)
+	th.AssertEqual(0, tr.MaxConnsPerHost)
+	th.AssertEqual(DefaultIdleConnTimeout, tr.IdleConnTimeout)
+
+	tr, err = HTTPTransport(nil, "", &ConnPool{
+		MaxIdleConns: 50, MaxConnsPerHost: 20, IdleConnTimeout: time.Minute})
+	th.AssertNoError(err)
+	th.AssertEqual(50, tr.MaxIdleConns)
+	th.AssertEqual(20, tr.MaxIdleConnsPerHost)
+	th.AssertEqual(20, tr.MaxConnsPerHost)
+	th.AssertEqual(time.Minute, tr.IdleConnTimeout)
+
+	tr, err = HTTPTransport(nil, "", &ConnPool{MaxIdleConns: 10})
+	th.AssertNoError(err)
+	th.AssertEqual(10, tr.MaxIdleConnsPerHost)
+	th.AssertEqual(time.Duration(0), tr.IdleConnTimeout)
+}
@@ -71,6 +71,16 @@ func SplitPlatform(p string) (os, arch, variant string) {
 	return
 }
 
+// MatchPlatform determines whether platform have matches the wanted platform
+// want, both in `os/arch[/variant]` form. When want does not specify a variant,
+// any variant matches.
+func MatchPlatform(want, have string) bool {
+	wOS, wArch, wVariant := SplitPlatform(want)
+	hOS, hArch, hVariant := SplitPlatform(have)
+	return wOS == hOS && wArch == hArch &&
+		(wVariant == "" || wVariant == hVariant)
+}
+
 //
 type creds struct {
 	Username string
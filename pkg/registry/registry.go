@@ -0,0 +1,61 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package registry lets programs outside of the dregsy module add their own
+// list sources, for registries whose repositories cannot be listed with the
+// built-in lister types. The types are those used by dregsy internally.
+package registry
+
+import (
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+)
+
+// ListSourceType is the lister type set with `type` in the `lister` of a
+// task's source.
+type ListSourceType = registry.ListSourceType
+
+// ListSource lists the repositories of a registry. Requests made by its
+// methods are canceled when the passed context is done.
+type ListSource = registry.ListSource
+
+// StreamListSource is implemented by list sources that can send repositories
+// while they are still being listed.
+type StreamListSource = registry.StreamListSource
+
+// TagListSource is implemented by list sources that can also list the tags of
+// a repository natively, typically providing push times along with the tags.
+type TagListSource = registry.TagListSource
+
+// Tag is a tag listed by a TagListSource, with its push time if known.
+type Tag = tags.Tag
+
+// ListSourceConfig holds what a factory needs for creating a list source.
+type ListSourceConfig = registry.ListSourceConfig
+
+// ListSourceFactory creates a list source from conf.
+type ListSourceFactory = registry.ListSourceFactory
+
+// Credentials are the credentials for listing, as passed in ListSourceConfig.
+type Credentials = auth.Credentials
+
+// Register makes list sources created by factory available as lister type
+// typ. It is meant to be called from init functions, and panics if typ is
+// empty or already registered, or if factory is nil.
+func Register(typ ListSourceType, factory ListSourceFactory) {
+	registry.Register(typ, factory)
+}
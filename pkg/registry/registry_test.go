@@ -0,0 +1,94 @@
+/*
+	Copyright 2022 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	internal "github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+	"github.com/xelalexv/dregsy/pkg/registry"
+)
+
+// staticSource lists a fixed set of repositories, each with tag 1.0
+type staticSource struct {
+	repos []string
+}
+
+//
+func (s *staticSource) Ping(ctx context.Context) error {
+	return nil
+}
+
+//
+func (s *staticSource) Retrieve(ctx context.Context, maxItems int) (
+	[]string, error) {
+	return s.repos, nil
+}
+
+//
+func (s *staticSource) ListTags(ctx context.Context, repo string) (
+	[]registry.Tag, error) {
+	return []registry.Tag{{Name: "1.0", Pushed: time.Unix(0, 0)}}, nil
+}
+
+//
+func init() {
+	registry.Register("static", func(conf *registry.ListSourceConfig) (
+		registry.ListSource, error) {
+		if conf.Settings["repos"] == "" {
+			return nil, errors.New("'repos' not set")
+		}
+		return &staticSource{repos: []string{conf.Settings["repos"]}}, nil
+	})
+}
+
+//
+func TestRegister(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	typ := registry.ListSourceType("static")
+	th.AssertTrue(typ.IsValid())
+
+	list, err := internal.NewRepoList("registry.example.com", nil, typ,
+		map[string]string{"type": "static", "repos": "team/app"}, nil, nil)
+	th.AssertNoError(err)
+	th.AssertTrue(list.CanListTags())
+
+	repos, err := list.Get(context.Background())
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"team/app"}, repos)
+
+	listed, err := list.ListTags(context.Background(), "team/app")
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(listed))
+	th.AssertEqual("1.0", listed[0].Name)
+
+	_, err = internal.NewRepoList("registry.example.com", nil, typ,
+		map[string]string{"type": "static"}, nil, nil)
+	th.AssertError(err, "'repos' not set")
+
+	defer func() { th.AssertNotNil(recover()) }()
+	registry.Register("static", func(conf *registry.ListSourceConfig) (
+		registry.ListSource, error) {
+		return nil, nil
+	})
+}